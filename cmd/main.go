@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/agents"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/api"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/health"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/retention"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,45 +34,168 @@ func main() {
 	// Load environment variables from .env file if it exists
 	_ = godotenv.Load()
 
-	// Initialize logger
-	log := logrus.New()
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "info"
+	// Load configuration from the config file, environment and flags,
+	// reporting every invalid setting at once
+	flags, err := config.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
 	}
-	level, err := logrus.ParseLevel(logLevel)
+	cfg, err := config.Load(flags)
 	if err != nil {
-		log.Warnf("Invalid log level %s, defaulting to info", logLevel)
-		level = logrus.InfoLevel
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	if flags.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Initialize logger. The level has been validated with the configuration.
+	log := logrus.New()
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
 	log.SetLevel(level)
 	log.SetFormatter(&logrus.JSONFormatter{})
 
-	// Initialize configuration
-	cfg := config.NewConfig()
+	// Scrub PII and secrets from everything that is logged
+	log.AddHook(redact.NewHook(redact.Default()))
+
+	if err := redact.ValidatePolicies(cfg); err != nil {
+		log.Fatalf("Invalid redaction policy: %v", err)
+	}
+
+	// Keep the configuration in a store it can be reloaded into. Requests
+	// take a snapshot when they arrive and keep it while they run.
+	configs := config.NewStore(cfg, flags)
+	reload := func(reason string) {
+		restart, err := configs.Reload(redact.ValidatePolicies)
+		if err != nil {
+			metrics.ConfigReloads.WithLabelValues("rejected").Inc()
+			log.Errorf("Rejected configuration reload on %s, keeping the current configuration: %v", reason, err)
+			return
+		}
+		metrics.ConfigReloads.WithLabelValues("applied").Inc()
+		level, _ := logrus.ParseLevel(configs.Current().LogLevel)
+		log.SetLevel(level)
+		if len(restart) > 0 {
+			log.Warnf("Reloaded configuration on %s; changes to %s take effect after a restart", reason, strings.Join(restart, ", "))
+			return
+		}
+		log.Infof("Reloaded configuration on %s", reason)
+	}
+
+	// Reload on SIGHUP, and when the config or policy file changes
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload("SIGHUP")
+		}
+	}()
+	if cfg.ConfigWatchInterval > 0 {
+		go configs.Watch(context.Background(), cfg.ConfigWatchInterval, func() { reload("file change") })
+	}
+
+	// Initialize tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	// Open the audit trail
+	auditSink, err := audit.NewSink(cfg.Audit)
+	if err != nil {
+		log.Fatalf("Failed to open audit sink: %v", err)
+	}
+
+	// Load the registered agents
+	agentRegistry, err := agents.NewRegistry(cfg.AgentRegistryFile)
+	if err != nil {
+		log.Fatalf("Failed to load agent registry: %v", err)
+	}
+
+	// Cache replies in memory unless the response cache is disabled
+	var responseCache responsecache.Store
+	if cfg.ResponseCacheSize > 0 {
+		responseCache = responsecache.NewMemoryStore(cfg.ResponseCacheSize)
+	}
 
 	// Initialize OpenAI client
-	openaiClient := openai.NewClient(cfg.OpenAIAPIKey, log)
+	openaiClient := openai.NewClient(cfg, log, responseCache)
+
+	// Cache answers to first questions per agent in memory unless the
+	// semantic cache is disabled
+	var semanticCache *semanticcache.Cache
+	if cfg.SemanticCacheSize > 0 {
+		semanticCache = semanticcache.New(semanticcache.NewEmbedder(cfg, openaiClient), cfg.SemanticCacheSize)
+		openaiClient.SetSemanticCache(semanticCache)
+	}
 
-	// Initialize API router
-	router := gin.Default()
-	api.SetupRoutes(router, openaiClient, log, cfg)
+	// Periodically evict expired threads from the cache
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			openaiClient.CleanupOldCacheEntries(configs.Current().ThreadTTL)
+		}
+	}()
 
-	// Get port from environment variable or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Purge data that has outlived its organization's retention period, at
+	// startup and then hourly
+	retentionService := retention.NewService(openaiClient, auditSink, responseCache, semanticCache, configs, log)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			retentionService.PurgeExpired(context.Background(), time.Now())
+			<-ticker.C
+		}
+	}()
+
+	// Check the configuration, the OpenAI API and the audit trail for readiness.
+	// The OpenAI check lists models, so its result is reused for a while. An
+	// upstream outage only degrades the service, since every instance would
+	// fail the check at once and taking them all out of rotation wouldn't
+	// help. A rejected reload leaves the service running on its earlier
+	// configuration, which degrades it too.
+	healthChecker := health.NewChecker()
+	healthChecker.Add("config", true, 0, func(ctx context.Context) error {
+		current := configs.Current()
+		if err := current.Validate(); err != nil {
+			return err
+		}
+		return redact.ValidatePolicies(current)
+	})
+	healthChecker.Add("config_reload", false, 0, func(ctx context.Context) error {
+		return configs.ReloadError()
+	})
+	healthChecker.Add("openai", false, cfg.HealthCheckTTL, openaiClient.Ping)
+	if auditSink != nil {
+		healthChecker.Add("audit", false, 0, auditSink.Ping)
 	}
 
+	// Initialize API router. Logging and recovery middleware are set up with
+	// the routes, so gin's plain-text defaults aren't used.
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	router := gin.New()
+	api.SetupRoutes(router, openaiClient, auditSink, semanticCache, retentionService, healthChecker, agentRegistry, log, configs)
+
 	// Start server
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
+		Addr:    fmt.Sprintf(":%s", cfg.Port),
 		Handler: router,
 	}
 
 	// Start server in a goroutine
 	go func() {
-		log.Infof("Starting server on port %s", port)
+		log.Infof("Starting server on port %s", cfg.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
@@ -71,6 +207,13 @@ func main() {
 	<-quit
 	log.Info("Shutting down server...")
 
+	// Fail readiness first and give load balancers time to stop sending
+	// traffic before the listener is closed
+	healthChecker.SetDraining()
+	drainDelay := configs.Current().DrainDelay
+	log.Infof("Draining for %s", drainDelay)
+	time.Sleep(drainDelay)
+
 	// Create a deadline to wait for
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -78,5 +221,17 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Flush any spans that haven't been exported yet
+	if err := shutdownTracing(ctx); err != nil {
+		log.Errorf("Failed to shut down tracing: %v", err)
+	}
+
+	// Close the audit trail once no more exchanges can be recorded
+	if auditSink != nil {
+		if err := auditSink.Close(); err != nil {
+			log.Errorf("Failed to close audit sink: %v", err)
+		}
+	}
+
 	log.Info("Server exiting")
 }
@@ -0,0 +1,99 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+)
+
+// Errors returned by the registry
+var (
+	ErrNotFound        = errors.New("agent not found")
+	ErrExists          = errors.New("agent already exists")
+	ErrVersionConflict = errors.New("agent version is not the latest")
+)
+
+// Overrides lists the settings of an agent that chat requests may override
+// with their own agent configuration. Nothing may be overridden by default.
+type Overrides struct {
+	Instructions    bool `json:"instructions,omitempty"`
+	Model           bool `json:"model,omitempty"`
+	Temperature     bool `json:"temperature,omitempty"`
+	MaxTokens       bool `json:"maxTokens,omitempty"`
+	InjectionPolicy bool `json:"injectionPolicy,omitempty"`
+}
+
+// Agent is a version of an agent definition. Agents are identified by
+// organization and ID; every update creates a new version.
+type Agent struct {
+	ID             string `json:"id"`
+	OrganizationID string `json:"organizationId"`
+	Version        int    `json:"version"`
+	models.AgentConfig
+	// Files are attached to every conversation with the agent, ahead of the
+	// request's files
+	Files          []models.File `json:"files,omitempty"`
+	AllowOverrides Overrides     `json:"allowOverrides"`
+	// Experiment names the experiment the Variants take part in. Changing it
+	// assigns sessions to variants afresh.
+	Experiment string    `json:"experiment,omitempty"`
+	Variants   []Variant `json:"variants,omitempty"`
+	// CreatedAt is when the first version was created, UpdatedAt when this one was
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// assignedVariant is the variant set by WithVariant
+	assignedVariant string
+}
+
+// Apply returns the agent's configuration with the settings of a request's
+// configuration the agent allows to be overridden, and the names of the
+// settings the request set but may not override
+func (a *Agent) Apply(requested models.AgentConfig) (models.AgentConfig, []string) {
+	cfg := a.AgentConfig
+	var ignored []string
+
+	override := func(name string, allowed, set bool, apply func()) {
+		switch {
+		case !set:
+		case allowed:
+			apply()
+		default:
+			ignored = append(ignored, name)
+		}
+	}
+	override("instructions", a.AllowOverrides.Instructions, requested.Instructions != "" && requested.Instructions != cfg.Instructions, func() {
+		cfg.Instructions = requested.Instructions
+	})
+	override("model", a.AllowOverrides.Model, requested.Model != "" && requested.Model != cfg.Model, func() {
+		cfg.Model = requested.Model
+	})
+	override("temperature", a.AllowOverrides.Temperature, requested.Temperature != nil && (cfg.Temperature == nil || *requested.Temperature != *cfg.Temperature), func() {
+		cfg.Temperature = requested.Temperature
+	})
+	override("maxTokens", a.AllowOverrides.MaxTokens, requested.MaxTokens != 0 && requested.MaxTokens != cfg.MaxTokens, func() {
+		cfg.MaxTokens = requested.MaxTokens
+	})
+	// Tools are part of the definition and can't be overridden
+	override("tools", false, len(requested.Tools) > 0, nil)
+	override("injectionPolicy", a.AllowOverrides.InjectionPolicy, requested.InjectionPolicy != "" && requested.InjectionPolicy != cfg.InjectionPolicy, func() {
+		cfg.InjectionPolicy = requested.InjectionPolicy
+	})
+	return cfg, ignored
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the agent a chat request runs with
+func NewContext(ctx context.Context, agent *Agent) context.Context {
+	return context.WithValue(ctx, contextKey{}, agent)
+}
+
+// FromContext returns the agent carried by ctx, or nil if the request's agent
+// isn't registered
+func FromContext(ctx context.Context) *Agent {
+	agent, _ := ctx.Value(contextKey{}).(*Agent)
+	return agent
+}
@@ -0,0 +1,225 @@
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// key identifies an agent within the registry
+type key struct {
+	organizationID string
+	id             string
+}
+
+// Registry holds the versions of every agent definition. Agents it returns
+// are shared and must not be modified.
+type Registry struct {
+	// path is the JSON file agents are saved to; empty keeps them in memory
+	path string
+
+	mu sync.RWMutex
+	// agents holds the versions of each agent, oldest first
+	agents map[key][]*Agent
+}
+
+// NewRegistry creates a registry saved to the JSON file at path, loading the
+// agents already saved there. An empty path keeps agents in memory only, so
+// they are lost on restart.
+func NewRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path, agents: make(map[key][]*Agent)}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent registry: %w", err)
+	}
+	var versions []*Agent
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("invalid agent registry %s: %w", path, err)
+	}
+	for _, agent := range versions {
+		k := key{agent.OrganizationID, agent.ID}
+		r.agents[k] = append(r.agents[k], agent)
+	}
+	for _, versions := range r.agents {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	return r, nil
+}
+
+// Get returns the latest version of an agent
+func (r *Registry) Get(organizationID, id string) (*Agent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.agents[key{organizationID, id}]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Version returns a version of an agent
+func (r *Registry) Version(organizationID, id string, version int) (*Agent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, agent := range r.agents[key{organizationID, id}] {
+		if agent.Version == version {
+			return agent, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Versions returns every version of an agent, oldest first
+func (r *Registry) Versions(organizationID, id string) ([]*Agent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.agents[key{organizationID, id}]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return append([]*Agent(nil), versions...), nil
+}
+
+// List returns the latest version of every agent of an organization, by ID
+func (r *Registry) List(organizationID string) []*Agent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var agents []*Agent
+	for k, versions := range r.agents {
+		if k.organizationID == organizationID {
+			agents = append(agents, versions[len(versions)-1])
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// Create stores the first version of an agent, failing with ErrExists if the
+// organization already has an agent with its ID
+func (r *Registry) Create(agent Agent) (*Agent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{agent.OrganizationID, agent.ID}
+	if len(r.agents[k]) > 0 {
+		return nil, ErrExists
+	}
+	now := time.Now().UTC()
+	agent.Version = 1
+	agent.CreatedAt = now
+	agent.UpdatedAt = now
+	return &agent, r.store(k, &agent)
+}
+
+// Update stores a new version of an agent. If agent.Version is set, it must
+// be the latest version, so concurrent updates don't overwrite each other.
+func (r *Registry) Update(agent Agent) (*Agent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{agent.OrganizationID, agent.ID}
+	versions := r.agents[k]
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	latest := versions[len(versions)-1]
+	if agent.Version != 0 && agent.Version != latest.Version {
+		return nil, ErrVersionConflict
+	}
+	agent.Version = latest.Version + 1
+	agent.CreatedAt = latest.CreatedAt
+	agent.UpdatedAt = time.Now().UTC()
+	return &agent, r.store(k, &agent)
+}
+
+// Delete removes every version of an agent
+func (r *Registry) Delete(organizationID, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{organizationID, id}
+	if len(r.agents[k]) == 0 {
+		return ErrNotFound
+	}
+	next := maps.Clone(r.agents)
+	delete(next, k)
+	if err := r.save(next); err != nil {
+		return err
+	}
+	r.agents = next
+	return nil
+}
+
+// store appends a version of an agent, keeping the registry unchanged if it
+// can't be saved. The caller must hold mu.
+func (r *Registry) store(k key, agent *Agent) error {
+	next := maps.Clone(r.agents)
+	versions := r.agents[k]
+	next[k] = append(versions[:len(versions):len(versions)], agent)
+	if err := r.save(next); err != nil {
+		return err
+	}
+	r.agents = next
+	return nil
+}
+
+// save writes every version of every agent to the registry file, replacing
+// it atomically
+func (r *Registry) save(agents map[key][]*Agent) error {
+	if r.path == "" {
+		return nil
+	}
+
+	var versions []*Agent
+	for _, agentVersions := range agents {
+		versions = append(versions, agentVersions...)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.OrganizationID != b.OrganizationID {
+			return a.OrganizationID < b.OrganizationID
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Version < b.Version
+	})
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save agent registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save agent registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save agent registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("failed to save agent registry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package agents
+
+import (
+	"hash/fnv"
+)
+
+// Variant is a variation of an agent's settings that a share of its
+// sessions runs with. Empty settings keep the agent's.
+type Variant struct {
+	Name string `json:"name"`
+	// Weight is the variant's share of sessions relative to the other
+	// variants' weights. Variants weighted 0 get no sessions.
+	Weight       int      `json:"weight"`
+	Instructions string   `json:"instructions,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+	MaxTokens    int      `json:"maxTokens,omitempty"`
+}
+
+// VariantFor returns the variant a session of the agent is assigned to, or
+// nil if the agent has no variants. Sessions are assigned by a hash of the
+// organization, agent, experiment and session IDs, so a session keeps its
+// variant as long as the experiment and the variants' weights don't change.
+func (a *Agent) VariantFor(sessionID string) *Variant {
+	total := 0
+	for _, variant := range a.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	hash := fnv.New64a()
+	for _, part := range []string{a.OrganizationID, a.ID, a.Experiment, sessionID} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	bucket := int(hash.Sum64() % uint64(total))
+	for i := range a.Variants {
+		bucket -= a.Variants[i].Weight
+		if bucket < 0 {
+			return &a.Variants[i]
+		}
+	}
+	return nil
+}
+
+// WithVariant returns a copy of the agent with the settings of a variant,
+// which AssignedVariant reports
+func (a *Agent) WithVariant(variant *Variant) *Agent {
+	agent := *a
+	agent.assignedVariant = variant.Name
+	if variant.Instructions != "" {
+		agent.Instructions = variant.Instructions
+	}
+	if variant.Model != "" {
+		agent.Model = variant.Model
+	}
+	if variant.Temperature != nil {
+		agent.Temperature = variant.Temperature
+	}
+	if variant.MaxTokens != 0 {
+		agent.MaxTokens = variant.MaxTokens
+	}
+	return &agent
+}
+
+// AssignedVariant returns the name of the variant the agent was given with
+// WithVariant, or "" if it wasn't
+func (a *Agent) AssignedVariant() string {
+	return a.assignedVariant
+}
@@ -0,0 +1,56 @@
+package agents
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariantFor(t *testing.T) {
+	agent := &Agent{ID: "support", OrganizationID: "org1", Experiment: "tone"}
+	assert.Nil(t, agent.VariantFor("session1"))
+
+	agent.Variants = []Variant{{Name: "control", Weight: 3}, {Name: "concise", Weight: 1}}
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		sessionID := fmt.Sprintf("session%d", i)
+		variant := agent.VariantFor(sessionID)
+		require.NotNil(t, variant)
+		// Sessions keep their variant
+		assert.Equal(t, variant.Name, agent.VariantFor(sessionID).Name)
+		counts[variant.Name]++
+	}
+	assert.InDelta(t, 3000, counts["control"], 200)
+	assert.InDelta(t, 1000, counts["concise"], 200)
+
+	// Renaming the experiment assigns sessions afresh
+	renamed := *agent
+	renamed.Experiment = "tone-2"
+	moved := 0
+	for i := 0; i < 100; i++ {
+		sessionID := fmt.Sprintf("session%d", i)
+		if agent.VariantFor(sessionID).Name != renamed.VariantFor(sessionID).Name {
+			moved++
+		}
+	}
+	assert.Positive(t, moved)
+}
+
+func TestWithVariant(t *testing.T) {
+	agent := &Agent{ID: "support"}
+	agent.Instructions = "Be helpful"
+	agent.Model = "gpt-4o"
+	agent.Temperature = temperature(0.7)
+
+	variant := agent.WithVariant(&Variant{Name: "concise", Instructions: "Be concise", Temperature: temperature(0.2)})
+	assert.Equal(t, "concise", variant.AssignedVariant())
+	assert.Equal(t, "Be concise", variant.Instructions)
+	assert.Equal(t, "gpt-4o", variant.Model)
+	assert.Equal(t, temperature(0.2), variant.Temperature)
+
+	// The agent itself is unchanged
+	assert.Equal(t, "", agent.AssignedVariant())
+	assert.Equal(t, "Be helpful", agent.Instructions)
+}
@@ -2,29 +2,112 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/agents"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/handlers"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/health"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/retention"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
 	"github.com/sirupsen/logrus"
 )
 
-// SetupRoutes configures the API routes
-func SetupRoutes(router *gin.Engine, openaiClient openai.ClientInterface, log *logrus.Logger, cfg *config.Config) {
-	// Create handler
-	handler := handlers.NewChatHandler(openaiClient, log, cfg)
+// SetupRoutes configures the API routes. Chat exchanges and feedback on them
+// are recorded in the audit sink unless it is nil, and changed agents' answers
+// are removed from the semantic cache unless it is nil. Every request runs
+// with the configuration current when it arrives.
+func SetupRoutes(router *gin.Engine, openaiClient openai.ClientInterface, auditSink audit.Sink, semanticCache *semanticcache.Cache, retentionService *retention.Service, healthChecker *health.Checker, agentRegistry *agents.Registry, log *logrus.Logger, configs *config.Store) {
+	// Create handlers. Outcomes of agents' experiments are aggregated per instance.
+	experimentRecorder := experiments.NewRecorder()
+	handler := handlers.NewChatHandler(openaiClient, log, configs, auditSink, agentRegistry, experimentRecorder)
+	agentHandler := handlers.NewAgentHandler(agentRegistry, experimentRecorder, semanticCache, log, configs)
+	feedbackHandler := handlers.NewFeedbackHandler(openaiClient, auditSink, experimentRecorder, log, configs)
+	completionsHandler := handlers.NewCompletionsHandler(openaiClient, log, configs, auditSink, handler)
+	adminHandler := handlers.NewAdminHandler(auditSink, retentionService, log, configs)
+	exportHandler := handlers.NewExportHandler(openaiClient, log, configs)
+	importHandler := handlers.NewImportHandler(openaiClient, auditSink, log, configs)
+	healthHandler := handlers.NewHealthHandler(healthChecker)
 
-	// Health check endpoint
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status": "ok",
-			"service": "chatgpt-service",
-		})
-	})
+	// Trace every request, continuing the caller's trace if there is one
+	router.Use(tracing.Middleware())
+
+	// Assign request IDs and write JSON access logs
+	router.Use(logging.Middleware(log))
+
+	// Record request metrics for every route
+	router.Use(metrics.Middleware())
+
+	// Recover from panics in handlers
+	router.Use(logging.Recovery(log))
+
+	// Pin each request to the current configuration
+	router.Use(handlers.SnapshotConfig(configs))
+
+	// Cap request body sizes
+	router.Use(handlers.LimitRequestBody(configs))
+
+	// Prometheus metrics endpoint
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// Health check endpoints. /health is kept as an alias of the liveness probe.
+	router.GET("/health", healthHandler.HandleLive)
+	router.GET("/health/live", healthHandler.HandleLive)
+	router.GET("/health/ready", healthHandler.HandleReady)
 
 	// API endpoints
 	api := router.Group("/api")
 	{
 		// Chat endpoint
 		api.POST("/chat", handler.HandleChat)
+
+		// Chat over a persistent WebSocket connection
+		api.GET("/chat/ws", handler.HandleChatWS)
+
+		// Stop the in-flight completion for a session
+		api.POST("/sessions/:id/cancel", handler.HandleCancelRun)
+
+		// Users' feedback on replies
+		api.POST("/feedback", feedbackHandler.HandleFeedback)
+
+		// Admin endpoints, authorized with ADMIN_API_KEY
+		requireAdmin := handlers.RequireAdmin(configs)
+		admin := api.Group("/admin", requireAdmin)
+		admin.GET("/audit", adminHandler.HandleAuditQuery)
+
+		// Export cached conversations as a fine-tuning dataset
+		admin.GET("/export", exportHandler.HandleExportDataset)
+
+		// Export the transcript of a cached conversation
+		api.GET("/sessions/:id/export", requireAdmin, exportHandler.HandleExportSession)
+
+		// Create a session from the transcript of a conversation
+		api.POST("/sessions/import", requireAdmin, importHandler.HandleImportSession)
+
+		// Erase all data of a user in an organization
+		api.DELETE("/users/:userId/data", requireAdmin, adminHandler.HandleEraseUserData)
+
+		// Manage the organizations' agent definitions, authorized with ADMIN_API_KEY
+		agentRoutes := api.Group("/agents", requireAdmin)
+		agentRoutes.POST("", agentHandler.HandleCreateAgent)
+		agentRoutes.GET("", agentHandler.HandleListAgents)
+		agentRoutes.GET("/:id", agentHandler.HandleGetAgent)
+		agentRoutes.PUT("/:id", agentHandler.HandleUpdateAgent)
+		agentRoutes.DELETE("/:id", agentHandler.HandleDeleteAgent)
+		agentRoutes.GET("/:id/versions", agentHandler.HandleListAgentVersions)
+		agentRoutes.GET("/:id/versions/:version", agentHandler.HandleGetAgentVersion)
+		agentRoutes.POST("/:id/render", agentHandler.HandleRenderAgent)
+		agentRoutes.GET("/:id/experiment", agentHandler.HandleExperimentStats)
+	}
+
+	// OpenAI-compatible endpoints, authorized with ADMIN_API_KEY
+	v1 := router.Group("/v1", completionsHandler.RequireAPIKey)
+	{
+		v1.GET("/models", completionsHandler.HandleListModels)
+		v1.POST("/chat/completions", completionsHandler.HandleChatCompletions)
 	}
 }
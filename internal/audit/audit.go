@@ -0,0 +1,245 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+)
+
+// Sink kinds
+const (
+	SinkNone   = "none"
+	SinkJSONL  = "jsonl"
+	SinkStdout = "stdout"
+	SinkSQL    = "sql"
+)
+
+// Moderation outcomes of an exchange
+const (
+	ModerationDisabled = "disabled"
+	ModerationPassed   = "passed"
+	ModerationFlagged  = "flagged"
+	ModerationBlocked  = "blocked"
+)
+
+// Record kinds. Records of exchanges have no kind, for compatibility with
+// records written before there were others.
+const (
+	KindExchange = ""
+	KindFeedback = "feedback"
+	KindImport   = "import"
+)
+
+// Query limits
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// ErasedUserID replaces the user ID of records whose user's data was erased
+const ErasedUserID = "[erased]"
+
+var (
+	// ErrQueryUnsupported is returned by sinks that can only be written to
+	ErrQueryUnsupported = errors.New("audit sink does not support queries")
+
+	// ErrScrubUnsupported is returned by sinks whose records can't be changed
+	// once written
+	ErrScrubUnsupported = errors.New("audit sink does not support scrubbing records")
+)
+
+// Record is a single chat exchange in the audit trail, a user's feedback on
+// one, or a conversation imported into a session
+type Record struct {
+	ID             string    `json:"id"`
+	Kind           string    `json:"kind,omitempty"` // One of the Kind* kinds
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"requestId"`
+	Channel        string    `json:"channel"` // "http", "ws" or "v1" for the OpenAI-compatible API
+	OrganizationID string    `json:"organizationId"`
+	UserID         string    `json:"userId"`
+	AgentID        string    `json:"agentId"`
+	SessionID      string    `json:"sessionId"`
+	Experiment     string    `json:"experiment,omitempty"` // The experiment of the agent, if any
+	Variant        string    `json:"variant,omitempty"`    // The variant of the experiment the session is assigned to
+	ConversationID string    `json:"conversationId,omitempty"`
+	ResponseID     string    `json:"responseId,omitempty"` // The reply of the exchange, or the one feedback is on
+	Model          string    `json:"model,omitempty"`
+	TokensUsed     int       `json:"tokensUsed"`
+	Cost           float64   `json:"cost"`
+	Cached         bool      `json:"cached,omitempty"` // Whether the reply came from the response cache
+	DurationMs     int64     `json:"durationMs"`
+	Status         string    `json:"status"` // "success", "error", "timeout" or "cancelled" for exchanges
+	ErrorCode      string    `json:"errorCode,omitempty"`
+	// Moderation is one of the Moderation* outcomes, with the categories
+	// flagged or blocked content was flagged for
+	Moderation           string   `json:"moderation"`
+	ModerationCategories []string `json:"moderationCategories,omitempty"`
+	InjectionDetected    bool     `json:"injectionDetected,omitempty"`
+	// MessageHash and ResponseHash identify the content as "sha256:<hex>"
+	MessageHash  string `json:"messageHash"`
+	ResponseHash string `json:"responseHash,omitempty"`
+	// Message and Response are recorded only for organizations whose audit
+	// policy includes content. The message of an import is its transcript.
+	Message  string `json:"message,omitempty"`
+	Response string `json:"response,omitempty"`
+	// Feedback is the feedback of a feedback record. Its comment is recorded
+	// only for organizations whose audit policy includes content.
+	Feedback *models.Feedback `json:"feedback,omitempty"`
+}
+
+// RemoveContent removes the message and reply, or the feedback's comment,
+// from the record, reporting whether there was any
+func (r *Record) RemoveContent() bool {
+	removed := false
+	if r.Feedback != nil && r.Feedback.Comment != "" {
+		feedback := *r.Feedback
+		feedback.Comment = ""
+		r.Feedback = &feedback
+		removed = true
+	}
+	if r.Message == "" && r.Response == "" {
+		return removed
+	}
+	r.Message, r.Response = "", ""
+	return true
+}
+
+// EraseUser removes the content and user ID from the record. Hashes and usage
+// are kept as evidence that the exchange took place.
+func (r *Record) EraseUser() bool {
+	removed := r.RemoveContent()
+	if r.UserID == ErasedUserID {
+		return removed
+	}
+	r.UserID = ErasedUserID
+	return true
+}
+
+// Filter selects records in a query. Empty fields match every record.
+type Filter struct {
+	OrganizationID string
+	UserID         string
+	AgentID        string
+	SessionID      string
+	From           time.Time
+	To             time.Time
+	// Limit caps the number of records returned, most recent first
+	Limit int
+}
+
+// Matches reports whether a record is selected by the filter
+func (f Filter) Matches(r *Record) bool {
+	return (f.OrganizationID == "" || r.OrganizationID == f.OrganizationID) &&
+		(f.UserID == "" || r.UserID == f.UserID) &&
+		(f.AgentID == "" || r.AgentID == f.AgentID) &&
+		(f.SessionID == "" || r.SessionID == f.SessionID) &&
+		(f.From.IsZero() || !r.Time.Before(f.From)) &&
+		(f.To.IsZero() || r.Time.Before(f.To))
+}
+
+// limit returns the number of records the filter allows
+func (f Filter) limit() int {
+	if f.Limit <= 0 {
+		return DefaultLimit
+	}
+	if f.Limit > MaxLimit {
+		return MaxLimit
+	}
+	return f.Limit
+}
+
+// Sink stores audit records. Records are only ever appended, and changed
+// only to remove personal data.
+type Sink interface {
+	Write(ctx context.Context, record *Record) error
+	// Query returns the records selected by the filter, most recent first
+	Query(ctx context.Context, filter Filter) ([]Record, error)
+	// Scrub calls scrub on every record selected by the filter, ignoring its
+	// limit, and stores the records it reports as changed. It returns the
+	// number of changed records.
+	Scrub(ctx context.Context, filter Filter, scrub func(record *Record) bool) (int, error)
+	// Ping checks that records can still be written
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Scan calls fn on every record selected by the filter, most recent first,
+// until fn returns false. It queries the sink a page of MaxLimit records at a
+// time, ignoring the filter's limit.
+func Scan(ctx context.Context, sink Sink, filter Filter, fn func(record *Record) bool) error {
+	filter.Limit = MaxLimit
+	seen := make(map[string]bool)
+	for {
+		records, err := sink.Query(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		var oldest time.Time
+		for i := range records {
+			if seen[records[i].ID] {
+				continue
+			}
+			if !fn(&records[i]) {
+				return nil
+			}
+			if oldest.IsZero() || records[i].Time.Before(oldest) {
+				oldest = records[i].Time
+			}
+		}
+		if len(records) < MaxLimit || oldest.IsZero() {
+			return nil
+		}
+
+		// The next page ends with the records written at the same time as
+		// the oldest of this page, which may not all have fit in it
+		clear(seen)
+		for i := range records {
+			if records[i].Time.Equal(oldest) {
+				seen[records[i].ID] = true
+			}
+		}
+		filter.To = oldest.Add(time.Nanosecond)
+	}
+}
+
+// NewSink opens the configured sink, or returns nil if auditing is disabled
+func NewSink(cfg config.AuditConfig) (Sink, error) {
+	switch cfg.Sink {
+	case SinkNone, "":
+		return nil, nil
+	case SinkJSONL:
+		sink, err := NewJSONLSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case SinkStdout:
+		return NewWriterSink(os.Stdout), nil
+	case SinkSQL:
+		sink, err := OpenSQLSink(cfg.SQLDriver, cfg.SQLDSN)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", cfg.Sink)
+	}
+}
+
+// Hash returns the hash identifying a piece of content, or "" for no content
+func Hash(content string) string {
+	if content == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
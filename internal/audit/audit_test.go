@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLSinkQuery(t *testing.T) {
+	sink, err := NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, org := range []string{"org1", "org2", "org1", "org1"} {
+		require.NoError(t, sink.Write(ctx, &Record{
+			ID:             string(rune('a' + i)),
+			Time:           start.Add(time.Duration(i) * time.Minute),
+			OrganizationID: org,
+			MessageHash:    Hash("message"),
+		}))
+	}
+
+	testCases := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"All, most recent first", Filter{}, []string{"d", "c", "b", "a"}},
+		{"Organization", Filter{OrganizationID: "org1"}, []string{"d", "c", "a"}},
+		{"Limit keeps the most recent", Filter{OrganizationID: "org1", Limit: 2}, []string{"d", "c"}},
+		{"Time range", Filter{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, []string{"c", "b"}},
+		{"No match", Filter{UserID: "user1"}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := sink.Query(ctx, tc.filter)
+			require.NoError(t, err)
+			var ids []string
+			for _, record := range records {
+				ids = append(ids, record.ID)
+			}
+			assert.Equal(t, tc.expected, ids)
+		})
+	}
+}
+
+func TestJSONLSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		sink, err := NewJSONLSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(ctx, &Record{ID: id, Time: time.Now()}))
+		require.NoError(t, sink.Close())
+	}
+
+	sink, err := NewJSONLSink(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	records, err := sink.Query(ctx, Filter{})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+
+	require.NoError(t, sink.Write(context.Background(), &Record{ID: "a", OrganizationID: "org1"}))
+	assert.Contains(t, buf.String(), `"id":"a"`)
+	assert.Contains(t, buf.String(), `"organizationId":"org1"`)
+
+	_, err := sink.Query(context.Background(), Filter{})
+	assert.ErrorIs(t, err, ErrQueryUnsupported)
+	_, err = sink.Scrub(context.Background(), Filter{}, (*Record).EraseUser)
+	assert.ErrorIs(t, err, ErrScrubUnsupported)
+}
+
+func TestHash(t *testing.T) {
+	assert.Equal(t, "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", Hash("hello"))
+	assert.Empty(t, Hash(""))
+}
+
+func TestJSONLSinkScrub(t *testing.T) {
+	sink, err := NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	ctx := context.Background()
+	for i, user := range []string{"user1", "user2", "user1"} {
+		require.NoError(t, sink.Write(ctx, &Record{
+			ID:             string(rune('a' + i)),
+			Time:           time.Now(),
+			OrganizationID: "org1",
+			UserID:         user,
+			Message:        "Hello",
+			MessageHash:    Hash("Hello"),
+		}))
+	}
+
+	erased, err := sink.Scrub(ctx, Filter{OrganizationID: "org1", UserID: "user1"}, (*Record).EraseUser)
+	require.NoError(t, err)
+	assert.Equal(t, 2, erased)
+
+	// Records written after scrubbing go to the rewritten file
+	require.NoError(t, sink.Write(ctx, &Record{ID: "d", Time: time.Now(), OrganizationID: "org1", UserID: "user3"}))
+
+	records, err := sink.Query(ctx, Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	byID := map[string]Record{}
+	for _, record := range records {
+		byID[record.ID] = record
+	}
+	for _, id := range []string{"a", "c"} {
+		assert.Equal(t, ErasedUserID, byID[id].UserID)
+		assert.Empty(t, byID[id].Message)
+		assert.Equal(t, Hash("Hello"), byID[id].MessageHash)
+	}
+	assert.Equal(t, "user2", byID["b"].UserID)
+	assert.Equal(t, "Hello", byID["b"].Message)
+
+	// Scrubbing again changes nothing
+	erased, err = sink.Scrub(ctx, Filter{OrganizationID: "org1", UserID: ErasedUserID}, (*Record).EraseUser)
+	require.NoError(t, err)
+	assert.Equal(t, 0, erased)
+}
+
+func TestRemoveContentOfFeedback(t *testing.T) {
+	feedback := &models.Feedback{Thumbs: "up", Comment: "Thanks"}
+	record := &Record{Kind: KindFeedback, Feedback: feedback}
+
+	assert.True(t, record.RemoveContent())
+	assert.Empty(t, record.Feedback.Comment)
+	assert.Equal(t, "up", record.Feedback.Thumbs)
+	assert.False(t, record.RemoveContent())
+}
+
+func TestScan(t *testing.T) {
+	sink, err := NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	// Pages of MaxLimit records end in the middle of records written at the
+	// same time
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	count := 2*MaxLimit + 10
+	for i := 0; i < count; i++ {
+		require.NoError(t, sink.Write(ctx, &Record{
+			ID:             fmt.Sprintf("record%d", i),
+			Time:           start.Add(time.Duration(i/20) * time.Second),
+			OrganizationID: "org1",
+		}))
+	}
+
+	seen := make(map[string]bool)
+	var last time.Time
+	require.NoError(t, Scan(ctx, sink, Filter{OrganizationID: "org1", Limit: 5}, func(record *Record) bool {
+		assert.False(t, seen[record.ID], "record %s scanned twice", record.ID)
+		seen[record.ID] = true
+		if !last.IsZero() {
+			assert.False(t, record.Time.After(last), "records out of order")
+		}
+		last = record.Time
+		return true
+	}))
+	assert.Len(t, seen, count)
+
+	scanned := 0
+	require.NoError(t, Scan(ctx, sink, Filter{}, func(record *Record) bool {
+		scanned++
+		return scanned < 3
+	}))
+	assert.Equal(t, 3, scanned)
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONLSink appends records to a file as JSON lines
+type JSONLSink struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewJSONLSink opens a JSONL file for appending, creating it if needed
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &JSONLSink{path: path, file: file}, nil
+}
+
+// Write implements Sink
+func (s *JSONLSink) Write(ctx context.Context, record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return s.file.Sync()
+}
+
+// Query implements Sink by scanning the whole file
+func (s *JSONLSink) Query(ctx context.Context, filter Filter) ([]Record, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	defer file.Close()
+
+	// Keep the most recent matches, in the order they were written
+	limit := filter.limit()
+	var records []Record
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record Record
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				return nil, fmt.Errorf("invalid audit record: %w", jsonErr)
+			}
+			if filter.Matches(&record) {
+				if len(records) == limit {
+					records = records[1:]
+				}
+				records = append(records, record)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit file: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Scrub implements Sink by rewriting the file, replacing it atomically
+func (s *JSONLSink) Scrub(ctx context.Context, filter Filter, scrub func(record *Record) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create audit file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	changed := 0
+	reader := bufio.NewReader(file)
+	writer := bufio.NewWriter(tmp)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record Record
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				return 0, fmt.Errorf("invalid audit record: %w", jsonErr)
+			}
+			if filter.Matches(&record) && scrub(&record) {
+				changed++
+				data, jsonErr := json.Marshal(&record)
+				if jsonErr != nil {
+					return 0, jsonErr
+				}
+				line = append(data, '\n')
+			}
+			if _, err := writer.Write(line); err != nil {
+				return 0, fmt.Errorf("failed to write audit file: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read audit file: %w", err)
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write audit file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to write audit file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return 0, fmt.Errorf("failed to replace audit file: %w", err)
+	}
+
+	// Appends must go to the new file
+	appendFile, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return changed, fmt.Errorf("failed to reopen audit file: %w", err)
+	}
+	s.file.Close()
+	s.file = appendFile
+	return changed, nil
+}
+
+// Ping implements Sink, checking that the file hasn't been removed
+func (s *JSONLSink) Ping(ctx context.Context) error {
+	if _, err := os.Stat(s.path); err != nil {
+		return fmt.Errorf("failed to find audit file: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink
+func (s *JSONLSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
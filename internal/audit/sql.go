@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// createTableSQL creates the audit table. The columns records are filtered
+// by are kept next to the full record as JSON.
+const createTableSQL = `CREATE TABLE IF NOT EXISTS audit_records (
+	id VARCHAR(64) PRIMARY KEY,
+	recorded_at TIMESTAMP NOT NULL,
+	organization_id VARCHAR(128) NOT NULL,
+	user_id VARCHAR(128) NOT NULL,
+	agent_id VARCHAR(128) NOT NULL,
+	session_id VARCHAR(128) NOT NULL,
+	record TEXT NOT NULL
+)`
+
+// SQLSink inserts records into an audit_records table
+type SQLSink struct {
+	db *sql.DB
+	// numbered is set for drivers using $1-style placeholders instead of ?
+	numbered bool
+}
+
+// OpenSQLSink connects to a database with a registered database/sql driver
+// and creates the audit table if it doesn't exist
+func OpenSQLSink(driver, dsn string) (*SQLSink, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit database: %w", err)
+	}
+	sink, err := NewSQLSink(db, driver == "postgres" || driver == "pgx")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// NewSQLSink creates a sink on an open database, creating the audit table if
+// it doesn't exist
+func NewSQLSink(db *sql.DB, numberedPlaceholders bool) (*SQLSink, error) {
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create audit table: %w", err)
+	}
+	return &SQLSink{db: db, numbered: numberedPlaceholders}, nil
+}
+
+// Write implements Sink
+func (s *SQLSink) Write(ctx context.Context, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO audit_records (id, recorded_at, organization_id, user_id, agent_id, session_id, record) VALUES (" +
+		s.placeholders(1, 7) + ")"
+	_, err = s.db.ExecContext(ctx, query, record.ID, record.Time.UTC(), record.OrganizationID, record.UserID,
+		record.AgentID, record.SessionID, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Query implements Sink
+func (s *SQLSink) Query(ctx context.Context, filter Filter) ([]Record, error) {
+	where, args := s.where(filter)
+	query := "SELECT record FROM audit_records" + where + " ORDER BY recorded_at DESC LIMIT " + strconv.Itoa(filter.limit())
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit records: %w", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read audit record: %w", err)
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Scrub implements Sink
+func (s *SQLSink) Scrub(ctx context.Context, filter Filter, scrub func(record *Record) bool) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scrub audit records: %w", err)
+	}
+	defer tx.Rollback()
+
+	where, args := s.where(filter)
+	rows, err := tx.QueryContext(ctx, "SELECT record FROM audit_records"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query audit records: %w", err)
+	}
+	var changed []Record
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read audit record: %w", err)
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("invalid audit record: %w", err)
+		}
+		if scrub(&record) {
+			changed = append(changed, record)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query audit records: %w", err)
+	}
+
+	update := "UPDATE audit_records SET user_id = " + s.placeholder(1) + ", record = " + s.placeholder(2) +
+		" WHERE id = " + s.placeholder(3)
+	for _, record := range changed {
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, update, record.UserID, string(data), record.ID); err != nil {
+			return 0, fmt.Errorf("failed to scrub audit record: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to scrub audit records: %w", err)
+	}
+	return len(changed), nil
+}
+
+// Ping implements Sink
+func (s *SQLSink) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to reach audit database: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
+
+// where returns the WHERE clause selecting the filter's records, ignoring its
+// limit, and its arguments
+func (s *SQLSink) where(filter Filter) (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+" "+s.placeholder(len(args)))
+	}
+	if filter.OrganizationID != "" {
+		add("organization_id =", filter.OrganizationID)
+	}
+	if filter.UserID != "" {
+		add("user_id =", filter.UserID)
+	}
+	if filter.AgentID != "" {
+		add("agent_id =", filter.AgentID)
+	}
+	if filter.SessionID != "" {
+		add("session_id =", filter.SessionID)
+	}
+	if !filter.From.IsZero() {
+		add("recorded_at >=", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		add("recorded_at <", filter.To.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// placeholder returns the placeholder of the nth query argument
+func (s *SQLSink) placeholder(n int) string {
+	if s.numbered {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// placeholders returns the comma-separated placeholders of arguments first to last
+func (s *SQLSink) placeholders(first, last int) string {
+	list := make([]string, 0, last-first+1)
+	for n := first; n <= last; n++ {
+		list = append(list, s.placeholder(n))
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// WriterSink writes records as JSON lines to a stream such as stdout, for
+// collection by a log shipper. It can't be queried.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write implements Sink
+func (s *WriterSink) Write(ctx context.Context, record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+// Query implements Sink
+func (s *WriterSink) Query(ctx context.Context, filter Filter) ([]Record, error) {
+	return nil, ErrQueryUnsupported
+}
+
+// Scrub implements Sink
+func (s *WriterSink) Scrub(ctx context.Context, filter Filter, scrub func(record *Record) bool) (int, error) {
+	return 0, ErrScrubUnsupported
+}
+
+// Ping implements Sink
+func (s *WriterSink) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Sink
+func (s *WriterSink) Close() error {
+	return nil
+}
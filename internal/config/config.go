@@ -1,87 +1,480 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Session concurrency modes control what happens when a request arrives for
+// a session that is already running another request
+const (
+	// SessionConcurrencyQueue waits for the running request to finish
+	SessionConcurrencyQueue = "queue"
+	// SessionConcurrencyReject fails the new request with session_busy
+	SessionConcurrencyReject = "reject"
+	// SessionConcurrencyCancel cancels the running request in favor of the new one
+	SessionConcurrencyCancel = "cancel"
+)
+
+// Moderation providers classify content for moderation
+const (
+	// ModerationProviderOpenAI uses the OpenAI moderation endpoint
+	ModerationProviderOpenAI = "openai"
+	// ModerationProviderRules uses the local rule-based classifier
+	ModerationProviderRules = "rules"
+)
+
+// Embedding providers compute the embeddings of questions for the semantic cache
+const (
+	// EmbeddingProviderOpenAI uses the OpenAI embeddings endpoint
+	EmbeddingProviderOpenAI = "openai"
+	// EmbeddingProviderLocal uses the local feature-hashing embedder
+	EmbeddingProviderLocal = "local"
 )
 
+// Moderation actions are what happens to content flagged by moderation
+const (
+	// ModerationActionAllow lets flagged content through, only recording it in the metrics
+	ModerationActionAllow = "allow"
+	// ModerationActionFlag lets flagged content through, marking it in the response
+	ModerationActionFlag = "flag"
+	// ModerationActionBlock rejects flagged content with content_blocked
+	ModerationActionBlock = "block"
+)
+
+// Injection policies are how untrusted file and chat history content is
+// checked for prompt injection
+const (
+	// InjectionPolicyDetect reports content with signs of injection in the response
+	InjectionPolicyDetect = "detect"
+	// InjectionPolicyQuarantine also leaves suspicious files out of the prompt
+	InjectionPolicyQuarantine = "quarantine"
+	// InjectionPolicyOff disables detection; files are still delimited
+	InjectionPolicyOff = "off"
+)
+
+// ModelPrice is the price of a model in USD per 1,000 tokens
+type ModelPrice struct {
+	PromptPer1K     float64 `yaml:"prompt_per_1k"`
+	CompletionPer1K float64 `yaml:"completion_per_1k"`
+}
+
+// defaultPricing returns the list prices of common models
+func defaultPricing() map[string]ModelPrice {
+	return map[string]ModelPrice{
+		"gpt-4o":        {PromptPer1K: 0.0025, CompletionPer1K: 0.01},
+		"gpt-4o-mini":   {PromptPer1K: 0.00015, CompletionPer1K: 0.0006},
+		"gpt-4-turbo":   {PromptPer1K: 0.01, CompletionPer1K: 0.03},
+		"gpt-4":         {PromptPer1K: 0.03, CompletionPer1K: 0.06},
+		"gpt-3.5-turbo": {PromptPer1K: 0.0005, CompletionPer1K: 0.0015},
+	}
+}
+
+// Limits bound the size of requests. Zero means unlimited.
+type Limits struct {
+	// MaxBodyBytes is the maximum size of a request body or WebSocket frame
+	MaxBodyBytes int64
+	// MaxMessageLength is the maximum length of a message in characters
+	MaxMessageLength int
+	// MaxFiles is the maximum number of context files
+	MaxFiles int
+	// MaxFilesBytes is the maximum total size of the context files' content
+	MaxFilesBytes int
+	// MaxChatHistory is the maximum number of chat history entries
+	MaxChatHistory int
+}
+
+// RedactionPolicy controls how an organization's PII and secrets are handled
+type RedactionPolicy struct {
+	// Kinds lists the built-in detectors to apply; empty means all of them
+	Kinds []string `json:"kinds,omitempty"`
+	// Patterns adds custom detectors as regular expressions by name
+	Patterns map[string]string `json:"patterns,omitempty"`
+	// MaskUpstream replaces detected values with placeholders before messages
+	// are sent to OpenAI, and restores them in the reply
+	MaskUpstream bool `json:"maskUpstream"`
+}
+
+// ModerationPolicy controls how an organization's content is moderated
+type ModerationPolicy struct {
+	// Action is one of the ModerationAction* actions; empty disables moderation
+	Action string `json:"action,omitempty"`
+	// CheckReplies also moderates the assistant's replies
+	CheckReplies bool `json:"checkReplies"`
+	// Categories limits the flagged categories the action applies to; empty
+	// means all of them
+	Categories []string `json:"categories,omitempty"`
+}
+
+// AuditPolicy controls what the audit trail records of an organization's chats
+type AuditPolicy struct {
+	// IncludeContent records messages and replies in full; otherwise only
+	// their hashes are recorded
+	IncludeContent bool `json:"includeContent"`
+}
+
+// RetentionPolicy controls how long an organization's conversations are kept
+type RetentionPolicy struct {
+	// Days after which conversation threads and audit content are purged;
+	// zero keeps them
+	Days int `json:"days"`
+}
+
+// OrgPolicy holds the settings of a single organization
+type OrgPolicy struct {
+	// Name is the organization's name as agents' instructions refer to it
+	Name string `json:"name,omitempty"`
+	// TimeZone is the IANA time zone of dates and times in agents'
+	// instructions for users without one of their own (default: UTC)
+	TimeZone string `json:"timeZone,omitempty"`
+
+	Redaction  RedactionPolicy  `json:"redaction"`
+	Moderation ModerationPolicy `json:"moderation"`
+	Audit      AuditPolicy      `json:"audit"`
+	Retention  RetentionPolicy  `json:"retention"`
+}
+
+// AuditConfig configures where the audit trail is written
+type AuditConfig struct {
+	// Sink is "none", "jsonl", "stdout" or "sql"
+	Sink string
+	// File is the path of the JSONL file
+	File string
+	// SQLDriver and SQLDSN select the database of the SQL sink
+	SQLDriver string
+	SQLDSN    string
+}
+
 // Config holds the application configuration
 type Config struct {
 	OpenAIAPIKey   string
+	OpenAIBaseURL  string
 	Port           string
 	ThreadTTL      time.Duration
 	DefaultModel   string
+	AllowedModels  []string
+	Pricing        map[string]ModelPrice
 	MaxRetries     int
 	RetryDelay     time.Duration
 	RequestTimeout time.Duration
+
+	// SessionConcurrency is one of the SessionConcurrency* modes
+	SessionConcurrency string
+
+	// WSAllowedOrigins lists the origins allowed to open the chat WebSocket.
+	// Empty means same-origin only; "*" allows any origin.
+	WSAllowedOrigins []string
+
+	// TracingExporter is where spans are exported: "none", "stdout" or "otlp"
+	TracingExporter string
+	// TracingSampleRatio is the fraction of new traces that are sampled.
+	// Traces continued from a caller follow the caller's sampling decision.
+	TracingSampleRatio float64
+
+	// ModerationProvider is one of the ModerationProvider* providers
+	ModerationProvider string
+
+	Limits Limits
+
+	Audit AuditConfig
+
+	// AdminAPIKey authorizes requests to the admin API. Empty disables it.
+	AdminAPIKey string
+
+	// LogLevel is the minimum level of logged entries
+	LogLevel string
+
+	// HealthCheckTTL is how long the result of the OpenAI readiness check is reused
+	HealthCheckTTL time.Duration
+	// DrainDelay is how long the service reports not ready before shutting
+	// down, so load balancers stop sending it traffic
+	DrainDelay time.Duration
+	// ConfigWatchInterval is how often config files are checked for changes.
+	// Zero disables reloading on changes; SIGHUP still reloads.
+	ConfigWatchInterval time.Duration
+
+	// ResponseCacheSize is the maximum number of replies in the response
+	// cache. Zero disables the cache.
+	ResponseCacheSize int
+	// ResponseCacheTTL is how long replies are cached for agents whose cache
+	// configuration doesn't set a TTL
+	ResponseCacheTTL time.Duration
+	// SemanticCacheSize is the maximum number of answers in the semantic
+	// cache per agent. Zero disables the cache.
+	SemanticCacheSize int
+	// SemanticCacheThreshold is the similarity a question must have to a
+	// cached one to get its answer, for agents whose cache configuration
+	// doesn't set a threshold
+	SemanticCacheThreshold float64
+	// EmbeddingProvider is one of the EmbeddingProvider* providers
+	EmbeddingProvider string
+	// EmbeddingModel is the model the openai embedding provider embeds with
+	EmbeddingModel string
+
+	// InjectionPolicy is the InjectionPolicy* policy of agents whose
+	// configuration doesn't set one
+	InjectionPolicy string
+
+	// AgentRegistryFile is the JSON file registered agents are saved to.
+	// Empty keeps them in memory only.
+	AgentRegistryFile string
+	// RequireRegisteredAgents rejects chat requests whose agent isn't
+	// registered instead of running them with the request's agent configuration
+	RequireRegisteredAgents bool
+
+	// DefaultPolicy applies to organizations without an entry in OrgPolicies
+	DefaultPolicy OrgPolicy
+	// OrgPolicyFile is the JSON file OrgPolicies are loaded from
+	OrgPolicyFile string
+	// OrgPolicies holds per-organization policies by organization ID
+	OrgPolicies map[string]OrgPolicy
+
+	// sources records where each setting was set by environment variable
+	sources map[string]string
 }
 
-// NewConfig creates a new configuration with values from environment variables
-func NewConfig() *Config {
-	// Get OpenAI API key from environment
-	openAIAPIKey := os.Getenv("OPENAI_API_KEY")
-	if openAIAPIKey == "" {
-		panic("OPENAI_API_KEY environment variable is required")
-	}
+// Default returns the configuration used for settings that aren't set
+func Default() *Config {
+	return &Config{
+		Port:               "8080",
+		LogLevel:           "info",
+		ThreadTTL:          60 * time.Minute,
+		DefaultModel:       "gpt-4o",
+		Pricing:            defaultPricing(),
+		MaxRetries:         3,
+		RetryDelay:         1 * time.Second,
+		RequestTimeout:     60 * time.Second,
+		SessionConcurrency: SessionConcurrencyQueue,
+		TracingExporter:    "none",
+		TracingSampleRatio: 1.0,
+		ModerationProvider: ModerationProviderOpenAI,
+		Limits: Limits{
+			MaxBodyBytes:     10 << 20,
+			MaxMessageLength: 32000,
+			MaxFiles:         20,
+			MaxFilesBytes:    5 << 20,
+			MaxChatHistory:   100,
+		},
+		Audit: AuditConfig{
+			Sink:      "none",
+			File:      "audit.jsonl",
+			SQLDriver: "postgres",
+		},
+		ResponseCacheSize:      1000,
+		ResponseCacheTTL:       time.Hour,
+		SemanticCacheSize:      1000,
+		SemanticCacheThreshold: 0.95,
+		EmbeddingProvider:      EmbeddingProviderOpenAI,
+		EmbeddingModel:         "text-embedding-3-small",
+		InjectionPolicy:        InjectionPolicyDetect,
+		HealthCheckTTL:         30 * time.Second,
+		DrainDelay:             5 * time.Second,
+		OrgPolicies:            map[string]OrgPolicy{},
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+		ConfigWatchInterval: 10 * time.Second,
 	}
+}
 
+// Validate checks the configuration for values the service can't run with,
+// reporting every problem found in an *Error
+func (c *Config) Validate() error {
+	var problems []error
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	if c.OpenAIAPIKey == "" {
+		add("OPENAI_API_KEY or OPENAI_API_KEY_FILE is required")
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		add("PORT: invalid port %q", c.Port)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		add("LOG_LEVEL: unknown log level %q", c.LogLevel)
+	}
+	if c.DefaultModel == "" {
+		add("DEFAULT_MODEL must not be empty")
+	}
+	if c.MaxRetries < 0 {
+		add("MAX_RETRIES must not be negative")
+	}
+	if c.ThreadTTL <= 0 {
+		add("THREAD_TTL must be positive")
+	}
+	if c.RequestTimeout <= 0 {
+		add("REQUEST_TIMEOUT must be positive")
+	}
+	if c.RetryDelay < 0 {
+		add("RETRY_DELAY must not be negative")
+	}
+	if c.HealthCheckTTL < 0 {
+		add("HEALTH_CHECK_TTL must not be negative")
+	}
+	if c.DrainDelay < 0 {
+		add("SHUTDOWN_DRAIN_DELAY must not be negative")
+	}
+	switch c.SessionConcurrency {
+	case SessionConcurrencyQueue, SessionConcurrencyReject, SessionConcurrencyCancel:
+	default:
+		add("SESSION_CONCURRENCY: unknown session concurrency mode %q", c.SessionConcurrency)
+	}
+	switch c.TracingExporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("TRACING_EXPORTER: unknown tracing exporter %q", c.TracingExporter)
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		add("TRACING_SAMPLE_RATIO must be between 0 and 1, got %v", c.TracingSampleRatio)
+	}
+	switch c.ModerationProvider {
+	case ModerationProviderOpenAI, ModerationProviderRules:
+	default:
+		add("MODERATION_PROVIDER: unknown moderation provider %q", c.ModerationProvider)
+	}
+	switch c.Audit.Sink {
+	case "none", "jsonl", "stdout", "sql":
+	default:
+		add("AUDIT_SINK: unknown audit sink %q", c.Audit.Sink)
+	}
+	if c.Audit.Sink == "sql" && c.Audit.SQLDSN == "" {
+		add("AUDIT_SQL_DSN or AUDIT_SQL_DSN_FILE is required with the sql audit sink")
+	}
+	if !IsInjectionPolicy(c.InjectionPolicy) {
+		add("INJECTION_POLICY: unknown injection policy %q", c.InjectionPolicy)
+	}
+	for model, price := range c.Pricing {
+		if price.PromptPer1K < 0 || price.CompletionPer1K < 0 {
+			add("pricing of %s: prices must not be negative", model)
+		}
+	}
+	if c.Limits.MaxBodyBytes < 0 || c.Limits.MaxMessageLength < 0 || c.Limits.MaxFiles < 0 ||
+		c.Limits.MaxFilesBytes < 0 || c.Limits.MaxChatHistory < 0 {
+		add("request limits must not be negative")
+	}
+	if c.ResponseCacheSize < 0 {
+		add("RESPONSE_CACHE_SIZE must not be negative")
+	}
+	if c.ResponseCacheSize > 0 && c.ResponseCacheTTL <= 0 {
+		add("RESPONSE_CACHE_TTL must be positive")
+	}
+	if c.SemanticCacheSize < 0 {
+		add("SEMANTIC_CACHE_SIZE must not be negative")
+	}
+	if c.SemanticCacheSize > 0 && (c.SemanticCacheThreshold <= 0 || c.SemanticCacheThreshold > 1) {
+		add("SEMANTIC_CACHE_THRESHOLD must be greater than 0 and at most 1, got %v", c.SemanticCacheThreshold)
+	}
+	switch c.EmbeddingProvider {
+	case EmbeddingProviderOpenAI, EmbeddingProviderLocal:
+	default:
+		add("EMBEDDING_PROVIDER: unknown embedding provider %q", c.EmbeddingProvider)
+	}
+	if c.SemanticCacheSize > 0 && c.EmbeddingProvider == EmbeddingProviderOpenAI && c.EmbeddingModel == "" {
+		add("EMBEDDING_MODEL is required with the openai embedding provider")
+	}
+	if err := validatePolicy(c.DefaultPolicy); err != nil {
+		add("default policy: %w", err)
+	}
+	for organizationID, policy := range c.OrgPolicies {
+		if err := validatePolicy(policy); err != nil {
+			add("policy of organization %s: %w", organizationID, err)
+		}
+	}
 
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
 
-	// Get thread TTL from environment or use default (60 minutes)
-	threadTTLStr := os.Getenv("THREAD_TTL")
-	threadTTL := 60 * time.Minute
-	if threadTTLStr != "" {
-		if ttl, err := strconv.Atoi(threadTTLStr); err == nil {
-			threadTTL = time.Duration(ttl) * time.Minute
+// IsModelAllowed reports whether a model may be requested by callers
+func (c *Config) IsModelAllowed(model string) bool {
+	if model == c.DefaultModel {
+		return true
+	}
+	for _, allowed := range c.AllowedModels {
+		if allowed == model {
+			return true
 		}
 	}
+	return false
+}
 
-	// Get default model from environment or use default
-	defaultModel := os.Getenv("DEFAULT_MODEL")
-	if defaultModel == "" {
-		defaultModel = "gpt-4o"
+// Cost returns the estimated cost in USD of a completion, or 0 if the
+// model's price is unknown
+func (c *Config) Cost(model string, promptTokens, completionTokens int) float64 {
+	price, exists := c.Pricing[model]
+	if !exists {
+		return 0
 	}
+	return (float64(promptTokens)*price.PromptPer1K + float64(completionTokens)*price.CompletionPer1K) / 1000
+}
 
-	// Get max retries from environment or use default
-	maxRetriesStr := os.Getenv("MAX_RETRIES")
-	maxRetries := 3
-	if maxRetriesStr != "" {
-		if mr, err := strconv.Atoi(maxRetriesStr); err == nil {
-			maxRetries = mr
-		}
+// PolicyFor returns the policy of an organization
+func (c *Config) PolicyFor(organizationID string) OrgPolicy {
+	if policy, exists := c.OrgPolicies[organizationID]; exists {
+		return policy
 	}
+	return c.DefaultPolicy
+}
 
-	// Get retry delay from environment or use default (1 second)
-	retryDelayStr := os.Getenv("RETRY_DELAY")
-	retryDelay := 1 * time.Second
-	if retryDelayStr != "" {
-		if rd, err := strconv.Atoi(retryDelayStr); err == nil {
-			retryDelay = time.Duration(rd) * time.Second
-		}
+// loadOrgPolicies reads per-organization policies from a JSON file mapping
+// organization IDs to policies
+func loadOrgPolicies(path string) (map[string]OrgPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies map[string]OrgPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
 	}
+	return policies, nil
+}
 
-	// Get request timeout from environment or use default (60 seconds)
-	requestTimeoutStr := os.Getenv("REQUEST_TIMEOUT")
-	requestTimeout := 60 * time.Second
-	if requestTimeoutStr != "" {
-		if rt, err := strconv.Atoi(requestTimeoutStr); err == nil {
-			requestTimeout = time.Duration(rt) * time.Second
-		}
+// validatePolicy checks the settings of an organization's policy
+func validatePolicy(policy OrgPolicy) error {
+	if err := validateModerationAction(policy.Moderation.Action); err != nil {
+		return err
+	}
+	if policy.Retention.Days < 0 {
+		return fmt.Errorf("retention days must not be negative, got %d", policy.Retention.Days)
+	}
+	if _, err := time.LoadLocation(policy.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %q", policy.TimeZone)
 	}
+	return nil
+}
 
-	return &Config{
-		OpenAIAPIKey:   openAIAPIKey,
-		Port:           port,
-		ThreadTTL:      threadTTL,
-		DefaultModel:   defaultModel,
-		MaxRetries:     maxRetries,
-		RetryDelay:     retryDelay,
-		RequestTimeout: requestTimeout,
+// IsInjectionPolicy reports whether policy is one of the InjectionPolicy* policies
+func IsInjectionPolicy(policy string) bool {
+	switch policy {
+	case InjectionPolicyDetect, InjectionPolicyQuarantine, InjectionPolicyOff:
+		return true
+	}
+	return false
+}
+
+// validateModerationAction checks that action is a moderation action or empty
+func validateModerationAction(action string) error {
+	switch action {
+	case "", ModerationActionAllow, ModerationActionFlag, ModerationActionBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown moderation action %q", action)
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
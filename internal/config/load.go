@@ -0,0 +1,530 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of a setting's value, from lowest to highest precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// redacted replaces the values of secrets in printed configurations
+const redacted = "[REDACTED]"
+
+// pricingKey is the key of the model prices in the config file, which
+// override or add to the built-in list prices
+const pricingKey = "pricing"
+
+// Error reports every problem found while loading or validating a
+// configuration
+type Error struct {
+	Problems []error
+}
+
+// Error implements the error interface, listing one problem per line
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, problem := range e.Problems {
+		b.WriteString("\n  - ")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// Unwrap exposes the problems to errors.Is/As
+func (e *Error) Unwrap() []error {
+	return e.Problems
+}
+
+// Flags are the command-line options of the service
+type Flags struct {
+	// ConfigFile is the YAML or JSON file settings are read from. CONFIG_FILE
+	// is used if it isn't set.
+	ConfigFile string
+	// PrintConfig prints the effective configuration instead of starting the
+	// service
+	PrintConfig bool
+
+	// values holds the settings given on the command line by flag name
+	values map[string]string
+}
+
+// configFile returns the path of the config file, or "" if there is none
+func (f *Flags) configFile() string {
+	if f.ConfigFile != "" {
+		return f.ConfigFile
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// ParseFlags parses the command line. Every setting has a flag named after
+// its environment variable, e.g. --thread-ttl for THREAD_TTL. Secrets can
+// only be given as files on the command line, e.g. --openai-api-key-file.
+func ParseFlags(args []string) (*Flags, error) {
+	flags := &Flags{values: make(map[string]string)}
+	fs := flag.NewFlagSet("chatgpt-service", flag.ContinueOnError)
+	fs.StringVar(&flags.ConfigFile, "config", "", "YAML or JSON configuration `file` (default $CONFIG_FILE)")
+	fs.BoolVar(&flags.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	for _, s := range settings {
+		name := s.flagName()
+		fs.Func(name, s.usage, func(value string) error {
+			flags.values[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return flags, nil
+}
+
+// Load builds the configuration from the defaults, overridden by the config
+// file, then by environment variables, then by flags. It returns an *Error
+// listing every invalid setting, rather than stopping at the first one.
+func Load(flags *Flags) (*Config, error) {
+	l := &loader{cfg: Default()}
+	l.cfg.sources = make(map[string]string)
+
+	if path := flags.configFile(); path != "" {
+		l.loadFile(path)
+	}
+	l.loadEnv()
+	l.loadFlags(flags)
+
+	cfg := l.cfg
+	if len(cfg.AllowedModels) == 0 {
+		cfg.AllowedModels = []string{cfg.DefaultModel}
+	}
+	if cfg.OrgPolicyFile != "" {
+		policies, err := loadOrgPolicies(cfg.OrgPolicyFile)
+		if err != nil {
+			l.problem("ORG_POLICY_FILE: %v", err)
+		} else {
+			cfg.OrgPolicies = policies
+		}
+	}
+
+	var invalid *Error
+	if err := cfg.Validate(); errors.As(err, &invalid) {
+		l.problems = append(l.problems, invalid.Problems...)
+	}
+	if len(l.problems) > 0 {
+		return nil, &Error{Problems: l.problems}
+	}
+	return cfg, nil
+}
+
+// Print writes the configuration as a YAML config file with secrets redacted.
+// Settings that aren't defaults are commented with where they were set.
+func (c *Config) Print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		value := s.get(c)
+		if s.secret && value != "" {
+			value = redacted
+		}
+		key := &yaml.Node{}
+		key.SetString(s.key())
+		node := &yaml.Node{}
+		if err := node.Encode(value); err != nil {
+			return err
+		}
+		if source := c.sources[s.env]; source != "" && source != SourceDefault {
+			node.LineComment = "from " + source
+		}
+		doc.Content = append(doc.Content, key, node)
+	}
+	key := &yaml.Node{}
+	key.SetString(pricingKey)
+	pricing := &yaml.Node{}
+	if err := pricing.Encode(c.Pricing); err != nil {
+		return err
+	}
+	doc.Content = append(doc.Content, key, pricing)
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// loader applies the layers of settings to a configuration, collecting
+// problems as it goes
+type loader struct {
+	cfg      *Config
+	problems []error
+}
+
+// problem records a problem with the configuration
+func (l *loader) problem(format string, args ...any) {
+	l.problems = append(l.problems, fmt.Errorf(format, args...))
+}
+
+// set applies a value of a setting, named as where it was set
+func (l *loader) set(s setting, name, source, value string) {
+	if err := s.set(l.cfg, value); err != nil {
+		l.problem("%s: %v", name, err)
+		return
+	}
+	l.cfg.sources[s.env] = source
+}
+
+// setSecretFile applies a secret setting from the contents of a file
+func (l *loader) setSecretFile(s setting, name, source, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		l.problem("%s: %v", name, err)
+		return
+	}
+	l.set(s, name, source, strings.TrimSpace(string(data)))
+}
+
+// loadFile applies the settings in a YAML or JSON file, whose keys are the
+// settings' environment variables in lower case
+func (l *loader) loadFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		l.problem("config file: %v", err)
+		return
+	}
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		l.problem("config file %s: %v", path, err)
+		return
+	}
+
+	known := map[string]bool{pricingKey: true}
+	if node, exists := values[pricingKey]; exists {
+		var pricing map[string]ModelPrice
+		if err := node.Decode(&pricing); err != nil {
+			l.problem("%s: %s: %v", path, pricingKey, err)
+		}
+		for model, price := range pricing {
+			l.cfg.Pricing[model] = price
+		}
+	}
+	for _, s := range settings {
+		known[s.key()] = true
+		if s.secret {
+			known[s.key()+"_file"] = true
+		}
+
+		node, direct := values[s.key()]
+		fileNode, fromFile := values[s.key()+"_file"]
+		if direct && fromFile {
+			l.problem("%s: set only one of %s and %s_file", path, s.key(), s.key())
+			continue
+		}
+		if fromFile && s.secret {
+			if value, ok := l.nodeValue(path, s.key()+"_file", &fileNode); ok {
+				l.setSecretFile(s, s.key()+"_file", SourceFile, value)
+			}
+			continue
+		}
+		if direct {
+			if value, ok := l.nodeValue(path, s.key(), &node); ok {
+				l.set(s, s.key(), SourceFile, value)
+			}
+		}
+	}
+
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		l.problem("%s: unknown setting %q", path, key)
+	}
+}
+
+// nodeValue returns the value of a setting in the config file. Lists are
+// joined with commas, like list values in the environment.
+func (l *loader) nodeValue(path, key string, node *yaml.Node) (string, bool) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", true
+		}
+		return node.Value, true
+	case yaml.SequenceNode:
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				l.problem("%s: %s must be a list of values", path, key)
+				return "", false
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), true
+	}
+	l.problem("%s: %s must be a value or a list of values", path, key)
+	return "", false
+}
+
+// loadEnv applies the settings set in the environment. Empty variables are
+// treated as unset.
+func (l *loader) loadEnv() {
+	for _, s := range settings {
+		value := os.Getenv(s.env)
+		path := ""
+		if s.secret {
+			path = os.Getenv(s.env + "_FILE")
+		}
+		switch {
+		case value != "" && path != "":
+			l.problem("set only one of %s and %s_FILE", s.env, s.env)
+		case path != "":
+			l.setSecretFile(s, s.env+"_FILE", SourceEnv, path)
+		case value != "":
+			l.set(s, s.env, SourceEnv, value)
+		}
+	}
+}
+
+// loadFlags applies the settings given on the command line
+func (l *loader) loadFlags(flags *Flags) {
+	for _, s := range settings {
+		name := s.flagName()
+		value, exists := flags.values[name]
+		if !exists {
+			continue
+		}
+		if s.secret {
+			l.setSecretFile(s, "--"+name, SourceFlag, value)
+		} else {
+			l.set(s, "--"+name, SourceFlag, value)
+		}
+	}
+}
+
+// setting is a configuration value that can be set in the config file, the
+// environment and on the command line
+type setting struct {
+	// env is the environment variable of the setting. Its key in the config
+	// file and its flag are derived from it.
+	env   string
+	usage string
+	// secret settings are redacted when printed and can also be read from a
+	// file named by <env>_FILE
+	secret bool
+	// restart settings are read once at startup, so reloading doesn't change them
+	restart bool
+	get     func(c *Config) any
+	set     func(c *Config, value string) error
+}
+
+// key returns the key of the setting in the config file
+func (s setting) key() string {
+	return strings.ToLower(s.env)
+}
+
+// flagName returns the name of the setting's flag
+func (s setting) flagName() string {
+	name := strings.ReplaceAll(s.key(), "_", "-")
+	if s.secret {
+		name += "-file"
+	}
+	return name
+}
+
+// settings lists every setting in the order they are printed
+var settings = []setting{
+	secretSetting("OPENAI_API_KEY", "OpenAI API key", func(c *Config) *string { return &c.OpenAIAPIKey }).restartOnly(),
+	stringSetting("OPENAI_BASE_URL", "OpenAI API base URL, e.g. for a proxy", func(c *Config) *string { return &c.OpenAIBaseURL }).restartOnly(),
+	stringSetting("PORT", "port to listen on", func(c *Config) *string { return &c.Port }).restartOnly(),
+	stringSetting("LOG_LEVEL", "minimum level of logged entries", func(c *Config) *string { return &c.LogLevel }),
+	durationSetting("THREAD_TTL", "time-to-live of cached conversation threads", time.Minute, func(c *Config) *time.Duration { return &c.ThreadTTL }),
+	stringSetting("DEFAULT_MODEL", "model used for chat requests", func(c *Config) *string { return &c.DefaultModel }),
+	listSetting("ALLOWED_MODELS", "models callers may request", func(c *Config) *[]string { return &c.AllowedModels }),
+	intSetting("MAX_RETRIES", "retries of failed OpenAI API calls", func(c *Config) *int { return &c.MaxRetries }).restartOnly(),
+	durationSetting("RETRY_DELAY", "delay before the first retry", time.Second, func(c *Config) *time.Duration { return &c.RetryDelay }).restartOnly(),
+	durationSetting("REQUEST_TIMEOUT", "timeout of chat requests", time.Second, func(c *Config) *time.Duration { return &c.RequestTimeout }),
+	stringSetting("SESSION_CONCURRENCY", "queue, reject or cancel requests to a busy session", func(c *Config) *string { return &c.SessionConcurrency }).restartOnly(),
+	listSetting("WS_ALLOWED_ORIGINS", "origins allowed to open the chat WebSocket", func(c *Config) *[]string { return &c.WSAllowedOrigins }),
+	int64Setting("MAX_BODY_BYTES", "maximum size of a request body", func(c *Config) *int64 { return &c.Limits.MaxBodyBytes }),
+	intSetting("MAX_MESSAGE_LENGTH", "maximum length of a chat message", func(c *Config) *int { return &c.Limits.MaxMessageLength }),
+	intSetting("MAX_FILES", "maximum number of context files", func(c *Config) *int { return &c.Limits.MaxFiles }),
+	intSetting("MAX_FILES_BYTES", "maximum total size of context files", func(c *Config) *int { return &c.Limits.MaxFilesBytes }),
+	intSetting("MAX_CHAT_HISTORY", "maximum number of chat history entries", func(c *Config) *int { return &c.Limits.MaxChatHistory }),
+	boolSetting("REDACT_UPSTREAM", "mask PII before messages are sent to OpenAI", func(c *Config) *bool { return &c.DefaultPolicy.Redaction.MaskUpstream }),
+	stringSetting("ORG_POLICY_FILE", "JSON file with per-organization policies", func(c *Config) *string { return &c.OrgPolicyFile }),
+	stringSetting("MODERATION_PROVIDER", "openai or rules", func(c *Config) *string { return &c.ModerationProvider }).restartOnly(),
+	stringSetting("MODERATION_ACTION", "allow, flag or block flagged content", func(c *Config) *string { return &c.DefaultPolicy.Moderation.Action }),
+	boolSetting("MODERATION_CHECK_REPLIES", "moderate assistant replies", func(c *Config) *bool { return &c.DefaultPolicy.Moderation.CheckReplies }),
+	stringSetting("AUDIT_SINK", "none, jsonl, stdout or sql", func(c *Config) *string { return &c.Audit.Sink }).restartOnly(),
+	stringSetting("AUDIT_FILE", "audit trail file of the jsonl sink", func(c *Config) *string { return &c.Audit.File }).restartOnly(),
+	stringSetting("AUDIT_SQL_DRIVER", "database driver of the sql sink", func(c *Config) *string { return &c.Audit.SQLDriver }).restartOnly(),
+	secretSetting("AUDIT_SQL_DSN", "database of the sql sink", func(c *Config) *string { return &c.Audit.SQLDSN }).restartOnly(),
+	boolSetting("AUDIT_INCLUDE_CONTENT", "record messages and replies in full", func(c *Config) *bool { return &c.DefaultPolicy.Audit.IncludeContent }),
+	intSetting("RETENTION_DAYS", "days after which conversations are purged", func(c *Config) *int { return &c.DefaultPolicy.Retention.Days }),
+	durationSetting("HEALTH_CHECK_TTL", "reuse of the OpenAI readiness check result", time.Second, func(c *Config) *time.Duration { return &c.HealthCheckTTL }).restartOnly(),
+	durationSetting("SHUTDOWN_DRAIN_DELAY", "time reported not ready before shutting down", time.Second, func(c *Config) *time.Duration { return &c.DrainDelay }),
+	durationSetting("CONFIG_WATCH_INTERVAL", "interval of checks for changed config files, 0 to disable", time.Second, func(c *Config) *time.Duration { return &c.ConfigWatchInterval }).restartOnly(),
+	secretSetting("ADMIN_API_KEY", "bearer token of the admin API", func(c *Config) *string { return &c.AdminAPIKey }),
+	intSetting("RESPONSE_CACHE_SIZE", "maximum number of cached replies, 0 to disable the cache", func(c *Config) *int { return &c.ResponseCacheSize }).restartOnly(),
+	durationSetting("RESPONSE_CACHE_TTL", "default time replies are cached", time.Second, func(c *Config) *time.Duration { return &c.ResponseCacheTTL }),
+	intSetting("SEMANTIC_CACHE_SIZE", "maximum number of cached answers per agent, 0 to disable the semantic cache", func(c *Config) *int { return &c.SemanticCacheSize }).restartOnly(),
+	floatSetting("SEMANTIC_CACHE_THRESHOLD", "default similarity of questions answered from the semantic cache", func(c *Config) *float64 { return &c.SemanticCacheThreshold }),
+	stringSetting("EMBEDDING_PROVIDER", "openai or local", func(c *Config) *string { return &c.EmbeddingProvider }).restartOnly(),
+	stringSetting("EMBEDDING_MODEL", "model of the openai embedding provider", func(c *Config) *string { return &c.EmbeddingModel }).restartOnly(),
+	stringSetting("INJECTION_POLICY", "detect, quarantine or off", func(c *Config) *string { return &c.InjectionPolicy }),
+	stringSetting("AGENT_REGISTRY_FILE", "JSON file registered agents are saved to", func(c *Config) *string { return &c.AgentRegistryFile }).restartOnly(),
+	boolSetting("REQUIRE_REGISTERED_AGENTS", "reject chat requests for agents that aren't registered", func(c *Config) *bool { return &c.RequireRegisteredAgents }),
+	stringSetting("TRACING_EXPORTER", "none, stdout or otlp", func(c *Config) *string { return &c.TracingExporter }).restartOnly(),
+	floatSetting("TRACING_SAMPLE_RATIO", "fraction of new traces to sample", func(c *Config) *float64 { return &c.TracingSampleRatio }).restartOnly(),
+}
+
+// restartOnly marks the setting as read only at startup
+func (s setting) restartOnly() setting {
+	s.restart = true
+	return s
+}
+
+func stringSetting(env, usage string, field func(c *Config) *string) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func secretSetting(env, usage string, field func(c *Config) *string) setting {
+	s := stringSetting(env, usage+", read from a `file`", field)
+	s.secret = true
+	return s
+}
+
+func listSetting(env, usage string, field func(c *Config) *[]string) setting {
+	return setting{
+		env:   env,
+		usage: usage + " (comma-separated)",
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = splitList(value)
+			return nil
+		},
+	}
+}
+
+func intSetting(env, usage string, field func(c *Config) *int) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", value)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func int64Setting(env, usage string, field func(c *Config) *int64) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", value)
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func floatSetting(env, usage string, field func(c *Config) *float64) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			*field(c) = f
+			return nil
+		},
+	}
+}
+
+func boolSetting(env, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		env:   env,
+		usage: usage,
+		get:   func(c *Config) any { return *field(c) },
+		set: func(c *Config, value string) error {
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q", value)
+			}
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+// durationSetting is a duration given as a whole number of units, as it
+// always has been in the environment, or as a Go duration such as "90s"
+func durationSetting(env, usage string, unit time.Duration, field func(c *Config) *time.Duration) setting {
+	unitName := "seconds"
+	if unit == time.Minute {
+		unitName = "minutes"
+	}
+	return setting{
+		env:   env,
+		usage: fmt.Sprintf("%s in %s, or a duration like 90s", usage, unitName),
+		get: func(c *Config) any {
+			if d := *field(c); d%unit != 0 {
+				return d.String()
+			}
+			return int64(*field(c) / unit)
+		},
+		set: func(c *Config, value string) error {
+			value = strings.TrimSpace(value)
+			if n, err := strconv.Atoi(value); err == nil {
+				*field(c) = time.Duration(n) * unit
+				return nil
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q, expected a number of %s or a duration like 90s", value, unitName)
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFile writes a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// problems returns the messages of the problems reported by Load
+func problems(t *testing.T, err error) []string {
+	var invalid *Error
+	require.True(t, errors.As(err, &invalid), "expected *Error, got %v", err)
+	var messages []string
+	for _, problem := range invalid.Problems {
+		messages = append(messages, problem.Error())
+	}
+	return messages
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+openai_api_key: file-key
+thread_ttl: 30
+default_model: gpt-4o-mini
+allowed_models: [gpt-4o-mini, gpt-4o]
+port: "9000"
+request_timeout: 90s
+`)
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("DEFAULT_MODEL", "gpt-4-turbo")
+	t.Setenv("PORT", "9001")
+
+	flags, err := ParseFlags([]string{"--config", path, "--port", "9002"})
+	require.NoError(t, err)
+	cfg, err := Load(flags)
+	require.NoError(t, err)
+
+	assert.Equal(t, "file-key", cfg.OpenAIAPIKey)
+	assert.Equal(t, 30*time.Minute, cfg.ThreadTTL)
+	assert.Equal(t, 90*time.Second, cfg.RequestTimeout)
+	assert.Equal(t, "gpt-4-turbo", cfg.DefaultModel)
+	assert.Equal(t, []string{"gpt-4o-mini", "gpt-4o"}, cfg.AllowedModels)
+	assert.Equal(t, "9002", cfg.Port)
+	assert.Equal(t, 3, cfg.MaxRetries)
+
+	assert.Equal(t, SourceFile, cfg.sources["THREAD_TTL"])
+	assert.Equal(t, SourceEnv, cfg.sources["DEFAULT_MODEL"])
+	assert.Equal(t, SourceFlag, cfg.sources["PORT"])
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	path := writeFile(t, "config.json", `{"thread_ttll": 30, "max_files": "many"}`)
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("THREAD_TTL", "abc")
+	t.Setenv("SESSION_CONCURRENCY", "parallel")
+	t.Setenv("REQUEST_TIMEOUT", "0")
+	t.Setenv("RETRY_DELAY", "-1s")
+
+	cfg, err := Load(&Flags{ConfigFile: path})
+	assert.Nil(t, cfg)
+	assert.Equal(t, []string{
+		`max_files: invalid integer "many"`,
+		path + `: unknown setting "thread_ttll"`,
+		`THREAD_TTL: invalid duration "abc", expected a number of minutes or a duration like 90s`,
+		"OPENAI_API_KEY or OPENAI_API_KEY_FILE is required",
+		"REQUEST_TIMEOUT must be positive",
+		"RETRY_DELAY must not be negative",
+		`SESSION_CONCURRENCY: unknown session concurrency mode "parallel"`,
+	}, problems(t, err))
+	assert.Contains(t, err.Error(), "invalid configuration:\n  - max_files")
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	keyFile := writeFile(t, "openai-key", "sk-from-file\n")
+
+	t.Run("From the environment", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "")
+		t.Setenv("OPENAI_API_KEY_FILE", keyFile)
+		cfg, err := Load(&Flags{})
+		require.NoError(t, err)
+		assert.Equal(t, "sk-from-file", cfg.OpenAIAPIKey)
+	})
+
+	t.Run("From a flag", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "sk-from-env")
+		flags, err := ParseFlags([]string{"--openai-api-key-file", keyFile})
+		require.NoError(t, err)
+		cfg, err := Load(flags)
+		require.NoError(t, err)
+		assert.Equal(t, "sk-from-file", cfg.OpenAIAPIKey)
+	})
+
+	t.Run("Both the value and the file", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "sk-from-env")
+		t.Setenv("OPENAI_API_KEY_FILE", keyFile)
+		_, err := Load(&Flags{})
+		assert.Contains(t, problems(t, err), "set only one of OPENAI_API_KEY and OPENAI_API_KEY_FILE")
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "")
+		t.Setenv("ADMIN_API_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+		_, err := Load(&Flags{})
+		assert.Len(t, problems(t, err), 2)
+	})
+}
+
+func TestParseFlagsRejectsSecretValues(t *testing.T) {
+	_, err := ParseFlags([]string{"--openai-api-key", "sk-secret"})
+	assert.Error(t, err)
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("AUDIT_SQL_DSN", "")
+	t.Setenv("THREAD_TTL", "90s")
+	cfg, err := Load(&Flags{})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, cfg.Print(&out))
+	printed := out.String()
+	assert.NotContains(t, printed, "sk-secret")
+	assert.Contains(t, printed, "openai_api_key: '[REDACTED]' # from env\n")
+	assert.Contains(t, printed, "audit_sql_dsn: \"\"\n")
+	assert.Contains(t, printed, "thread_ttl: 1m30s # from env\n")
+	assert.Contains(t, printed, "max_retries: 3\n")
+
+	// The printed configuration can be loaded as a config file
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("THREAD_TTL", "")
+	reloaded, err := Load(&Flags{ConfigFile: writeFile(t, "printed.yaml", printed)})
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, reloaded.ThreadTTL)
+}
+
+func TestLoadValidatesCacheSettingsOnlyWithCaches(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("RESPONSE_CACHE_TTL", "0")
+	t.Setenv("SEMANTIC_CACHE_THRESHOLD", "0")
+
+	_, err := Load(&Flags{})
+	assert.Equal(t, []string{
+		"RESPONSE_CACHE_TTL must be positive",
+		"SEMANTIC_CACHE_THRESHOLD must be greater than 0 and at most 1, got 0",
+	}, problems(t, err))
+
+	// Disabled caches don't need their settings
+	t.Setenv("RESPONSE_CACHE_SIZE", "0")
+	t.Setenv("SEMANTIC_CACHE_SIZE", "0")
+	cfg, err := Load(&Flags{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, cfg.ResponseCacheSize)
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotReloadable is returned when reloading a configuration that wasn't
+// loaded from a file, the environment or flags
+var ErrNotReloadable = errors.New("configuration was not loaded with Load and can't be reloaded")
+
+// Store holds the current configuration and replaces it atomically when it
+// is reloaded. Stored configurations are never changed, so a request that
+// took a snapshot keeps the same settings until it is done.
+type Store struct {
+	current atomic.Pointer[Config]
+	flags   *Flags
+	// reloadMutex serializes reloads and guards reloadErr
+	reloadMutex sync.Mutex
+	reloadErr   error
+}
+
+// NewStore creates a store holding cfg. It can be reloaded with the same
+// flags cfg was loaded with; a nil flags makes it static.
+func NewStore(cfg *Config, flags *Flags) *Store {
+	s := &Store{flags: flags}
+	s.current.Store(cfg)
+	return s
+}
+
+// Current returns the current configuration
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying a snapshot of the configuration
+func NewContext(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, contextKey{}, cfg)
+}
+
+// For returns the snapshot carried by ctx, or the current configuration if
+// there is none
+func (s *Store) For(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(contextKey{}).(*Config); ok {
+		return cfg
+	}
+	return s.Current()
+}
+
+// Reload loads the configuration again and replaces the current one if it,
+// and every check, is valid. Otherwise the current configuration is kept.
+// It returns the environment variables of settings that changed but only
+// take effect after a restart.
+func (s *Store) Reload(checks ...func(cfg *Config) error) ([]string, error) {
+	if s.flags == nil {
+		return nil, ErrNotReloadable
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	cfg, err := Load(s.flags)
+	if err != nil {
+		s.reloadErr = err
+		return nil, err
+	}
+	for _, check := range checks {
+		if err := check(cfg); err != nil {
+			s.reloadErr = err
+			return nil, err
+		}
+	}
+
+	previous := s.current.Swap(cfg)
+	s.reloadErr = nil
+	var restart []string
+	for _, setting := range settings {
+		if setting.restart && !reflect.DeepEqual(setting.get(previous), setting.get(cfg)) {
+			restart = append(restart, setting.env)
+		}
+	}
+	return restart, nil
+}
+
+// ReloadError returns the error of the last reload if it was rejected, in
+// which case the service still runs with an earlier configuration
+func (s *Store) ReloadError() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	return s.reloadErr
+}
+
+// Watch checks the config file and the organization policy file for changes
+// every interval until ctx is done, calling reload when either was modified,
+// created or removed
+func (s *Store) Watch(ctx context.Context, interval time.Duration, reload func()) {
+	modTimes := s.modTimes()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := s.modTimes()
+			if !maps.Equal(current, modTimes) {
+				modTimes = current
+				reload()
+			}
+		}
+	}
+}
+
+// modTimes returns the modification times of the files the configuration is
+// loaded from, zero for missing files
+func (s *Store) modTimes() map[string]time.Time {
+	var files []string
+	if s.flags != nil {
+		if path := s.flags.configFile(); path != "" {
+			files = append(files, path)
+		}
+	}
+	if path := s.Current().OrgPolicyFile; path != "" {
+		files = append(files, path)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, path := range files {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		} else {
+			modTimes[path] = time.Time{}
+		}
+	}
+	return modTimes
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreReload(t *testing.T) {
+	path := writeFile(t, "config.yaml", "openai_api_key: key\ndefault_model: gpt-4o-mini\nport: \"9000\"\n")
+	t.Setenv("OPENAI_API_KEY", "")
+
+	flags := &Flags{ConfigFile: path}
+	cfg, err := Load(flags)
+	require.NoError(t, err)
+	store := NewStore(cfg, flags)
+	snapshot := NewContext(context.Background(), store.Current())
+
+	require.NoError(t, os.WriteFile(path, []byte("openai_api_key: key\ndefault_model: gpt-4o\nport: \"9001\"\n"), 0o600))
+	restart, err := store.Reload()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"PORT"}, restart)
+	assert.Equal(t, "gpt-4o", store.Current().DefaultModel)
+	assert.Equal(t, "gpt-4o", store.For(context.Background()).DefaultModel)
+	// Requests keep the snapshot they started with
+	assert.Equal(t, "gpt-4o-mini", store.For(snapshot).DefaultModel)
+	assert.NoError(t, store.ReloadError())
+}
+
+func TestStoreRejectsInvalidReload(t *testing.T) {
+	path := writeFile(t, "config.yaml", "openai_api_key: key\ndefault_model: gpt-4o-mini\n")
+	t.Setenv("OPENAI_API_KEY", "")
+
+	flags := &Flags{ConfigFile: path}
+	cfg, err := Load(flags)
+	require.NoError(t, err)
+	store := NewStore(cfg, flags)
+
+	tests := []struct {
+		name    string
+		content string
+		check   func(*Config) error
+	}{
+		{
+			name:    "invalid setting",
+			content: "openai_api_key: key\ndefault_model: gpt-4o\nmax_retries: -1\n",
+		},
+		{
+			name:    "failed check",
+			content: "openai_api_key: key\ndefault_model: gpt-4o\n",
+			check:   func(*Config) error { return errors.New("bad policy") },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+			var checks []func(*Config) error
+			if tc.check != nil {
+				checks = append(checks, tc.check)
+			}
+
+			_, err := store.Reload(checks...)
+			assert.Error(t, err)
+			assert.Equal(t, err, store.ReloadError())
+			assert.Same(t, cfg, store.Current())
+		})
+	}
+}
+
+func TestStaticStoreIsNotReloadable(t *testing.T) {
+	cfg := Default()
+	store := NewStore(cfg, nil)
+
+	_, err := store.Reload()
+	assert.ErrorIs(t, err, ErrNotReloadable)
+	assert.Same(t, cfg, store.Current())
+}
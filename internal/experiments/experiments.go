@@ -0,0 +1,218 @@
+package experiments
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+)
+
+// maxTrackedResponses is the number of most recent replies feedback can be
+// attributed to their variant for
+const maxTrackedResponses = 10000
+
+// Outcome is the outcome of a chat exchange with a variant of an agent
+type Outcome struct {
+	// Status is "success", "error", "timeout" or "cancelled"
+	Status   string
+	Tokens   int
+	Cost     float64
+	Duration time.Duration
+	// ResponseID identifies the reply of a successful exchange, so feedback
+	// on it can be attributed to the variant
+	ResponseID string
+}
+
+// VariantStats summarizes the exchanges with a variant and the feedback on
+// its replies. Averages are over successful exchanges, and over ratings.
+type VariantStats struct {
+	Variant      string  `json:"variant"`
+	Requests     int     `json:"requests"`
+	Successes    int     `json:"successes"`
+	Errors       int     `json:"errors"`
+	Tokens       int     `json:"tokens"`
+	AvgTokens    float64 `json:"avgTokens"`
+	Cost         float64 `json:"costUsd"`
+	AvgCost      float64 `json:"avgCostUsd"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+	ThumbsUp     int     `json:"thumbsUp"`
+	ThumbsDown   int     `json:"thumbsDown"`
+	Ratings      int     `json:"ratings"`
+	AvgRating    float64 `json:"avgRating"`
+
+	// latency is the total duration of successful exchanges, and ratingSum
+	// the sum of the ratings
+	latency   time.Duration
+	ratingSum int
+}
+
+// addFeedback adds feedback to the stats, or removes it if sign is -1
+func (s *VariantStats) addFeedback(feedback *models.Feedback, sign int) {
+	switch feedback.Thumbs {
+	case "up":
+		s.ThumbsUp += sign
+	case "down":
+		s.ThumbsDown += sign
+	}
+	if feedback.Rating > 0 {
+		s.Ratings += sign
+		s.ratingSum += sign * feedback.Rating
+	}
+	s.AvgRating = 0
+	if s.Ratings > 0 {
+		s.AvgRating = float64(s.ratingSum) / float64(s.Ratings)
+	}
+}
+
+// key identifies a variant of an experiment
+type key struct {
+	organizationID string
+	agentID        string
+	experiment     string
+	variant        string
+}
+
+// trackedResponse is a recent reply of a variant with the latest feedback on it
+type trackedResponse struct {
+	key      key
+	feedback *models.Feedback
+}
+
+// Recorder aggregates the outcomes of exchanges per variant in memory and
+// records them in the metrics
+type Recorder struct {
+	started time.Time
+
+	mu    sync.Mutex
+	stats map[key]*VariantStats
+	// responses holds the most recent replies, oldest first in order
+	responses map[string]*trackedResponse
+	order     []string
+}
+
+// NewRecorder creates a recorder without any outcomes
+func NewRecorder() *Recorder {
+	return &Recorder{
+		started:   time.Now().UTC(),
+		stats:     make(map[key]*VariantStats),
+		responses: make(map[string]*trackedResponse),
+	}
+}
+
+// Since returns when the recorder started aggregating outcomes
+func (r *Recorder) Since() time.Time {
+	return r.started
+}
+
+// Record adds the outcome of an exchange with a variant of an agent
+func (r *Recorder) Record(organizationID, agentID, experiment, variant string, outcome Outcome) {
+	metrics.RecordVariant(organizationID, agentID, variant, outcome.Status, outcome.Tokens, outcome.Cost, outcome.Duration)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{organizationID, agentID, experiment, variant}
+	stats, exists := r.stats[k]
+	if !exists {
+		stats = &VariantStats{Variant: variant}
+		r.stats[k] = stats
+	}
+	stats.Requests++
+	if outcome.Status != "success" {
+		if outcome.Status != "cancelled" {
+			stats.Errors++
+		}
+		return
+	}
+	stats.Successes++
+	stats.Tokens += outcome.Tokens
+	stats.Cost += outcome.Cost
+	stats.latency += outcome.Duration
+	stats.AvgTokens = float64(stats.Tokens) / float64(stats.Successes)
+	stats.AvgCost = stats.Cost / float64(stats.Successes)
+	stats.AvgLatencyMs = float64(stats.latency.Milliseconds()) / float64(stats.Successes)
+
+	if outcome.ResponseID != "" {
+		r.track(outcome.ResponseID, k)
+	}
+}
+
+// track adds a reply to the recent replies, forgetting the oldest if there
+// are too many. It must be called with the lock held.
+func (r *Recorder) track(responseID string, k key) *trackedResponse {
+	if len(r.order) == maxTrackedResponses {
+		delete(r.responses, r.order[0])
+		r.order = r.order[1:]
+	}
+	response := &trackedResponse{key: k}
+	r.responses[responseID] = response
+	r.order = append(r.order, responseID)
+	return response
+}
+
+// RecordFeedback adds feedback on a reply to the stats of its variant,
+// replacing earlier feedback on the same reply. It reports whether the reply
+// is one of the recent replies of a variant.
+func (r *Recorder) RecordFeedback(responseID string, feedback models.Feedback) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	response, exists := r.responses[responseID]
+	if !exists {
+		return false
+	}
+	stats := r.stats[response.key]
+	if response.feedback != nil {
+		stats.addFeedback(response.feedback, -1)
+	}
+	response.feedback = &feedback
+	stats.addFeedback(&feedback, 1)
+	return true
+}
+
+// AttributeFeedback adds the first feedback on a reply of a variant that
+// isn't one of the recent replies, e.g. one served by another instance, to
+// the stats of the variant, and tracks the reply so later feedback on it
+// replaces this one
+func (r *Recorder) AttributeFeedback(organizationID, agentID, experiment, variant, responseID string, feedback models.Feedback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.responses[responseID]; exists {
+		return
+	}
+	k := key{organizationID, agentID, experiment, variant}
+	stats, exists := r.stats[k]
+	if !exists {
+		stats = &VariantStats{Variant: variant}
+		r.stats[k] = stats
+	}
+	r.track(responseID, k).feedback = &feedback
+	stats.addFeedback(&feedback, 1)
+}
+
+// Stats returns the stats of every variant of an experiment with outcomes,
+// and of the given variants without any, by variant name
+func (r *Recorder) Stats(organizationID, agentID, experiment string, variants ...string) []VariantStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byName := make(map[string]VariantStats)
+	for _, variant := range variants {
+		byName[variant] = VariantStats{Variant: variant}
+	}
+	for k, stats := range r.stats {
+		if k.organizationID == organizationID && k.agentID == agentID && k.experiment == experiment {
+			byName[k.variant] = *stats
+		}
+	}
+
+	list := make([]VariantStats, 0, len(byName))
+	for _, stats := range byName {
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Variant < list[j].Variant })
+	return list
+}
@@ -0,0 +1,75 @@
+package experiments
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderStats(t *testing.T) {
+	recorder := NewRecorder()
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "success", Tokens: 100, Cost: 0.01, Duration: 200 * time.Millisecond})
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "success", Tokens: 300, Cost: 0.03, Duration: 400 * time.Millisecond})
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "timeout"})
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "cancelled"})
+	recorder.Record("org1", "support", "old", "control", Outcome{Status: "success", Tokens: 50})
+	recorder.Record("org2", "support", "tone", "control", Outcome{Status: "success", Tokens: 50})
+
+	stats := recorder.Stats("org1", "support", "tone", "concise", "control")
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, VariantStats{Variant: "concise"}, stats[0])
+
+	control := stats[1]
+	assert.Equal(t, "control", control.Variant)
+	assert.Equal(t, 4, control.Requests)
+	assert.Equal(t, 2, control.Successes)
+	assert.Equal(t, 1, control.Errors)
+	assert.Equal(t, 400, control.Tokens)
+	assert.Equal(t, 200.0, control.AvgTokens)
+	assert.InDelta(t, 0.04, control.Cost, 1e-9)
+	assert.InDelta(t, 0.02, control.AvgCost, 1e-9)
+	assert.Equal(t, 300.0, control.AvgLatencyMs)
+}
+
+func TestRecorderFeedback(t *testing.T) {
+	recorder := NewRecorder()
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "success", ResponseID: "resp1"})
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "success", ResponseID: "resp2"})
+
+	assert.True(t, recorder.RecordFeedback("resp1", models.Feedback{Thumbs: "down", Rating: 2}))
+	assert.True(t, recorder.RecordFeedback("resp2", models.Feedback{Thumbs: "up", Rating: 5}))
+	// Later feedback on a reply replaces earlier feedback
+	assert.True(t, recorder.RecordFeedback("resp1", models.Feedback{Thumbs: "up", Rating: 4}))
+	assert.False(t, recorder.RecordFeedback("unknown", models.Feedback{Thumbs: "up"}))
+
+	stats := recorder.Stats("org1", "support", "tone")
+	require.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].ThumbsUp)
+	assert.Equal(t, 0, stats[0].ThumbsDown)
+	assert.Equal(t, 2, stats[0].Ratings)
+	assert.Equal(t, 4.5, stats[0].AvgRating)
+}
+
+func TestRecorderAttributeFeedback(t *testing.T) {
+	recorder := NewRecorder()
+	recorder.Record("org1", "support", "tone", "control", Outcome{Status: "success", ResponseID: "resp1"})
+
+	// Replies served by another instance are attributed to their variant
+	recorder.AttributeFeedback("org1", "support", "tone", "concise", "resp2", models.Feedback{Thumbs: "down"})
+	assert.True(t, recorder.RecordFeedback("resp2", models.Feedback{Thumbs: "up"}))
+	// Recent replies are already attributed
+	recorder.AttributeFeedback("org1", "support", "tone", "concise", "resp1", models.Feedback{Thumbs: "up"})
+
+	stats := recorder.Stats("org1", "support", "tone")
+	require.Len(t, stats, 2)
+	assert.Equal(t, "concise", stats[0].Variant)
+	assert.Equal(t, 0, stats[0].Requests)
+	assert.Equal(t, 1, stats[0].ThumbsUp)
+	assert.Equal(t, 0, stats[0].ThumbsDown)
+	assert.Equal(t, "control", stats[1].Variant)
+	assert.Equal(t, 0, stats[1].ThumbsUp)
+}
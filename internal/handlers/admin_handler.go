@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/retention"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminHandler handles requests to the admin API
+type AdminHandler struct {
+	auditSink audit.Sink
+	retention *retention.Service
+	log       *logrus.Logger
+	configs   *config.Store
+}
+
+// NewAdminHandler creates a new admin handler. The audit trail can't be
+// queried if auditSink is nil.
+func NewAdminHandler(auditSink audit.Sink, retention *retention.Service, log *logrus.Logger, configs *config.Store) *AdminHandler {
+	return &AdminHandler{
+		auditSink: auditSink,
+		retention: retention,
+		log:       log,
+		configs:   configs,
+	}
+}
+
+// AuditQueryResponse is the response of an audit trail query
+type AuditQueryResponse struct {
+	Records []audit.Record `json:"records"`
+	Count   int            `json:"count"`
+}
+
+// RequireAdmin rejects requests that don't carry the admin API key as a
+// bearer token. All requests are rejected if no key is configured.
+func RequireAdmin(configs *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := configs.For(c.Request.Context()).AdminAPIKey
+		if apiKey == "" {
+			respondAdminError(c, http.StatusForbidden, "admin_disabled", "The admin API is disabled")
+			c.Abort()
+			return
+		}
+		if !hasBearerToken(c, apiKey) {
+			respondAdminError(c, http.StatusUnauthorized, "unauthorized", "A valid admin API key is required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasBearerToken reports whether the request carries apiKey as a bearer token
+func hasBearerToken(c *gin.Context, apiKey string) bool {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) == 1
+}
+
+// HandleAuditQuery returns audit records, most recent first, filtered by the
+// organizationId, userId, agentId and sessionId query parameters and the time
+// range from (inclusive) to (exclusive) in RFC 3339 format
+func (h *AdminHandler) HandleAuditQuery(c *gin.Context) {
+	if h.auditSink == nil {
+		respondAdminError(c, http.StatusNotImplemented, "audit_disabled", "The audit trail is disabled")
+		return
+	}
+
+	filter := audit.Filter{
+		OrganizationID: c.Query("organizationId"),
+		UserID:         c.Query("userId"),
+		AgentID:        c.Query("agentId"),
+		SessionID:      c.Query("sessionId"),
+	}
+	var errs validationErrors
+	filter.From = parseTimeParam(c, "from", &errs)
+	filter.To = parseTimeParam(c, "to", &errs)
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > audit.MaxLimit {
+			errs.add("limit", "must be a number between 1 and %d", audit.MaxLimit)
+		}
+		filter.Limit = n
+	}
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return
+	}
+
+	records, err := h.auditSink.Query(c.Request.Context(), filter)
+	if errors.Is(err, audit.ErrQueryUnsupported) {
+		respondAdminError(c, http.StatusNotImplemented, "query_unsupported", "The audit sink can't be queried")
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context(), h.log).Errorf("Failed to query audit trail: %v", err)
+		respondAdminError(c, http.StatusInternalServerError, "processing_error", "Failed to query the audit trail")
+		return
+	}
+
+	if records == nil {
+		records = []audit.Record{}
+	}
+	c.JSON(http.StatusOK, AuditQueryResponse{Records: records, Count: len(records)})
+}
+
+// HandleEraseUserData erases all data of a user in the organization given by
+// the organizationId query parameter and responds with a receipt
+func (h *AdminHandler) HandleEraseUserData(c *gin.Context) {
+	var errs validationErrors
+	errs.requireID("userId", c.Param("userId"))
+	errs.requireID("organizationId", c.Query("organizationId"))
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return
+	}
+
+	receipt := h.retention.EraseUser(c.Request.Context(), c.Query("organizationId"), c.Param("userId"))
+	status := http.StatusOK
+	if receipt.Failed() {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, receipt)
+}
+
+// parseTimeParam parses an optional RFC 3339 query parameter, recording an
+// error if it is malformed
+func parseTimeParam(c *gin.Context, name string, errs *validationErrors) time.Time {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		errs.add(name, "must be a time in RFC 3339 format")
+	}
+	return t
+}
+
+// respondAdminError writes an error response of the admin API
+func respondAdminError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, gin.H{"error": &models.ErrorInfo{
+		Code:    code,
+		Message: message,
+	}})
+}
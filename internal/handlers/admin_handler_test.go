@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/retention"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleAuditQuery(t *testing.T) {
+	sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	for i, org := range []string{"org1", "org2", "org1"} {
+		require.NoError(t, sink.Write(context.Background(), &audit.Record{
+			ID:             string(rune('a' + i)),
+			Time:           time.Date(2024, 1, 1, 12, i, 0, 0, time.UTC),
+			OrganizationID: org,
+		}))
+	}
+
+	testCases := []struct {
+		name           string
+		adminAPIKey    string
+		authorization  string
+		query          string
+		expectedStatus int
+		expectedCode   string
+		expectedIDs    []string
+	}{
+		{
+			name:           "Filtered by organization",
+			adminAPIKey:    "secret",
+			authorization:  "Bearer secret",
+			query:          "?organizationId=org1",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"c", "a"},
+		},
+		{
+			name:           "Time range and limit",
+			adminAPIKey:    "secret",
+			authorization:  "Bearer secret",
+			query:          "?from=2024-01-01T12:00:00Z&to=2024-01-01T12:02:00Z&limit=1",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"b"},
+		},
+		{
+			name:           "Invalid parameters",
+			adminAPIKey:    "secret",
+			authorization:  "Bearer secret",
+			query:          "?from=yesterday&limit=0",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_error",
+		},
+		{
+			name:           "Wrong key",
+			adminAPIKey:    "secret",
+			authorization:  "Bearer guess",
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "unauthorized",
+		},
+		{
+			name:           "Admin API disabled",
+			authorization:  "Bearer ",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   "admin_disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			cfg := &config.Config{AdminAPIKey: tc.adminAPIKey}
+			handler := NewAdminHandler(sink, nil, logrus.New(), config.NewStore(cfg, nil))
+
+			router := gin.New()
+			router.GET("/admin/audit", RequireAdmin(config.NewStore(cfg, nil)), handler.HandleAuditQuery)
+
+			req, _ := http.NewRequest("GET", "/admin/audit"+tc.query, nil)
+			req.Header.Set("Authorization", tc.authorization)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			var response struct {
+				AuditQueryResponse
+				Error *struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			if tc.expectedCode != "" {
+				require.NotNil(t, response.Error)
+				assert.Equal(t, tc.expectedCode, response.Error.Code)
+				return
+			}
+			var ids []string
+			for _, record := range response.Records {
+				ids = append(ids, record.ID)
+			}
+			assert.Equal(t, tc.expectedIDs, ids)
+			assert.Equal(t, len(tc.expectedIDs), response.Count)
+		})
+	}
+}
+
+func TestHandleEraseUserData(t *testing.T) {
+	testCases := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectErased   int
+	}{
+		{"Erased", "/users/user1/data?organizationId=org1", http.StatusOK, 1},
+		{"Missing organization", "/users/user1/data", http.StatusBadRequest, 0},
+		{"Invalid user ID", "/users/-user1/data?organizationId=org1", http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			log := logrus.New()
+			cfg := &config.Config{AdminAPIKey: "secret"}
+
+			var erasedOrg, erasedUser string
+			mockClient := openai.NewMockClient(log)
+			mockClient.PurgeThreadsFunc = func(match func(thread *models.ThreadInfo) bool) int {
+				thread := &models.ThreadInfo{OrganizationID: "org1", UserID: "user1"}
+				if match(thread) {
+					erasedOrg, erasedUser = thread.OrganizationID, thread.UserID
+					return 1
+				}
+				return 0
+			}
+			handler := NewAdminHandler(nil, retention.NewService(mockClient, nil, nil, nil, config.NewStore(cfg, nil), log), log, config.NewStore(cfg, nil))
+
+			router := gin.New()
+			router.DELETE("/users/:userId/data", RequireAdmin(config.NewStore(cfg, nil)), handler.HandleEraseUserData)
+
+			req, _ := http.NewRequest("DELETE", tc.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedStatus != http.StatusOK {
+				assert.Empty(t, erasedUser)
+				return
+			}
+			var receipt retention.Receipt
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+			assert.NotEmpty(t, receipt.ReceiptID)
+			assert.Equal(t, retention.StatusCompleted, receipt.Status)
+			assert.Equal(t, []retention.StoreReceipt{{Store: "threads", Status: retention.StatusErased, Erased: tc.expectErased}}, receipt.Stores)
+			assert.Equal(t, "org1", erasedOrg)
+			assert.Equal(t, "user1", erasedUser)
+		})
+	}
+}
@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/agents"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/prompts"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/sirupsen/logrus"
+)
+
+// maxTemperature is the highest sampling temperature OpenAI accepts
+const maxTemperature = 2
+
+// AgentHandler handles requests to the agent registry. Every request is
+// scoped to the organization given by the organizationId query parameter.
+type AgentHandler struct {
+	registry      *agents.Registry
+	experiments   *experiments.Recorder
+	semanticCache *semanticcache.Cache
+	log           *logrus.Logger
+	configs       *config.Store
+}
+
+// NewAgentHandler creates a new agent registry handler reporting the
+// outcomes of agents' experiments from experimentRecorder. Agents' answers
+// are removed from semanticCache, unless it is nil, when they change.
+func NewAgentHandler(registry *agents.Registry, experimentRecorder *experiments.Recorder, semanticCache *semanticcache.Cache, log *logrus.Logger, configs *config.Store) *AgentHandler {
+	return &AgentHandler{
+		registry:      registry,
+		experiments:   experimentRecorder,
+		semanticCache: semanticCache,
+		log:           log,
+		configs:       configs,
+	}
+}
+
+// AgentListResponse is the response listing agents or versions of an agent
+type AgentListResponse struct {
+	Agents []*agents.Agent `json:"agents"`
+	Count  int             `json:"count"`
+}
+
+// RenderRequest previews the instructions of an agent rendered for a user
+type RenderRequest struct {
+	UserID    string              `json:"userId"`
+	User      *models.UserProfile `json:"user,omitempty"`
+	Variables map[string]string   `json:"variables,omitempty"`
+	// Version selects the version of the agent; zero renders the latest one
+	Version int `json:"version,omitempty"`
+	// Instructions renders a draft instead of the agent's instructions
+	Instructions string `json:"instructions,omitempty"`
+	// Time renders dates and times at this time instead of now
+	Time *time.Time `json:"time,omitempty"`
+	// Strict fails on missing variables even if the agent doesn't
+	Strict bool `json:"strict,omitempty"`
+}
+
+// RenderResponse holds the rendered instructions of an agent
+type RenderResponse struct {
+	Instructions string `json:"instructions"`
+	AgentVersion int    `json:"agentVersion"`
+}
+
+// ExperimentResponse compares the outcomes of the variants of an agent's
+// experiment since the instance started
+type ExperimentResponse struct {
+	AgentID    string `json:"agentId"`
+	Experiment string `json:"experiment"`
+	// Scope is always "instance": the stats only cover the exchanges of the
+	// instance serving the request. The audit trail records the variant of
+	// every exchange on every instance.
+	Scope    string                     `json:"scope"`
+	Since    time.Time                  `json:"since"`
+	Variants []experiments.VariantStats `json:"variants"`
+}
+
+// experimentScope is the scope of experiment stats
+const experimentScope = "instance"
+
+// HandleCreateAgent registers a new agent, responding with its first version
+func (h *AgentHandler) HandleCreateAgent(c *gin.Context) {
+	agent, ok := h.bindAgent(c, "")
+	if !ok {
+		return
+	}
+
+	created, err := h.registry.Create(*agent)
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	logging.FromContext(c.Request.Context(), h.log).WithFields(agentLogFields(created)).Info("Registered agent")
+	c.JSON(http.StatusCreated, created)
+}
+
+// HandleListAgents lists the latest version of every agent of the organization
+func (h *AgentHandler) HandleListAgents(c *gin.Context) {
+	organizationID, ok := agentScope(c, false)
+	if !ok {
+		return
+	}
+
+	list := h.registry.List(organizationID)
+	if list == nil {
+		list = []*agents.Agent{}
+	}
+	c.JSON(http.StatusOK, AgentListResponse{Agents: list, Count: len(list)})
+}
+
+// HandleGetAgent returns the latest version of an agent
+func (h *AgentHandler) HandleGetAgent(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+
+	agent, err := h.registry.Get(organizationID, c.Param("id"))
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, agent)
+}
+
+// HandleUpdateAgent stores a new version of an agent, responding with it. A
+// version in the body must be the latest one.
+func (h *AgentHandler) HandleUpdateAgent(c *gin.Context) {
+	agent, ok := h.bindAgent(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	updated, err := h.registry.Update(*agent)
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	h.invalidateAnswers(updated.OrganizationID, updated.ID)
+	logging.FromContext(c.Request.Context(), h.log).WithFields(agentLogFields(updated)).Info("Updated agent")
+	c.JSON(http.StatusOK, updated)
+}
+
+// HandleDeleteAgent removes every version of an agent
+func (h *AgentHandler) HandleDeleteAgent(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+
+	if err := h.registry.Delete(organizationID, c.Param("id")); err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	h.invalidateAnswers(organizationID, c.Param("id"))
+	logging.FromContext(c.Request.Context(), h.log).WithFields(logrus.Fields{
+		"organization_id": organizationID,
+		"agent_id":        c.Param("id"),
+	}).Info("Deleted agent")
+	c.Status(http.StatusNoContent)
+}
+
+// invalidateAnswers removes an agent's answers from the semantic cache after
+// its definition changed. The answers would no longer match questions anyway,
+// but they'd take up room until they expired.
+func (h *AgentHandler) invalidateAnswers(organizationID, agentID string) {
+	if h.semanticCache != nil {
+		h.semanticCache.Invalidate(organizationID, agentID)
+	}
+}
+
+// HandleListAgentVersions lists every version of an agent, oldest first
+func (h *AgentHandler) HandleListAgentVersions(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+
+	versions, err := h.registry.Versions(organizationID, c.Param("id"))
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, AgentListResponse{Agents: versions, Count: len(versions)})
+}
+
+// HandleGetAgentVersion returns a version of an agent
+func (h *AgentHandler) HandleGetAgentVersion(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		var errs validationErrors
+		errs.add("version", "must be a positive number")
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(errs)})
+		return
+	}
+
+	agent, err := h.registry.Version(organizationID, c.Param("id"), version)
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, agent)
+}
+
+// HandleRenderAgent renders the instructions of an agent with the variables
+// of the request, as a chat request would
+func (h *AgentHandler) HandleRenderAgent(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+	var req RenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": &models.ErrorInfo{
+			Code:    "invalid_request",
+			Message: "Invalid request format",
+			Details: redact.String(err.Error()),
+		}})
+		return
+	}
+	if req.User != nil && req.User.TimeZone != "" {
+		if _, err := time.LoadLocation(req.User.TimeZone); err != nil {
+			var errs validationErrors
+			errs.add("user.timeZone", "must be an IANA time zone such as 'Europe/Berlin'")
+			c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(errs)})
+			return
+		}
+	}
+
+	var agent *agents.Agent
+	var err error
+	if req.Version != 0 {
+		agent, err = h.registry.Version(organizationID, c.Param("id"), req.Version)
+	} else {
+		agent, err = h.registry.Get(organizationID, c.Param("id"))
+	}
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+
+	chatRequest := &models.ChatRequest{
+		OrganizationID: organizationID,
+		AgentID:        agent.ID,
+		UserID:         req.UserID,
+		User:           req.User,
+		Variables:      req.Variables,
+		Context:        models.Context{AgentConfig: agent.AgentConfig},
+	}
+	instructions := agent.Instructions
+	if req.Instructions != "" {
+		instructions = req.Instructions
+	}
+	now := time.Now()
+	if req.Time != nil {
+		now = *req.Time
+	}
+
+	vars := promptVariables(h.configs.For(c.Request.Context()), chatRequest, now)
+	rendered, err := prompts.Render(c.Request.Context(), instructions, vars, agent.StrictVariables || req.Strict)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": &models.ErrorInfo{
+			Code:    "render_failed",
+			Message: "The instructions could not be rendered",
+			Details: err.Error(),
+		}})
+		return
+	}
+	c.JSON(http.StatusOK, RenderResponse{Instructions: rendered, AgentVersion: agent.Version})
+}
+
+// HandleExperimentStats compares the outcomes of the variants of an agent's
+// current experiment, or of the experiment given by the experiment query
+// parameter
+func (h *AgentHandler) HandleExperimentStats(c *gin.Context) {
+	organizationID, ok := agentScope(c, true)
+	if !ok {
+		return
+	}
+	agent, err := h.registry.Get(organizationID, c.Param("id"))
+	if err != nil {
+		h.respondRegistryError(c, err)
+		return
+	}
+
+	experiment, exists := c.GetQuery("experiment")
+	var variants []string
+	if !exists {
+		experiment = agent.Experiment
+		for _, variant := range agent.Variants {
+			variants = append(variants, variant.Name)
+		}
+	}
+	c.JSON(http.StatusOK, ExperimentResponse{
+		AgentID:    agent.ID,
+		Experiment: experiment,
+		Scope:      experimentScope,
+		Since:      h.experiments.Since(),
+		Variants:   h.experiments.Stats(organizationID, agent.ID, experiment, variants...),
+	})
+}
+
+// agentScope returns the organization a request is scoped to, responding
+// with an error if it, or the agent ID when withID is set, is malformed
+func agentScope(c *gin.Context, withID bool) (string, bool) {
+	var errs validationErrors
+	errs.requireID("organizationId", c.Query("organizationId"))
+	if withID {
+		errs.requireID("id", c.Param("id"))
+	}
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return "", false
+	}
+	return c.Query("organizationId"), true
+}
+
+// bindAgent parses and validates the agent definition in the request body,
+// scoped to the organization of the request and, if set, the agent ID of the
+// path. It responds with an error if the definition is invalid.
+func (h *AgentHandler) bindAgent(c *gin.Context, id string) (*agents.Agent, bool) {
+	var agent agents.Agent
+	if err := c.ShouldBindJSON(&agent); err != nil {
+		if isBodyTooLarge(err) {
+			respondAdminError(c, http.StatusRequestEntityTooLarge, "request_too_large", "Request body too large")
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": &models.ErrorInfo{
+			Code:    "invalid_request",
+			Message: "Invalid request format",
+			Details: redact.String(err.Error()),
+		}})
+		return nil, false
+	}
+
+	var errs validationErrors
+	organizationID := c.Query("organizationId")
+	errs.requireID("organizationId", organizationID)
+	if agent.OrganizationID != "" && agent.OrganizationID != organizationID {
+		errs.add("organizationId", "must match the organizationId query parameter")
+	}
+	agent.OrganizationID = organizationID
+	if id != "" {
+		if agent.ID != "" && agent.ID != id {
+			errs.add("id", "must match the agent ID of the path")
+		}
+		agent.ID = id
+	}
+	if agent.AIProvider == "" {
+		agent.AIProvider = "chatgpt"
+	}
+	validateAgent(h.configs.For(c.Request.Context()), &agent, &errs)
+
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return nil, false
+	}
+	return &agent, true
+}
+
+// validateAgent records every invalid field of an agent definition
+func validateAgent(cfg *config.Config, agent *agents.Agent, errs *validationErrors) {
+	errs.requireID("id", agent.ID)
+
+	if agent.AIProvider != "chatgpt" {
+		errs.add("aiProvider", "must be 'chatgpt'")
+	}
+	if agent.Model != "" && !cfg.IsModelAllowed(agent.Model) {
+		errs.add("model", "must be one of the allowed models")
+	}
+	if t := agent.Temperature; t != nil && (*t < 0 || *t > maxTemperature) {
+		errs.add("temperature", "must be between 0 and %d", maxTemperature)
+	}
+	if agent.MaxTokens < 0 {
+		errs.add("maxTokens", "must not be negative")
+	}
+	if agent.InjectionPolicy != "" && !config.IsInjectionPolicy(agent.InjectionPolicy) {
+		errs.add("injectionPolicy", "must be 'detect', 'quarantine' or 'off'")
+	}
+	if agent.Cache != nil {
+		validateCacheConfig("cache", agent.Cache, agent.Temperature, errs)
+	}
+	if err := prompts.Parse(agent.Instructions); err != nil {
+		errs.add("instructions", "is not a valid template: %v", err)
+	}
+	validateTools("tools", agent.Tools, errs)
+
+	limits := cfg.Limits
+	if limits.MaxFiles > 0 && len(agent.Files) > limits.MaxFiles {
+		errs.add("files", "must not contain more than %d files", limits.MaxFiles)
+	}
+	filesBytes := 0
+	for i, file := range agent.Files {
+		if file.Filename == "" {
+			errs.add(fmt.Sprintf("files[%d].filename", i), "is required")
+		}
+		filesBytes += len(file.Content)
+	}
+	if limits.MaxFilesBytes > 0 && filesBytes > limits.MaxFilesBytes {
+		errs.add("files", "must not exceed %d bytes of content in total", limits.MaxFilesBytes)
+	}
+	validateVariants(cfg, agent, errs)
+}
+
+// validateVariants records every invalid field of an agent's experiment
+func validateVariants(cfg *config.Config, agent *agents.Agent, errs *validationErrors) {
+	if agent.Experiment != "" {
+		errs.requireID("experiment", agent.Experiment)
+	}
+
+	names := make(map[string]bool, len(agent.Variants))
+	total := 0
+	for i, variant := range agent.Variants {
+		field := fmt.Sprintf("variants[%d]", i)
+		if names[variant.Name] {
+			errs.add(field+".name", "must be unique")
+		} else {
+			errs.requireID(field+".name", variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			errs.add(field+".weight", "must not be negative")
+		}
+		total += variant.Weight
+		if variant.Model != "" && !cfg.IsModelAllowed(variant.Model) {
+			errs.add(field+".model", "must be one of the allowed models")
+		}
+		if t := variant.Temperature; t != nil && (*t < 0 || *t > maxTemperature) {
+			errs.add(field+".temperature", "must be between 0 and %d", maxTemperature)
+		} else if t != nil && agent.Cache != nil && !agent.Cache.AnyTemperature && !isZeroTemperature(t) {
+			errs.add(field+".temperature", "must be 0 since the agent caches replies, unless cache.anyTemperature is set")
+		}
+		if variant.MaxTokens < 0 {
+			errs.add(field+".maxTokens", "must not be negative")
+		}
+		if err := prompts.Parse(variant.Instructions); err != nil {
+			errs.add(field+".instructions", "is not a valid template: %v", err)
+		}
+	}
+	if len(agent.Variants) > 0 && total <= 0 {
+		errs.add("variants", "must have a positive total weight")
+	}
+}
+
+// respondRegistryError writes the error response of a failed registry operation
+func (h *AgentHandler) respondRegistryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, agents.ErrNotFound):
+		respondAdminError(c, http.StatusNotFound, "not_found", "No such agent in the organization")
+	case errors.Is(err, agents.ErrExists):
+		respondAdminError(c, http.StatusConflict, "agent_exists", "The organization already has an agent with this ID")
+	case errors.Is(err, agents.ErrVersionConflict):
+		respondAdminError(c, http.StatusConflict, "version_conflict", "The agent was updated since the given version")
+	default:
+		logging.FromContext(c.Request.Context(), h.log).Errorf("Agent registry operation failed: %v", err)
+		respondAdminError(c, http.StatusInternalServerError, "processing_error", "Failed to update the agent registry")
+	}
+}
+
+// agentLogFields returns the log fields identifying a version of an agent
+func agentLogFields(agent *agents.Agent) logrus.Fields {
+	return logrus.Fields{
+		"organization_id": agent.OrganizationID,
+		"agent_id":        agent.ID,
+		"agent_version":   agent.Version,
+	}
+}
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/agents"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAgentRouter serves the agent registry endpoints without authorization
+func newAgentRouter(registry *agents.Registry, cfg *config.Config) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	handler := NewAgentHandler(registry, experiments.NewRecorder(), nil, logrus.New(), config.NewStore(cfg, nil))
+
+	router := gin.New()
+	router.POST("/agents", handler.HandleCreateAgent)
+	router.GET("/agents", handler.HandleListAgents)
+	router.GET("/agents/:id", handler.HandleGetAgent)
+	router.PUT("/agents/:id", handler.HandleUpdateAgent)
+	router.DELETE("/agents/:id", handler.HandleDeleteAgent)
+	router.GET("/agents/:id/versions", handler.HandleListAgentVersions)
+	router.GET("/agents/:id/versions/:version", handler.HandleGetAgentVersion)
+	router.POST("/agents/:id/render", handler.HandleRenderAgent)
+	return router
+}
+
+// serveJSON serves a request with an optional JSON body
+func serveJSON(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAgentRegistryEndpoints(t *testing.T) {
+	registry, err := agents.NewRegistry("")
+	require.NoError(t, err)
+	cfg := &config.Config{DefaultModel: "gpt-4o", AllowedModels: []string{"gpt-4o-mini"}}
+	router := newAgentRouter(registry, cfg)
+
+	w := serveJSON(router, "POST", "/agents?organizationId=org1", `{
+		"id": "support",
+		"instructions": "Be helpful",
+		"model": "gpt-4o-mini",
+		"tools": [{"name": "lookup_order", "description": "Find an order by ID", "parameters": {"type": "object"}}]
+	}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var agent agents.Agent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &agent))
+	assert.Equal(t, "org1", agent.OrganizationID)
+	assert.Equal(t, "chatgpt", agent.AIProvider)
+	assert.Equal(t, 1, agent.Version)
+
+	w = serveJSON(router, "GET", "/agents/support?organizationId=org1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &agent))
+	require.Len(t, agent.Tools, 1)
+	assert.Equal(t, "lookup_order", agent.Tools[0].Name)
+	assert.Equal(t, "Find an order by ID", agent.Tools[0].Description)
+	assert.JSONEq(t, `{"type": "object"}`, string(agent.Tools[0].Parameters))
+
+	w = serveJSON(router, "POST", "/agents?organizationId=org1", `{"id": "support"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = serveJSON(router, "PUT", "/agents/support?organizationId=org1", `{"version": 1, "instructions": "Be concise"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &agent))
+	assert.Equal(t, 2, agent.Version)
+
+	w = serveJSON(router, "PUT", "/agents/support?organizationId=org1", `{"version": 1, "instructions": "Be brief"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = serveJSON(router, "GET", "/agents/support/versions/1?organizationId=org1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &agent))
+	assert.Equal(t, "Be helpful", agent.Instructions)
+
+	var list AgentListResponse
+	w = serveJSON(router, "GET", "/agents/support/versions?organizationId=org1", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, 2, list.Count)
+
+	// Other organizations don't see the agent
+	w = serveJSON(router, "GET", "/agents/support?organizationId=org2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serveJSON(router, "GET", "/agents?organizationId=org2", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, 0, list.Count)
+
+	w = serveJSON(router, "DELETE", "/agents/support?organizationId=org1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serveJSON(router, "GET", "/agents/support?organizationId=org1", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCreateAgentValidation(t *testing.T) {
+	registry, err := agents.NewRegistry("")
+	require.NoError(t, err)
+	cfg := &config.Config{DefaultModel: "gpt-4o", Limits: config.Limits{MaxFiles: 1}}
+	router := newAgentRouter(registry, cfg)
+
+	w := serveJSON(router, "POST", "/agents?organizationId=org1", `{
+		"id": "support",
+		"organizationId": "org2",
+		"model": "gpt-3",
+		"temperature": 3,
+		"cache": {"ttlSeconds": -1, "threshold": 1.5},
+		"tools": [{"name": "look up"}, {"name": "search", "parameters": []}, {"name": "search"}],
+		"files": [{"filename": "a.txt"}, {"content": "b"}],
+		"variants": [{"name": "a", "weight": 0, "temperature": 5}, {"name": "a", "weight": 0, "temperature": 0.5}]
+	}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response struct {
+		Error models.ErrorInfo `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	var fields []string
+	for _, field := range response.Error.Fields {
+		fields = append(fields, field.Field)
+	}
+	assert.Equal(t, []string{
+		"organizationId",
+		"model",
+		"temperature",
+		"cache",
+		"cache.ttlSeconds",
+		"cache.threshold",
+		"tools[0].name",
+		"tools[1].parameters",
+		"tools[2].name",
+		"files",
+		"files[1].filename",
+		"variants[0].temperature",
+		"variants[1].name",
+		"variants[1].temperature",
+		"variants",
+	}, fields)
+}
+
+func TestHandleChatRegisteredAgent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	cfg := &config.Config{
+		RequestTimeout: 30 * time.Second,
+		DefaultModel:   "gpt-4o",
+		AllowedModels:  []string{"gpt-4o-mini"},
+	}
+
+	registry, err := agents.NewRegistry("")
+	require.NoError(t, err)
+	agent := agents.Agent{ID: "agent123", OrganizationID: "org123"}
+	agent.AIProvider = "chatgpt"
+	agent.Model = "gpt-4o-mini"
+	agent.Tools = []models.Tool{{Name: "lookup_order", Parameters: json.RawMessage(`{"type":"object"}`)}}
+	_, err = registry.Create(agent)
+	require.NoError(t, err)
+
+	requestTools := []models.Tool{{Name: "delete_order"}}
+
+	mockClient := openai.NewMockClient(log)
+	var usedModel string
+	mockClient.RunThreadFunc = func(ctx context.Context, threadID, model string) (string, error) {
+		usedModel = model
+		return "Hi", nil
+	}
+
+	testCases := []struct {
+		name            string
+		agentID         string
+		require         bool
+		expectedStatus  int
+		expectedModel   string
+		expectedVersion int
+		expectedTools   []models.Tool
+	}{
+		{
+			name:            "Registered agent",
+			agentID:         "agent123",
+			expectedStatus:  http.StatusOK,
+			expectedModel:   "gpt-4o-mini",
+			expectedVersion: 1,
+			expectedTools:   agent.Tools,
+		},
+		{
+			name:           "Unregistered agent runs with the request's configuration",
+			agentID:        "other",
+			expectedStatus: http.StatusOK,
+			expectedModel:  "gpt-4o",
+			expectedTools:  requestTools,
+		},
+		{
+			name:           "Unregistered agent rejected",
+			agentID:        "other",
+			require:        true,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			usedModel = ""
+			mockClient.Runs = nil
+			cfg.RequireRegisteredAgents = tc.require
+			handler := NewChatHandler(mockClient, log, config.NewStore(cfg, nil), nil, registry, nil)
+			router := gin.New()
+			router.POST("/chat", handler.HandleChat)
+
+			// The request's model and tools aren't allowed to override the agent's
+			body, _ := json.Marshal(models.ChatRequest{
+				OrganizationID: "org123",
+				AgentID:        tc.agentID,
+				UserID:         "user123",
+				SessionID:      "session123",
+				Message:        "Hello",
+				Context: models.Context{
+					AgentConfig: models.AgentConfig{AIProvider: "chatgpt", Model: "gpt-4o", Tools: requestTools},
+				},
+			})
+			w := serveJSON(router, "POST", "/chat", string(body))
+
+			assert.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			var response models.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tc.expectedModel, usedModel)
+			assert.Equal(t, tc.expectedVersion, response.Metadata.AgentVersion)
+			if tc.expectedStatus == http.StatusOK {
+				require.Len(t, mockClient.Runs, 1)
+				assert.Equal(t, tc.expectedTools, mockClient.Runs[0].Tools)
+			}
+		})
+	}
+}
+
+func TestHandleRenderAgent(t *testing.T) {
+	registry, err := agents.NewRegistry("")
+	require.NoError(t, err)
+	agent := agents.Agent{ID: "support", OrganizationID: "org1"}
+	agent.AIProvider = "chatgpt"
+	agent.Instructions = "Help {{.User.Name}} of {{.Org.Name}} with {{.Vars.product}}. Today is {{.Date}}."
+	_, err = registry.Create(agent)
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		DefaultModel: "gpt-4o",
+		OrgPolicies:  map[string]config.OrgPolicy{"org1": {Name: "Acme", TimeZone: "Asia/Tokyo"}},
+	}
+	router := newAgentRouter(registry, cfg)
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expected       string
+		expectedCode   string
+	}{
+		{
+			name:           "Organization time zone",
+			body:           `{"user": {"name": "Ada"}, "variables": {"product": "Rockets"}, "time": "2024-03-01T20:00:00Z"}`,
+			expectedStatus: http.StatusOK,
+			expected:       "Help Ada of Acme with Rockets. Today is 2024-03-02.",
+		},
+		{
+			name:           "User time zone",
+			body:           `{"user": {"name": "Ada", "timeZone": "America/New_York"}, "variables": {"product": "Rockets"}, "time": "2024-03-01T20:00:00Z"}`,
+			expectedStatus: http.StatusOK,
+			expected:       "Help Ada of Acme with Rockets. Today is 2024-03-01.",
+		},
+		{
+			name:           "Missing variable in strict mode",
+			body:           `{"user": {"name": "Ada"}, "strict": true}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   "render_failed",
+		},
+		{
+			name:           "Draft instructions",
+			body:           `{"instructions": "Hi {{.Agent.ID}}"}`,
+			expectedStatus: http.StatusOK,
+			expected:       "Hi support",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveJSON(router, "POST", "/agents/support/render?organizationId=org1", tc.body)
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+
+			var response struct {
+				RenderResponse
+				Error *models.ErrorInfo `json:"error"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			if tc.expectedCode != "" {
+				assert.Equal(t, tc.expectedCode, response.Error.Code)
+				return
+			}
+			assert.Equal(t, tc.expected, response.Instructions)
+			assert.Equal(t, 1, response.AgentVersion)
+		})
+	}
+}
+
+func TestAgentExperiment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	cfg := &config.Config{
+		RequestTimeout: 30 * time.Second,
+		DefaultModel:   "gpt-4o",
+		AllowedModels:  []string{"gpt-4o-mini"},
+	}
+	configs := config.NewStore(cfg, nil)
+
+	registry, err := agents.NewRegistry("")
+	require.NoError(t, err)
+	agent := agents.Agent{
+		ID:             "agent123",
+		OrganizationID: "org123",
+		Experiment:     "model",
+		Variants:       []agents.Variant{{Name: "control", Weight: 0}, {Name: "mini", Weight: 1, Model: "gpt-4o-mini"}},
+	}
+	agent.AIProvider = "chatgpt"
+	_, err = registry.Create(agent)
+	require.NoError(t, err)
+
+	mockClient := openai.NewMockClient(log)
+	var usedModel string
+	mockClient.RunThreadFunc = func(ctx context.Context, threadID, model string) (string, error) {
+		usedModel = model
+		return "Hi", nil
+	}
+
+	sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	recorder := experiments.NewRecorder()
+	chatHandler := NewChatHandler(mockClient, log, configs, sink, registry, recorder)
+	agentHandler := NewAgentHandler(registry, recorder, nil, log, configs)
+	router := gin.New()
+	router.POST("/chat", chatHandler.HandleChat)
+	router.GET("/agents/:id/experiment", agentHandler.HandleExperimentStats)
+
+	body, _ := json.Marshal(models.ChatRequest{
+		OrganizationID: "org123",
+		AgentID:        "agent123",
+		UserID:         "user123",
+		SessionID:      "session123",
+		Message:        "Hello",
+		Context:        models.Context{AgentConfig: models.AgentConfig{AIProvider: "chatgpt"}},
+	})
+	w := serveJSON(router, "POST", "/chat", string(body))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var chat models.ChatResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &chat))
+	assert.Equal(t, "mini", chat.Metadata.Variant)
+	assert.Equal(t, "gpt-4o-mini", usedModel)
+
+	records, err := sink.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "model", records[0].Experiment)
+	assert.Equal(t, "mini", records[0].Variant)
+
+	w = serveJSON(router, "GET", "/agents/agent123/experiment?organizationId=org123", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response ExperimentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "model", response.Experiment)
+	assert.Equal(t, "instance", response.Scope)
+	require.Len(t, response.Variants, 2)
+	assert.Equal(t, "control", response.Variants[0].Variant)
+	assert.Equal(t, 0, response.Variants[0].Requests)
+	assert.Equal(t, "mini", response.Variants[1].Variant)
+	assert.Equal(t, 1, response.Variants[1].Successes)
+
+	w = serveJSON(router, "GET", "/agents/agent123/experiment?organizationId=org123&experiment=other", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Empty(t, response.Variants)
+}
+
+func TestRenderInstructions(t *testing.T) {
+	agent := &agents.Agent{ID: "support", OrganizationID: "org1"}
+	agent.Instructions = "Help {{.User.Name}}."
+	handler := NewChatHandler(openai.NewMockClient(logrus.New()), logrus.New(), config.NewStore(&config.Config{}, nil), nil, nil, nil)
+
+	testCases := []struct {
+		name         string
+		agent        *agents.Agent
+		instructions string
+		expected     string
+	}{
+		{
+			name:         "Registered agent",
+			agent:        agent,
+			instructions: agent.Instructions,
+			expected:     "Help Ada.",
+		},
+		{
+			name:         "Instructions of an unregistered agent",
+			instructions: "Help {{.User.Name}}.{{range 2000000000}}{{end}}",
+			expected:     "Help {{.User.Name}}.{{range 2000000000}}{{end}}",
+		},
+		{
+			name:         "Instructions overriding the registered agent's",
+			agent:        agent,
+			instructions: "Hi {{.User.Name}}.",
+			expected:     "Hi {{.User.Name}}.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &models.ChatRequest{
+				OrganizationID: "org1",
+				User:           &models.UserProfile{Name: "Ada"},
+				Context:        models.Context{AgentConfig: models.AgentConfig{Instructions: tc.instructions}},
+			}
+			require.NoError(t, handler.renderInstructions(context.Background(), req, tc.agent))
+			assert.Equal(t, tc.expected, req.Context.AgentConfig.Instructions)
+		})
+	}
+}
+
+func TestRecordVariantSkipsCachedReplies(t *testing.T) {
+	agent := &agents.Agent{ID: "agent123", OrganizationID: "org123", Experiment: "model"}
+	ctx := agents.NewContext(context.Background(), agent.WithVariant(&agents.Variant{Name: "mini", Weight: 1}))
+	recorder := experiments.NewRecorder()
+	handler := NewChatHandler(openai.NewMockClient(logrus.New()), logrus.New(), config.NewStore(&config.Config{}, nil), nil, nil, recorder)
+	req := &models.ChatRequest{OrganizationID: "org123", AgentID: "agent123", SessionID: "session123"}
+
+	for _, cached := range []bool{true, false} {
+		response := &models.ChatResponse{ResponseID: "resp", Metadata: models.ResponseMeta{Cached: cached}}
+		handler.recordVariant(ctx, req, response, nil, time.Now())
+	}
+
+	stats := recorder.Stats("org123", "agent123", "model")
+	require.Len(t, stats, 1)
+	assert.Equal(t, 1, stats[0].Requests)
+}
@@ -2,33 +2,68 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/agents"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/moderation"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/promptguard"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/prompts"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	goopenai "github.com/sashabaranov/go-openai"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ChatHandler handles chat requests
 type ChatHandler struct {
 	openaiClient openai.ClientInterface
 	log          *logrus.Logger
-	cfg          *config.Config
+	configs      *config.Store
+	redactors    *redact.Registry
+	moderation   *moderation.Checker
+	auditSink    audit.Sink
+	agents       *agents.Registry
+	experiments  *experiments.Recorder
 }
 
-// NewChatHandler creates a new chat handler
-func NewChatHandler(openaiClient openai.ClientInterface, log *logrus.Logger, cfg *config.Config) *ChatHandler {
+// NewChatHandler creates a new chat handler. Exchanges are recorded in the
+// audit sink unless it is nil. Requests for agents in the registry run with
+// the registered definition; a nil registry has no agents. Outcomes of
+// exchanges with variants of agents are recorded unless experimentRecorder
+// is nil.
+func NewChatHandler(openaiClient openai.ClientInterface, log *logrus.Logger, configs *config.Store, auditSink audit.Sink, agentRegistry *agents.Registry, experimentRecorder *experiments.Recorder) *ChatHandler {
 	return &ChatHandler{
 		openaiClient: openaiClient,
 		log:          log,
-		cfg:          cfg,
+		configs:      configs,
+		redactors:    redact.NewRegistry(configs),
+		moderation:   moderation.NewChecker(configs),
+		auditSink:    auditSink,
+		agents:       agentRegistry,
+		experiments:  experimentRecorder,
 	}
 }
 
+// cfg returns the configuration the request of ctx runs with
+func (h *ChatHandler) cfg(ctx context.Context) *config.Config {
+	return h.configs.For(ctx)
+}
+
 // HandleChat handles chat requests
 func (h *ChatHandler) HandleChat(c *gin.Context) {
 	startTime := time.Now()
@@ -36,111 +71,669 @@ func (h *ChatHandler) HandleChat(c *gin.Context) {
 	// Parse request
 	var req models.ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		if isBodyTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, models.ChatResponse{
+				Status: "error",
+				Error: &models.ErrorInfo{
+					Code:    "request_too_large",
+					Message: "Request body too large",
+					Details: fmt.Sprintf("the request body must not exceed %d bytes", h.cfg(c.Request.Context()).Limits.MaxBodyBytes),
+				},
+			})
+			return
+		}
 		c.JSON(http.StatusBadRequest, models.ChatResponse{
 			Status: "error",
 			Error: &models.ErrorInfo{
 				Code:    "invalid_request",
 				Message: "Invalid request format",
-				Details: err.Error(),
+				Details: redact.String(err.Error()),
 			},
 		})
 		return
 	}
+	h.bindRequestContext(c, &req)
 
-	// Validate request
-	if err := h.validateRequest(&req); err != nil {
+	// Resolve the agent and validate the request
+	ctx, err := h.prepareRequest(c.Request.Context(), &req)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, models.ChatResponse{
 			Status: "error",
-			Error: &models.ErrorInfo{
-				Code:    "validation_error",
-				Message: "Request validation failed",
-				Details: err.Error(),
-			},
+			Error:  validationErrorInfo(err),
 		})
 		return
 	}
 
+	ctx, span := startChatSpan(ctx, "ChatHandler.HandleChat", &req)
+	defer span.End()
+
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(c.Request.Context(), h.cfg.RequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, h.cfg(ctx).RequestTimeout)
 	defer cancel()
 
 	// Process the chat request
-	response, err := h.processChat(ctx, &req)
+	response, err := h.runChat(ctx, &req, nil)
+	tracing.RecordError(span, err)
+	h.recordAudit(ctx, "http", &req, response, err, startTime)
+	h.recordVariant(ctx, &req, response, err, startTime)
+	if errors.Is(err, openai.ErrRunCancelled) {
+		logging.FromContext(ctx, h.log).Info("Chat request was cancelled")
+		c.JSON(http.StatusOK, cancelledResponse(&req))
+		return
+	}
 	if err != nil {
-		h.log.Errorf("Error processing chat: %v", err)
-		c.JSON(http.StatusInternalServerError, models.ChatResponse{
-			Status:    "error",
-			SessionID: req.SessionID,
-			Error: &models.ErrorInfo{
-				Code:    "processing_error",
-				Message: "Error processing chat request",
-				Details: err.Error(),
-			},
-		})
+		logging.FromContext(ctx, h.log).Errorf("Error processing chat: %v", err)
+		status, response := errorResponse(req.SessionID, err)
+		c.JSON(status, response)
 		return
 	}
 
+	h.finalizeResponse(response, &req, startTime)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// bindRequestContext makes the request ID in the chat request's metadata the
+// request's correlation ID, filling it in with the generated one if the caller
+// sent none, and tags the request's log entry with the chat request's
+// identifiers
+func (h *ChatHandler) bindRequestContext(c *gin.Context, req *models.ChatRequest) {
+	if !logging.IsValidRequestID(req.Metadata.RequestID) {
+		req.Metadata.RequestID = logging.RequestID(c.Request.Context())
+		if req.Metadata.RequestID == "" {
+			req.Metadata.RequestID = utils.GenerateUUID()
+		}
+	}
+	logging.SetRequestID(c, h.log, req.Metadata.RequestID)
+	logging.WithFields(c, h.log, chatLogFields(req))
+}
+
+// chatLogFields returns the log fields identifying a chat request
+func chatLogFields(req *models.ChatRequest) logrus.Fields {
+	return logrus.Fields{
+		"organization_id": req.OrganizationID,
+		"agent_id":        req.AgentID,
+		"session_id":      req.SessionID,
+		"user_id":         req.UserID,
+	}
+}
+
+// finalizeResponse fills in the per-request response metadata
+func (h *ChatHandler) finalizeResponse(response *models.ChatResponse, req *models.ChatRequest, startTime time.Time) {
 	// Calculate processing time
 	processingTime := time.Since(startTime).Seconds()
 	response.Metadata.ProcessingTime = processingTime
 	response.Metadata.RequestID = req.Metadata.RequestID
+}
 
-	c.JSON(http.StatusOK, response)
+// recordAudit appends a chat exchange to the audit trail. Failures are logged
+// rather than failing the exchange, which has already happened.
+func (h *ChatHandler) recordAudit(ctx context.Context, channel string, req *models.ChatRequest, response *models.ChatResponse, err error, startTime time.Time) {
+	if h.auditSink == nil {
+		return
+	}
+
+	record := &audit.Record{
+		ID:             utils.GenerateUUID(),
+		Time:           startTime.UTC(),
+		RequestID:      req.Metadata.RequestID,
+		Channel:        channel,
+		OrganizationID: req.OrganizationID,
+		UserID:         req.UserID,
+		AgentID:        req.AgentID,
+		SessionID:      req.SessionID,
+		DurationMs:     time.Since(startTime).Milliseconds(),
+		Status:         "success",
+		Moderation:     audit.ModerationDisabled,
+		MessageHash:    audit.Hash(req.Message),
+	}
+	if agent := agents.FromContext(ctx); agent != nil && agent.AssignedVariant() != "" {
+		record.Experiment = agent.Experiment
+		record.Variant = agent.AssignedVariant()
+	}
+	if h.moderation.Enabled(ctx, req.OrganizationID, moderation.StageInput) {
+		record.Moderation = audit.ModerationPassed
+	}
+
+	var blocked *moderation.BlockedError
+	switch {
+	case errors.Is(err, openai.ErrRunCancelled) || errors.Is(context.Cause(ctx), errTurnCancelled):
+		record.Status = "cancelled"
+	case errors.As(err, &blocked):
+		record.Status = "error"
+		record.ErrorCode = "content_blocked"
+		record.Moderation = audit.ModerationBlocked
+		record.ModerationCategories = blocked.Categories
+	case err != nil:
+		_, errResponse := errorResponse(req.SessionID, err)
+		record.Status = errResponse.Status
+		record.ErrorCode = errResponse.Error.Code
+	}
+
+	if response != nil {
+		record.ConversationID = response.ConversationID
+		record.ResponseID = response.ResponseID
+		record.Model = response.Metadata.Model
+		record.TokensUsed = response.Metadata.TokensUsed
+		record.Cost = response.Metadata.Cost
+		record.Cached = response.Metadata.Cached
+		record.InjectionDetected = response.Metadata.InjectionDetected
+		record.ResponseHash = audit.Hash(response.Response)
+		for _, flagged := range response.Metadata.Moderation {
+			record.Moderation = audit.ModerationFlagged
+			record.ModerationCategories = append(record.ModerationCategories, flagged.Categories...)
+		}
+	}
+
+	if h.cfg(ctx).PolicyFor(req.OrganizationID).Audit.IncludeContent {
+		record.Message = req.Message
+		if response != nil {
+			record.Response = response.Response
+		}
+	}
+
+	// Exchanges that were cancelled or timed out are recorded all the same
+	if err := h.auditSink.Write(context.WithoutCancel(ctx), record); err != nil {
+		metrics.AuditWriteErrors.Inc()
+		logging.FromContext(ctx, h.log).Errorf("Failed to write audit record: %v", err)
+	}
 }
 
-// validateRequest validates the chat request
-func (h *ChatHandler) validateRequest(req *models.ChatRequest) error {
-	if req.OrganizationID == "" {
-		return fmt.Errorf("organizationId is required")
+// recordVariant records the outcome of an exchange with a variant of an agent
+// in an experiment
+func (h *ChatHandler) recordVariant(ctx context.Context, req *models.ChatRequest, response *models.ChatResponse, err error, startTime time.Time) {
+	agent := agents.FromContext(ctx)
+	if h.experiments == nil || agent == nil || agent.AssignedVariant() == "" {
+		return
 	}
-	if req.AgentID == "" {
-		return fmt.Errorf("agentId is required")
+	// Cached replies took no tokens or time to generate, so they'd skew the
+	// comparison of the variants
+	if response != nil && response.Metadata.Cached {
+		return
 	}
-	if req.UserID == "" {
-		return fmt.Errorf("userId is required")
+
+	outcome := experiments.Outcome{Status: "success", Duration: time.Since(startTime)}
+	switch {
+	case errors.Is(err, openai.ErrRunCancelled) || errors.Is(context.Cause(ctx), errTurnCancelled):
+		outcome.Status = "cancelled"
+	case err != nil:
+		_, errResponse := errorResponse(req.SessionID, err)
+		outcome.Status = errResponse.Status
 	}
-	if req.Message == "" {
-		return fmt.Errorf("message is required")
+	if response != nil {
+		outcome.Tokens = response.Metadata.TokensUsed
+		outcome.Cost = response.Metadata.Cost
+		outcome.ResponseID = response.ResponseID
+	}
+	h.experiments.Record(req.OrganizationID, req.AgentID, agent.Experiment, agent.AssignedVariant(), outcome)
+}
+
+// HandleCancelRun stops the in-flight completion for a session. The session
+// must belong to the organization and user given by the organizationId and
+// userId query parameters.
+func (h *ChatHandler) HandleCancelRun(c *gin.Context) {
+	sessionID := c.Param("id")
+	organizationID := c.Query("organizationId")
+	userID := c.Query("userId")
+
+	var errs validationErrors
+	errs.requireID("organizationId", organizationID)
+	errs.requireID("userId", userID)
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, models.ChatResponse{
+			Status:    "error",
+			SessionID: sessionID,
+			Error:     validationErrorInfo(err),
+		})
+		return
 	}
-	if req.SessionID == "" {
-		return fmt.Errorf("sessionId is required")
+
+	// Only the runs the user started are cancelled, including those still
+	// waiting for the session. Runs of other organizations and users are
+	// reported like sessions without a run, so their IDs can't be probed.
+	if !h.openaiClient.CancelRun(sessionID, organizationID, userID) {
+		c.JSON(http.StatusNotFound, models.ChatResponse{
+			Status:    "error",
+			SessionID: sessionID,
+			Error: &models.ErrorInfo{
+				Code:    "not_found",
+				Message: "No active run for this session",
+			},
+		})
+		return
 	}
-	if req.Context.AgentConfig.AIProvider != "chatgpt" {
-		return fmt.Errorf("aiProvider must be 'chatgpt'")
+
+	c.JSON(http.StatusOK, models.ChatResponse{
+		Status:    "cancelled",
+		SessionID: sessionID,
+	})
+}
+
+// startChatSpan starts a span for a chat request, tagged with its organization,
+// agent and session
+func startChatSpan(ctx context.Context, name string, req *models.ChatRequest) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(
+		tracing.AttrOrganizationID.String(req.OrganizationID),
+		tracing.AttrAgentID.String(req.AgentID),
+		tracing.AttrSessionID.String(req.SessionID),
+	))
+}
+
+// appendModerationInfo records content flagged by moderation at a stage, if it was
+func appendModerationInfo(flagged []models.ModerationInfo, stage string, verdict *moderation.Result) []models.ModerationInfo {
+	if verdict == nil {
+		return flagged
+	}
+	return append(flagged, models.ModerationInfo{
+		Flagged:    true,
+		Stage:      stage,
+		Categories: verdict.Categories,
+	})
+}
+
+// injectionPolicy returns the prompt injection policy of the request's agent
+func (h *ChatHandler) injectionPolicy(ctx context.Context, req *models.ChatRequest) string {
+	if policy := req.Context.AgentConfig.InjectionPolicy; policy != "" {
+		return policy
+	}
+	return h.cfg(ctx).InjectionPolicy
+}
+
+// guardPrompt builds the system prompt of a chat request, recording content
+// with signs of prompt injection
+func (h *ChatHandler) guardPrompt(ctx context.Context, req *models.ChatRequest) (*promptguard.Prompt, []models.InjectionInfo) {
+	prompt := promptguard.Build(req.Context.AgentConfig.Instructions, req.Context.Files, req.Context.ChatHistory, h.injectionPolicy(ctx, req))
+
+	var injections []models.InjectionInfo
+	for _, finding := range prompt.Findings {
+		action := "flagged"
+		if finding.Quarantined {
+			action = "quarantined"
+		}
+		metrics.InjectionDetections.WithLabelValues(req.OrganizationID, req.AgentID, finding.Source, action).Inc()
+		logging.FromContext(ctx, h.log).WithFields(logrus.Fields{
+			"source":  finding.Source,
+			"name":    finding.Name,
+			"signals": finding.Signals,
+		}).Warnf("Possible prompt injection %s", action)
+
+		injections = append(injections, models.InjectionInfo{
+			Source:      finding.Source,
+			Name:        finding.Name,
+			Signals:     finding.Signals,
+			Quarantined: finding.Quarantined,
+		})
+	}
+	return prompt, injections
+}
+
+// historyMessages converts chat history entries into thread messages
+func historyMessages(history []models.ChatEntry) []models.ThreadMessage {
+	messages := make([]models.ThreadMessage, 0, len(history))
+	for _, entry := range history {
+		messages = append(messages, models.ThreadMessage{
+			ChatCompletionMessage: goopenai.ChatCompletionMessage{
+				Role:    entry.Role,
+				Content: entry.Content,
+			},
+			Time: entry.Timestamp,
+		})
+	}
+	return messages
+}
+
+// cancelledResponse builds the response for a chat request whose run was cancelled
+func cancelledResponse(req *models.ChatRequest) *models.ChatResponse {
+	return &models.ChatResponse{
+		SessionID: req.SessionID,
+		Status:    "cancelled",
+		Metadata: models.ResponseMeta{
+			Provider:  "chatgpt",
+			RequestID: req.Metadata.RequestID,
+		},
+	}
+}
+
+// prepareRequest resolves the agent of a chat request, validates the request
+// and renders the agent's instructions, returning validationErrors listing
+// every failing field. A registered agent replaces the request's agent
+// configuration, except for the settings it allows to be overridden,
+// attaches its files and is carried by the returned context.
+func (h *ChatHandler) prepareRequest(ctx context.Context, req *models.ChatRequest) (context.Context, error) {
+	var agent *agents.Agent
+	if h.agents != nil {
+		// Get only fails for agents that aren't registered
+		agent, _ = h.agents.Get(req.OrganizationID, req.AgentID)
+	}
+	if agent == nil && h.cfg(ctx).RequireRegisteredAgents {
+		var errs validationErrors
+		errs.add("agentId", "is not a registered agent of the organization")
+		return ctx, errs
+	}
+
+	if agent != nil {
+		// Sessions of agents in an experiment run with their variant
+		if variant := agent.VariantFor(req.SessionID); variant != nil {
+			agent = agent.WithVariant(variant)
+		}
+		var ignored []string
+		req.Context.AgentConfig, ignored = agent.Apply(req.Context.AgentConfig)
+		if len(ignored) > 0 {
+			logging.FromContext(ctx, h.log).WithField("agent_version", agent.Version).
+				Warnf("Ignoring agent settings the request may not override: %v", ignored)
+		}
+	}
+	if err := h.validateRequest(ctx, req); err != nil {
+		return ctx, err
 	}
+	if err := h.renderInstructions(ctx, req, agent); err != nil {
+		return ctx, err
+	}
+	if agent == nil {
+		return ctx, nil
+	}
+
+	req.Context.Files = append(slices.Clip(agent.Files), req.Context.Files...)
+	return agents.NewContext(ctx, agent), nil
+}
+
+// renderInstructions renders the instructions of the request's registered
+// agent with the request's variables. Instructions that can't be rendered are
+// used as they are, unless the agent requires strict variables. Instructions
+// supplied by the caller are never rendered, so callers can't run templates.
+func (h *ChatHandler) renderInstructions(ctx context.Context, req *models.ChatRequest, agent *agents.Agent) error {
+	agentConfig := &req.Context.AgentConfig
+	if agent == nil || agentConfig.Instructions != agent.Instructions || !prompts.IsTemplate(agentConfig.Instructions) {
+		return nil
+	}
+
+	instructions, err := prompts.Render(ctx, agentConfig.Instructions, promptVariables(h.cfg(ctx), req, time.Now()), agentConfig.StrictVariables)
+	if err != nil {
+		if agentConfig.StrictVariables {
+			var errs validationErrors
+			errs.add("context.agentConfig.instructions", "could not be rendered: %v", err)
+			return errs
+		}
+		logging.FromContext(ctx, h.log).Warnf("Using instructions as they are since they could not be rendered: %v", err)
+		return nil
+	}
+	agentConfig.Instructions = instructions
 	return nil
 }
 
-// processChat processes a chat request
-func (h *ChatHandler) processChat(ctx context.Context, req *models.ChatRequest) (*models.ChatResponse, error) {
+// promptVariables returns the variables the instructions of a chat request's
+// agent are rendered with. Dates and times are in the user's time zone, or
+// else the organization's.
+func promptVariables(cfg *config.Config, req *models.ChatRequest, now time.Time) prompts.Variables {
+	policy := cfg.PolicyFor(req.OrganizationID)
+	vars := prompts.Variables{
+		User:  map[string]string{},
+		Org:   map[string]string{},
+		Agent: map[string]string{},
+		Vars:  req.Variables,
+	}
+	setVariable(vars.Org, "ID", req.OrganizationID)
+	setVariable(vars.Org, "Name", policy.Name)
+	setVariable(vars.Agent, "ID", req.AgentID)
+	setVariable(vars.Agent, "Name", req.Context.AgentConfig.Name)
+
+	location, err := time.LoadLocation(policy.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+	if user := req.User; user != nil {
+		for name, value := range user.Attributes {
+			setVariable(vars.User, name, value)
+		}
+		setVariable(vars.User, "Name", user.Name)
+		setVariable(vars.User, "Email", user.Email)
+		setVariable(vars.User, "Locale", user.Locale)
+		setVariable(vars.User, "TimeZone", user.TimeZone)
+		if userLocation, err := time.LoadLocation(user.TimeZone); err == nil && user.TimeZone != "" {
+			location = userLocation
+		}
+	}
+	setVariable(vars.User, "ID", req.UserID)
+	vars.Now = now.In(location)
+	return vars
+}
+
+// setVariable sets a template variable unless its value is empty, so strict
+// rendering fails on it
+func setVariable(vars map[string]string, name, value string) {
+	if value != "" {
+		vars[name] = value
+	}
+}
+
+// validateRequest validates the chat request, returning validationErrors
+// listing every failing field
+func (h *ChatHandler) validateRequest(ctx context.Context, req *models.ChatRequest) error {
+	limits := h.cfg(ctx).Limits
+	var errs validationErrors
+
+	errs.requireID("organizationId", req.OrganizationID)
+	errs.requireID("agentId", req.AgentID)
+	errs.requireID("userId", req.UserID)
+	errs.requireID("sessionId", req.SessionID)
+
+	if req.Message == "" {
+		errs.add("message", "is required")
+	} else if limits.MaxMessageLength > 0 && utf8.RuneCountInString(req.Message) > limits.MaxMessageLength {
+		errs.add("message", "must not exceed %d characters", limits.MaxMessageLength)
+	}
+
+	if req.Context.AgentConfig.AIProvider != "chatgpt" {
+		errs.add("context.agentConfig.aiProvider", "must be 'chatgpt'")
+	}
+	if policy := req.Context.AgentConfig.InjectionPolicy; policy != "" && !config.IsInjectionPolicy(policy) {
+		errs.add("context.agentConfig.injectionPolicy", "must be 'detect', 'quarantine' or 'off'")
+	}
+	if model := req.Context.AgentConfig.Model; model != "" && !h.cfg(ctx).IsModelAllowed(model) {
+		errs.add("context.agentConfig.model", "must be one of the allowed models")
+	}
+	if req.User != nil && req.User.TimeZone != "" {
+		if _, err := time.LoadLocation(req.User.TimeZone); err != nil {
+			errs.add("user.timeZone", "must be an IANA time zone such as 'Europe/Berlin'")
+		}
+	}
+
+	if limits.MaxFiles > 0 && len(req.Context.Files) > limits.MaxFiles {
+		errs.add("context.files", "must not contain more than %d files", limits.MaxFiles)
+	}
+	filesBytes := 0
+	for i, file := range req.Context.Files {
+		if file.Filename == "" {
+			errs.add(fmt.Sprintf("context.files[%d].filename", i), "is required")
+		}
+		filesBytes += len(file.Content)
+	}
+	if limits.MaxFilesBytes > 0 && filesBytes > limits.MaxFilesBytes {
+		errs.add("context.files", "must not exceed %d bytes of content in total", limits.MaxFilesBytes)
+	}
+
+	if limits.MaxChatHistory > 0 && len(req.Context.ChatHistory) > limits.MaxChatHistory {
+		errs.add("context.chatHistory", "must not contain more than %d entries", limits.MaxChatHistory)
+	}
+	if cache := req.Context.AgentConfig.Cache; cache != nil {
+		validateCacheConfig("context.agentConfig.cache", cache, req.Context.AgentConfig.Temperature, &errs)
+	}
+	validateTools("context.agentConfig.tools", req.Context.AgentConfig.Tools, &errs)
+	for i, entry := range req.Context.ChatHistory {
+		if !chatHistoryRoles[entry.Role] {
+			errs.add(fmt.Sprintf("context.chatHistory[%d].role", i), "must be 'user' or 'assistant'")
+		}
+	}
+
+	return errs.err()
+}
+
+// runChat waits for the session to be free, registers the run so it can be
+// stopped through the cancel endpoint and processes the chat request. Errors
+// of cancelled runs wrap openai.ErrRunCancelled.
+func (h *ChatHandler) runChat(ctx context.Context, req *models.ChatRequest, events *chatEvents) (*models.ChatResponse, error) {
+	runCtx, done, err := h.openaiClient.StartRun(ctx, req.SessionID, req.OrganizationID, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	response, err := h.processChat(runCtx, req, utils.GenerateUUID(), events)
+	if err != nil && openai.IsCancelled(runCtx) {
+		return nil, context.Cause(runCtx)
+	}
+	return response, err
+}
+
+// chatEvents receives intermediate events while a chat request is processed.
+// A nil *chatEvents processes the request without streaming.
+type chatEvents struct {
+	onProgress func(stage string)
+	onDelta    func(delta string) error
+}
+
+// progress reports a processing stage if anyone is listening
+func (e *chatEvents) progress(stage string) {
+	if e != nil && e.onProgress != nil {
+		e.onProgress(stage)
+	}
+}
+
+// processChat processes a chat request, identifying its reply by responseID
+func (h *ChatHandler) processChat(ctx context.Context, req *models.ChatRequest, responseID string, events *chatEvents) (_ *models.ChatResponse, err error) {
+	ctx, span := startChatSpan(ctx, "ChatHandler.processChat", req)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	// Mask PII before it reaches OpenAI if the organization requires it
+	ctx = redact.WithMasker(ctx, h.redactors.Masker(ctx, req.OrganizationID))
+
+	// Moderate the message before it becomes part of the conversation
+	var flagged []models.ModerationInfo
+	verdict, err := h.moderation.Check(ctx, req.OrganizationID, moderation.StageInput, req.Message)
+	if err != nil {
+		return nil, err
+	}
+	flagged = appendModerationInfo(flagged, moderation.StageInput, verdict)
+
+	// Delimit the files in the system prompt and check them and the chat
+	// history for prompt injection
+	prompt, injections := h.guardPrompt(ctx, req)
+
 	// Get or create thread (conversation)
-	thread, err := h.openaiClient.GetOrCreateThread(ctx, req.SessionID, req.AgentID, req.UserID)
+	thread, err := h.openaiClient.GetOrCreateThread(ctx, req.SessionID, req.OrganizationID, req.AgentID, req.UserID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get or create thread: %w", err)
 	}
 
+	// Start a new thread from the caller's chat history, as checked for
+	// prompt injection
+	if _, err := h.openaiClient.SeedThread(ctx, thread.ThreadID, historyMessages(prompt.History)); err != nil {
+		return nil, fmt.Errorf("failed to seed thread: %w", err)
+	}
+	events.progress("thread_ready")
+
 	// Add message to thread
 	if err := h.openaiClient.AddMessageToThread(ctx, thread.ThreadID, req.Message); err != nil {
 		return nil, fmt.Errorf("failed to add message to thread: %w", err)
 	}
+	events.progress("generating")
 
-	// Run the thread with the specified model (using default model from config)
-	response, err := h.openaiClient.RunThread(ctx, thread.ThreadID, h.cfg.DefaultModel)
+	// Run the thread with the specified model (using default model from config).
+	// Replies that moderation may block aren't streamed, since they must be
+	// checked before the caller sees any of them.
+	model := req.Context.AgentConfig.Model
+	if model == "" {
+		model = h.cfg(ctx).DefaultModel
+	}
+	opts := openai.RunOptions{
+		Model:        model,
+		SystemPrompt: prompt.SystemPrompt,
+		Temperature:  openai.Temperature(req.Context.AgentConfig.Temperature),
+		MaxTokens:    req.Context.AgentConfig.MaxTokens,
+		Tools:        req.Context.AgentConfig.Tools,
+		ResponseID:   responseID,
+	}
+	if cache := req.Context.AgentConfig.Cache; cache != nil {
+		ttl := h.cfg(ctx).ResponseCacheTTL
+		if cache.TTLSeconds > 0 {
+			ttl = time.Duration(cache.TTLSeconds) * time.Second
+		}
+		threshold := h.cfg(ctx).SemanticCacheThreshold
+		if cache.Threshold > 0 {
+			threshold = cache.Threshold
+		}
+		opts.Cache = &openai.CacheOptions{
+			OrganizationID: req.OrganizationID,
+			AgentID:        req.AgentID,
+			UserID:         req.UserID,
+			TTL:            ttl,
+			Boundary:       prompt.Boundary,
+			Semantic:       cache.Semantic,
+			Threshold:      threshold,
+		}
+	}
+	var result *openai.RunResult
+	stream := events != nil && events.onDelta != nil && !h.moderation.Blocks(ctx, req.OrganizationID, moderation.StageOutput)
+	if stream {
+		result, err = h.openaiClient.RunThreadStream(ctx, thread.ThreadID, opts, events.onDelta)
+	} else {
+		result, err = h.openaiClient.RunThread(ctx, thread.ThreadID, opts)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to run thread: %w", err)
 	}
+	events.progress("completed")
+
+	// Track usage and cost
+	cost := h.cfg(ctx).Cost(result.Model, result.Usage.PromptTokens, result.Usage.CompletionTokens)
+	span.SetAttributes(
+		tracing.AttrModel.String(result.Model),
+		tracing.AttrPromptTokens.Int(result.Usage.PromptTokens),
+		tracing.AttrCompletionTokens.Int(result.Usage.CompletionTokens),
+	)
+	metrics.RecordUsage(req.OrganizationID, req.AgentID, result.Model, result.Usage.PromptTokens, result.Usage.CompletionTokens, cost)
+
+	// Moderate the reply, keeping a blocked one out of the conversation
+	verdict, err = h.moderation.Check(ctx, req.OrganizationID, moderation.StageOutput, result.Content)
+	if err != nil {
+		if discardErr := h.openaiClient.DiscardLastTurn(ctx, thread.ThreadID); discardErr != nil {
+			logging.FromContext(ctx, h.log).Warnf("Failed to discard moderated turn: %v", discardErr)
+		}
+		return nil, err
+	}
+	flagged = appendModerationInfo(flagged, moderation.StageOutput, verdict)
+
+	// Only replies that passed moderation may answer later requests
+	h.openaiClient.CommitCachedReply(ctx, result)
 
 	// Create response
+	var agentVersion int
+	var variant string
+	if agent := agents.FromContext(ctx); agent != nil {
+		agentVersion = agent.Version
+		variant = agent.AssignedVariant()
+	}
 	chatResponse := &models.ChatResponse{
-		Response:       response,
+		Response:       result.Content,
 		SessionID:      req.SessionID,
 		ConversationID: thread.ThreadID, // Use thread ID as conversation ID
+		ResponseID:     opts.ResponseID,
 		Status:         "success",
 		Metadata: models.ResponseMeta{
-			Model:      h.cfg.DefaultModel,
-			TokensUsed: 0, // We don't track token usage in this implementation
+			Model:      result.Model,
+			TokensUsed: result.Usage.TotalTokens,
 			Provider:   "chatgpt",
-			Cost:       0, // We don't track cost in this implementation
+			Cost:       cost,
+			Cached:     result.Cached,
+			Moderation: flagged,
+
+			CacheSimilarity:   result.CacheSimilarity,
+			InjectionDetected: len(injections) > 0,
+			Injections:        injections,
+			AgentVersion:      agentVersion,
+			Variant:           variant,
+			PromptTokens:      result.Usage.PromptTokens,
+			CompletionTokens:  result.Usage.CompletionTokens,
 		},
 		Context: &models.ResponseContext{
 			ThreadID:    thread.ThreadID,
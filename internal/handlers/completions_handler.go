@@ -0,0 +1,702 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/moderation"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	goopenai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+)
+
+// Headers that bind an OpenAI-compatible request to a managed session. The
+// request's "user" field identifies the user.
+const (
+	HeaderSessionID      = "X-Session-ID"
+	HeaderOrganizationID = "X-Organization-ID"
+	HeaderAgentID        = "X-Agent-ID"
+)
+
+// modelInfo represents a model in the OpenAI-compatible models list
+type modelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// modelsList represents the OpenAI-compatible models list
+type modelsList struct {
+	Object string      `json:"object"`
+	Data   []modelInfo `json:"data"`
+}
+
+// CompletionsHandler serves an OpenAI-compatible API so off-the-shelf SDKs
+// and tools can use the service
+type CompletionsHandler struct {
+	openaiClient openai.ClientInterface
+	log          *logrus.Logger
+	configs      *config.Store
+	redactors    *redact.Registry
+	moderation   *moderation.Checker
+	auditSink    audit.Sink
+	// sessions prepares and processes requests bound to sessions like chat
+	// requests
+	sessions *ChatHandler
+}
+
+// NewCompletionsHandler creates a new OpenAI-compatible API handler. Requests
+// bound to sessions are prepared and processed by the chat handler, so they
+// run with the registered agents and under the same checks as chat requests.
+func NewCompletionsHandler(openaiClient openai.ClientInterface, log *logrus.Logger, configs *config.Store, auditSink audit.Sink, chatHandler *ChatHandler) *CompletionsHandler {
+	return &CompletionsHandler{
+		openaiClient: openaiClient,
+		log:          log,
+		configs:      configs,
+		redactors:    redact.NewRegistry(configs),
+		moderation:   moderation.NewChecker(configs),
+		auditSink:    auditSink,
+		sessions:     chatHandler,
+	}
+}
+
+// cfg returns the configuration the request of ctx runs with
+func (h *CompletionsHandler) cfg(ctx context.Context) *config.Config {
+	return h.configs.For(ctx)
+}
+
+// RequireAPIKey rejects requests that don't carry the admin API key as a
+// bearer token, with OpenAI-style errors so SDKs report them. All requests are
+// rejected if no key is configured.
+func (h *CompletionsHandler) RequireAPIKey(c *gin.Context) {
+	apiKey := h.cfg(c.Request.Context()).AdminAPIKey
+	if apiKey == "" {
+		h.respondError(c, http.StatusForbidden, "api_disabled", "The OpenAI-compatible API is disabled")
+		c.Abort()
+		return
+	}
+	if !hasBearerToken(c, apiKey) {
+		h.respondError(c, http.StatusUnauthorized, "invalid_api_key", "A valid API key is required")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// HandleListModels lists the models callers may request
+func (h *CompletionsHandler) HandleListModels(c *gin.Context) {
+	list := modelsList{Object: "list", Data: []modelInfo{}}
+	seen := make(map[string]bool)
+	cfg := h.cfg(c.Request.Context())
+	for _, model := range append([]string{cfg.DefaultModel}, cfg.AllowedModels...) {
+		if model == "" || seen[model] {
+			continue
+		}
+		seen[model] = true
+		list.Data = append(list.Data, modelInfo{ID: model, Object: "model", OwnedBy: "openai"})
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// HandleChatCompletions handles OpenAI-compatible chat completion requests.
+// Every request is scoped to, and moderated under the policy of, the
+// organization of the X-Organization-ID header.
+// Requests are passed through statelessly unless the X-Session-ID header binds
+// them to a managed conversation, in which case the last user message is added
+// to the session's thread.
+func (h *CompletionsHandler) HandleChatCompletions(c *gin.Context) {
+	var body completionRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		if isBodyTooLarge(err) {
+			h.respondError(c, http.StatusRequestEntityTooLarge, "request_too_large",
+				fmt.Sprintf("The request body must not exceed %d bytes", h.cfg(c.Request.Context()).Limits.MaxBodyBytes))
+			return
+		}
+		h.respondError(c, http.StatusBadRequest, "invalid_request", "Invalid request format: "+redact.String(err.Error()))
+		return
+	}
+
+	req := body.ChatCompletionRequest
+	req.Temperature = openai.Temperature(body.Temperature)
+	requestedModel := req.Model
+	if req.Model == "" {
+		req.Model = h.cfg(c.Request.Context()).DefaultModel
+	}
+	logging.WithFields(c, h.log, logrus.Fields{
+		"organization_id": c.GetHeader(HeaderOrganizationID),
+		"agent_id":        c.GetHeader(HeaderAgentID),
+		"session_id":      c.GetHeader(HeaderSessionID),
+		"user_id":         req.User,
+		"model":           req.Model,
+	})
+	if !h.cfg(c.Request.Context()).IsModelAllowed(req.Model) {
+		h.respondError(c, http.StatusNotFound, "model_not_found", fmt.Sprintf("The model %s is not available", req.Model))
+		return
+	}
+	if len(req.Messages) == 0 {
+		h.respondError(c, http.StatusBadRequest, "validation_error", "messages must not be empty")
+		return
+	}
+	var errs validationErrors
+	errs.requireID(HeaderOrganizationID, c.GetHeader(HeaderOrganizationID))
+	if err := errs.err(); err != nil {
+		h.respondError(c, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.cfg(c.Request.Context()).RequestTimeout)
+	defer cancel()
+
+	// Mask PII before it reaches OpenAI if the organization requires it
+	ctx = redact.WithMasker(ctx, h.redactors.Masker(ctx, c.GetHeader(HeaderOrganizationID)))
+
+	if sessionID := c.GetHeader(HeaderSessionID); sessionID != "" {
+		h.completeSession(ctx, c, &req, sessionID, requestedModel, body.Temperature)
+		return
+	}
+
+	ex := h.newExchange(c, &req)
+	defer h.recordAudit(ctx, ex)
+	if err := h.moderate(ctx, ex, moderation.StageInput, userContent(req.Messages)); err != nil {
+		h.respondProcessingError(c, ex.fail(err))
+		return
+	}
+
+	// Replies that moderation may block aren't streamed, since they must be
+	// checked before the caller sees any of them
+	if req.Stream && !h.moderation.Blocks(ctx, ex.organizationID, moderation.StageOutput) {
+		started := false
+		var content strings.Builder
+		usage, err := h.openaiClient.CreateChatCompletionStream(ctx, req, func(chunk goopenai.ChatCompletionStreamResponse) error {
+			if !started {
+				startSSE(c)
+				started = true
+			}
+			ex.responseID = chunk.ID
+			for _, choice := range chunk.Choices {
+				content.WriteString(choice.Delta.Content)
+			}
+			return writeSSE(c, chunk)
+		})
+		// Tokens of a stream that failed part way were still used
+		if started || err == nil {
+			h.recordUsage(c, req.Model, usage)
+			ex.model, ex.usage, ex.reply = req.Model, usage, content.String()
+		}
+		if err == nil {
+			err = h.moderate(ctx, ex, moderation.StageOutput, content.String())
+		}
+		h.finishStream(c, started, ex.fail(err))
+		return
+	}
+
+	resp, err := h.openaiClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		h.respondProcessingError(c, ex.fail(err))
+		return
+	}
+	h.recordUsage(c, req.Model, resp.Usage)
+	replies := make([]string, len(resp.Choices))
+	for i, choice := range resp.Choices {
+		replies[i] = choice.Message.Content
+	}
+	ex.responseID, ex.model, ex.usage, ex.reply = resp.ID, req.Model, resp.Usage, strings.Join(replies, "\n\n")
+	if err := h.moderate(ctx, ex, moderation.StageOutput, ex.reply); err != nil {
+		h.respondProcessingError(c, ex.fail(err))
+		return
+	}
+	if req.Stream {
+		h.finishStream(c, true, ex.fail(writeCompletionStream(c, resp)))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// completionRequest is a chat completion request as callers send it. The
+// OpenAI client can't tell a temperature of 0 from none, so the temperature
+// is decoded on its own.
+type completionRequest struct {
+	goopenai.ChatCompletionRequest
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// completionExchange collects the outcome of a chat completion request for
+// the audit trail
+type completionExchange struct {
+	start          time.Time
+	organizationID string
+	agentID        string
+	sessionID      string
+	userID         string
+	// message is the request's last message
+	message        string
+	conversationID string
+	responseID     string
+	model          string
+	usage          goopenai.Usage
+	cached         bool
+	reply          string
+	// moderated is set if the input was moderated, and flagged lists the
+	// categories content was flagged for
+	moderated bool
+	flagged   []string
+	err       error
+}
+
+// newExchange starts collecting the outcome of a chat completion request
+func (h *CompletionsHandler) newExchange(c *gin.Context, req *goopenai.ChatCompletionRequest) *completionExchange {
+	return &completionExchange{
+		start:          time.Now(),
+		organizationID: c.GetHeader(HeaderOrganizationID),
+		agentID:        c.GetHeader(HeaderAgentID),
+		sessionID:      c.GetHeader(HeaderSessionID),
+		userID:         req.User,
+		message:        req.Messages[len(req.Messages)-1].Content,
+	}
+}
+
+// fail records the error the exchange failed with, if any, and returns it
+func (ex *completionExchange) fail(err error) error {
+	if err != nil {
+		ex.err = err
+	}
+	return err
+}
+
+// moderate moderates text at a stage under the organization's policy,
+// recording the categories it was flagged for. It returns the error of
+// blocked content.
+func (h *CompletionsHandler) moderate(ctx context.Context, ex *completionExchange, stage, text string) error {
+	if stage == moderation.StageInput {
+		ex.moderated = h.moderation.Enabled(ctx, ex.organizationID, stage)
+	}
+	verdict, err := h.moderation.Check(ctx, ex.organizationID, stage, text)
+	if verdict != nil {
+		ex.flagged = append(ex.flagged, verdict.Categories...)
+	}
+	return err
+}
+
+// recordAudit writes a chat completion exchange to the audit trail, if enabled
+func (h *CompletionsHandler) recordAudit(ctx context.Context, ex *completionExchange) {
+	if h.auditSink == nil {
+		return
+	}
+
+	record := &audit.Record{
+		ID:             utils.GenerateUUID(),
+		Time:           ex.start.UTC(),
+		RequestID:      logging.RequestID(ctx),
+		Channel:        "v1",
+		OrganizationID: ex.organizationID,
+		UserID:         ex.userID,
+		AgentID:        ex.agentID,
+		SessionID:      ex.sessionID,
+		ConversationID: ex.conversationID,
+		ResponseID:     ex.responseID,
+		Model:          ex.model,
+		TokensUsed:     ex.usage.TotalTokens,
+		Cost:           h.cfg(ctx).Cost(ex.model, ex.usage.PromptTokens, ex.usage.CompletionTokens),
+		Cached:         ex.cached,
+		DurationMs:     time.Since(ex.start).Milliseconds(),
+		Status:         "success",
+		Moderation:     audit.ModerationDisabled,
+		MessageHash:    audit.Hash(ex.message),
+		ResponseHash:   audit.Hash(ex.reply),
+	}
+	if ex.moderated {
+		record.Moderation = audit.ModerationPassed
+	}
+	if len(ex.flagged) > 0 {
+		record.Moderation = audit.ModerationFlagged
+		record.ModerationCategories = ex.flagged
+	}
+
+	var blocked *moderation.BlockedError
+	switch {
+	case errors.Is(ex.err, openai.ErrRunCancelled):
+		record.Status = "cancelled"
+	case errors.As(ex.err, &blocked):
+		record.Status = "error"
+		record.ErrorCode = "content_blocked"
+		record.Moderation = audit.ModerationBlocked
+		record.ModerationCategories = blocked.Categories
+	case ex.err != nil:
+		_, errResponse := errorResponse(ex.sessionID, ex.err)
+		record.Status = errResponse.Status
+		record.ErrorCode = errResponse.Error.Code
+	}
+
+	if h.cfg(ctx).PolicyFor(ex.organizationID).Audit.IncludeContent {
+		record.Message = ex.message
+		record.Response = ex.reply
+	}
+
+	// Exchanges that were cancelled or timed out are recorded all the same
+	if err := h.auditSink.Write(context.WithoutCancel(ctx), record); err != nil {
+		metrics.AuditWriteErrors.Inc()
+		logging.FromContext(ctx, h.log).Errorf("Failed to write audit record: %v", err)
+	}
+}
+
+// userContent returns the content of the user messages of a request, which
+// is moderated as the request's input
+func userContent(messages []goopenai.ChatCompletionMessage) string {
+	var content []string
+	for _, message := range messages {
+		if message.Role == goopenai.ChatMessageRoleUser && message.Content != "" {
+			content = append(content, message.Content)
+		}
+	}
+	return strings.Join(content, "\n\n")
+}
+
+// completeSession runs the request's last user message against a managed
+// session. A leading system message is sent as the system prompt, and the
+// messages before the last one must repeat the session's conversation, which
+// they start if the session is new. The request is prepared and processed like
+// a chat request, so it runs with the registered agent and under the same
+// limits and prompt injection checks. requestedModel and temperature are the
+// model and temperature the caller asked for, if any.
+func (h *CompletionsHandler) completeSession(ctx context.Context, c *gin.Context, req *goopenai.ChatCompletionRequest, sessionID, requestedModel string, temperature *float64) {
+	organizationID := c.GetHeader(HeaderOrganizationID)
+	agentID := c.GetHeader(HeaderAgentID)
+	var errs validationErrors
+	errs.requireID(HeaderSessionID, sessionID)
+	errs.requireID(HeaderAgentID, agentID)
+	errs.requireID("user", req.User)
+	systemPrompt, history, question := sessionMessages(req.Messages, &errs)
+	if err := errs.err(); err != nil {
+		h.respondError(c, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	chatReq := sessionChatRequest(c, req, sessionID, requestedModel, temperature, systemPrompt, history, question)
+	ctx, err := h.sessions.prepareRequest(ctx, chatReq)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
+
+	runCtx, done, err := h.openaiClient.StartRun(ctx, sessionID, organizationID, req.User)
+	if err != nil {
+		h.respondProcessingError(c, err)
+		return
+	}
+	defer done()
+
+	// Sessions belong to the organization and user that started them
+	others := h.openaiClient.Threads(func(thread *models.ThreadInfo) bool {
+		return thread.SessionID == sessionID && (thread.OrganizationID != organizationID || thread.UserID != req.User)
+	})
+	if len(others) > 0 {
+		h.respondError(c, http.StatusNotFound, "not_found", fmt.Sprintf("Session %s not found", sessionID))
+		return
+	}
+	if h.conflictsWithSession(sessionID, history) {
+		h.respondError(c, http.StatusConflict, "conversation_mismatch",
+			"The messages before the last one must repeat the session's conversation")
+		return
+	}
+
+	ex := h.newExchange(c, req)
+	ex.responseID = "chatcmpl-" + utils.GenerateUUID()
+	ex.moderated = h.moderation.Enabled(runCtx, organizationID, moderation.StageInput)
+	defer h.recordAudit(runCtx, ex)
+
+	created := time.Now().Unix()
+	chunk := func(delta goopenai.ChatCompletionStreamChoiceDelta, finishReason goopenai.FinishReason) goopenai.ChatCompletionStreamResponse {
+		return goopenai.ChatCompletionStreamResponse{
+			ID:      ex.responseID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []goopenai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finishReason}},
+		}
+	}
+
+	// Replies that moderation may block aren't streamed, since they must be
+	// checked before the caller sees any of them
+	if req.Stream && !h.moderation.Blocks(runCtx, organizationID, moderation.StageOutput) {
+		startSSE(c)
+		err := writeSSE(c, chunk(goopenai.ChatCompletionStreamChoiceDelta{Role: goopenai.ChatMessageRoleAssistant}, ""))
+		if err == nil {
+			err = h.runSession(runCtx, ex, chatReq, &chatEvents{onDelta: func(delta string) error {
+				return writeSSE(c, chunk(goopenai.ChatCompletionStreamChoiceDelta{Content: delta}, ""))
+			}})
+		}
+		if err == nil {
+			err = writeSSE(c, chunk(goopenai.ChatCompletionStreamChoiceDelta{}, goopenai.FinishReasonStop))
+		}
+		h.finishStream(c, true, ex.fail(err))
+		return
+	}
+
+	if err := h.runSession(runCtx, ex, chatReq, nil); err != nil {
+		h.respondProcessingError(c, ex.fail(err))
+		return
+	}
+
+	resp := goopenai.ChatCompletionResponse{
+		ID:      ex.responseID,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   ex.model,
+		Choices: []goopenai.ChatCompletionChoice{{
+			Message: goopenai.ChatCompletionMessage{
+				Role:    goopenai.ChatMessageRoleAssistant,
+				Content: ex.reply,
+			},
+			FinishReason: goopenai.FinishReasonStop,
+		}},
+		Usage: ex.usage,
+	}
+	if req.Stream {
+		h.finishStream(c, true, ex.fail(writeCompletionStream(c, resp)))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// runSession processes a session's chat request like the chat handler does,
+// recording its outcome in the exchange and in the agent's experiment. The
+// reply is streamed to events, if not nil, and identified by the exchange's
+// response ID.
+func (h *CompletionsHandler) runSession(runCtx context.Context, ex *completionExchange, req *models.ChatRequest, events *chatEvents) error {
+	start := time.Now()
+	response, err := h.sessions.processChat(runCtx, req, ex.responseID, events)
+	err = h.runError(runCtx, err)
+	h.sessions.recordVariant(runCtx, req, response, err, start)
+	if response == nil {
+		return err
+	}
+
+	ex.conversationID = response.ConversationID
+	ex.model, ex.cached, ex.reply = response.Metadata.Model, response.Metadata.Cached, response.Response
+	ex.usage = goopenai.Usage{
+		PromptTokens:     response.Metadata.PromptTokens,
+		CompletionTokens: response.Metadata.CompletionTokens,
+		TotalTokens:      response.Metadata.TokensUsed,
+	}
+	for _, flagged := range response.Metadata.Moderation {
+		ex.flagged = append(ex.flagged, flagged.Categories...)
+	}
+	return err
+}
+
+// sessionChatRequest returns the chat request a completion request bound to
+// a session makes, with the system prompt as the agent's instructions and the
+// messages before the last one as its chat history
+func sessionChatRequest(c *gin.Context, req *goopenai.ChatCompletionRequest, sessionID, requestedModel string, temperature *float64, systemPrompt string, history []models.ChatEntry, question string) *models.ChatRequest {
+	return &models.ChatRequest{
+		OrganizationID: c.GetHeader(HeaderOrganizationID),
+		AgentID:        c.GetHeader(HeaderAgentID),
+		UserID:         req.User,
+		SessionID:      sessionID,
+		Message:        question,
+		Context: models.Context{
+			AgentConfig: models.AgentConfig{
+				AIProvider:   "chatgpt",
+				Instructions: systemPrompt,
+				Model:        requestedModel,
+				Temperature:  temperature,
+				MaxTokens:    req.MaxTokens,
+			},
+			ChatHistory: history,
+		},
+		Metadata: models.Metadata{RequestID: logging.RequestID(c.Request.Context())},
+	}
+}
+
+// sessionMessages splits the messages of a request bound to a session into
+// its system prompt, the conversation before the last message and the last
+// message, recording errors in messages that can't be sent to a session
+func sessionMessages(messages []goopenai.ChatCompletionMessage, errs *validationErrors) (string, []models.ChatEntry, string) {
+	var systemPrompt string
+	first := 0
+	if messages[0].Role == goopenai.ChatMessageRoleSystem {
+		systemPrompt = messages[0].Content
+		first = 1
+	}
+	last := messages[len(messages)-1]
+	if first == len(messages) || last.Role != goopenai.ChatMessageRoleUser || last.Content == "" {
+		errs.add("messages", "must end with a non-empty user message")
+		return "", nil, ""
+	}
+
+	history := make([]models.ChatEntry, 0, len(messages)-first-1)
+	for i := first; i < len(messages)-1; i++ {
+		message := messages[i]
+		if !chatHistoryRoles[message.Role] {
+			errs.add(fmt.Sprintf("messages[%d].role", i), "must be user or assistant after the first message")
+			continue
+		}
+		history = append(history, models.ChatEntry{Role: message.Role, Content: message.Content})
+	}
+	return systemPrompt, history, last.Content
+}
+
+// conflictsWithSession reports whether history doesn't repeat the messages
+// of a session whose thread already has some. History may be left out of
+// requests to such sessions, and starts the conversation of sessions without
+// messages.
+func (h *CompletionsHandler) conflictsWithSession(sessionID string, history []models.ChatEntry) bool {
+	if len(history) == 0 {
+		return false
+	}
+	threads := h.openaiClient.Threads(func(thread *models.ThreadInfo) bool {
+		return thread.SessionID == sessionID
+	})
+	if len(threads) != 1 || len(threads[0].Messages) == 0 {
+		return false
+	}
+	if len(threads[0].Messages) != len(history) {
+		return true
+	}
+	for i, message := range threads[0].Messages {
+		if message.Role != history[i].Role || message.Content != history[i].Content {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUsage records the tokens and cost of a completion under the
+// organization and agent headers, if the caller sent them
+func (h *CompletionsHandler) recordUsage(c *gin.Context, model string, usage goopenai.Usage) {
+	cost := h.cfg(c.Request.Context()).Cost(model, usage.PromptTokens, usage.CompletionTokens)
+	metrics.RecordUsage(c.GetHeader(HeaderOrganizationID), c.GetHeader(HeaderAgentID), model, usage.PromptTokens, usage.CompletionTokens, cost)
+}
+
+// runError replaces the error of a cancelled run with its cancellation cause
+func (h *CompletionsHandler) runError(runCtx context.Context, err error) error {
+	if err != nil && openai.IsCancelled(runCtx) {
+		return context.Cause(runCtx)
+	}
+	return err
+}
+
+// finishStream terminates a server-sent event stream, reporting err in the
+// stream if it had already started
+func (h *CompletionsHandler) finishStream(c *gin.Context, started bool, err error) {
+	if err != nil {
+		if !started {
+			h.respondProcessingError(c, err)
+			return
+		}
+		logging.FromContext(c.Request.Context(), h.log).Errorf("Error streaming chat completion: %v", err)
+		status, apiErr := openAIError(err)
+		apiErr.HTTPStatusCode = status
+		_ = writeSSE(c, goopenai.ErrorResponse{Error: apiErr})
+	}
+
+	_, _ = fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+// respondProcessingError responds with the OpenAI-style error for a processing error
+func (h *CompletionsHandler) respondProcessingError(c *gin.Context, err error) {
+	logging.FromContext(c.Request.Context(), h.log).Errorf("Error processing chat completion: %v", err)
+	status, apiErr := openAIError(err)
+	c.JSON(status, goopenai.ErrorResponse{Error: apiErr})
+}
+
+// respondError responds with an OpenAI-style error
+func (h *CompletionsHandler) respondError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, goopenai.ErrorResponse{Error: &goopenai.APIError{
+		Code:    code,
+		Message: message,
+		Type:    openAIErrorType(status),
+	}})
+}
+
+// openAIError maps a processing error onto an HTTP status and OpenAI-style error
+func openAIError(err error) (int, *goopenai.APIError) {
+	if errors.Is(err, openai.ErrRunCancelled) {
+		return http.StatusConflict, &goopenai.APIError{
+			Code:    "cancelled",
+			Message: "The request was cancelled",
+			Type:    openAIErrorType(http.StatusConflict),
+		}
+	}
+
+	status, response := errorResponse("", err)
+	return status, &goopenai.APIError{
+		Code:    response.Error.Code,
+		Message: fmt.Sprintf("%s: %s", response.Error.Message, response.Error.Details),
+		Type:    openAIErrorType(status),
+	}
+}
+
+// openAIErrorType returns the OpenAI error type for an HTTP status
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// startSSE writes the headers of a server-sent event stream
+func startSSE(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+}
+
+// writeCompletionStream starts a server-sent event stream and sends a
+// completion as a single chunk, for replies that had to be complete before
+// the caller saw any of them
+func writeCompletionStream(c *gin.Context, resp goopenai.ChatCompletionResponse) error {
+	startSSE(c)
+	chunk := goopenai.ChatCompletionStreamResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion.chunk",
+		Created: resp.Created,
+		Model:   resp.Model,
+	}
+	for _, choice := range resp.Choices {
+		chunk.Choices = append(chunk.Choices, goopenai.ChatCompletionStreamChoice{
+			Index: choice.Index,
+			Delta: goopenai.ChatCompletionStreamChoiceDelta{
+				Role:    choice.Message.Role,
+				Content: choice.Message.Content,
+			},
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return writeSSE(c, chunk)
+}
+
+// writeSSE writes v as a single server-sent event
+func writeSSE(c *gin.Context, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/moderation"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+)
+
+// errorMapping describes how an error kind is reported to callers
+type errorMapping struct {
+	kind       error
+	httpStatus int
+	status     string
+	code       string
+	message    string
+}
+
+// errorMappings maps error kinds from the openai and moderation packages onto HTTP statuses
+// and ErrorInfo codes. The first matching kind wins.
+var errorMappings = []errorMapping{
+	{openai.ErrTimeout, http.StatusGatewayTimeout, "timeout", "timeout", "The request timed out"},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout", "timeout", "The request timed out"},
+	{openai.ErrSessionBusy, http.StatusConflict, "error", "session_busy", "Another request for this session is in progress"},
+	{openai.ErrSessionNotFound, http.StatusNotFound, "error", "not_found", "Session not found"},
+	{openai.ErrRateLimited, http.StatusTooManyRequests, "error", "rate_limited", "The upstream rate limit was exceeded"},
+	{openai.ErrContextLengthExceeded, http.StatusBadRequest, "error", "context_length_exceeded", "The conversation exceeds the model's context length"},
+	{openai.ErrContentFiltered, http.StatusUnprocessableEntity, "error", "content_filtered", "The content was rejected by the upstream content filter"},
+	{openai.ErrAuthFailed, http.StatusBadGateway, "error", "auth_failed", "Authentication with the upstream provider failed"},
+	{openai.ErrUpstreamUnavailable, http.StatusBadGateway, "error", "upstream_unavailable", "The upstream provider is unavailable"},
+	{moderation.ErrContentBlocked, http.StatusUnprocessableEntity, "error", "content_blocked", "The content was blocked by moderation"},
+	{moderation.ErrUnavailable, http.StatusServiceUnavailable, "error", "moderation_unavailable", "The content could not be moderated"},
+}
+
+// errorResponse maps a processing error onto its HTTP status and response.
+// Errors of no known kind are reported as processing errors.
+func errorResponse(sessionID string, err error) (int, models.ChatResponse) {
+	mapping := errorMapping{
+		httpStatus: http.StatusInternalServerError,
+		status:     "error",
+		code:       "processing_error",
+		message:    "Error processing chat request",
+	}
+	for _, m := range errorMappings {
+		if errors.Is(err, m.kind) {
+			mapping = m
+			break
+		}
+	}
+
+	// Timeouts of our own deadline are worth retrying as well
+	retryable := openai.IsRetryable(err) || mapping.code == "timeout" || mapping.code == "session_busy" ||
+		mapping.code == "moderation_unavailable"
+
+	info := &models.ErrorInfo{
+		Code:      mapping.code,
+		Message:   mapping.message,
+		Details:   redact.String(err.Error()),
+		Retryable: retryable,
+	}
+	var blocked *moderation.BlockedError
+	if errors.As(err, &blocked) {
+		info.Categories = blocked.Categories
+	}
+
+	return mapping.httpStatus, models.ChatResponse{
+		Status:    mapping.status,
+		SessionID: sessionID,
+		Error:     info,
+	}
+}
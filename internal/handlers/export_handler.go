@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/transcripts"
+	"github.com/sirupsen/logrus"
+)
+
+// ExportHandler exports conversations from the thread cache
+type ExportHandler struct {
+	openaiClient openai.ClientInterface
+	log          *logrus.Logger
+	configs      *config.Store
+	// started is when the instance started caching threads
+	started time.Time
+}
+
+// NewExportHandler creates a new export handler
+func NewExportHandler(openaiClient openai.ClientInterface, log *logrus.Logger, configs *config.Store) *ExportHandler {
+	return &ExportHandler{
+		openaiClient: openaiClient,
+		log:          log,
+		configs:      configs,
+		started:      time.Now(),
+	}
+}
+
+// heldSince returns the time since when the instance holds every
+// conversation that was active on it: when it started, or the thread TTL
+// ago, since threads unused for longer are evicted
+func (h *ExportHandler) heldSince(cfg *config.Config) time.Time {
+	since := time.Now().Add(-cfg.ThreadTTL)
+	if since.Before(h.started) {
+		return h.started
+	}
+	return since
+}
+
+// HandleExportSession returns the transcript of a session in the organization
+// given by the organizationId query parameter, in the format given by the
+// format query parameter: json (the default), jsonl, markdown or html
+func (h *ExportHandler) HandleExportSession(c *gin.Context) {
+	sessionID := c.Param("id")
+	organizationID := c.Query("organizationId")
+	format := c.DefaultQuery("format", transcripts.FormatJSON)
+
+	var errs validationErrors
+	errs.requireID("id", sessionID)
+	errs.requireID("organizationId", organizationID)
+	contentType, err := transcripts.ContentType(format)
+	if err != nil {
+		errs.add("format", "must be one of %s, %s, %s or %s", transcripts.FormatJSON, transcripts.FormatJSONL, transcripts.FormatMarkdown, transcripts.FormatHTML)
+	}
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return
+	}
+
+	threads := h.openaiClient.Threads(func(thread *models.ThreadInfo) bool {
+		return thread.SessionID == sessionID && thread.OrganizationID == organizationID
+	})
+	if len(threads) == 0 {
+		respondAdminError(c, http.StatusNotFound, "not_found", "No conversation with this session ID in the organization")
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", transcripts.Filename(sessionID, format)))
+	c.Status(http.StatusOK)
+	if err := transcripts.New(threads[0]).Write(c.Writer, format); err != nil {
+		logging.FromContext(c.Request.Context(), h.log).Errorf("Failed to write transcript: %v", err)
+	}
+}
+
+// HandleExportDataset returns the conversations of the organization given by
+// the organizationId query parameter as an OpenAI chat fine-tuning dataset in
+// JSONL format. The conversations can be narrowed to an agent with the
+// agentId query parameter, to those active in the time range from
+// (inclusive) to (exclusive) in RFC 3339 format, and with feedback=positive
+// to those whose replies got only positive feedback. Since conversations are
+// only exported from the thread cache, from is required and can't be earlier
+// than the time since which the instance holds every conversation.
+func (h *ExportHandler) HandleExportDataset(c *gin.Context) {
+	organizationID := c.Query("organizationId")
+	agentID := c.Query("agentId")
+	feedback := c.DefaultQuery("feedback", "any")
+
+	var errs validationErrors
+	errs.requireID("organizationId", organizationID)
+	if agentID != "" {
+		errs.requireID("agentId", agentID)
+	}
+	from := parseTimeParam(c, "from", &errs)
+	to := parseTimeParam(c, "to", &errs)
+	if feedback != "any" && feedback != "positive" {
+		errs.add("feedback", "must be 'any' or 'positive'")
+	}
+	if err := errs.err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationErrorInfo(err)})
+		return
+	}
+	if since := h.heldSince(h.configs.For(c.Request.Context())); from.Before(since) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": &models.ErrorInfo{
+			Code:    "range_not_covered",
+			Message: "This instance doesn't hold every conversation of the time range",
+			Details: fmt.Sprintf("from must be %s or later", since.UTC().Truncate(time.Second).Add(time.Second).Format(time.RFC3339)),
+		}})
+		return
+	}
+
+	threads := h.openaiClient.Threads(func(thread *models.ThreadInfo) bool {
+		return thread.OrganizationID == organizationID &&
+			(agentID == "" || thread.AgentID == agentID) &&
+			(from.IsZero() || !thread.LastUsed.Before(from)) &&
+			(to.IsZero() || thread.CreatedAt.Before(to))
+	})
+
+	c.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", organizationID+"-fine-tuning.jsonl"))
+	c.Status(http.StatusOK)
+	exported := 0
+	for _, thread := range threads {
+		if feedback == "positive" && !transcripts.HasPositiveFeedback(thread) {
+			continue
+		}
+		written, err := transcripts.WriteFineTuning(c.Writer, thread)
+		if err != nil {
+			logging.FromContext(c.Request.Context(), h.log).Errorf("Failed to write fine-tuning dataset: %v", err)
+			return
+		}
+		if written {
+			exported++
+		}
+	}
+	logging.FromContext(c.Request.Context(), h.log).WithFields(logrus.Fields{
+		"organization_id": organizationID,
+		"agent_id":        agentID,
+		"conversations":   exported,
+	}).Info("Exported fine-tuning dataset")
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	goopenai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExportRouter serves the export endpoints over mock threads, held since
+// March 1, 2024
+func newExportRouter(threads []*models.ThreadInfo) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	mockClient := openai.NewMockClient(log)
+	mockClient.ThreadsFunc = func(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo {
+		var matched []*models.ThreadInfo
+		for _, thread := range threads {
+			if match(thread) {
+				matched = append(matched, thread)
+			}
+		}
+		return matched
+	}
+	started := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	handler := NewExportHandler(mockClient, log, config.NewStore(&config.Config{ThreadTTL: time.Since(started) + time.Hour}, nil))
+	handler.started = started
+	router := gin.New()
+	router.GET("/sessions/:id/export", handler.HandleExportSession)
+	router.GET("/admin/export", handler.HandleExportDataset)
+	return router
+}
+
+// exportThread returns a thread with an exchange on a day, with feedback on
+// the reply unless thumbs is ""
+func exportThread(sessionID, agentID string, day int, thumbs string) *models.ThreadInfo {
+	start := time.Date(2024, 3, day, 12, 0, 0, 0, time.UTC)
+	reply := models.ThreadMessage{
+		ChatCompletionMessage: goopenai.ChatCompletionMessage{Role: goopenai.ChatMessageRoleAssistant, Content: "Reply in " + sessionID},
+		Time:                  start,
+		ResponseID:            "resp-" + sessionID,
+		Model:                 "gpt-4",
+		TokensUsed:            10,
+	}
+	if thumbs != "" {
+		reply.Feedback = &models.Feedback{Thumbs: thumbs}
+	}
+	return &models.ThreadInfo{
+		ThreadID:       sessionID,
+		SessionID:      sessionID,
+		OrganizationID: "org123",
+		AgentID:        agentID,
+		UserID:         "user123",
+		CreatedAt:      start,
+		LastUsed:       start,
+		Messages: []models.ThreadMessage{
+			{ChatCompletionMessage: goopenai.ChatCompletionMessage{Role: goopenai.ChatMessageRoleUser, Content: "Question in " + sessionID}, Time: start},
+			reply,
+		},
+	}
+}
+
+func TestHandleExportSession(t *testing.T) {
+	router := newExportRouter([]*models.ThreadInfo{exportThread("session1", "agent123", 1, "up")})
+
+	testCases := []struct {
+		name                string
+		path                string
+		expectedStatus      int
+		expectedContentType string
+		expectedFilename    string
+		expectedCode        string
+	}{
+		{
+			name:                "Default format",
+			path:                "/sessions/session1/export?organizationId=org123",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "application/json; charset=utf-8",
+			expectedFilename:    `attachment; filename="session1.json"`,
+		},
+		{
+			name:                "Markdown",
+			path:                "/sessions/session1/export?organizationId=org123&format=markdown",
+			expectedStatus:      http.StatusOK,
+			expectedContentType: "text/markdown; charset=utf-8",
+			expectedFilename:    `attachment; filename="session1.md"`,
+		},
+		{
+			name:           "Session of another organization",
+			path:           "/sessions/session1/export?organizationId=org456",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   "not_found",
+		},
+		{
+			name:           "Unknown format",
+			path:           "/sessions/session1/export?organizationId=org123&format=pdf",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_error",
+		},
+		{
+			name:           "Missing organization",
+			path:           "/sessions/session1/export",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_error",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveJSON(router, "GET", tc.path, "")
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			if tc.expectedCode != "" {
+				var response struct {
+					Error models.ErrorInfo `json:"error"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tc.expectedCode, response.Error.Code)
+				return
+			}
+			assert.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, tc.expectedFilename, w.Header().Get("Content-Disposition"))
+			assert.Contains(t, w.Body.String(), "Reply in session1")
+		})
+	}
+}
+
+func TestHandleExportDataset(t *testing.T) {
+	router := newExportRouter([]*models.ThreadInfo{
+		exportThread("session1", "agent123", 1, "up"),
+		exportThread("session2", "agent123", 2, ""),
+		exportThread("session3", "agent123", 3, "down"),
+		exportThread("session4", "agent456", 4, "up"),
+	})
+
+	testCases := []struct {
+		name             string
+		query            string
+		expectedStatus   int
+		expectedSessions []string
+	}{
+		{
+			name:             "Whole organization",
+			query:            "organizationId=org123&from=2024-03-01T00:00:00Z",
+			expectedStatus:   http.StatusOK,
+			expectedSessions: []string{"session1", "session2", "session3", "session4"},
+		},
+		{
+			name:             "Agent and time range",
+			query:            "organizationId=org123&agentId=agent123&from=2024-03-02T00:00:00Z&to=2024-03-04T00:00:00Z",
+			expectedStatus:   http.StatusOK,
+			expectedSessions: []string{"session2", "session3"},
+		},
+		{
+			name:             "Positive feedback only",
+			query:            "organizationId=org123&from=2024-03-01T00:00:00Z&feedback=positive",
+			expectedStatus:   http.StatusOK,
+			expectedSessions: []string{"session1", "session4"},
+		},
+		{
+			name:             "Another organization",
+			query:            "organizationId=org456&from=2024-03-01T00:00:00Z",
+			expectedStatus:   http.StatusOK,
+			expectedSessions: nil,
+		},
+		{
+			name:           "Range starting before the instance holds conversations",
+			query:          "organizationId=org123&from=2024-02-01T00:00:00Z",
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Range without a start",
+			query:          "organizationId=org123",
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Invalid parameters",
+			query:          "organizationId=org123&from=yesterday&feedback=mixed",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveJSON(router, "GET", "/admin/export?"+tc.query, "")
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "application/x-ndjson; charset=utf-8", w.Header().Get("Content-Type"))
+
+			var sessions []string
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var example struct {
+					Messages []struct {
+						Role    string `json:"role"`
+						Content string `json:"content"`
+					} `json:"messages"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &example))
+				require.Len(t, example.Messages, 2)
+				assert.Equal(t, "assistant", example.Messages[1].Role)
+				sessions = append(sessions, strings.TrimPrefix(example.Messages[1].Content, "Reply in "))
+			}
+			assert.Equal(t, tc.expectedSessions, sessions)
+		})
+	}
+}
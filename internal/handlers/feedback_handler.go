@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFeedbackCommentLength is the maximum length of feedback comments in characters
+const maxFeedbackCommentLength = 4000
+
+// FeedbackHandler handles users' feedback on replies
+type FeedbackHandler struct {
+	openaiClient openai.ClientInterface
+	auditSink    audit.Sink
+	experiments  *experiments.Recorder
+	log          *logrus.Logger
+	configs      *config.Store
+}
+
+// NewFeedbackHandler creates a new feedback handler. Feedback is recorded in
+// the audit sink unless it is nil, and attributed to variants of agents
+// unless experimentRecorder is nil.
+func NewFeedbackHandler(openaiClient openai.ClientInterface, auditSink audit.Sink, experimentRecorder *experiments.Recorder, log *logrus.Logger, configs *config.Store) *FeedbackHandler {
+	return &FeedbackHandler{
+		openaiClient: openaiClient,
+		auditSink:    auditSink,
+		experiments:  experimentRecorder,
+		log:          log,
+		configs:      configs,
+	}
+}
+
+// HandleFeedback records a user's feedback on a reply in a session. Later
+// feedback on the same reply replaces earlier feedback.
+func (h *FeedbackHandler) HandleFeedback(c *gin.Context) {
+	var req models.FeedbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.FeedbackResponse{
+			Status: "error",
+			Error: &models.ErrorInfo{
+				Code:    "invalid_request",
+				Message: "Invalid request format",
+				Details: redact.String(err.Error()),
+			},
+		})
+		return
+	}
+	logging.WithFields(c, h.log, logrus.Fields{
+		"organization_id": req.OrganizationID,
+		"session_id":      req.SessionID,
+		"response_id":     req.ResponseID,
+	})
+	if err := validateFeedback(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.FeedbackResponse{
+			Status:     "error",
+			SessionID:  req.SessionID,
+			ResponseID: req.ResponseID,
+			Error:      validationErrorInfo(err),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	feedback := models.Feedback{
+		Thumbs:  req.Thumbs,
+		Rating:  req.Rating,
+		Comment: req.Comment,
+		Time:    time.Now().UTC(),
+	}
+	reply, err := h.attachFeedback(ctx, &req, feedback)
+	if errors.Is(err, openai.ErrResponseNotFound) {
+		c.JSON(http.StatusNotFound, models.FeedbackResponse{
+			Status:     "error",
+			SessionID:  req.SessionID,
+			ResponseID: req.ResponseID,
+			Error: &models.ErrorInfo{
+				Code:    "not_found",
+				Message: "No reply with this response ID in the session",
+			},
+		})
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx, h.log).Errorf("Failed to find the reply feedback is on: %v", err)
+		c.JSON(http.StatusInternalServerError, models.FeedbackResponse{
+			Status:     "error",
+			SessionID:  req.SessionID,
+			ResponseID: req.ResponseID,
+			Error: &models.ErrorInfo{
+				Code:      "processing_error",
+				Message:   "Failed to record the feedback",
+				Retryable: true,
+			},
+		})
+		return
+	}
+
+	exchange := reply.exchange
+	// Metrics can't take feedback back, so they count the first feedback on
+	// each reply
+	if reply.previous == nil {
+		metrics.RecordFeedback(exchange.OrganizationID, exchange.AgentID, feedback.Thumbs, feedback.Rating)
+	}
+	if h.experiments != nil && !h.experiments.RecordFeedback(req.ResponseID, feedback) && reply.variant != "" && reply.previous == nil {
+		h.experiments.AttributeFeedback(exchange.OrganizationID, exchange.AgentID, reply.experiment, reply.variant, req.ResponseID, feedback)
+	}
+	h.recordAudit(ctx, reply, req.ResponseID, feedback)
+	logging.FromContext(ctx, h.log).WithField("agent_id", exchange.AgentID).Info("Recorded feedback")
+
+	c.JSON(http.StatusOK, models.FeedbackResponse{
+		Status:     "success",
+		SessionID:  req.SessionID,
+		ResponseID: req.ResponseID,
+	})
+}
+
+// ratedReply is the reply feedback is on
+type ratedReply struct {
+	// exchange is the thread of the reply, without its messages
+	exchange *models.ThreadInfo
+	// experiment and variant are the variant of the agent the reply came
+	// from, if known
+	experiment string
+	variant    string
+	// previous is the earlier feedback on the reply, if any
+	previous *models.Feedback
+}
+
+// attachFeedback attaches feedback to the reply it is on in the session's
+// cached thread and returns the reply. Replies in threads that are no longer
+// cached, e.g. because they expired or were served by another instance, are
+// looked up in the audit trail.
+func (h *FeedbackHandler) attachFeedback(ctx context.Context, req *models.FeedbackRequest, feedback models.Feedback) (*ratedReply, error) {
+	thread, previous, err := h.openaiClient.SetFeedback(ctx, req.OrganizationID, req.SessionID, req.ResponseID, feedback)
+	if err == nil {
+		return &ratedReply{exchange: thread, previous: previous}, nil
+	}
+	if !errors.Is(err, openai.ErrResponseNotFound) || h.auditSink == nil {
+		return nil, err
+	}
+
+	// Records are scanned most recent first, so the latest feedback on the
+	// reply comes before the exchange
+	var reply *ratedReply
+	var latest *models.Feedback
+	filter := audit.Filter{OrganizationID: req.OrganizationID, SessionID: req.SessionID}
+	err = audit.Scan(ctx, h.auditSink, filter, func(record *audit.Record) bool {
+		if record.ResponseID != req.ResponseID {
+			return true
+		}
+		switch record.Kind {
+		case audit.KindFeedback:
+			if latest == nil {
+				latest = record.Feedback
+			}
+		case audit.KindExchange:
+			reply = &ratedReply{
+				exchange: &models.ThreadInfo{
+					ThreadID:       record.ConversationID,
+					SessionID:      record.SessionID,
+					OrganizationID: record.OrganizationID,
+					AgentID:        record.AgentID,
+					UserID:         record.UserID,
+				},
+				experiment: record.Experiment,
+				variant:    record.Variant,
+				previous:   latest,
+			}
+			return false
+		}
+		return true
+	})
+	if errors.Is(err, audit.ErrQueryUnsupported) {
+		return nil, openai.ErrResponseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, openai.ErrResponseNotFound
+	}
+	return reply, nil
+}
+
+// recordAudit appends feedback to the audit trail, next to the exchange it is
+// on. Failures are logged rather than failing the request, since the feedback
+// has been recorded with the thread.
+func (h *FeedbackHandler) recordAudit(ctx context.Context, reply *ratedReply, responseID string, feedback models.Feedback) {
+	if h.auditSink == nil {
+		return
+	}
+	exchange := reply.exchange
+	if !h.configs.For(ctx).PolicyFor(exchange.OrganizationID).Audit.IncludeContent {
+		feedback.Comment = ""
+	}
+
+	record := &audit.Record{
+		ID:             utils.GenerateUUID(),
+		Kind:           audit.KindFeedback,
+		Time:           feedback.Time,
+		RequestID:      logging.RequestID(ctx),
+		Channel:        "http",
+		OrganizationID: exchange.OrganizationID,
+		UserID:         exchange.UserID,
+		AgentID:        exchange.AgentID,
+		SessionID:      exchange.SessionID,
+		Experiment:     reply.experiment,
+		Variant:        reply.variant,
+		ConversationID: exchange.ThreadID,
+		ResponseID:     responseID,
+		Feedback:       &feedback,
+	}
+	if err := h.auditSink.Write(context.WithoutCancel(ctx), record); err != nil {
+		metrics.AuditWriteErrors.Inc()
+		logging.FromContext(ctx, h.log).Errorf("Failed to write audit record: %v", err)
+	}
+}
+
+// validateFeedback validates a feedback request, returning validationErrors
+// listing every failing field
+func validateFeedback(req *models.FeedbackRequest) error {
+	var errs validationErrors
+	errs.requireID("organizationId", req.OrganizationID)
+	errs.requireID("sessionId", req.SessionID)
+	errs.requireID("responseId", req.ResponseID)
+
+	if req.Thumbs != "" && req.Thumbs != "up" && req.Thumbs != "down" {
+		errs.add("thumbs", "must be 'up' or 'down'")
+	}
+	if req.Rating != 0 && (req.Rating < models.MinRating || req.Rating > models.MaxRating) {
+		errs.add("rating", "must be between %d and %d", models.MinRating, models.MaxRating)
+	}
+	if utf8.RuneCountInString(req.Comment) > maxFeedbackCommentLength {
+		errs.add("comment", "must not exceed %d characters", maxFeedbackCommentLength)
+	}
+	if req.Thumbs == "" && req.Rating == 0 && req.Comment == "" {
+		errs.add("thumbs", "is required unless there is a rating or comment")
+	}
+	return errs.err()
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/experiments"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleFeedback(t *testing.T) {
+	testCases := []struct {
+		name           string
+		body           string
+		includeContent bool
+		expectedStatus int
+		expectedCode   string
+		expectedFields []string
+		expectedAgent  string
+	}{
+		{
+			name:           "Reply in a cached thread",
+			body:           `{"organizationId": "org123", "sessionId": "session123", "responseId": "cached", "thumbs": "up", "rating": 5, "comment": "Spot on"}`,
+			expectedStatus: http.StatusOK,
+			expectedAgent:  "agent123",
+		},
+		{
+			name:           "Comment recorded with content",
+			body:           `{"organizationId": "org123", "sessionId": "session123", "responseId": "cached", "comment": "Spot on"}`,
+			includeContent: true,
+			expectedStatus: http.StatusOK,
+			expectedAgent:  "agent123",
+		},
+		{
+			name:           "Reply found in the audit trail",
+			body:           `{"organizationId": "org123", "sessionId": "session123", "responseId": "audited", "thumbs": "down"}`,
+			expectedStatus: http.StatusOK,
+			expectedAgent:  "agent456",
+		},
+		{
+			name:           "Reply of another organization",
+			body:           `{"organizationId": "org456", "sessionId": "session123", "responseId": "audited", "thumbs": "down"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   "not_found",
+		},
+		{
+			name:           "Invalid feedback",
+			body:           `{"organizationId": "org123", "sessionId": "session123", "thumbs": "sideways", "rating": 6}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_error",
+			expectedFields: []string{"responseId", "thumbs", "rating"},
+		},
+		{
+			name:           "No feedback",
+			body:           `{"organizationId": "org123", "sessionId": "session123", "responseId": "cached"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_error",
+			expectedFields: []string{"thumbs"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			log := logrus.New()
+			cfg := &config.Config{
+				DefaultPolicy: config.OrgPolicy{Audit: config.AuditPolicy{IncludeContent: tc.includeContent}},
+			}
+
+			sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+			require.NoError(t, err)
+			t.Cleanup(func() { sink.Close() })
+			ctx := context.Background()
+			require.NoError(t, sink.Write(ctx, &audit.Record{
+				ID:             "record1",
+				Time:           time.Now(),
+				OrganizationID: "org123",
+				UserID:         "user456",
+				AgentID:        "agent456",
+				SessionID:      "session123",
+				ResponseID:     "audited",
+				Status:         "success",
+			}))
+
+			mockClient := openai.NewMockClient(log)
+			mockClient.SetFeedbackFunc = func(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error) {
+				if organizationID != "org123" || responseID != "cached" {
+					return nil, nil, openai.ErrResponseNotFound
+				}
+				return &models.ThreadInfo{
+					ThreadID:       sessionID,
+					SessionID:      sessionID,
+					OrganizationID: organizationID,
+					AgentID:        "agent123",
+					UserID:         "user123",
+				}, nil, nil
+			}
+			handler := NewFeedbackHandler(mockClient, sink, experiments.NewRecorder(), log, config.NewStore(cfg, nil))
+			router := gin.New()
+			router.POST("/feedback", handler.HandleFeedback)
+
+			w := serveJSON(router, "POST", "/feedback", tc.body)
+			require.Equal(t, tc.expectedStatus, w.Code, w.Body.String())
+			var response models.FeedbackResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+			records, err := sink.Query(ctx, audit.Filter{})
+			require.NoError(t, err)
+			if tc.expectedCode != "" {
+				assert.Equal(t, "error", response.Status)
+				assert.Equal(t, tc.expectedCode, response.Error.Code)
+				var fields []string
+				for _, field := range response.Error.Fields {
+					fields = append(fields, field.Field)
+				}
+				assert.Equal(t, tc.expectedFields, fields)
+				assert.Len(t, records, 1)
+				return
+			}
+
+			assert.Equal(t, "success", response.Status)
+			require.Len(t, records, 2)
+			record := records[0]
+			assert.Equal(t, audit.KindFeedback, record.Kind)
+			assert.Equal(t, tc.expectedAgent, record.AgentID)
+			assert.Equal(t, "session123", record.SessionID)
+			assert.Equal(t, response.ResponseID, record.ResponseID)
+			require.NotNil(t, record.Feedback)
+			if tc.includeContent {
+				assert.Equal(t, "Spot on", record.Feedback.Comment)
+			} else {
+				assert.Empty(t, record.Feedback.Comment)
+			}
+		})
+	}
+}
+
+func TestHandleFeedbackFromAuditTrail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+
+	// The reply is followed by more records of the session than a query
+	// returns
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour)
+	require.NoError(t, sink.Write(ctx, &audit.Record{
+		ID:             "exchange",
+		Time:           start,
+		OrganizationID: "org123",
+		UserID:         "user123",
+		AgentID:        "agent-feedback",
+		SessionID:      "session123",
+		Experiment:     "tone",
+		Variant:        "concise",
+		ResponseID:     "old-reply",
+		Status:         "success",
+	}))
+	for i := 0; i < audit.MaxLimit+10; i++ {
+		require.NoError(t, sink.Write(ctx, &audit.Record{
+			ID:             fmt.Sprintf("later%d", i),
+			Time:           start.Add(time.Duration(i+1) * time.Millisecond),
+			OrganizationID: "org123",
+			UserID:         "user123",
+			AgentID:        "agent-feedback",
+			SessionID:      "session123",
+			ResponseID:     fmt.Sprintf("reply%d", i),
+			Status:         "success",
+		}))
+	}
+
+	recorder := experiments.NewRecorder()
+	handler := NewFeedbackHandler(openai.NewMockClient(log), sink, recorder, log, config.NewStore(&config.Config{}, nil))
+	router := gin.New()
+	router.POST("/feedback", handler.HandleFeedback)
+
+	// Feedback given again replaces the earlier feedback rather than adding to it
+	for _, thumbs := range []string{"down", "up"} {
+		body := fmt.Sprintf(`{"organizationId": "org123", "sessionId": "session123", "responseId": "old-reply", "thumbs": %q}`, thumbs)
+		w := serveJSON(router, "POST", "/feedback", body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Feedback.WithLabelValues("org123", "agent-feedback", "down")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.Feedback.WithLabelValues("org123", "agent-feedback", "up")))
+
+	stats := recorder.Stats("org123", "agent-feedback", "tone")
+	require.Len(t, stats, 1)
+	assert.Equal(t, "concise", stats[0].Variant)
+	assert.Equal(t, 1, stats[0].ThumbsUp)
+	assert.Equal(t, 0, stats[0].ThumbsDown)
+
+	records, err := sink.Query(ctx, audit.Filter{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, audit.KindFeedback, records[0].Kind)
+	assert.Equal(t, "concise", records[0].Variant)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/health"
+)
+
+// serviceName identifies the service in health responses
+const serviceName = "chatgpt-service"
+
+// HealthHandler handles liveness and readiness probes
+type HealthHandler struct {
+	checker *health.Checker
+}
+
+// NewHealthHandler creates a new health handler
+func NewHealthHandler(checker *health.Checker) *HealthHandler {
+	return &HealthHandler{checker: checker}
+}
+
+// ReadinessResponse is the response of a readiness probe
+type ReadinessResponse struct {
+	Service string `json:"service"`
+	*health.Report
+}
+
+// HandleLive reports that the process is up and serving requests
+func (h *HealthHandler) HandleLive(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"service": serviceName,
+	})
+}
+
+// HandleReady reports whether the service should receive traffic, with the
+// result of every check. It responds 503 when a critical check failed or the
+// service is shutting down; a degraded service is still ready.
+func (h *HealthHandler) HandleReady(c *gin.Context) {
+	report := h.checker.Check(c.Request.Context())
+	status := http.StatusOK
+	if !report.Ready() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, ReadinessResponse{Service: serviceName, Report: report})
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		name           string
+		upstreamErr    error
+		draining       bool
+		expectedStatus int
+		expectedState  string
+	}{
+		{
+			name:           "Ready",
+			expectedStatus: http.StatusOK,
+			expectedState:  health.StatusReady,
+		},
+		{
+			name:           "Upstream authentication failed",
+			upstreamErr:    errors.New("upstream authentication failed"),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedState:  health.StatusNotReady,
+		},
+		{
+			name:           "Draining",
+			draining:       true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedState:  health.StatusDraining,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := health.NewChecker()
+			checker.Add("openai", true, 0, func(ctx context.Context) error { return tc.upstreamErr })
+			if tc.draining {
+				checker.SetDraining()
+			}
+			handler := NewHealthHandler(checker)
+			router := gin.New()
+			router.GET("/health/live", handler.HandleLive)
+			router.GET("/health/ready", handler.HandleReady)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			var response ReadinessResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "chatgpt-service", response.Service)
+			assert.Equal(t, tc.expectedState, response.Status)
+			if tc.upstreamErr != nil {
+				assert.Equal(t, health.StatusFailed, response.Checks["openai"].Status)
+				assert.Equal(t, tc.upstreamErr.Error(), response.Checks["openai"].Error)
+			}
+
+			// The process stays live while it is not ready
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/transcripts"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// ImportHandler creates sessions from transcripts of conversations
+type ImportHandler struct {
+	openaiClient openai.ClientInterface
+	auditSink    audit.Sink
+	log          *logrus.Logger
+	configs      *config.Store
+}
+
+// NewImportHandler creates a new import handler. Imports are recorded in the
+// audit sink unless it is nil.
+func NewImportHandler(openaiClient openai.ClientInterface, auditSink audit.Sink, log *logrus.Logger, configs *config.Store) *ImportHandler {
+	return &ImportHandler{
+		openaiClient: openaiClient,
+		auditSink:    auditSink,
+		log:          log,
+		configs:      configs,
+	}
+}
+
+// HandleImportSession creates a session whose conversation is the imported
+// transcript, which chat requests to the session then continue. Sessions
+// that already have a conversation can't be imported into.
+func (h *ImportHandler) HandleImportSession(c *gin.Context) {
+	var req models.ImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ImportResponse{
+			Status: "error",
+			Error: &models.ErrorInfo{
+				Code:    "invalid_request",
+				Message: "Invalid request format",
+				Details: redact.String(err.Error()),
+			},
+		})
+		return
+	}
+	if req.Format == "" {
+		req.Format = transcripts.ImportEntries
+	}
+	if req.SessionID == "" {
+		req.SessionID = utils.GenerateUUID()
+	}
+	logging.WithFields(c, h.log, logrus.Fields{
+		"organization_id": req.OrganizationID,
+		"agent_id":        req.AgentID,
+		"user_id":         req.UserID,
+		"session_id":      req.SessionID,
+	})
+
+	ctx := c.Request.Context()
+	messages, duplicates, err := h.prepareImport(ctx, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ImportResponse{
+			Status:    "error",
+			SessionID: req.SessionID,
+			Error:     validationErrorInfo(err),
+		})
+		return
+	}
+
+	startTime := time.Now()
+	thread, err := h.openaiClient.GetOrCreateThread(ctx, req.SessionID, req.OrganizationID, req.AgentID, req.UserID)
+	seeded := false
+	switch {
+	case errors.Is(err, openai.ErrSessionNotFound):
+		// Sessions of other organizations and agents are reported like
+		// existing ones, without being changed
+		err = nil
+	case err == nil:
+		seeded, err = h.openaiClient.SeedThread(ctx, thread.ThreadID, messages)
+	}
+	switch {
+	case err != nil:
+		h.recordAudit(ctx, &req, "", startTime, "processing_error")
+	case !seeded:
+		h.recordAudit(ctx, &req, "", startTime, "session_exists")
+	default:
+		h.recordAudit(ctx, &req, thread.ThreadID, startTime, "")
+	}
+	if err != nil {
+		logging.FromContext(ctx, h.log).Errorf("Failed to import session: %v", err)
+		c.JSON(http.StatusInternalServerError, models.ImportResponse{
+			Status:    "error",
+			SessionID: req.SessionID,
+			Error: &models.ErrorInfo{
+				Code:      "processing_error",
+				Message:   "Failed to import the conversation",
+				Retryable: true,
+			},
+		})
+		return
+	}
+	if !seeded {
+		c.JSON(http.StatusConflict, models.ImportResponse{
+			Status:    "error",
+			SessionID: req.SessionID,
+			Error: &models.ErrorInfo{
+				Code:    "session_exists",
+				Message: "The session already has a conversation",
+			},
+		})
+		return
+	}
+
+	logging.FromContext(ctx, h.log).WithFields(logrus.Fields{
+		"format":   req.Format,
+		"messages": len(messages),
+	}).Info("Imported conversation")
+	c.JSON(http.StatusCreated, models.ImportResponse{
+		Status:         "success",
+		SessionID:      req.SessionID,
+		ConversationID: thread.ThreadID,
+		Messages:       len(messages),
+		Duplicates:     duplicates,
+	})
+}
+
+// recordAudit appends an import to the audit trail, with the code of the
+// error that failed it, if any. Failures are logged rather than failing the
+// request.
+func (h *ImportHandler) recordAudit(ctx context.Context, req *models.ImportRequest, conversationID string, startTime time.Time, errorCode string) {
+	if h.auditSink == nil {
+		return
+	}
+
+	record := &audit.Record{
+		ID:             utils.GenerateUUID(),
+		Kind:           audit.KindImport,
+		Time:           startTime.UTC(),
+		RequestID:      logging.RequestID(ctx),
+		Channel:        "http",
+		OrganizationID: req.OrganizationID,
+		UserID:         req.UserID,
+		AgentID:        req.AgentID,
+		SessionID:      req.SessionID,
+		ConversationID: conversationID,
+		DurationMs:     time.Since(startTime).Milliseconds(),
+		Status:         "success",
+		ErrorCode:      errorCode,
+		Moderation:     audit.ModerationDisabled,
+		MessageHash:    audit.Hash(string(req.Transcript)),
+	}
+	if errorCode != "" {
+		record.Status = "error"
+	}
+	if h.configs.For(ctx).PolicyFor(req.OrganizationID).Audit.IncludeContent {
+		record.Message = string(req.Transcript)
+	}
+	if err := h.auditSink.Write(context.WithoutCancel(ctx), record); err != nil {
+		metrics.AuditWriteErrors.Inc()
+		logging.FromContext(ctx, h.log).Errorf("Failed to write audit record: %v", err)
+	}
+}
+
+// prepareImport validates an import request and parses its transcript into
+// the messages to import, applying the system prompt and dedup options. The
+// transcript's system messages are only kept in the form of an explicit
+// system prompt, since they would instruct the agent. It returns
+// validationErrors listing every failing field.
+func (h *ImportHandler) prepareImport(ctx context.Context, req *models.ImportRequest) ([]models.ThreadMessage, int, error) {
+	var errs validationErrors
+	errs.requireID("organizationId", req.OrganizationID)
+	errs.requireID("agentId", req.AgentID)
+	errs.requireID("userId", req.UserID)
+	errs.requireID("sessionId", req.SessionID)
+	if len(req.Transcript) == 0 {
+		errs.add("transcript", "is required")
+		return nil, 0, errs.err()
+	}
+
+	messages, err := transcripts.Parse(req.Format, req.Transcript, req.ChatGPTConversationID)
+	switch {
+	case errors.Is(err, transcripts.ErrUnknownFormat):
+		errs.add("format", "must be '%s', '%s' or '%s'", transcripts.ImportEntries, transcripts.ImportOpenAI, transcripts.ImportChatGPT)
+	case errors.Is(err, transcripts.ErrConversationNotFound):
+		errs.add("chatgptConversationId", "must be the ID of a conversation in the export if it has several")
+	case err != nil:
+		errs.add("transcript", "must be a transcript in the %s format: %s", req.Format, redact.String(err.Error()))
+	}
+	for i, message := range messages {
+		if !importRoles[message.Role] {
+			errs.add(fmt.Sprintf("transcript[%d].role", i), "must be 'user', 'assistant' or 'system'")
+		}
+		if message.Content == "" {
+			errs.add(fmt.Sprintf("transcript[%d].content", i), "is required")
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, 0, err
+	}
+
+	systemPrompt := ""
+	if req.SystemPrompt != nil {
+		systemPrompt = *req.SystemPrompt
+	}
+	messages = transcripts.WithSystemPrompt(messages, systemPrompt)
+	duplicates := 0
+	if req.Dedup {
+		messages, duplicates = transcripts.Dedup(messages)
+	}
+	limits := h.configs.For(ctx).Limits
+	switch {
+	case len(messages) == 0:
+		errs.add("transcript", "must contain at least one message")
+	case limits.MaxChatHistory > 0 && len(messages) > limits.MaxChatHistory:
+		errs.add("transcript", "must not contain more than %d messages", limits.MaxChatHistory)
+	}
+	return messages, duplicates, errs.err()
+}
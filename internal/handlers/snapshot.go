@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+)
+
+// SnapshotConfig pins every request to the configuration current when it
+// arrives, so a reload never changes settings under a running request
+func SnapshotConfig(configs *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(config.NewContext(c.Request.Context(), configs.Current()))
+		c.Next()
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+)
+
+// idPattern is the format of organization, agent, user and session IDs
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:@-]{0,127}$`)
+
+// chatHistoryRoles are the roles allowed in chat history entries
+var chatHistoryRoles = map[string]bool{
+	"user":      true,
+	"assistant": true,
+}
+
+// importRoles are the roles allowed in imported transcripts
+var importRoles = map[string]bool{
+	"user":      true,
+	"assistant": true,
+	"system":    true,
+}
+
+// toolNamePattern is the format OpenAI requires of function names
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validationErrors lists every field of a request that failed validation
+type validationErrors []models.FieldError
+
+// Error implements the error interface
+func (e validationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fieldError.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records a failing field
+func (e *validationErrors) add(field, format string, args ...any) {
+	*e = append(*e, models.FieldError{
+		Field:   field,
+		Message: field + " " + fmt.Sprintf(format, args...),
+	})
+}
+
+// err returns the errors as an error, or nil if there are none
+func (e validationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// requireID records an error if a required ID is missing or malformed
+func (e *validationErrors) requireID(field, value string) {
+	switch {
+	case value == "":
+		e.add(field, "is required")
+	case !idPattern.MatchString(value):
+		e.add(field, "must be 1-128 letters, digits or ._:@- starting with a letter or digit")
+	}
+}
+
+// validateCacheConfig records errors in the cache configuration of an agent
+// with a temperature, with fields prefixed by prefix. Only agents with a
+// temperature of 0 may cache replies, unless the configuration allows any.
+func validateCacheConfig(prefix string, cache *models.CacheConfig, temperature *float64, errs *validationErrors) {
+	if !cache.AnyTemperature && !isZeroTemperature(temperature) {
+		errs.add(prefix, "requires a temperature of 0, unless anyTemperature is set")
+	}
+	if cache.TTLSeconds < 0 {
+		errs.add(prefix+".ttlSeconds", "must not be negative")
+	}
+	if cache.Threshold < 0 || cache.Threshold > 1 {
+		errs.add(prefix+".threshold", "must be between 0 and 1")
+	}
+}
+
+// validateTools records errors in an agent's tools, with fields prefixed by prefix
+func validateTools(prefix string, tools []models.Tool, errs *validationErrors) {
+	names := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		field := fmt.Sprintf("%s[%d]", prefix, i)
+		switch {
+		case !toolNamePattern.MatchString(tool.Name):
+			errs.add(field+".name", "must be 1-64 letters, digits, underscores or dashes")
+		case names[tool.Name]:
+			errs.add(field+".name", "must be unique")
+		}
+		names[tool.Name] = true
+		if len(tool.Parameters) > 0 && !bytes.HasPrefix(bytes.TrimSpace(tool.Parameters), []byte("{")) {
+			errs.add(field+".parameters", "must be a JSON schema object")
+		}
+	}
+}
+
+// isZeroTemperature reports whether a temperature is set to 0
+func isZeroTemperature(temperature *float64) bool {
+	return temperature != nil && *temperature == 0
+}
+
+// validationErrorInfo builds the error info of a failed validation, listing
+// every failing field
+func validationErrorInfo(err error) *models.ErrorInfo {
+	info := &models.ErrorInfo{
+		Code:    "validation_error",
+		Message: "Request validation failed",
+		Details: err.Error(),
+	}
+	var fieldErrors validationErrors
+	if errors.As(err, &fieldErrors) {
+		info.Fields = fieldErrors
+	}
+	return info
+}
+
+// LimitRequestBody caps the size of request bodies, so oversized requests
+// fail while being read instead of being buffered in memory. Handlers report
+// the failure with isBodyTooLarge.
+func LimitRequestBody(configs *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxBytes := configs.For(c.Request.Context()).Limits.MaxBodyBytes
+		if maxBytes > 0 && c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+		c.Next()
+	}
+}
+
+// isBodyTooLarge reports whether reading a request body failed because it
+// exceeded the size limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+)
+
+const (
+	// Time allowed to write a single frame to the peer
+	wsWriteWait = 10 * time.Second
+	// Time allowed between pongs before the connection is considered dead
+	wsPongWait = 60 * time.Second
+	// Interval for sending pings; must be shorter than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// Maximum size of a single inbound frame unless MaxBodyBytes is configured
+	wsMaxMessageSize = 1 << 20
+)
+
+// errTurnCancelled is the cancellation cause for turns stopped by the client
+var errTurnCancelled = errors.New("turn cancelled by client")
+
+// wsConn serializes writes to a WebSocket connection, which supports only one
+// concurrent writer
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+// send writes a single framed message to the peer
+func (w *wsConn) send(msg models.WSMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_ = w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return w.conn.WriteJSON(msg)
+}
+
+// ping writes a ping control frame to the peer
+func (w *wsConn) ping() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+}
+
+// sendError writes an error event for the given turn
+func (w *wsConn) sendError(id, code, message, details string) error {
+	return w.send(models.WSMessage{
+		Type: models.WSEventError,
+		ID:   id,
+		Error: &models.ErrorInfo{
+			Code:    code,
+			Message: message,
+			Details: redact.String(details),
+		},
+	})
+}
+
+// HandleChatWS upgrades the request to a WebSocket and serves chat turns over
+// the persistent connection. Each "chat" frame starts a turn identified by its
+// ID; a "cancel" frame with the same ID stops the in-flight generation.
+func (h *ChatHandler) HandleChatWS(c *gin.Context) {
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already written an HTTP error response
+		logging.FromContext(c.Request.Context(), h.log).Warnf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ws := &wsConn{conn: conn}
+	connCtx, cancelAll := context.WithCancel(c.Request.Context())
+
+	var (
+		turnsMutex sync.Mutex
+		turns      = make(map[string]context.CancelCauseFunc)
+		wg         sync.WaitGroup
+	)
+	defer func() {
+		cancelAll()
+		wg.Wait()
+	}()
+
+	readLimit := int64(wsMaxMessageSize)
+	if maxBodyBytes := h.cfg(connCtx).Limits.MaxBodyBytes; maxBodyBytes > 0 {
+		readLimit = maxBodyBytes
+	}
+	conn.SetReadLimit(readLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go h.keepAlive(connCtx, ws)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logging.FromContext(connCtx, h.log).Warnf("WebSocket read error: %v", err)
+			}
+			return
+		}
+
+		var msg models.WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			_ = ws.sendError("", "invalid_request", "Invalid message format", err.Error())
+			continue
+		}
+
+		switch msg.Type {
+		case models.WSEventChat:
+			if msg.ID == "" {
+				msg.ID = utils.GenerateUUID()
+			}
+
+			turnsMutex.Lock()
+			if _, exists := turns[msg.ID]; exists {
+				turnsMutex.Unlock()
+				_ = ws.sendError(msg.ID, "invalid_request", "A turn with this ID is already in progress", "")
+				continue
+			}
+			turnCtx, cancel := context.WithCancelCause(connCtx)
+			turns[msg.ID] = cancel
+			turnsMutex.Unlock()
+
+			wg.Add(1)
+			go func(id string, req *models.ChatRequest) {
+				defer wg.Done()
+				defer func() {
+					turnsMutex.Lock()
+					delete(turns, id)
+					turnsMutex.Unlock()
+					cancel(nil)
+				}()
+				h.serveWSTurn(turnCtx, ws, id, req)
+			}(msg.ID, msg.Request)
+
+		case models.WSEventCancel:
+			turnsMutex.Lock()
+			cancel, exists := turns[msg.ID]
+			turnsMutex.Unlock()
+			if !exists {
+				_ = ws.sendError(msg.ID, "not_found", "No turn in progress with this ID", "")
+				continue
+			}
+			cancel(errTurnCancelled)
+
+		default:
+			_ = ws.sendError(msg.ID, "invalid_request", "Unknown message type", msg.Type)
+		}
+	}
+}
+
+// serveWSTurn processes a single chat turn and streams its events to the peer
+func (h *ChatHandler) serveWSTurn(ctx context.Context, ws *wsConn, id string, req *models.ChatRequest) {
+	startTime := time.Now()
+
+	if req == nil {
+		_ = ws.sendError(id, "invalid_request", "Invalid request format", "request is required")
+		return
+	}
+	if !logging.IsValidRequestID(req.Metadata.RequestID) {
+		req.Metadata.RequestID = utils.GenerateUUID()
+	}
+	fields := chatLogFields(req)
+	fields["request_id"] = req.Metadata.RequestID
+	fields["turn_id"] = id
+	log := logging.FromContext(ctx, h.log).WithFields(fields)
+	ctx = logging.WithEntry(ctx, log)
+
+	// Every turn runs with the configuration current when it starts, however
+	// long the connection has been open
+	ctx = config.NewContext(ctx, h.configs.Current())
+
+	ctx, err := h.prepareRequest(ctx, req)
+	if err != nil {
+		_ = ws.send(models.WSMessage{Type: models.WSEventError, ID: id, Error: validationErrorInfo(err)})
+		return
+	}
+
+	ctx, span := startChatSpan(ctx, "ChatHandler.serveWSTurn", req)
+	defer span.End()
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(ctx, h.cfg(ctx).RequestTimeout)
+	defer cancel()
+
+	typing := true
+	_ = ws.send(models.WSMessage{Type: models.WSEventTyping, ID: id, Typing: &typing})
+
+	events := &chatEvents{
+		onProgress: func(stage string) {
+			_ = ws.send(models.WSMessage{Type: models.WSEventProgress, ID: id, Stage: stage})
+		},
+		onDelta: func(delta string) error {
+			return ws.send(models.WSMessage{Type: models.WSEventDelta, ID: id, Delta: delta})
+		},
+	}
+	response, err := h.runChat(ctx, req, events)
+	tracing.RecordError(span, err)
+	h.recordAudit(ctx, "ws", req, response, err, startTime)
+	h.recordVariant(ctx, req, response, err, startTime)
+
+	typing = false
+	_ = ws.send(models.WSMessage{Type: models.WSEventTyping, ID: id, Typing: &typing})
+
+	if errors.Is(err, openai.ErrRunCancelled) || errors.Is(context.Cause(ctx), errTurnCancelled) {
+		_ = ws.send(models.WSMessage{Type: models.WSEventResponse, ID: id, Response: cancelledResponse(req)})
+		return
+	}
+	if err != nil {
+		log.Errorf("Error processing chat: %v", err)
+		_, errResponse := errorResponse(req.SessionID, err)
+		_ = ws.send(models.WSMessage{Type: models.WSEventError, ID: id, Error: errResponse.Error})
+		return
+	}
+
+	h.finalizeResponse(response, req, startTime)
+	_ = ws.send(models.WSMessage{Type: models.WSEventResponse, ID: id, Response: response})
+}
+
+// keepAlive pings the peer until the connection context is done
+func (h *ChatHandler) keepAlive(ctx context.Context, ws *wsConn) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ws.ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin enforces the configured WebSocket origin allow-list
+func (h *ChatHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.cfg(r.Context()).WSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	// Fall back to gorilla's same-origin check
+	return origin == "http://"+r.Host || origin == "https://"+r.Host
+}
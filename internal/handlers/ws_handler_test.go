@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newWSTestServer starts a test server serving the chat WebSocket and dials it
+func newWSTestServer(t *testing.T, client openai.ClientInterface) *websocket.Conn {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	cfg := &config.Config{
+		RequestTimeout: 30 * time.Second,
+	}
+	handler := NewChatHandler(client, log, config.NewStore(cfg, nil), nil, nil, nil)
+
+	router := gin.New()
+	router.GET("/chat/ws", handler.HandleChatWS)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/chat/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func validWSChatRequest() *models.ChatRequest {
+	return &models.ChatRequest{
+		OrganizationID: "org123",
+		AgentID:        "agent123",
+		UserID:         "user123",
+		Message:        "Hello",
+		SessionID:      "session123",
+		Context: models.Context{
+			AgentConfig: models.AgentConfig{
+				AIProvider: "chatgpt",
+			},
+		},
+		Metadata: models.Metadata{
+			RequestID: "req123",
+		},
+	}
+}
+
+// readUntil reads frames until one of the given type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, eventType string) (models.WSMessage, []models.WSMessage) {
+	var seen []models.WSMessage
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg models.WSMessage
+		require.NoError(t, conn.ReadJSON(&msg))
+		if msg.Type == eventType {
+			return msg, seen
+		}
+		seen = append(seen, msg)
+	}
+}
+
+func TestHandleChatWSStreamsResponse(t *testing.T) {
+	conn := newWSTestServer(t, openai.NewMockClient(logrus.New()))
+
+	require.NoError(t, conn.WriteJSON(models.WSMessage{
+		Type:    models.WSEventChat,
+		ID:      "turn1",
+		Request: validWSChatRequest(),
+	}))
+
+	msg, seen := readUntil(t, conn, models.WSEventResponse)
+	assert.Equal(t, "turn1", msg.ID)
+	assert.NotNil(t, msg.Response)
+	assert.Equal(t, "success", msg.Response.Status)
+	assert.Equal(t, "req123", msg.Response.Metadata.RequestID)
+
+	var deltas strings.Builder
+	for _, event := range seen {
+		if event.Type == models.WSEventDelta {
+			deltas.WriteString(event.Delta)
+		}
+	}
+	assert.Equal(t, msg.Response.Response, deltas.String())
+}
+
+func TestHandleChatWSCancel(t *testing.T) {
+	mockClient := openai.NewMockClient(logrus.New())
+	started := make(chan struct{})
+	mockClient.RunThreadStreamFunc = func(ctx context.Context, threadID, model string, onDelta func(delta string) error) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	conn := newWSTestServer(t, mockClient)
+
+	require.NoError(t, conn.WriteJSON(models.WSMessage{
+		Type:    models.WSEventChat,
+		ID:      "turn1",
+		Request: validWSChatRequest(),
+	}))
+	<-started
+	require.NoError(t, conn.WriteJSON(models.WSMessage{
+		Type: models.WSEventCancel,
+		ID:   "turn1",
+	}))
+
+	msg, _ := readUntil(t, conn, models.WSEventResponse)
+	assert.Equal(t, "turn1", msg.ID)
+	assert.Equal(t, "cancelled", msg.Response.Status)
+}
+
+func TestHandleChatWSValidationError(t *testing.T) {
+	conn := newWSTestServer(t, openai.NewMockClient(logrus.New()))
+
+	require.NoError(t, conn.WriteJSON(models.WSMessage{
+		Type:    models.WSEventChat,
+		ID:      "turn1",
+		Request: &models.ChatRequest{Message: "Hello"},
+	}))
+
+	msg, _ := readUntil(t, conn, models.WSEventError)
+	assert.Equal(t, "turn1", msg.ID)
+	assert.Equal(t, "validation_error", msg.Error.Code)
+}
@@ -0,0 +1,164 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+)
+
+// Statuses of a single check
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// Readiness statuses of the service
+const (
+	// StatusReady means every check passed
+	StatusReady = "ready"
+	// StatusDegraded means only non-critical checks failed; the service can
+	// still serve requests
+	StatusDegraded = "degraded"
+	// StatusNotReady means a critical check failed
+	StatusNotReady = "not_ready"
+	// StatusDraining means the service is shutting down
+	StatusDraining = "draining"
+)
+
+// CheckTimeout bounds how long a single check may run
+const CheckTimeout = 5 * time.Second
+
+// CheckFunc checks a dependency, returning an error if it is unavailable
+type CheckFunc func(ctx context.Context) error
+
+// Result is the outcome of a single check
+type Result struct {
+	Status     string    `json:"status"`
+	Critical   bool      `json:"critical"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checkedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Cached     bool      `json:"cached,omitempty"`
+}
+
+// Report is the readiness of the service and the results of its checks
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// Ready reports whether the service should receive traffic
+func (r *Report) Ready() bool {
+	return r.Status == StatusReady || r.Status == StatusDegraded
+}
+
+// check is a registered check with its last result
+type check struct {
+	name     string
+	critical bool
+	ttl      time.Duration
+	run      CheckFunc
+
+	// mu is held while the check runs, so concurrent probes share a result
+	mu     sync.Mutex
+	result Result
+}
+
+// Checker runs the readiness checks of the service
+type Checker struct {
+	checks   []*check
+	draining atomic.Bool
+}
+
+// NewChecker creates a checker without any checks
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check. A failed critical check makes the service not ready;
+// other failures only degrade it. Results are reused for ttl, so checks
+// calling remote services don't run on every probe.
+func (c *Checker) Add(name string, critical bool, ttl time.Duration, run CheckFunc) {
+	c.checks = append(c.checks, &check{name: name, critical: critical, ttl: ttl, run: run})
+}
+
+// SetDraining marks the service as shutting down, failing readiness so load
+// balancers stop sending traffic
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Draining reports whether the service is shutting down
+func (c *Checker) Draining() bool {
+	return c.draining.Load()
+}
+
+// Check runs every check concurrently and reports the readiness of the service
+func (c *Checker) Check(ctx context.Context) *Report {
+	if c.Draining() {
+		return &Report{Status: StatusDraining}
+	}
+
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i := range c.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.checks[i].check(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusReady, Checks: make(map[string]Result, len(c.checks))}
+	for i, check := range c.checks {
+		result := results[i]
+		report.Checks[check.name] = result
+		if result.Status == StatusOK {
+			metrics.HealthCheckUp.WithLabelValues(check.name).Set(1)
+			continue
+		}
+		metrics.HealthCheckUp.WithLabelValues(check.name).Set(0)
+		if check.critical {
+			report.Status = StatusNotReady
+		} else if report.Status == StatusReady {
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+// check runs the check unless its last result is still fresh
+func (c *check) check(ctx context.Context) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.result.CheckedAt.IsZero() && time.Since(c.result.CheckedAt) < c.ttl {
+		result := c.result
+		result.Cached = true
+		return result
+	}
+
+	// The result is shared with other probes, so it must not fail because
+	// this probe's caller went away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), CheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.run(ctx)
+
+	c.result = Result{
+		Status:     StatusOK,
+		Critical:   c.critical,
+		CheckedAt:  start.UTC(),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		c.result.Status = StatusFailed
+		c.result.Error = redact.String(err.Error())
+	}
+	return c.result
+}
@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	testCases := []struct {
+		name           string
+		critical       CheckFunc
+		optional       CheckFunc
+		expectedStatus string
+		expectedReady  bool
+	}{
+		{
+			name:           "All checks pass",
+			critical:       ok,
+			optional:       ok,
+			expectedStatus: StatusReady,
+			expectedReady:  true,
+		},
+		{
+			name:           "Non-critical check fails",
+			critical:       ok,
+			optional:       fail,
+			expectedStatus: StatusDegraded,
+			expectedReady:  true,
+		},
+		{
+			name:           "Critical check fails",
+			critical:       fail,
+			optional:       ok,
+			expectedStatus: StatusNotReady,
+			expectedReady:  false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := NewChecker()
+			checker.Add("upstream", true, 0, tc.critical)
+			checker.Add("store", false, 0, tc.optional)
+
+			report := checker.Check(context.Background())
+			assert.Equal(t, tc.expectedStatus, report.Status)
+			assert.Equal(t, tc.expectedReady, report.Ready())
+			assert.Len(t, report.Checks, 2)
+			assert.True(t, report.Checks["upstream"].Critical)
+			assert.False(t, report.Checks["store"].Critical)
+			for _, result := range report.Checks {
+				if result.Status == StatusFailed {
+					assert.Equal(t, "connection refused", result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCachesResults(t *testing.T) {
+	calls := 0
+	checker := NewChecker()
+	checker.Add("upstream", true, time.Minute, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+
+	first := checker.Check(context.Background())
+	second := checker.Check(context.Background())
+	assert.Equal(t, 1, calls)
+	assert.False(t, first.Checks["upstream"].Cached)
+	assert.True(t, second.Checks["upstream"].Cached)
+	assert.Equal(t, first.Checks["upstream"].CheckedAt, second.Checks["upstream"].CheckedAt)
+}
+
+func TestCheckDraining(t *testing.T) {
+	calls := 0
+	checker := NewChecker()
+	checker.Add("upstream", true, 0, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+
+	assert.True(t, checker.Check(context.Background()).Ready())
+	checker.SetDraining()
+	report := checker.Check(context.Background())
+	assert.Equal(t, StatusDraining, report.Status)
+	assert.False(t, report.Ready())
+	assert.Equal(t, 1, calls)
+}
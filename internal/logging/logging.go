@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderRequestID carries the request's correlation ID. An incoming value is
+// reused, and the final ID is always echoed in the response.
+const HeaderRequestID = "X-Request-ID"
+
+// validRequestID limits caller-supplied request IDs to what is safe to log
+// and echo back
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// IsValidRequestID reports whether a caller-supplied request ID may be used
+// as the request's correlation ID
+func IsValidRequestID(id string) bool {
+	return validRequestID.MatchString(id)
+}
+
+type contextKey int
+
+const (
+	entryKey contextKey = iota
+	requestIDKey
+)
+
+// WithEntry returns a copy of ctx carrying a request-scoped log entry
+func WithEntry(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, entryKey, entry)
+}
+
+// FromContext returns the request-scoped log entry carried by ctx, or a plain
+// entry of log if there is none. The entry carries ctx, so hooks see the
+// request's context.
+func FromContext(ctx context.Context, log *logrus.Logger) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey).(*logrus.Entry); ok {
+		return entry.WithContext(ctx)
+	}
+	return logrus.NewEntry(log).WithContext(ctx)
+}
+
+// RequestID returns the correlation ID of the request ctx belongs to, or ""
+// if it has none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithFields adds fields to the request-scoped log entry of a request, so
+// they appear on every later log line of the request including the access log
+func WithFields(c *gin.Context, log *logrus.Logger, fields logrus.Fields) {
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(WithEntry(ctx, FromContext(ctx, log).WithFields(fields)))
+}
+
+// SetRequestID replaces the correlation ID of a request, e.g. with one the
+// caller sent in the request body, and echoes it in the response
+func SetRequestID(c *gin.Context, log *logrus.Logger, id string) {
+	c.Header(HeaderRequestID, id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey, id))
+	WithFields(c, log, logrus.Fields{"request_id": id})
+}
+
+// Middleware assigns every request a correlation ID, attaches a
+// request-scoped log entry to its context and writes a JSON access log line
+// once the request has been served
+func Middleware(log *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(HeaderRequestID)
+		if !IsValidRequestID(requestID) {
+			requestID = utils.GenerateUUID()
+		}
+
+		fields := logrus.Fields{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+		}
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.HasTraceID() {
+			fields["trace_id"] = spanContext.TraceID().String()
+		}
+		WithFields(c, log, fields)
+		SetRequestID(c, log, requestID)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := FromContext(c.Request.Context(), log).WithFields(logrus.Fields{
+			"route":      c.FullPath(),
+			"status":     status,
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+			"bytes":      c.Writer.Size(),
+			"user_agent": c.Request.UserAgent(),
+		})
+		switch {
+		case status >= http.StatusInternalServerError:
+			entry.Error("Request served")
+		case status >= http.StatusBadRequest:
+			entry.Warn("Request served")
+		default:
+			entry.Info("Request served")
+		}
+	}
+}
+
+// Recovery recovers from panics in handlers, logging them with the request's
+// log entry and responding with 500
+func Recovery(log *logrus.Logger) gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		FromContext(c.Request.Context(), log).Errorf("Recovered from panic: %v", recovered)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		// header is the incoming X-Request-ID, if any
+		header   string
+		expected string
+	}{
+		{
+			name:     "incoming ID kept",
+			header:   "req-123",
+			expected: "req-123",
+		},
+		{
+			name: "missing ID generated",
+		},
+		{
+			name:   "invalid ID replaced",
+			header: "bad id\nwith newline",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			var contextID string
+			var fields logrus.Fields
+			router := gin.New()
+			router.Use(Middleware(log))
+			router.GET("/ping", func(c *gin.Context) {
+				contextID = RequestID(c.Request.Context())
+				fields = FromContext(c.Request.Context(), log).Data
+				c.Status(http.StatusOK)
+			})
+
+			req, _ := http.NewRequest("GET", "/ping", nil)
+			if tt.header != "" {
+				req.Header.Set(HeaderRequestID, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			requestID := w.Header().Get(HeaderRequestID)
+			if tt.expected != "" {
+				assert.Equal(t, tt.expected, requestID)
+			} else {
+				assert.True(t, IsValidRequestID(requestID))
+				assert.NotEqual(t, tt.header, requestID)
+			}
+			assert.Equal(t, requestID, contextID)
+			assert.Equal(t, requestID, fields["request_id"])
+			assert.Equal(t, "GET", fields["method"])
+			assert.Equal(t, "/ping", fields["path"])
+		})
+	}
+}
+
+func TestSetRequestIDReplacesID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	var fields logrus.Fields
+	router := gin.New()
+	router.Use(Middleware(log))
+	router.GET("/ping", func(c *gin.Context) {
+		SetRequestID(c, log, "body-id")
+		fields = FromContext(c.Request.Context(), log).Data
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set(HeaderRequestID, "header-id")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, "body-id", w.Header().Get(HeaderRequestID))
+	assert.Equal(t, "body-id", fields["request_id"])
+}
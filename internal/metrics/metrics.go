@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chatgpt_service"
+
+var (
+	// HTTPRequests counts served HTTP requests per route, method and status
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests served.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestDuration observes HTTP request latency per route, method and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency in seconds.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestsInFlight tracks the HTTP requests currently being served
+	HTTPRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being served.",
+	})
+
+	// UpstreamRequestDuration observes OpenAI API call latency per model and operation
+	UpstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "OpenAI API call latency in seconds.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"model", "operation"})
+
+	// UpstreamErrors counts failed OpenAI API calls per model and error kind
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Total number of failed OpenAI API calls.",
+	}, []string{"model", "kind"})
+
+	// UpstreamRetries counts retried OpenAI API calls per model
+	UpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Total number of retried OpenAI API calls.",
+	}, []string{"model"})
+
+	// Tokens counts tokens used per organization, agent, model and token type
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Total number of tokens used.",
+	}, []string{"organization", "agent", "model", "type"})
+
+	// Cost counts the estimated cost in USD per organization, agent and model
+	Cost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cost_usd_total",
+		Help:      "Total estimated cost in USD.",
+	}, []string{"organization", "agent", "model"})
+
+	// ModerationResults counts moderation checks per organization, stage and
+	// outcome: passed, error, or the action taken on flagged content
+	ModerationResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "moderation_results_total",
+		Help:      "Total number of moderation checks by outcome.",
+	}, []string{"organization", "stage", "outcome"})
+
+	// InjectionDetections counts files and chat history entries with signs of
+	// prompt injection per organization, agent, source and action: flagged or
+	// quarantined
+	InjectionDetections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "injection_detections_total",
+		Help:      "Total number of files and chat history entries with signs of prompt injection.",
+	}, []string{"organization", "agent", "source", "action"})
+
+	// VariantRequests counts chat exchanges with variants of agents in
+	// experiments per organization, agent, variant and status
+	VariantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "variant_requests_total",
+		Help:      "Total number of chat exchanges with variants of agents.",
+	}, []string{"organization", "agent", "variant", "status"})
+
+	// VariantTokens counts tokens used per organization, agent and variant
+	VariantTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "variant_tokens_total",
+		Help:      "Total number of tokens used by variants of agents.",
+	}, []string{"organization", "agent", "variant"})
+
+	// VariantCost counts the estimated cost in USD per organization, agent and variant
+	VariantCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "variant_cost_usd_total",
+		Help:      "Total estimated cost in USD of variants of agents.",
+	}, []string{"organization", "agent", "variant"})
+
+	// VariantDuration observes the latency of successful chat exchanges per
+	// organization, agent and variant
+	VariantDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "variant_duration_seconds",
+		Help:      "Latency of successful chat exchanges with variants of agents in seconds.",
+		Buckets:   []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"organization", "agent", "variant"})
+
+	// Feedback counts feedback on replies per organization, agent and thumbs:
+	// up, down or none
+	Feedback = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "feedback_total",
+		Help:      "Total number of feedback submissions on replies.",
+	}, []string{"organization", "agent", "thumbs"})
+
+	// FeedbackRatings observes the ratings of replies per organization and agent
+	FeedbackRatings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "feedback_rating",
+		Help:      "Ratings of replies given as feedback.",
+		Buckets:   []float64{1, 2, 3, 4, 5},
+	}, []string{"organization", "agent"})
+
+	// ResponseCacheLookups counts lookups in the response cache per
+	// organization, agent and result: hit, miss or error
+	ResponseCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_cache_lookups_total",
+		Help:      "Total number of lookups of replies in the response cache by result.",
+	}, []string{"organization", "agent", "result"})
+
+	// ResponseCacheSize tracks the number of replies in the in-memory response cache
+	ResponseCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "response_cache_size",
+		Help:      "Number of replies in the response cache.",
+	})
+
+	// ResponseCacheEvictions counts replies evicted from the full in-memory response cache
+	ResponseCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_cache_evictions_total",
+		Help:      "Total number of replies evicted from the response cache to make room.",
+	})
+
+	// SemanticCacheLookups counts lookups in the semantic cache per
+	// organization, agent and result: hit, miss, error or skipped for
+	// questions naming someone or something in particular
+	SemanticCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_lookups_total",
+		Help:      "Total number of lookups of answers to similar questions in the semantic cache by result.",
+	}, []string{"organization", "agent", "result"})
+
+	// SemanticCacheSimilarity observes the similarity of questions to the most
+	// similar cached question, hit or not, to help tune thresholds
+	SemanticCacheSimilarity = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_similarity",
+		Help:      "Similarity of questions to the most similar question in the semantic cache.",
+		Buckets:   []float64{0.5, 0.7, 0.8, 0.85, 0.9, 0.925, 0.95, 0.975, 0.99, 1},
+	})
+
+	// SemanticCacheSize tracks the number of answers in the semantic cache
+	SemanticCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_size",
+		Help:      "Number of answers in the semantic cache.",
+	})
+
+	// SemanticCacheInvalidations counts answers removed from the semantic
+	// cache because their agent changed
+	SemanticCacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_invalidations_total",
+		Help:      "Total number of answers removed from the semantic cache because their agent changed.",
+	})
+
+	// AuditWriteErrors counts audit records that could not be written
+	AuditWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_write_errors_total",
+		Help:      "Total number of audit records that could not be written.",
+	})
+
+	// RetentionPurged counts items purged from a store per store and reason:
+	// retention or erasure
+	RetentionPurged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_purged_total",
+		Help:      "Total number of items purged under retention policies or erased on request.",
+	}, []string{"store", "reason"})
+
+	// ConfigReloads counts configuration reloads per result: applied or rejected
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Total number of configuration reloads by result.",
+	}, []string{"result"})
+
+	// HealthCheckUp tracks whether each readiness check passed when it last ran
+	HealthCheckUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "health_check_up",
+		Help:      "Whether a readiness check passed (1) or failed (0) when it last ran.",
+	}, []string{"check"})
+
+	// ThreadCacheSize tracks the number of cached conversation threads
+	ThreadCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "thread_cache_size",
+		Help:      "Number of conversation threads in the cache.",
+	})
+
+	// ThreadCacheEvictions counts threads removed from the cache after their TTL expired
+	ThreadCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "thread_cache_evictions_total",
+		Help:      "Total number of conversation threads evicted from the cache.",
+	})
+)
+
+// RecordUsage records the tokens and cost of a completion
+func RecordUsage(organizationID, agentID, model string, promptTokens, completionTokens int, cost float64) {
+	Tokens.WithLabelValues(organizationID, agentID, model, "prompt").Add(float64(promptTokens))
+	Tokens.WithLabelValues(organizationID, agentID, model, "completion").Add(float64(completionTokens))
+	Cost.WithLabelValues(organizationID, agentID, model).Add(cost)
+}
+
+// RecordVariant records the outcome of a chat exchange with a variant of an agent
+func RecordVariant(organizationID, agentID, variant, status string, tokens int, cost float64, duration time.Duration) {
+	VariantRequests.WithLabelValues(organizationID, agentID, variant, status).Inc()
+	if status != "success" {
+		return
+	}
+	VariantTokens.WithLabelValues(organizationID, agentID, variant).Add(float64(tokens))
+	VariantCost.WithLabelValues(organizationID, agentID, variant).Add(cost)
+	VariantDuration.WithLabelValues(organizationID, agentID, variant).Observe(duration.Seconds())
+}
+
+// RecordFeedback records feedback on a reply. Thumbs is "" if the feedback
+// has none, and rating 0.
+func RecordFeedback(organizationID, agentID, thumbs string, rating int) {
+	if thumbs == "" {
+		thumbs = "none"
+	}
+	Feedback.WithLabelValues(organizationID, agentID, thumbs).Inc()
+	if rating > 0 {
+		FeedbackRatings.WithLabelValues(organizationID, agentID).Observe(float64(rating))
+	}
+}
+
+// Middleware records request counts, latencies and in-flight requests per route
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		HTTPRequestsInFlight.Inc()
+		defer HTTPRequestsInFlight.Dec()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		HTTPRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+		HTTPRequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	var inFlight float64
+	router.GET("/api/threads/:sessionId", func(c *gin.Context) {
+		inFlight = testutil.ToFloat64(HTTPRequestsInFlight)
+		c.Status(http.StatusNotFound)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		route  string
+		status string
+	}{
+		{
+			name:   "matched route",
+			path:   "/api/threads/session123",
+			route:  "/api/threads/:sessionId",
+			status: "404",
+		},
+		{
+			name:   "unmatched route",
+			path:   "/unknown",
+			route:  "unmatched",
+			status: "404",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := testutil.ToFloat64(HTTPRequests.WithLabelValues(tt.route, "GET", tt.status))
+
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, requests+1, testutil.ToFloat64(HTTPRequests.WithLabelValues(tt.route, "GET", tt.status)))
+			assert.Positive(t, testutil.CollectAndCount(HTTPRequestDuration))
+			assert.Equal(t, float64(0), testutil.ToFloat64(HTTPRequestsInFlight))
+		})
+	}
+	assert.Equal(t, float64(1), inFlight)
+}
+
+func TestRecordUsage(t *testing.T) {
+	RecordUsage("org-usage", "agent123", "gpt-4o", 100, 20, 0.5)
+	RecordUsage("org-usage", "agent123", "gpt-4o", 50, 10, 0.25)
+
+	assert.Equal(t, float64(150), testutil.ToFloat64(Tokens.WithLabelValues("org-usage", "agent123", "gpt-4o", "prompt")))
+	assert.Equal(t, float64(30), testutil.ToFloat64(Tokens.WithLabelValues("org-usage", "agent123", "gpt-4o", "completion")))
+	assert.Equal(t, 0.75, testutil.ToFloat64(Cost.WithLabelValues("org-usage", "agent123", "gpt-4o")))
+}
+
+func TestRecordVariant(t *testing.T) {
+	RecordVariant("org-variant", "agent123", "b", "success", 120, 0.5, 2*time.Second)
+	RecordVariant("org-variant", "agent123", "b", "error", 80, 0.25, time.Second)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(VariantRequests.WithLabelValues("org-variant", "agent123", "b", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(VariantRequests.WithLabelValues("org-variant", "agent123", "b", "error")))
+	assert.Equal(t, float64(120), testutil.ToFloat64(VariantTokens.WithLabelValues("org-variant", "agent123", "b")))
+	assert.Equal(t, 0.5, testutil.ToFloat64(VariantCost.WithLabelValues("org-variant", "agent123", "b")))
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
@@ -15,6 +16,20 @@ type ChatRequest struct {
 	SessionID      string    `json:"sessionId"`
 	Context        Context   `json:"context"`
 	Metadata       Metadata  `json:"metadata"`
+	// User describes the user to agents whose instructions refer to them
+	User *UserProfile `json:"user,omitempty"`
+	// Variables are the caller's values for the agent's instructions
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// UserProfile describes the user of a chat request
+type UserProfile struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"` // IANA time zone, e.g. "Europe/Berlin"
+	// Attributes holds further profile fields, e.g. {"plan": "pro"}
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 // Context represents the context information for the chat request
@@ -43,9 +58,49 @@ type AgentConfig struct {
 	Name         string  `json:"name"`
 	Description  string  `json:"description"`
 	Instructions string  `json:"instructions"`
-	Temperature  float64 `json:"temperature"`
 	MaxTokens    int     `json:"maxTokens"`
 	AIProvider   string  `json:"aiProvider"` // Should be "chatgpt" for this service
+	// Temperature is the sampling temperature, between 0 and 2 (default: the
+	// model's). 0 makes replies as deterministic as possible.
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Model is the model the agent runs with, one of the allowed models
+	// (default: the service's default model)
+	Model string `json:"model,omitempty"`
+	// InjectionPolicy is how files and chat history are checked for prompt
+	// injection: "detect", "quarantine" or "off" (default: the service default)
+	InjectionPolicy string `json:"injectionPolicy,omitempty"`
+	// StrictVariables fails requests whose instructions refer to variables
+	// that aren't set, instead of leaving them empty
+	StrictVariables bool `json:"strictVariables,omitempty"`
+	// Cache caches the agent's replies, answering identical requests with
+	// them instead of running the model. Nil disables caching.
+	Cache *CacheConfig `json:"cache,omitempty"`
+	// Tools are the functions the model may call in its replies
+	Tools []Tool `json:"tools,omitempty"`
+}
+
+// Tool is a function an agent's model may call, described the way OpenAI expects it
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON schema of the function's arguments
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// CacheConfig configures the caching of an agent's replies
+type CacheConfig struct {
+	// TTLSeconds is how long replies are cached (default: the service default)
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+	// Semantic also answers the first question of conversations with the
+	// reply to a similar enough question
+	Semantic bool `json:"semantic,omitempty"`
+	// Threshold is the similarity, between 0 and 1, a question must have to
+	// a cached one to get its reply (default: the service default)
+	Threshold float64 `json:"threshold,omitempty"`
+	// AnyTemperature allows caching the replies of agents with a temperature
+	// other than 0, which then give the same reply to identical requests
+	// while it's cached
+	AnyTemperature bool `json:"anyTemperature,omitempty"`
 }
 
 // Metadata represents metadata for the request
@@ -60,7 +115,9 @@ type ChatResponse struct {
 	Response       string         `json:"response"`
 	SessionID      string         `json:"sessionId"`
 	ConversationID string         `json:"conversationId"`
-	Status         string         `json:"status"` // "success", "error", or "timeout"
+	// ResponseID identifies the reply, e.g. to give feedback on it
+	ResponseID     string         `json:"responseId,omitempty"`
+	Status         string         `json:"status"` // "success", "error", "timeout", or "cancelled"
 	Metadata       ResponseMeta   `json:"metadata"`
 	Error          *ErrorInfo     `json:"error,omitempty"`
 	Context        *ResponseContext `json:"context,omitempty"`
@@ -74,13 +131,61 @@ type ResponseMeta struct {
 	Provider       string  `json:"provider"` // Should be "chatgpt" for this service
 	Cost           float64 `json:"cost"`
 	RequestID      string  `json:"requestId"`
+	// Cached is set when the reply came from the response or semantic cache,
+	// costing nothing
+	Cached bool `json:"cached,omitempty"`
+	// CacheSimilarity is the similarity of the message to the question the
+	// cached reply was given to, when it came from the semantic cache
+	CacheSimilarity float64 `json:"cacheSimilarity,omitempty"`
+	// Moderation is set when the message or reply was flagged by moderation
+	Moderation []ModerationInfo `json:"moderation,omitempty"`
+	// InjectionDetected is set when files or chat history showed signs of
+	// prompt injection, which Injections details
+	InjectionDetected bool            `json:"injectionDetected,omitempty"`
+	Injections        []InjectionInfo `json:"injections,omitempty"`
+	// AgentVersion is the version of the registered agent the request ran
+	// with, if its agent is registered
+	AgentVersion int `json:"agentVersion,omitempty"`
+	// Variant is the variant of the agent the session is assigned to, if the
+	// agent runs an experiment
+	Variant string `json:"variant,omitempty"`
+	// PromptTokens and CompletionTokens split TokensUsed into the tokens of
+	// the prompt and of the reply
+	PromptTokens     int `json:"promptTokens,omitempty"`
+	CompletionTokens int `json:"completionTokens,omitempty"`
 }
 
 // ErrorInfo represents error information in the response
 type ErrorInfo struct {
-	Code    string `json:"code"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   string `json:"details,omitempty"`
+	Retryable bool   `json:"retryable"` // Whether the same request may succeed if retried later
+	// Categories lists the moderation categories blocked content was flagged for
+	Categories []string `json:"categories,omitempty"`
+	// Fields lists every field that failed validation
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes a request field that failed validation
+type FieldError struct {
+	Field   string `json:"field"` // JSON path of the field, e.g. "context.files[0].filename"
 	Message string `json:"message"`
-	Details string `json:"details,omitempty"`
+}
+
+// ModerationInfo reports content flagged, but not blocked, by moderation
+type ModerationInfo struct {
+	Flagged    bool     `json:"flagged"`
+	Stage      string   `json:"stage"` // "input" or "output"
+	Categories []string `json:"categories"`
+}
+
+// InjectionInfo reports a file or chat history entry with signs of prompt injection
+type InjectionInfo struct {
+	Source      string   `json:"source"` // "file" or "chatHistory"
+	Name        string   `json:"name"`   // Filename, or e.g. "chatHistory[2]"
+	Signals     []string `json:"signals"`
+	Quarantined bool     `json:"quarantined"` // Whether the file was left out of the prompt
 }
 
 // ResponseContext represents additional context information in the response
@@ -90,6 +195,33 @@ type ResponseContext struct {
 	NextActions  []string `json:"nextActions,omitempty"`
 }
 
+// WebSocket event types exchanged on the chat socket
+const (
+	// Client to server
+	WSEventChat   = "chat"
+	WSEventCancel = "cancel"
+
+	// Server to client
+	WSEventTyping   = "typing"
+	WSEventProgress = "progress"
+	WSEventDelta    = "delta"
+	WSEventResponse = "response"
+	WSEventError    = "error"
+)
+
+// WSMessage represents a single framed message on the chat WebSocket.
+// ID correlates all events belonging to one chat turn.
+type WSMessage struct {
+	Type     string        `json:"type"`
+	ID       string        `json:"id,omitempty"`
+	Request  *ChatRequest  `json:"request,omitempty"`
+	Response *ChatResponse `json:"response,omitempty"`
+	Delta    string        `json:"delta,omitempty"`
+	Typing   *bool         `json:"typing,omitempty"`
+	Stage    string        `json:"stage,omitempty"`
+	Error    *ErrorInfo    `json:"error,omitempty"`
+}
+
 // AssistantInfo represents information about an OpenAI Assistant
 type AssistantInfo struct {
 	AssistantID  string
@@ -103,11 +235,110 @@ type AssistantInfo struct {
 
 // ThreadInfo represents information about a chat thread
 type ThreadInfo struct {
-	ThreadID     string
-	SessionID    string
-	AgentID      string
+	ThreadID       string
+	SessionID      string
+	OrganizationID string
+	AgentID        string
 	UserID       string
-	Messages     []openai.ChatCompletionMessage
+	Messages     []ThreadMessage
 	CreatedAt    time.Time
 	LastUsed     time.Time
+	// Participants are the users other than UserID who sent messages to the
+	// thread's session
+	Participants []string
+	// SystemPrompt is the system prompt of the thread's latest run, which
+	// isn't one of its messages
+	SystemPrompt string
+}
+
+// HasUser reports whether a user started the thread or sent messages to it
+func (t *ThreadInfo) HasUser(userID string) bool {
+	if t.UserID == userID {
+		return true
+	}
+	for _, participant := range t.Participants {
+		if participant == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ThreadMessage is a message of a chat thread. Replies of the assistant are
+// annotated with the response they were sent in.
+type ThreadMessage struct {
+	openai.ChatCompletionMessage
+	// Time is when the message was added, or when it was sent for seeded
+	// history, if known
+	Time time.Time
+	// ResponseID, Model and TokensUsed are those of the response of an
+	// assistant reply, and Feedback the user's latest feedback on it
+	ResponseID string
+	Model      string
+	TokensUsed int
+	Feedback   *Feedback
+}
+
+// Feedback ratings
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// Feedback is a user's feedback on an assistant reply
+type Feedback struct {
+	Thumbs  string    `json:"thumbs,omitempty"` // "up" or "down"
+	Rating  int       `json:"rating,omitempty"` // MinRating to MaxRating
+	Comment string    `json:"comment,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// FeedbackRequest gives feedback on a reply in a session
+type FeedbackRequest struct {
+	OrganizationID string `json:"organizationId"`
+	SessionID      string `json:"sessionId"`
+	// ResponseID is the responseId of the ChatResponse of the reply
+	ResponseID string `json:"responseId"`
+	Thumbs     string `json:"thumbs,omitempty"`
+	Rating     int    `json:"rating,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+}
+
+// FeedbackResponse acknowledges feedback
+type FeedbackResponse struct {
+	Status     string     `json:"status"` // "success" or "error"
+	SessionID  string     `json:"sessionId"`
+	ResponseID string     `json:"responseId"`
+	Error      *ErrorInfo `json:"error,omitempty"`
+}
+
+// ImportRequest creates a session from the transcript of a conversation
+type ImportRequest struct {
+	OrganizationID string `json:"organizationId"`
+	AgentID        string `json:"agentId"`
+	UserID         string `json:"userId"`
+	// SessionID is generated if empty
+	SessionID string `json:"sessionId,omitempty"`
+	// Format is the format of the transcript: "entries" (default), "openai"
+	// or "chatgpt"
+	Format     string          `json:"format,omitempty"`
+	Transcript json.RawMessage `json:"transcript"`
+	// ChatGPTConversationID picks the conversation of a ChatGPT export
+	// holding several
+	ChatGPTConversationID string `json:"chatgptConversationId,omitempty"`
+	// SystemPrompt, if set and not "", leads the imported conversation. The
+	// transcript's own system messages are always dropped.
+	SystemPrompt *string `json:"systemPrompt,omitempty"`
+	// Dedup drops messages repeating the message before them
+	Dedup bool `json:"dedup,omitempty"`
+}
+
+// ImportResponse reports the session created from a transcript
+type ImportResponse struct {
+	Status         string     `json:"status"` // "success" or "error"
+	SessionID      string     `json:"sessionId"`
+	ConversationID string     `json:"conversationId,omitempty"`
+	Messages       int        `json:"messages"`             // Number of messages imported
+	Duplicates     int        `json:"duplicates,omitempty"` // Number of messages dropped by Dedup
+	Error          *ErrorInfo `json:"error,omitempty"`
 }
@@ -0,0 +1,145 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+)
+
+// Stages at which content is moderated
+const (
+	StageInput  = "input"
+	StageOutput = "output"
+)
+
+var (
+	// ErrContentBlocked is the kind of errors returned for content an
+	// organization's policy blocks
+	ErrContentBlocked = errors.New("content blocked by moderation")
+
+	// ErrUnavailable is returned when content can't be moderated and the
+	// organization's policy blocks flagged content, so it can't be let through
+	ErrUnavailable = errors.New("moderation unavailable")
+)
+
+// BlockedError reports content blocked by moderation and the categories it
+// was flagged for
+type BlockedError struct {
+	Stage      string
+	Categories []string
+}
+
+// Error implements the error interface
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("%v: %s flagged for %s", ErrContentBlocked, e.Stage, strings.Join(e.Categories, ", "))
+}
+
+// Is makes a *BlockedError match ErrContentBlocked
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrContentBlocked
+}
+
+// Result is the outcome of moderating a piece of content
+type Result struct {
+	Flagged    bool
+	Categories []string
+}
+
+// Moderator classifies content
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (*Result, error)
+}
+
+// NewModerator creates the moderator selected by the configured provider
+func NewModerator(cfg *config.Config) Moderator {
+	if cfg.ModerationProvider == config.ModerationProviderRules {
+		return NewRuleModerator()
+	}
+	return NewOpenAIModerator(cfg)
+}
+
+// Checker moderates content under organizations' moderation policies, as
+// configured for the request being moderated
+type Checker struct {
+	moderator Moderator
+	configs   *config.Store
+}
+
+// NewChecker creates a checker using the moderator configured at startup
+func NewChecker(configs *config.Store) *Checker {
+	return &Checker{moderator: NewModerator(configs.Current()), configs: configs}
+}
+
+// Enabled reports whether the organization's content is moderated at a stage
+func (c *Checker) Enabled(ctx context.Context, organizationID, stage string) bool {
+	policy := c.configs.For(ctx).PolicyFor(organizationID).Moderation
+	if policy.Action == "" {
+		return false
+	}
+	return stage == StageInput || policy.CheckReplies
+}
+
+// Blocks reports whether the organization's policy blocks flagged content at a stage
+func (c *Checker) Blocks(ctx context.Context, organizationID, stage string) bool {
+	return c.Enabled(ctx, organizationID, stage) &&
+		c.configs.For(ctx).PolicyFor(organizationID).Moderation.Action == config.ModerationActionBlock
+}
+
+// Check moderates text at a stage under the organization's policy. It
+// returns a *BlockedError if the policy blocks the content, and otherwise the
+// result if the content was flagged for a category the policy acts on, or
+// nil. Errors of the moderator are returned only if the policy blocks
+// flagged content.
+func (c *Checker) Check(ctx context.Context, organizationID, stage, text string) (*Result, error) {
+	if !c.Enabled(ctx, organizationID, stage) || text == "" {
+		return nil, nil
+	}
+	policy := c.configs.For(ctx).PolicyFor(organizationID).Moderation
+
+	result, err := c.moderator.Moderate(ctx, text)
+	if err != nil {
+		metrics.ModerationResults.WithLabelValues(organizationID, stage, "error").Inc()
+		if policy.Action == config.ModerationActionBlock {
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return nil, nil
+	}
+
+	categories := relevantCategories(result.Categories, policy.Categories)
+	if !result.Flagged || len(categories) == 0 {
+		metrics.ModerationResults.WithLabelValues(organizationID, stage, "passed").Inc()
+		return nil, nil
+	}
+
+	metrics.ModerationResults.WithLabelValues(organizationID, stage, policy.Action).Inc()
+	switch policy.Action {
+	case config.ModerationActionBlock:
+		return nil, &BlockedError{Stage: stage, Categories: categories}
+	case config.ModerationActionFlag:
+		return &Result{Flagged: true, Categories: categories}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// relevantCategories returns the flagged categories a policy acts on; an
+// empty policy list acts on all of them
+func relevantCategories(flagged, policy []string) []string {
+	if len(policy) == 0 {
+		return flagged
+	}
+	var relevant []string
+	for _, category := range flagged {
+		for _, wanted := range policy {
+			if category == wanted {
+				relevant = append(relevant, category)
+				break
+			}
+		}
+	}
+	return relevant
+}
@@ -0,0 +1,231 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubModerator returns a fixed result or error
+type stubModerator struct {
+	result *Result
+	err    error
+	calls  int
+}
+
+func (m *stubModerator) Moderate(ctx context.Context, text string) (*Result, error) {
+	m.calls++
+	return m.result, m.err
+}
+
+// newTestChecker creates a checker with the moderator, applying the policy to org123
+func newTestChecker(moderator Moderator, policy config.ModerationPolicy) *Checker {
+	cfg := &config.Config{
+		OrgPolicies: map[string]config.OrgPolicy{"org123": {Moderation: policy}},
+	}
+	return &Checker{moderator: moderator, configs: config.NewStore(cfg, nil)}
+}
+
+func TestCheck(t *testing.T) {
+	violence := &Result{Flagged: true, Categories: []string{"harassment", "violence"}}
+	providerErr := errors.New("connection refused")
+
+	tests := []struct {
+		name   string
+		policy config.ModerationPolicy
+		stage  string
+		result *Result
+		err    error
+		// expectedCategories are those of the returned result; nil expects none
+		expectedCategories []string
+		expectedBlocked    []string
+		expectedErr        error
+		expectedCalls      int
+	}{
+		{
+			name:          "moderation disabled",
+			stage:         StageInput,
+			result:        violence,
+			expectedCalls: 0,
+		},
+		{
+			name:            "block flagged content",
+			policy:          config.ModerationPolicy{Action: config.ModerationActionBlock},
+			stage:           StageInput,
+			result:          violence,
+			expectedBlocked: []string{"harassment", "violence"},
+			expectedCalls:   1,
+		},
+		{
+			name:               "flag flagged content",
+			policy:             config.ModerationPolicy{Action: config.ModerationActionFlag},
+			stage:              StageInput,
+			result:             violence,
+			expectedCategories: []string{"harassment", "violence"},
+			expectedCalls:      1,
+		},
+		{
+			name:          "allow flagged content",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionAllow},
+			stage:         StageInput,
+			result:        violence,
+			expectedCalls: 1,
+		},
+		{
+			name:          "content not flagged",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionBlock},
+			stage:         StageInput,
+			result:        &Result{},
+			expectedCalls: 1,
+		},
+		{
+			name:            "only the policy's categories",
+			policy:          config.ModerationPolicy{Action: config.ModerationActionBlock, Categories: []string{"violence", "self-harm"}},
+			stage:           StageInput,
+			result:          violence,
+			expectedBlocked: []string{"violence"},
+			expectedCalls:   1,
+		},
+		{
+			name:          "no category of the policy",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionBlock, Categories: []string{"self-harm"}},
+			stage:         StageInput,
+			result:        violence,
+			expectedCalls: 1,
+		},
+		{
+			name:          "replies not checked",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionBlock},
+			stage:         StageOutput,
+			result:        violence,
+			expectedCalls: 0,
+		},
+		{
+			name:            "replies checked",
+			policy:          config.ModerationPolicy{Action: config.ModerationActionBlock, CheckReplies: true},
+			stage:           StageOutput,
+			result:          violence,
+			expectedBlocked: []string{"harassment", "violence"},
+			expectedCalls:   1,
+		},
+		{
+			name:          "provider error when blocking",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionBlock},
+			stage:         StageInput,
+			err:           providerErr,
+			expectedErr:   ErrUnavailable,
+			expectedCalls: 1,
+		},
+		{
+			name:          "provider error when flagging",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionFlag},
+			stage:         StageInput,
+			err:           providerErr,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moderator := &stubModerator{result: tt.result, err: tt.err}
+			checker := newTestChecker(moderator, tt.policy)
+
+			result, err := checker.Check(context.Background(), "org123", tt.stage, "some content")
+
+			assert.Equal(t, tt.expectedCalls, moderator.calls)
+			switch {
+			case tt.expectedBlocked != nil:
+				var blocked *BlockedError
+				require.True(t, errors.As(err, &blocked))
+				assert.ErrorIs(t, err, ErrContentBlocked)
+				assert.Equal(t, tt.stage, blocked.Stage)
+				assert.Equal(t, tt.expectedBlocked, blocked.Categories)
+				assert.Nil(t, result)
+			case tt.expectedErr != nil:
+				assert.ErrorIs(t, err, tt.expectedErr)
+				assert.Nil(t, result)
+			default:
+				require.NoError(t, err)
+				if tt.expectedCategories == nil {
+					assert.Nil(t, result)
+				} else {
+					require.NotNil(t, result)
+					assert.True(t, result.Flagged)
+					assert.Equal(t, tt.expectedCategories, result.Categories)
+				}
+			}
+		})
+	}
+}
+
+func TestEnabledAndBlocks(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         config.ModerationPolicy
+		expectedInput  [2]bool
+		expectedOutput [2]bool
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:          "block input only",
+			policy:        config.ModerationPolicy{Action: config.ModerationActionBlock},
+			expectedInput: [2]bool{true, true},
+		},
+		{
+			name:           "block input and replies",
+			policy:         config.ModerationPolicy{Action: config.ModerationActionBlock, CheckReplies: true},
+			expectedInput:  [2]bool{true, true},
+			expectedOutput: [2]bool{true, true},
+		},
+		{
+			name:           "flag input and replies",
+			policy:         config.ModerationPolicy{Action: config.ModerationActionFlag, CheckReplies: true},
+			expectedInput:  [2]bool{true, false},
+			expectedOutput: [2]bool{true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := newTestChecker(&stubModerator{}, tt.policy)
+			ctx := context.Background()
+
+			assert.Equal(t, tt.expectedInput[0], checker.Enabled(ctx, "org123", StageInput))
+			assert.Equal(t, tt.expectedInput[1], checker.Blocks(ctx, "org123", StageInput))
+			assert.Equal(t, tt.expectedOutput[0], checker.Enabled(ctx, "org123", StageOutput))
+			assert.Equal(t, tt.expectedOutput[1], checker.Blocks(ctx, "org123", StageOutput))
+			assert.False(t, checker.Enabled(ctx, "org456", StageInput))
+		})
+	}
+}
+
+func TestRuleModerator(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{"self-harm", "I want to end my life", []string{"self-harm"}},
+		{"violence", "I'm going to kill you", []string{"violence"}},
+		{"hate", "We should exterminate all of them", []string{"hate/threatening"}},
+		{"several categories", "I will kill you, then hurt myself", []string{"self-harm", "violence"}},
+		{"harmless", "This build is killing me", nil},
+	}
+
+	moderator := NewRuleModerator()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := moderator.Moderate(context.Background(), tt.text)
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected != nil, result.Flagged)
+			assert.Equal(t, tt.expected, result.Categories)
+		})
+	}
+}
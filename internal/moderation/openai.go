@@ -0,0 +1,69 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAIModerator classifies content with the OpenAI moderation endpoint
+type OpenAIModerator struct {
+	client *openai.Client
+}
+
+// NewOpenAIModerator creates a moderator using the configured OpenAI API
+func NewOpenAIModerator(cfg *config.Config) *OpenAIModerator {
+	clientConfig := openai.DefaultConfig(cfg.OpenAIAPIKey)
+	if cfg.OpenAIBaseURL != "" {
+		clientConfig.BaseURL = cfg.OpenAIBaseURL
+	}
+	return &OpenAIModerator{client: openai.NewClientWithConfig(clientConfig)}
+}
+
+// Moderate implements Moderator
+func (m *OpenAIModerator) Moderate(ctx context.Context, text string) (*Result, error) {
+	// Organizations that don't send raw PII to OpenAI don't for moderation either
+	text = redact.MaskerFromContext(ctx).Mask(text)
+
+	start := time.Now()
+	resp, err := m.client.Moderations(ctx, openai.ModerationRequest{
+		Input: text,
+		Model: openai.ModerationTextLatest,
+	})
+	metrics.UpstreamRequestDuration.WithLabelValues(openai.ModerationTextLatest, "moderation").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to moderate content: %w", err)
+	}
+
+	result := &Result{}
+	for _, r := range resp.Results {
+		if !r.Flagged {
+			continue
+		}
+		result.Flagged = true
+
+		// The categories' JSON names are the category names callers see
+		data, err := json.Marshal(r.Categories)
+		if err != nil {
+			return nil, err
+		}
+		var categories map[string]bool
+		if err := json.Unmarshal(data, &categories); err != nil {
+			return nil, err
+		}
+		for category, flagged := range categories {
+			if flagged {
+				result.Categories = append(result.Categories, category)
+			}
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
@@ -0,0 +1,44 @@
+package moderation
+
+import (
+	"context"
+	"regexp"
+	"sort"
+)
+
+// defaultRules are the expressions of the rule-based moderator per category.
+// They use the same category names as the OpenAI moderation endpoint.
+var defaultRules = map[string]string{
+	"self-harm":        `(?i)\b(kill|hurt|harm|cut)\s+my\s*self\b|\bsuicid(e|al)\b|\bend\s+my\s+life\b`,
+	"violence":         `(?i)\b(i\s+will|i'?m\s+going\s+to|gonna)\s+(kill|murder|stab|shoot)\s+(you|him|her|them)\b`,
+	"hate/threatening": `(?i)\b(exterminate|wipe\s+out)\s+(all|every)\s+\w+`,
+	"sexual/minors":    `(?i)\b(child|minor|underage)\s+(porn|sex)`,
+}
+
+// RuleModerator classifies content locally with regular expressions per
+// category. It catches only blatant cases, but needs no network calls.
+type RuleModerator struct {
+	rules map[string]*regexp.Regexp
+}
+
+// NewRuleModerator creates a rule-based moderator with the built-in rules
+func NewRuleModerator() *RuleModerator {
+	rules := make(map[string]*regexp.Regexp, len(defaultRules))
+	for category, pattern := range defaultRules {
+		rules[category] = regexp.MustCompile(pattern)
+	}
+	return &RuleModerator{rules: rules}
+}
+
+// Moderate implements Moderator
+func (m *RuleModerator) Moderate(ctx context.Context, text string) (*Result, error) {
+	result := &Result{}
+	for category, re := range m.rules {
+		if re.MatchString(text) {
+			result.Flagged = true
+			result.Categories = append(result.Categories, category)
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
@@ -0,0 +1,211 @@
+package openai
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/sashabaranov/go-openai"
+)
+
+// CacheOptions configures the caching of a run's reply in the response cache
+// and the semantic cache
+type CacheOptions struct {
+	// OrganizationID and AgentID scope the cached replies. UserID is recorded
+	// with them so the user's data can be erased.
+	OrganizationID string
+	AgentID        string
+	UserID         string
+	TTL            time.Duration
+	// Boundary is the random boundary of the files in the system prompt. It is
+	// left out of cache keys so requests with the same files share replies.
+	Boundary string
+	// Semantic also caches the reply to the first question of a conversation
+	// in the semantic cache, and answers questions similar to it by at least
+	// Threshold with it
+	Semantic  bool
+	Threshold float64
+}
+
+// cacheLookup is a run's lookup in the caches, with what's needed to cache
+// its reply if it missed
+type cacheLookup struct {
+	// key is the reply's key in the response cache, or "" if the reply isn't
+	// cached there
+	key string
+	// query is the run's question in the semantic cache, with its embedding,
+	// or nil if the reply isn't cached there
+	query     *semanticcache.Query
+	embedding []float32
+}
+
+// cachedReply is a reply found in the caches
+type cachedReply struct {
+	content string
+	model   string
+	// similarity is the similarity of the questions of a reply from the
+	// semantic cache
+	similarity float64
+}
+
+// lookupCache looks up the reply to a run with the given messages in the
+// response cache, then in the semantic cache. Failed lookups are logged and
+// count as misses.
+func (c *Client) lookupCache(ctx context.Context, opts RunOptions, messages []openai.ChatCompletionMessage) (*cacheLookup, *cachedReply) {
+	lookup := &cacheLookup{}
+	if opts.Cache == nil {
+		return lookup, nil
+	}
+	if boundary := opts.Cache.Boundary; boundary != "" {
+		unbounded := make([]openai.ChatCompletionMessage, len(messages))
+		for i, message := range messages {
+			message.Content = strings.ReplaceAll(message.Content, boundary, "")
+			unbounded[i] = message
+		}
+		messages = unbounded
+	}
+
+	if c.responseCache != nil {
+		lookup.key = responsecache.Key(opts.Cache.OrganizationID, opts.Cache.AgentID, opts.request(messages))
+		entry, err := c.responseCache.Get(ctx, lookup.key)
+		if err != nil {
+			c.logger(ctx).Warnf("Failed to look up cached reply: %v", err)
+		}
+		metrics.ResponseCacheLookups.WithLabelValues(opts.Cache.OrganizationID, opts.Cache.AgentID, cacheResult(entry != nil, err)).Inc()
+		if err == nil && entry != nil {
+			return lookup, &cachedReply{content: entry.Content, model: entry.Model}
+		}
+	}
+
+	if c.semanticCache == nil {
+		return lookup, nil
+	}
+	query := semanticQuery(opts, messages)
+	if query == nil {
+		return lookup, nil
+	}
+	if personalQuestion(ctx, query.Question) {
+		metrics.SemanticCacheLookups.WithLabelValues(opts.Cache.OrganizationID, opts.Cache.AgentID, "skipped").Inc()
+		return lookup, nil
+	}
+	match, embedding, err := c.semanticCache.Lookup(ctx, *query)
+	metrics.SemanticCacheLookups.WithLabelValues(opts.Cache.OrganizationID, opts.Cache.AgentID, cacheResult(match != nil, err)).Inc()
+	if err != nil {
+		c.logger(ctx).Warnf("Failed to look up similar question: %v", err)
+		return lookup, nil
+	}
+	if match != nil {
+		return lookup, &cachedReply{content: match.Content, model: match.Model, similarity: match.Similarity}
+	}
+	lookup.query, lookup.embedding = query, embedding
+	return lookup, nil
+}
+
+// semanticQuery returns the question of a run with the given messages in the
+// semantic cache, or nil if the run doesn't cache its reply there. Only the
+// first question of a conversation is, as the replies to later ones depend on
+// the conversation. Questions share replies if everything else sent with
+// them, including the system prompt, is the same.
+func semanticQuery(opts RunOptions, messages []openai.ChatCompletionMessage) *semanticcache.Query {
+	if !opts.Cache.Semantic || len(messages) == 0 {
+		return nil
+	}
+	instructions := messages[:len(messages)-1]
+	if len(instructions) > 1 || (len(instructions) == 1 && instructions[0].Role != openai.ChatMessageRoleSystem) {
+		return nil
+	}
+	question := messages[len(messages)-1]
+	if question.Role != openai.ChatMessageRoleUser {
+		return nil
+	}
+	return &semanticcache.Query{
+		OrganizationID: opts.Cache.OrganizationID,
+		AgentID:        opts.Cache.AgentID,
+		Fingerprint:    responsecache.Key(opts.Cache.OrganizationID, opts.Cache.AgentID, opts.request(instructions)),
+		Question:       question.Content,
+		Threshold:      opts.Cache.Threshold,
+	}
+}
+
+// personalQuestion reports whether a question names someone or something in
+// particular, such as an email address or an order number. Its answer may be
+// personal and mustn't be given to a similar question naming someone else, so
+// it isn't answered from or added to the semantic cache. Questions with any
+// digits or with values the organization's masker or the built-in detectors
+// find are.
+func personalQuestion(ctx context.Context, question string) bool {
+	return strings.ContainsFunc(question, unicode.IsDigit) ||
+		redact.MaskerFromContext(ctx).Detects(question) ||
+		redact.Default().Detects(question)
+}
+
+// cacheResult returns the result label of a cache lookup
+func cacheResult(hit bool, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case hit:
+		return "hit"
+	default:
+		return "miss"
+	}
+}
+
+// cachedResult completes a run with a cached reply, which uses no tokens
+func (c *Client) cachedResult(threadID string, opts RunOptions, reply *cachedReply) *RunResult {
+	c.appendAssistantMessage(threadID, opts, reply.content, 0)
+	return &RunResult{
+		Content:         reply.content,
+		Model:           reply.model,
+		Cached:          true,
+		CacheSimilarity: reply.similarity,
+	}
+}
+
+// CommitCachedReply caches the reply of a run that missed the caches, if the
+// run's options cache it. Runs don't cache their replies themselves, so that
+// callers can commit a reply once they accept it, e.g. after moderation, and
+// replies they reject are never answered from the caches.
+func (c *Client) CommitCachedReply(ctx context.Context, result *RunResult) {
+	if result.Cached || result.lookup == nil {
+		return
+	}
+	c.cacheReply(ctx, result.lookup, result.opts, result.Content, result.finishReason)
+}
+
+// cacheReply caches the reply to a run that missed the caches. Truncated and
+// empty replies aren't cached, and failures are logged.
+func (c *Client) cacheReply(ctx context.Context, lookup *cacheLookup, opts RunOptions, content string, finishReason openai.FinishReason) {
+	if content == "" || finishReason == openai.FinishReasonLength {
+		return
+	}
+	now := time.Now()
+	if lookup.key != "" {
+		err := c.responseCache.Set(ctx, lookup.key, &responsecache.Entry{
+			Content:        content,
+			Model:          opts.Model,
+			OrganizationID: opts.Cache.OrganizationID,
+			AgentID:        opts.Cache.AgentID,
+			UserID:         opts.Cache.UserID,
+			CreatedAt:      now,
+			ExpiresAt:      now.Add(opts.Cache.TTL),
+		})
+		if err != nil {
+			c.logger(ctx).Warnf("Failed to cache reply: %v", err)
+		}
+	}
+	if lookup.query != nil {
+		c.semanticCache.Add(*lookup.query, lookup.embedding, semanticcache.Entry{
+			Content:   content,
+			Model:     opts.Model,
+			UserID:    opts.Cache.UserID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(opts.Cache.TTL),
+		})
+	}
+}
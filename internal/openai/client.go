@@ -2,71 +2,163 @@ package openai
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
 	"github.com/sashabaranov/go-openai"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrResponseNotFound is returned by SetFeedback when the session's thread
+// isn't cached or has no reply with the response ID
+var ErrResponseNotFound = errors.New("response not found")
+
+// ErrSessionNotFound is returned by GetOrCreateThread for sessions of other
+// organizations or agents, so their IDs can't be probed or joined
+var ErrSessionNotFound = errors.New("session not found")
+
 // Client wraps the OpenAI client with additional functionality
 type Client struct {
 	client      *openai.Client
 	log         *logrus.Logger
 	threadCache map[string]*models.ThreadInfo
 	threadMutex sync.RWMutex
+	maxRetries  int
+	retryDelay  time.Duration
+
+	// httpClient, baseURL and apiKey make the requests the go-openai client
+	// can't, such as embeddings with embeddingModel
+	httpClient     *http.Client
+	baseURL        string
+	apiKey         string
+	embeddingModel string
+
+	// responseCache and semanticCache cache the replies of runs with
+	// CacheOptions
+	responseCache responsecache.Store
+	semanticCache *semanticcache.Cache
+
+	sessionConcurrency string
+	sessionGates       map[string]*sessionGate
+	runMutex           sync.Mutex
 }
 
-// NewClient creates a new OpenAI client wrapper
-func NewClient(apiKey string, log *logrus.Logger) *Client {
+// NewClient creates a new OpenAI client wrapper. Replies aren't cached in
+// responseCache if it is nil, nor in a semantic cache until one is set with
+// SetSemanticCache.
+func NewClient(cfg *config.Config, log *logrus.Logger, responseCache responsecache.Store) *Client {
+	clientConfig := openai.DefaultConfig(cfg.OpenAIAPIKey)
+	if cfg.OpenAIBaseURL != "" {
+		clientConfig.BaseURL = cfg.OpenAIBaseURL
+	}
+
 	return &Client{
-		client:      openai.NewClient(apiKey),
-		log:         log,
-		threadCache: make(map[string]*models.ThreadInfo),
+		client:             openai.NewClientWithConfig(clientConfig),
+		log:                log,
+		threadCache:        make(map[string]*models.ThreadInfo),
+		maxRetries:         cfg.MaxRetries,
+		retryDelay:         cfg.RetryDelay,
+		httpClient:         clientConfig.HTTPClient,
+		baseURL:            clientConfig.BaseURL,
+		apiKey:             cfg.OpenAIAPIKey,
+		embeddingModel:     cfg.EmbeddingModel,
+		sessionConcurrency: cfg.SessionConcurrency,
+		sessionGates:       make(map[string]*sessionGate),
+		responseCache:      responseCache,
 	}
 }
 
-// GetOrCreateThread gets an existing thread or creates a new one
-func (c *Client) GetOrCreateThread(ctx context.Context, sessionID, agentID, userID string) (*models.ThreadInfo, error) {
+// SetSemanticCache caches the replies of runs with semantic CacheOptions in
+// semanticCache. The cache may embed questions with the client, so it is set
+// once both exist, before the client is used.
+func (c *Client) SetSemanticCache(semanticCache *semanticcache.Cache) {
+	c.semanticCache = semanticCache
+}
+
+// GetOrCreateThread gets an existing thread or creates a new one. Users other
+// than the one who started an existing thread become its participants; other
+// organizations and agents get ErrSessionNotFound.
+func (c *Client) GetOrCreateThread(ctx context.Context, sessionID, organizationID, agentID, userID string) (*models.ThreadInfo, error) {
+	_, span := tracing.Tracer().Start(ctx, "openai.GetOrCreateThread", trace.WithAttributes(
+		tracing.AttrSessionID.String(sessionID),
+		tracing.AttrAgentID.String(agentID),
+	))
+	defer span.End()
+
 	// Check cache first
 	c.threadMutex.RLock()
 	thread, exists := c.threadCache[sessionID]
 	c.threadMutex.RUnlock()
+	span.SetAttributes(attribute.Bool("chat.thread_cached", exists))
 
 	if exists {
+		if thread.OrganizationID != organizationID || thread.AgentID != agentID {
+			return nil, ErrSessionNotFound
+		}
+
 		// Update last used time
 		c.threadMutex.Lock()
 		thread.LastUsed = time.Now()
+		if userID != "" && !thread.HasUser(userID) {
+			thread.Participants = append(thread.Participants, userID)
+		}
 		c.threadMutex.Unlock()
 		return thread, nil
 	}
 
 	// Create a new thread
-	c.log.Infof("Creating new thread for session %s", sessionID)
+	c.logger(ctx).Infof("Creating new thread for session %s", sessionID)
 	
 	// Create the thread info
 	threadInfo := &models.ThreadInfo{
-		ThreadID:  sessionID, // Use sessionID as threadID for simplicity
-		SessionID: sessionID,
-		AgentID:   agentID,
-		UserID:    userID,
-		Messages:  []openai.ChatCompletionMessage{},
-		CreatedAt: time.Now(),
-		LastUsed:  time.Now(),
+		ThreadID:       sessionID, // Use sessionID as threadID for simplicity
+		SessionID:      sessionID,
+		OrganizationID: organizationID,
+		AgentID:        agentID,
+		UserID:         userID,
+		Messages:       []models.ThreadMessage{},
+		CreatedAt:      time.Now(),
+		LastUsed:       time.Now(),
 	}
 	
 	c.threadMutex.Lock()
 	c.threadCache[sessionID] = threadInfo
+	metrics.ThreadCacheSize.Set(float64(len(c.threadCache)))
 	c.threadMutex.Unlock()
 	
 	return threadInfo, nil
 }
 
 // AddMessageToThread adds a message to a thread
-func (c *Client) AddMessageToThread(ctx context.Context, threadID, content string) error {
+func (c *Client) AddMessageToThread(ctx context.Context, threadID, content string) (err error) {
+	_, span := tracing.Tracer().Start(ctx, "openai.AddMessageToThread", trace.WithAttributes(
+		tracing.AttrThreadID.String(threadID),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	// Don't leave a user turn behind for a run that was already cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	c.threadMutex.Lock()
 	defer c.threadMutex.Unlock()
 	
@@ -76,59 +168,496 @@ func (c *Client) AddMessageToThread(ctx context.Context, threadID, content strin
 	}
 	
 	// Add user message to the thread
-	thread.Messages = append(thread.Messages, openai.ChatCompletionMessage{
-		Role:    "user",
-		Content: content,
+	thread.Messages = append(thread.Messages, models.ThreadMessage{
+		ChatCompletionMessage: openai.ChatCompletionMessage{
+			Role:    "user",
+			Content: content,
+		},
+		Time: time.Now(),
 	})
 	
 	return nil
 }
 
-// RunThread runs a thread with the model and returns the assistant's response
-func (c *Client) RunThread(ctx context.Context, threadID, model string) (string, error) {
-	c.threadMutex.RLock()
+// SeedThread fills a thread that has no messages yet with prior conversation
+// history, e.g. from before the thread was cached. Threads that already have
+// messages are left unchanged, and whether the thread was seeded is returned.
+func (c *Client) SeedThread(ctx context.Context, threadID string, messages []models.ThreadMessage) (bool, error) {
+	c.threadMutex.Lock()
+	defer c.threadMutex.Unlock()
+
 	thread, exists := c.threadCache[threadID]
 	if !exists {
-		c.threadMutex.RUnlock()
-		return "", fmt.Errorf("thread %s not found", threadID)
+		return false, fmt.Errorf("thread %s not found", threadID)
+	}
+	if len(thread.Messages) > 0 || len(messages) == 0 {
+		return false, nil
+	}
+	thread.Messages = append([]models.ThreadMessage{}, messages...)
+	c.logger(ctx).Infof("Seeded thread %s with %d messages of history", threadID, len(messages))
+	return true, nil
+}
+
+// RunOptions configures a thread run
+type RunOptions struct {
+	Model string
+	// SystemPrompt is sent ahead of the thread's messages on every run
+	// without becoming part of the thread
+	SystemPrompt string
+	// Temperature and MaxTokens are left to the upstream default when zero
+	Temperature float32
+	MaxTokens   int
+	// Tools are the functions the model may call
+	Tools []models.Tool
+	// ResponseID identifies the reply in the thread
+	ResponseID string
+	// Cache answers the run from the response cache if it holds the reply to
+	// the run's request, and caches the reply otherwise. Nil disables caching.
+	Cache *CacheOptions
+}
+
+// RunResult is the outcome of running a thread
+type RunResult struct {
+	Content string
+	Model   string
+	Usage   openai.Usage
+	// UsageEstimated is set when the upstream didn't report token usage, as
+	// for streamed responses, and Usage was estimated from the text length
+	UsageEstimated bool
+	// Cached is set when the reply came from the response or semantic cache,
+	// using no tokens. CacheSimilarity is the similarity of the questions of a
+	// reply from the semantic cache.
+	Cached          bool
+	CacheSimilarity float64
+
+	// opts, lookup and finishReason are kept for CommitCachedReply
+	opts         RunOptions
+	lookup       *cacheLookup
+	finishReason openai.FinishReason
+}
+
+// RunThread runs a thread with the model and returns the assistant's response
+func (c *Client) RunThread(ctx context.Context, threadID string, opts RunOptions) (result *RunResult, err error) {
+	model := opts.Model
+	ctx, span := startRunThreadSpan(ctx, "openai.RunThread", threadID, model)
+	defer func() { endRunThreadSpan(span, result, err) }()
+
+	messages, err := c.threadMessages(threadID)
+	if err != nil {
+		return nil, err
 	}
 	
-	// Make a copy of the messages to avoid race conditions
-	messages := make([]openai.ChatCompletionMessage, len(thread.Messages))
-	copy(messages, thread.Messages)
-	c.threadMutex.RUnlock()
-	
-	// Create chat completion request
-	req := openai.ChatCompletionRequest{
-		Model:    model,
-		Messages: messages,
+	// Answer from the caches if they hold the reply
+	messages = opts.messages(messages)
+	lookup, cached := c.lookupCache(ctx, opts, messages)
+	if cached != nil {
+		return c.cachedResult(threadID, opts, cached), nil
 	}
 	
+	// Create chat completion request, masking sensitive values if the
+	// organization's policy requires it
+	masker := redact.MaskerFromContext(ctx)
+	req := opts.request(maskMessages(masker, messages))
+	
 	// Call the OpenAI API
-	resp, err := c.client.CreateChatCompletion(ctx, req)
+	var resp openai.ChatCompletionResponse
+	err = c.withRetry(ctx, model, "chat_completion", func() error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, req)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create chat completion: %w", err)
+		c.rollbackTurn(ctx, threadID)
+		return nil, fmt.Errorf("failed to create chat completion: %w", err)
 	}
 	
 	if len(resp.Choices) == 0 {
-		return "", errors.New("no response choices returned")
+		c.rollbackTurn(ctx, threadID)
+		return nil, errors.New("no response choices returned")
+	}
+	if resp.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+		c.rollbackTurn(ctx, threadID)
+		metrics.UpstreamErrors.WithLabelValues(model, errorKindLabel(ErrContentFiltered)).Inc()
+		return nil, &Error{Kind: ErrContentFiltered}
 	}
 	
 	// Get the assistant's response
-	assistantResponse := resp.Choices[0].Message.Content
+	assistantResponse := masker.Restore(resp.Choices[0].Message.Content)
+	c.appendAssistantMessage(threadID, opts, assistantResponse, resp.Usage.TotalTokens)
+	
+	return &RunResult{
+		Content:      assistantResponse,
+		Model:        model,
+		Usage:        resp.Usage,
+		opts:         opts,
+		lookup:       lookup,
+		finishReason: resp.Choices[0].FinishReason,
+	}, nil
+}
+
+// RunThreadStream runs a thread with the model, calling onDelta for every
+// content fragment as it arrives, and returns the complete assistant response.
+// Returning an error from onDelta aborts the stream.
+func (c *Client) RunThreadStream(ctx context.Context, threadID string, opts RunOptions, onDelta func(delta string) error) (result *RunResult, err error) {
+	model := opts.Model
+	ctx, span := startRunThreadSpan(ctx, "openai.RunThreadStream", threadID, model)
+	defer func() { endRunThreadSpan(span, result, err) }()
+
+	messages, err := c.threadMessages(threadID)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Answer from the caches if they hold the reply, in one delta
+	messages = opts.messages(messages)
+	lookup, cached := c.lookupCache(ctx, opts, messages)
+	if cached != nil {
+		if err := onDelta(cached.content); err != nil {
+			c.rollbackTurn(ctx, threadID)
+			return nil, err
+		}
+		return c.cachedResult(threadID, opts, cached), nil
+	}
+	
+	masker := redact.MaskerFromContext(ctx)
+	req := opts.request(maskMessages(masker, messages))
+	req.Stream = true
+	
+	var stream *openai.ChatCompletionStream
+	err = c.withRetry(ctx, model, "chat_completion_stream", func() error {
+		var err error
+		stream, err = c.client.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		c.rollbackTurn(ctx, threadID)
+		return nil, fmt.Errorf("failed to create chat completion stream: %w", err)
+	}
+	defer stream.Close()
+	
+	var builder strings.Builder
+	var finishReason openai.FinishReason
+	restorer := masker.NewStreamRestorer()
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			err = classifyError(ctx, err)
+			metrics.UpstreamErrors.WithLabelValues(model, errorKindLabel(err)).Inc()
+			c.rollbackTurn(ctx, threadID)
+			return nil, fmt.Errorf("failed to receive chat completion stream: %w", err)
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if chunk.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+			c.rollbackTurn(ctx, threadID)
+			metrics.UpstreamErrors.WithLabelValues(model, errorKindLabel(ErrContentFiltered)).Inc()
+			return nil, &Error{Kind: ErrContentFiltered}
+		}
+		if chunk.Choices[0].FinishReason != "" {
+			finishReason = chunk.Choices[0].FinishReason
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		
+		delta := restorer.Write(chunk.Choices[0].Delta.Content)
+		if delta == "" {
+			continue
+		}
+		builder.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			c.rollbackTurn(ctx, threadID)
+			return nil, err
+		}
+	}
+	if delta := restorer.Flush(); delta != "" {
+		builder.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			c.rollbackTurn(ctx, threadID)
+			return nil, err
+		}
+	}
+	
+	assistantResponse := builder.String()
 	
-	// Add the assistant's response to the thread
+	// Streamed responses don't report usage, so estimate it
+	usage := openai.Usage{
+		PromptTokens:     estimateTokens(messages...),
+		CompletionTokens: estimateTokens(openai.ChatCompletionMessage{Content: assistantResponse}),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	c.appendAssistantMessage(threadID, opts, assistantResponse, usage.TotalTokens)
+	
+	return &RunResult{
+		Content:        assistantResponse,
+		Model:          model,
+		Usage:          usage,
+		UsageEstimated: true,
+		opts:           opts,
+		lookup:         lookup,
+		finishReason:   finishReason,
+	}, nil
+}
+
+// messages returns the messages to send for a run of a thread with the given messages
+func (opts RunOptions) messages(thread []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if opts.SystemPrompt == "" {
+		return thread
+	}
+	return append([]openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: opts.SystemPrompt,
+	}}, thread...)
+}
+
+// zeroTemperature is sent for a temperature of 0. The OpenAI client leaves a
+// temperature of 0 out of requests, which then run with the model's default,
+// so the smallest temperature above 0 is sent instead; it samples like 0.
+const zeroTemperature = math.SmallestNonzeroFloat32
+
+// Temperature converts an optional sampling temperature into that of
+// RunOptions and chat completion requests, where 0 means the model's default
+func Temperature(temperature *float64) float32 {
+	switch {
+	case temperature == nil:
+		return 0
+	case *temperature == 0:
+		return zeroTemperature
+	default:
+		return float32(*temperature)
+	}
+}
+
+// request builds the chat completion request of a run
+func (opts RunOptions) request(messages []openai.ChatCompletionMessage) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model:       opts.Model,
+		Messages:    messages,
+		Temperature: opts.Temperature,
+		MaxTokens:   opts.MaxTokens,
+		Functions:   functions(opts.Tools),
+	}
+}
+
+// noParameters is the JSON schema of functions without arguments, which
+// OpenAI requires functions to have
+var noParameters = json.RawMessage(`{"type":"object","properties":{}}`)
+
+// functions describes tools as the functions of a chat completion request
+func functions(tools []models.Tool) []openai.FunctionDefinition {
+	if len(tools) == 0 {
+		return nil
+	}
+	definitions := make([]openai.FunctionDefinition, len(tools))
+	for i, tool := range tools {
+		parameters := tool.Parameters
+		if len(parameters) == 0 {
+			parameters = noParameters
+		}
+		definitions[i] = openai.FunctionDefinition{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  parameters,
+		}
+	}
+	return definitions
+}
+
+// maskMessages returns a copy of messages with sensitive values masked, or
+// messages itself if there is no masker
+func maskMessages(masker *redact.Masker, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if masker == nil {
+		return messages
+	}
+	masked := make([]openai.ChatCompletionMessage, len(messages))
+	for i, message := range messages {
+		message.Content = masker.Mask(message.Content)
+		masked[i] = message
+	}
+	return masked
+}
+
+// startRunThreadSpan starts the span of a thread run
+func startRunThreadSpan(ctx context.Context, name, threadID, model string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(
+		tracing.AttrThreadID.String(threadID),
+		tracing.AttrModel.String(model),
+	))
+}
+
+// endRunThreadSpan records the token usage of a successful run on its span
+// and ends it
+func endRunThreadSpan(span trace.Span, result *RunResult, err error) {
+	if result != nil {
+		span.SetAttributes(
+			tracing.AttrPromptTokens.Int(result.Usage.PromptTokens),
+			tracing.AttrCompletionTokens.Int(result.Usage.CompletionTokens),
+			attribute.Bool("gen_ai.usage.estimated", result.UsageEstimated),
+			attribute.Bool("chat.response_cached", result.Cached),
+		)
+	}
+	tracing.EndSpan(span, err)
+}
+
+// estimateTokens roughly estimates the number of tokens in messages, at
+// about four characters per token
+func estimateTokens(messages ...openai.ChatCompletionMessage) int {
+	chars := 0
+	for _, message := range messages {
+		chars += len(message.Content)
+	}
+	return (chars + 3) / 4
+}
+
+// withRetry calls fn, retrying retryable upstream errors with exponential
+// backoff up to the configured number of retries. The returned error is
+// classified into one of the error kinds where possible. Every attempt is
+// recorded in the upstream metrics under the model and operation and traced
+// as a client span of its own.
+func (c *Client) withRetry(ctx context.Context, model, operation string, fn func() error) error {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		_, span := tracing.Tracer().Start(ctx, "openai.upstream."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				tracing.AttrModel.String(model),
+				tracing.AttrAttempt.Int(attempt+1),
+			),
+		)
+		start := time.Now()
+		err := classifyError(ctx, fn())
+		metrics.UpstreamRequestDuration.WithLabelValues(model, operation).Observe(time.Since(start).Seconds())
+		tracing.EndSpan(span, err)
+		if err != nil {
+			metrics.UpstreamErrors.WithLabelValues(model, errorKindLabel(err)).Inc()
+		}
+		if err == nil || attempt >= c.maxRetries || !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		c.logger(ctx).Warnf("Retrying upstream call after error (attempt %d of %d): %v", attempt+1, c.maxRetries, err)
+		metrics.UpstreamRetries.WithLabelValues(model).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// threadMessages returns a copy of the thread's messages so they can be sent
+// upstream without holding the cache lock
+func (c *Client) threadMessages(threadID string) ([]openai.ChatCompletionMessage, error) {
+	c.threadMutex.RLock()
+	defer c.threadMutex.RUnlock()
+	
+	thread, exists := c.threadCache[threadID]
+	if !exists {
+		return nil, fmt.Errorf("thread %s not found", threadID)
+	}
+	
+	messages := make([]openai.ChatCompletionMessage, len(thread.Messages))
+	for i, message := range thread.Messages {
+		messages[i] = message.ChatCompletionMessage
+	}
+	return messages, nil
+}
+
+// rollbackTurn removes the trailing user message of a thread whose run
+// failed without a reply, whether it was cancelled, rejected or failed
+// upstream, so a retry of the message doesn't add it twice and a message
+// that can't be answered doesn't break the rest of the conversation
+func (c *Client) rollbackTurn(ctx context.Context, threadID string) {
 	c.threadMutex.Lock()
-	thread, stillExists := c.threadCache[threadID]
-	if stillExists {
-		thread.Messages = append(thread.Messages, openai.ChatCompletionMessage{
-			Role:    "assistant",
-			Content: assistantResponse,
-		})
+	defer c.threadMutex.Unlock()
+
+	thread, exists := c.threadCache[threadID]
+	if !exists || len(thread.Messages) == 0 {
+		return
 	}
-	c.threadMutex.Unlock()
+	if last := thread.Messages[len(thread.Messages)-1]; last.Role == "user" {
+		thread.Messages = thread.Messages[:len(thread.Messages)-1]
+		c.logger(ctx).Infof("Rolled back unanswered user message in thread %s", threadID)
+	}
+}
+
+// DiscardLastTurn removes the last exchange, the trailing assistant reply and
+// the user message it answered, from a thread. It is used when a reply must
+// not become part of the conversation, e.g. because moderation blocked it.
+func (c *Client) DiscardLastTurn(ctx context.Context, threadID string) error {
+	c.threadMutex.Lock()
+	defer c.threadMutex.Unlock()
+
+	thread, exists := c.threadCache[threadID]
+	if !exists {
+		return fmt.Errorf("thread %s not found", threadID)
+	}
+	messages := thread.Messages
+	if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+		messages = messages[:n-1]
+	}
+	if n := len(messages); n > 0 && messages[n-1].Role == "user" {
+		messages = messages[:n-1]
+	}
+	thread.Messages = messages
+	c.logger(ctx).Infof("Discarded last turn of thread %s", threadID)
+	return nil
+}
+
+// appendAssistantMessage adds the assistant's response to a run to the thread
+// if it is still cached
+func (c *Client) appendAssistantMessage(threadID string, opts RunOptions, content string, tokens int) {
+	c.threadMutex.Lock()
+	defer c.threadMutex.Unlock()
 	
-	return assistantResponse, nil
+	if thread, exists := c.threadCache[threadID]; exists {
+		thread.SystemPrompt = opts.SystemPrompt
+		thread.Messages = append(thread.Messages, models.ThreadMessage{
+			ChatCompletionMessage: openai.ChatCompletionMessage{
+				Role:    "assistant",
+				Content: content,
+			},
+			Time:       time.Now(),
+			ResponseID: opts.ResponseID,
+			Model:      opts.Model,
+			TokensUsed: tokens,
+		})
+	}
+}
+
+// SetFeedback records feedback on the reply with the response ID in the
+// session's cached thread, if it belongs to the organization, replacing any
+// earlier feedback on the reply. It returns a copy of the thread without its
+// messages, and the earlier feedback, if any.
+func (c *Client) SetFeedback(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error) {
+	c.threadMutex.Lock()
+	defer c.threadMutex.Unlock()
+
+	thread, exists := c.threadCache[sessionID]
+	if !exists || thread.OrganizationID != organizationID || responseID == "" {
+		return nil, nil, ErrResponseNotFound
+	}
+	for i := range thread.Messages {
+		if thread.Messages[i].ResponseID == responseID {
+			previous := thread.Messages[i].Feedback
+			thread.Messages[i].Feedback = &feedback
+			info := *thread
+			info.Messages = nil
+			return &info, previous, nil
+		}
+	}
+	return nil, nil, ErrResponseNotFound
+}
+
+// logger returns the request-scoped log entry carried by ctx, falling back to
+// the client's logger
+func (c *Client) logger(ctx context.Context) *logrus.Entry {
+	return logging.FromContext(ctx, c.log)
 }
 
 // CleanupOldCacheEntries removes old entries from the cache
@@ -141,7 +670,68 @@ func (c *Client) CleanupOldCacheEntries(threadTTL time.Duration) {
 		if now.Sub(thread.LastUsed) > threadTTL {
 			c.log.Infof("Removing thread %s from cache due to TTL expiration", thread.ThreadID)
 			delete(c.threadCache, sessionID)
+			metrics.ThreadCacheEvictions.Inc()
 		}
 	}
+	metrics.ThreadCacheSize.Set(float64(len(c.threadCache)))
 	c.threadMutex.Unlock()
 }
+
+// PurgeThreads removes every cached thread matched by match and returns how
+// many were removed
+func (c *Client) PurgeThreads(match func(thread *models.ThreadInfo) bool) int {
+	c.threadMutex.Lock()
+	defer c.threadMutex.Unlock()
+
+	purged := 0
+	for sessionID, thread := range c.threadCache {
+		if match(thread) {
+			delete(c.threadCache, sessionID)
+			purged++
+		}
+	}
+	metrics.ThreadCacheSize.Set(float64(len(c.threadCache)))
+	return purged
+}
+
+// Threads returns copies of the cached threads matched by match, oldest first
+func (c *Client) Threads(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo {
+	c.threadMutex.RLock()
+	defer c.threadMutex.RUnlock()
+
+	var threads []*models.ThreadInfo
+	for _, thread := range c.threadCache {
+		if match(thread) {
+			threads = append(threads, copyThread(thread))
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].CreatedAt.Before(threads[j].CreatedAt)
+	})
+	return threads
+}
+
+// copyThread returns a copy of a thread whose messages and feedback can be
+// read without holding the cache lock
+func copyThread(thread *models.ThreadInfo) *models.ThreadInfo {
+	info := *thread
+	info.Participants = append([]string(nil), thread.Participants...)
+	info.Messages = make([]models.ThreadMessage, len(thread.Messages))
+	for i, message := range thread.Messages {
+		if message.Feedback != nil {
+			feedback := *message.Feedback
+			message.Feedback = &feedback
+		}
+		info.Messages[i] = message
+	}
+	return &info
+}
+
+// Ping checks that the OpenAI API is reachable and accepts the API key by
+// listing models, without retrying
+func (c *Client) Ping(ctx context.Context) error {
+	if _, err := c.client.ListModels(ctx); err != nil {
+		return classifyError(ctx, err)
+	}
+	return nil
+}
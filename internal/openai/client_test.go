@@ -0,0 +1,801 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient creates a client backed by a fake chat completions API that
+// replies to the last user message with "reply to <message>"
+func newTestClient(t *testing.T, sessionConcurrency string) *Client {
+	return newTestClientWithHandler(t, &config.Config{SessionConcurrency: sessionConcurrency}, echoHandler)
+}
+
+// newTestClientWithHandler creates a client backed by a fake API served by handler
+func newTestClientWithHandler(t *testing.T, cfg *config.Config, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	cfg.OpenAIAPIKey = "test-key"
+	cfg.OpenAIBaseURL = server.URL + "/v1"
+	return NewClient(cfg, log, nil)
+}
+
+// echoHandler is a fake chat completions API that replies to the last user
+// message with "reply to <message>"
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Give concurrent requests a chance to interleave
+	time.Sleep(time.Millisecond)
+
+	last := req.Messages[len(req.Messages)-1]
+	_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		Model: req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    "assistant",
+				Content: "reply to " + last.Content,
+			},
+		}},
+	})
+}
+
+// errorHandler is a fake API that fails every request with the given status and code
+func errorHandler(status int, code string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error": map[string]any{
+				"message": "upstream error",
+				"type":    "test_error",
+				"code":    code,
+			},
+		})
+	}
+}
+
+// runTurn performs one chat turn the way the chat handler does
+func runTurn(ctx context.Context, c *Client, sessionID, message string) error {
+	ctx, done, err := c.StartRun(ctx, sessionID, "org123", "user123")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	thread, err := c.GetOrCreateThread(ctx, sessionID, "org123", "agent123", "user123")
+	if err != nil {
+		return err
+	}
+	if err := c.AddMessageToThread(ctx, thread.ThreadID, message); err != nil {
+		return err
+	}
+	_, err = c.RunThread(ctx, thread.ThreadID, RunOptions{Model: "gpt-4o"})
+	return err
+}
+
+func TestGetOrCreateThreadRejectsOtherOrganizationsAndAgents(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+	ctx := context.Background()
+	thread, err := c.GetOrCreateThread(ctx, "session123", "org123", "agent123", "user123")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		organizationID string
+		agentID        string
+		userID         string
+		expectedErr    error
+	}{
+		{"same organization and agent", "org123", "agent123", "user123", nil},
+		{"other user", "org123", "agent123", "user456", nil},
+		{"other organization", "org456", "agent123", "user123", ErrSessionNotFound},
+		{"other agent", "org123", "agent456", "user123", ErrSessionNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			joined, err := c.GetOrCreateThread(ctx, "session123", tt.organizationID, tt.agentID, tt.userID)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				assert.Nil(t, joined)
+				return
+			}
+			require.NoError(t, err)
+			assert.Same(t, thread, joined)
+		})
+	}
+
+	c.threadMutex.RLock()
+	defer c.threadMutex.RUnlock()
+	assert.Equal(t, []string{"user456"}, thread.Participants)
+}
+
+func TestStartRunQueueSerializesSession(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+
+	const turns = 20
+	var wg sync.WaitGroup
+	for i := 0; i < turns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, runTurn(context.Background(), c, "session123", fmt.Sprintf("message %d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	messages, err := c.threadMessages("session123")
+	require.NoError(t, err)
+	require.Len(t, messages, 2*turns)
+	for i := 0; i < len(messages); i += 2 {
+		assert.Equal(t, "user", messages[i].Role)
+		assert.Equal(t, "assistant", messages[i+1].Role)
+		assert.Equal(t, "reply to "+messages[i].Content, messages[i+1].Content)
+	}
+	assert.Empty(t, c.sessionGates)
+}
+
+func TestStartRunQueueAllowsOtherSessions(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+
+	_, done, err := c.StartRun(context.Background(), "session1", "org123", "user123")
+	require.NoError(t, err)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, done2, err := c.StartRun(ctx, "session2", "org123", "user123")
+	require.NoError(t, err)
+	done2()
+}
+
+func TestStartRunQueueRespectsContext(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+
+	_, done, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = c.StartRun(ctx, "session123", "org123", "user123")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestStartRunRejectsBusySession(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyReject)
+
+	_, done, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+
+	_, _, err = c.StartRun(context.Background(), "session123", "org123", "user123")
+	assert.ErrorIs(t, err, ErrSessionBusy)
+
+	done()
+	_, done, err = c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+	done()
+}
+
+func TestStartRunRejectConcurrent(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyReject)
+
+	const turns = 20
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	for i := 0; i < turns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := runTurn(context.Background(), c, "session123", fmt.Sprintf("message %d", i))
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+				return
+			}
+			assert.ErrorIs(t, err, ErrSessionBusy)
+		}(i)
+	}
+	wg.Wait()
+
+	messages, err := c.threadMessages("session123")
+	require.NoError(t, err)
+	assert.Len(t, messages, 2*accepted)
+	for i := 0; i < len(messages); i += 2 {
+		assert.Equal(t, "reply to "+messages[i].Content, messages[i+1].Content)
+	}
+}
+
+func TestStartRunCancelsPrevious(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyCancel)
+
+	firstCtx, firstDone, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+
+	started := make(chan error, 1)
+	go func() {
+		_, done, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+		if err == nil {
+			done()
+		}
+		started <- err
+	}()
+
+	select {
+	case <-firstCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("previous run was not cancelled")
+	}
+	assert.True(t, IsCancelled(firstCtx))
+	assert.ErrorIs(t, context.Cause(firstCtx), ErrRunSuperseded)
+
+	// The new run starts only once the previous one has finished
+	firstDone()
+	assert.NoError(t, <-started)
+}
+
+func TestCancelRunCancelsQueuedRun(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+
+	_, done, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+	defer done()
+
+	// The queued run has no thread yet but belongs to its organization and user
+	started := make(chan error, 1)
+	go func() {
+		_, done, err := c.StartRun(context.Background(), "session123", "org123", "user456")
+		if err == nil {
+			done()
+		}
+		started <- err
+	}()
+	require.Eventually(t, func() bool {
+		c.runMutex.Lock()
+		defer c.runMutex.Unlock()
+		return len(c.sessionGates["session123"].runs) == 2
+	}, time.Second, time.Millisecond)
+
+	assert.False(t, c.CancelRun("session123", "org456", "user456"))
+	assert.True(t, c.CancelRun("session123", "org123", "user456"))
+	assert.ErrorIs(t, <-started, ErrRunCancelled)
+
+	// The running run of user123 goes on
+	c.runMutex.Lock()
+	assert.Len(t, c.sessionGates["session123"].runs, 1)
+	c.runMutex.Unlock()
+}
+
+func TestCancelRunRollsBackUserMessage(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+	require.NoError(t, runTurn(context.Background(), c, "session123", "first"))
+
+	ctx, done, err := c.StartRun(context.Background(), "session123", "org123", "user123")
+	require.NoError(t, err)
+	defer done()
+
+	require.NoError(t, c.AddMessageToThread(ctx, "session123", "second"))
+	assert.True(t, c.CancelRun("session123", "org123", "user123"))
+
+	_, err = c.RunThread(ctx, "session123", RunOptions{Model: "gpt-4o"})
+	assert.Error(t, err)
+	assert.True(t, IsCancelled(ctx))
+
+	messages, err := c.threadMessages("session123")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "first", messages[0].Content)
+	assert.Equal(t, "reply to first", messages[1].Content)
+}
+
+func TestRunThreadClassifiesErrors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		status    int
+		code      string
+		kind      error
+		retryable bool
+	}{
+		{"Rate limited", http.StatusTooManyRequests, "rate_limit_exceeded", ErrRateLimited, true},
+		{"Quota exhausted", http.StatusTooManyRequests, "insufficient_quota", ErrRateLimited, false},
+		{"Invalid API key", http.StatusUnauthorized, "invalid_api_key", ErrAuthFailed, false},
+		{"Context length exceeded", http.StatusBadRequest, "context_length_exceeded", ErrContextLengthExceeded, false},
+		{"Content filtered", http.StatusBadRequest, "content_filter", ErrContentFiltered, false},
+		{"Server error", http.StatusServiceUnavailable, "", ErrUpstreamUnavailable, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClientWithHandler(t, &config.Config{}, errorHandler(tc.status, tc.code))
+			thread, err := c.GetOrCreateThread(context.Background(), "session123", "org123", "agent123", "user123")
+			require.NoError(t, err)
+			require.NoError(t, c.AddMessageToThread(context.Background(), thread.ThreadID, "Hello"))
+
+			_, err = c.RunThread(context.Background(), thread.ThreadID, RunOptions{Model: "gpt-4o"})
+			assert.ErrorIs(t, err, tc.kind)
+			assert.Equal(t, tc.retryable, IsRetryable(err))
+
+			// The unanswered message is rolled back, so a retry doesn't add
+			// it twice
+			messages, err := c.threadMessages(thread.ThreadID)
+			require.NoError(t, err)
+			assert.Empty(t, messages)
+		})
+	}
+}
+
+func TestRunThreadRetriesRetryableErrors(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		attempt := calls
+		mu.Unlock()
+
+		if attempt < 3 {
+			errorHandler(http.StatusTooManyRequests, "rate_limit_exceeded")(w, r)
+			return
+		}
+		echoHandler(w, r)
+	}
+	c := newTestClientWithHandler(t, &config.Config{MaxRetries: 3, RetryDelay: time.Millisecond}, handler)
+
+	require.NoError(t, runTurn(context.Background(), c, "session123", "Hello"))
+	assert.Equal(t, 3, calls)
+}
+
+func TestRunThreadGivesUpAfterMaxRetries(t *testing.T) {
+	var calls int
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		errorHandler(http.StatusBadGateway, "")(w, r)
+	}
+	c := newTestClientWithHandler(t, &config.Config{MaxRetries: 2, RetryDelay: time.Millisecond}, handler)
+
+	err := runTurn(context.Background(), c, "session123", "Hello")
+	assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRunThreadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := runTurn(ctx, c, "session123", "Hello")
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestRunThreadMasksSensitiveValues(t *testing.T) {
+	var upstream []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		last := req.Messages[len(req.Messages)-1]
+		upstream = append(upstream, last.Content)
+
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{
+					Role:    "assistant",
+					Content: "reply to " + last.Content,
+				},
+			}},
+		})
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+
+	ctx := redact.WithMasker(context.Background(), redact.Default().NewMasker())
+	thread, err := c.GetOrCreateThread(ctx, "session123", "org123", "agent123", "user123")
+	require.NoError(t, err)
+	require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "I am jane@example.com"))
+
+	result, err := c.RunThread(ctx, thread.ThreadID, RunOptions{Model: "gpt-4o"})
+	require.NoError(t, err)
+
+	require.Len(t, upstream, 1)
+	assert.NotContains(t, upstream[0], "jane@example.com")
+	assert.Regexp(t, `^I am \[EMAIL_[0-9a-f]{8}\]$`, upstream[0])
+	assert.Equal(t, "reply to I am jane@example.com", result.Content)
+
+	// The thread keeps the original values
+	messages, err := c.threadMessages(thread.ThreadID)
+	require.NoError(t, err)
+	assert.Equal(t, "I am jane@example.com", messages[0].Content)
+	assert.Equal(t, "reply to I am jane@example.com", messages[1].Content)
+}
+
+func TestRunThreadSendsSeededHistoryAndSystemPrompt(t *testing.T) {
+	var upstream []openai.ChatCompletionMessage
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		upstream = req.Messages
+
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{Role: "assistant", Content: "Fine"},
+			}},
+		})
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+
+	ctx := context.Background()
+	thread, err := c.GetOrCreateThread(ctx, "session123", "org123", "agent123", "user123")
+	require.NoError(t, err)
+	history := []openai.ChatCompletionMessage{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	}
+	seeded, err := c.SeedThread(ctx, thread.ThreadID, []models.ThreadMessage{
+		{ChatCompletionMessage: history[0]},
+		{ChatCompletionMessage: history[1]},
+	})
+	require.NoError(t, err)
+	assert.True(t, seeded)
+	require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "How are you?"))
+
+	_, err = c.RunThread(ctx, thread.ThreadID, RunOptions{Model: "gpt-4o", SystemPrompt: "Be brief"})
+	require.NoError(t, err)
+
+	require.Len(t, upstream, 4)
+	assert.Equal(t, openai.ChatCompletionMessage{Role: "system", Content: "Be brief"}, upstream[0])
+	assert.Equal(t, history, upstream[1:3])
+	assert.Equal(t, "How are you?", upstream[3].Content)
+
+	// The system prompt isn't stored, and a thread with messages isn't seeded again
+	messages, err := c.threadMessages(thread.ThreadID)
+	require.NoError(t, err)
+	assert.Len(t, messages, 4)
+	assert.Equal(t, "user", messages[0].Role)
+	seeded, err = c.SeedThread(ctx, thread.ThreadID, []models.ThreadMessage{{ChatCompletionMessage: history[0]}})
+	require.NoError(t, err)
+	assert.False(t, seeded)
+}
+
+func TestRunThreadSendsTools(t *testing.T) {
+	var functions []json.RawMessage
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model     string            `json:"model"`
+			Functions []json.RawMessage `json:"functions"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		functions = req.Functions
+
+		_ = json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: req.Model,
+			Choices: []openai.ChatCompletionChoice{{
+				Message: openai.ChatCompletionMessage{Role: "assistant", Content: "Fine"},
+			}},
+		})
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+
+	ctx := context.Background()
+	thread, err := c.GetOrCreateThread(ctx, "session123", "org123", "agent123", "user123")
+	require.NoError(t, err)
+	require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "Where is my order?"))
+
+	_, err = c.RunThread(ctx, thread.ThreadID, RunOptions{Model: "gpt-4o", Tools: []models.Tool{
+		{Name: "lookup_order", Description: "Find an order by ID", Parameters: json.RawMessage(`{"type":"object","properties":{"orderId":{"type":"string"}}}`)},
+		{Name: "list_orders"},
+	}})
+	require.NoError(t, err)
+
+	require.Len(t, functions, 2)
+	assert.JSONEq(t, `{"name":"lookup_order","description":"Find an order by ID","parameters":{"type":"object","properties":{"orderId":{"type":"string"}}}}`, string(functions[0]))
+	assert.JSONEq(t, `{"name":"list_orders","parameters":{"type":"object","properties":{}}}`, string(functions[1]))
+}
+
+func TestSetFeedback(t *testing.T) {
+	c := newTestClient(t, config.SessionConcurrencyQueue)
+	ctx := context.Background()
+	thread, err := c.GetOrCreateThread(ctx, "session123", "org123", "agent123", "user123")
+	require.NoError(t, err)
+	require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "Hello"))
+	_, err = c.RunThread(ctx, thread.ThreadID, RunOptions{Model: "gpt-4o", SystemPrompt: "Be brief.", ResponseID: "resp1"})
+	require.NoError(t, err)
+
+	feedback := models.Feedback{Thumbs: "up", Rating: 5}
+	_, _, err = c.SetFeedback(ctx, "org456", "session123", "resp1", feedback)
+	assert.ErrorIs(t, err, ErrResponseNotFound)
+	_, _, err = c.SetFeedback(ctx, "org123", "session123", "resp2", feedback)
+	assert.ErrorIs(t, err, ErrResponseNotFound)
+
+	info, previous, err := c.SetFeedback(ctx, "org123", "session123", "resp1", models.Feedback{Thumbs: "down"})
+	require.NoError(t, err)
+	assert.Equal(t, "agent123", info.AgentID)
+	assert.Equal(t, "user123", info.UserID)
+	assert.Equal(t, "Be brief.", info.SystemPrompt)
+	assert.Nil(t, previous)
+
+	_, previous, err = c.SetFeedback(ctx, "org123", "session123", "resp1", feedback)
+	require.NoError(t, err)
+	assert.Equal(t, &models.Feedback{Thumbs: "down"}, previous)
+
+	c.threadMutex.RLock()
+	defer c.threadMutex.RUnlock()
+	reply := c.threadCache[thread.ThreadID].Messages[1]
+	assert.Equal(t, "resp1", reply.ResponseID)
+	assert.Equal(t, "gpt-4o", reply.Model)
+	assert.Equal(t, &feedback, reply.Feedback)
+}
+
+func TestRunThreadResponseCache(t *testing.T) {
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		echoHandler(w, r)
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+	c.responseCache = responsecache.NewMemoryStore(10)
+
+	ctx := context.Background()
+	run := func(sessionID, agentID, boundary string, stream bool) *RunResult {
+		thread, err := c.GetOrCreateThread(ctx, sessionID, "org123", agentID, "user123")
+		require.NoError(t, err)
+		require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "What are your opening hours?"))
+		opts := RunOptions{
+			Model:        "gpt-4o",
+			SystemPrompt: "Files delimited by " + boundary,
+			ResponseID:   sessionID,
+			Cache:        &CacheOptions{OrganizationID: "org123", AgentID: agentID, UserID: "user123", TTL: time.Hour, Boundary: boundary},
+		}
+		var result *RunResult
+		if stream {
+			var deltas []string
+			result, err = c.RunThreadStream(ctx, thread.ThreadID, opts, func(delta string) error {
+				deltas = append(deltas, delta)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{result.Content}, deltas)
+		} else {
+			result, err = c.RunThread(ctx, thread.ThreadID, opts)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "reply to What are your opening hours?", result.Content)
+		c.CommitCachedReply(ctx, result)
+
+		// Cached replies become part of the conversation like any other
+		messages, err := c.threadMessages(thread.ThreadID)
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+		assert.Equal(t, result.Content, messages[1].Content)
+		return result
+	}
+
+	result := run("session1", "agent123", "b1", false)
+	assert.False(t, result.Cached)
+	assert.Equal(t, 1, calls)
+
+	// Identical requests are answered from the cache, whatever their boundary
+	result = run("session2", "agent123", "b2", false)
+	assert.True(t, result.Cached)
+	assert.Equal(t, "gpt-4o", result.Model)
+	assert.Zero(t, result.Usage.TotalTokens)
+	result = run("session3", "agent123", "b3", true)
+	assert.True(t, result.Cached)
+	assert.Equal(t, 1, calls)
+
+	// Other agents don't share replies
+	result = run("session4", "agent456", "b4", false)
+	assert.False(t, result.Cached)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRunThreadSemanticCache(t *testing.T) {
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		echoHandler(w, r)
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+	c.semanticCache = semanticcache.New(semanticcache.NewLocalEmbedder(), 10)
+
+	ctx := context.Background()
+	run := func(sessionID, systemPrompt string, questions ...string) *RunResult {
+		thread, err := c.GetOrCreateThread(ctx, sessionID, "org123", "agent123", "user123")
+		require.NoError(t, err)
+		var result *RunResult
+		for _, question := range questions {
+			require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, question))
+			result, err = c.RunThread(ctx, thread.ThreadID, RunOptions{
+				Model:        "gpt-4o",
+				SystemPrompt: systemPrompt,
+				Cache:        &CacheOptions{OrganizationID: "org123", AgentID: "agent123", UserID: "user123", TTL: time.Hour, Semantic: true, Threshold: 0.8},
+			})
+			require.NoError(t, err)
+			c.CommitCachedReply(ctx, result)
+		}
+		return result
+	}
+
+	result := run("session1", "Be brief", "What are your opening hours?")
+	assert.False(t, result.Cached)
+	assert.Equal(t, 1, calls)
+
+	// Similar first questions get the cached reply
+	result = run("session2", "Be brief", "what are your opening hours on sunday")
+	assert.True(t, result.Cached)
+	assert.Equal(t, "reply to What are your opening hours?", result.Content)
+	assert.Greater(t, result.CacheSimilarity, 0.8)
+	assert.Less(t, result.CacheSimilarity, 1.0)
+	assert.Equal(t, 1, calls)
+
+	// Dissimilar questions, later questions and other system prompts miss
+	assert.False(t, run("session3", "Be brief", "How do I reset my password?").Cached)
+	assert.False(t, run("session4", "Be brief", "Hello", "What are your opening hours?").Cached)
+	assert.False(t, run("session5", "Be verbose", "What are your opening hours?").Cached)
+	assert.Equal(t, 5, calls)
+}
+
+func TestRunThreadSemanticCacheSkipsPersonalQuestions(t *testing.T) {
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		echoHandler(w, r)
+	}
+	c := newTestClientWithHandler(t, &config.Config{}, handler)
+	c.semanticCache = semanticcache.New(semanticcache.NewLocalEmbedder(), 10)
+
+	ctx := context.Background()
+	run := func(sessionID, userID, question string) *RunResult {
+		thread, err := c.GetOrCreateThread(ctx, sessionID, "org123", "agent123", userID)
+		require.NoError(t, err)
+		require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, question))
+		result, err := c.RunThread(ctx, thread.ThreadID, RunOptions{
+			Model: "gpt-4o",
+			Cache: &CacheOptions{OrganizationID: "org123", AgentID: "agent123", UserID: userID, TTL: time.Hour, Semantic: true, Threshold: 0.5},
+		})
+		require.NoError(t, err)
+		c.CommitCachedReply(ctx, result)
+		return result
+	}
+
+	// Questions differing only in an identifier don't share answers
+	testCases := []struct {
+		name  string
+		first string
+		other string
+	}{
+		{"Order number", "What is the status of order 48213?", "What is the status of order 48214?"},
+		{"Email address", "Is jane@example.com subscribed to the newsletter?", "Is john@example.com subscribed to the newsletter?"},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.False(t, run(fmt.Sprintf("first%d", i), "user123", tc.first).Cached)
+			result := run(fmt.Sprintf("other%d", i), "user456", tc.other)
+			assert.False(t, result.Cached)
+			assert.Equal(t, "reply to "+tc.other, result.Content)
+		})
+	}
+	assert.Equal(t, 4, calls)
+}
+
+func TestCommitCachedReply(t *testing.T) {
+	testCases := []struct {
+		name     string
+		semantic bool
+	}{
+		{"Response cache", false},
+		{"Semantic cache", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				echoHandler(w, r)
+			}
+			c := newTestClientWithHandler(t, &config.Config{}, handler)
+			if tc.semantic {
+				c.semanticCache = semanticcache.New(semanticcache.NewLocalEmbedder(), 10)
+			} else {
+				c.responseCache = responsecache.NewMemoryStore(10)
+			}
+
+			ctx := context.Background()
+			run := func(sessionID string) *RunResult {
+				thread, err := c.GetOrCreateThread(ctx, sessionID, "org123", "agent123", "user123")
+				require.NoError(t, err)
+				require.NoError(t, c.AddMessageToThread(ctx, thread.ThreadID, "What are your opening hours?"))
+				result, err := c.RunThread(ctx, thread.ThreadID, RunOptions{
+					Model: "gpt-4o",
+					Cache: &CacheOptions{OrganizationID: "org123", AgentID: "agent123", UserID: "user123", TTL: time.Hour, Semantic: tc.semantic, Threshold: 0.8},
+				})
+				require.NoError(t, err)
+				return result
+			}
+
+			// Replies that aren't committed, such as those blocked by
+			// moderation, don't answer later runs
+			assert.False(t, run("session1").Cached)
+			result := run("session2")
+			assert.False(t, result.Cached)
+			assert.Equal(t, 2, calls)
+
+			c.CommitCachedReply(ctx, result)
+			result = run("session3")
+			assert.True(t, result.Cached)
+			assert.Equal(t, 2, calls)
+
+			// Committing a cached reply changes nothing
+			c.CommitCachedReply(ctx, result)
+			assert.True(t, run("session4").Cached)
+		})
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	var (
+		models []string
+		calls  int
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			errorHandler(http.StatusServiceUnavailable, "")(w, r)
+			return
+		}
+		assert.Equal(t, "/v1/embeddings", r.URL.Path)
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+		var req embeddingRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		models = append(models, req.Model)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"data": []map[string]any{{"embedding": []float32{0.6, 0.8}}},
+		})
+	}
+	c := newTestClientWithHandler(t, &config.Config{EmbeddingModel: "text-embedding-3-small", MaxRetries: 1, RetryDelay: time.Millisecond}, handler)
+
+	// Retryable errors are retried like chat completions
+	embedding, err := c.Embed(context.Background(), "What are your opening hours?")
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.6, 0.8}, embedding)
+	assert.Equal(t, []string{"text-embedding-3-small"}, models)
+	assert.Equal(t, 2, calls)
+
+	c = newTestClientWithHandler(t, &config.Config{EmbeddingModel: "text-embedding-3-small"}, errorHandler(http.StatusUnauthorized, "invalid_api_key"))
+	_, err = c.Embed(context.Background(), "What are your opening hours?")
+	assert.ErrorIs(t, err, ErrAuthFailed)
+}
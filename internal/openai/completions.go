@@ -0,0 +1,118 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CreateChatCompletion passes a stateless chat completion request through to
+// the OpenAI API
+func (c *Client) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (resp openai.ChatCompletionResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "openai.CreateChatCompletion", trace.WithAttributes(
+		tracing.AttrModel.String(req.Model),
+	))
+	defer func() {
+		span.SetAttributes(
+			tracing.AttrPromptTokens.Int(resp.Usage.PromptTokens),
+			tracing.AttrCompletionTokens.Int(resp.Usage.CompletionTokens),
+		)
+		tracing.EndSpan(span, err)
+	}()
+
+	req.Stream = false
+	masker := redact.MaskerFromContext(ctx)
+	req.Messages = maskMessages(masker, req.Messages)
+
+	err = c.withRetry(ctx, req.Model, "chat_completion", func() error {
+		var err error
+		resp, err = c.client.CreateChatCompletion(ctx, req)
+		return err
+	})
+	if err != nil {
+		return resp, fmt.Errorf("failed to create chat completion: %w", err)
+	}
+	for i := range resp.Choices {
+		resp.Choices[i].Message.Content = masker.Restore(resp.Choices[i].Message.Content)
+	}
+	return resp, nil
+}
+
+// CreateChatCompletionStream passes a stateless streaming chat completion
+// request through to the OpenAI API, calling onChunk for every chunk received.
+// Returning an error from onChunk aborts the stream. The upstream doesn't
+// report the token usage of streams, so the returned usage is estimated from
+// the text sent and received, including when the stream failed part way.
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(chunk openai.ChatCompletionStreamResponse) error) (usage openai.Usage, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "openai.CreateChatCompletionStream", trace.WithAttributes(
+		tracing.AttrModel.String(req.Model),
+	))
+	defer func() {
+		span.SetAttributes(
+			tracing.AttrPromptTokens.Int(usage.PromptTokens),
+			tracing.AttrCompletionTokens.Int(usage.CompletionTokens),
+		)
+		tracing.EndSpan(span, err)
+	}()
+
+	req.Stream = true
+	masker := redact.MaskerFromContext(ctx)
+	req.Messages = maskMessages(masker, req.Messages)
+
+	var stream *openai.ChatCompletionStream
+	err = c.withRetry(ctx, req.Model, "chat_completion_stream", func() error {
+		var err error
+		stream, err = c.client.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		return usage, fmt.Errorf("failed to create chat completion stream: %w", err)
+	}
+	defer stream.Close()
+
+	var completion strings.Builder
+	defer func() {
+		usage.PromptTokens = estimateTokens(req.Messages...)
+		usage.CompletionTokens = estimateTokens(openai.ChatCompletionMessage{Content: completion.String()})
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}()
+
+	// Placeholders may be split across chunks, so each choice is restored
+	// as a stream of its own
+	restorers := make(map[int]*redact.StreamRestorer)
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return usage, nil
+		}
+		if err != nil {
+			err = classifyError(ctx, err)
+			metrics.UpstreamErrors.WithLabelValues(req.Model, errorKindLabel(err)).Inc()
+			return usage, fmt.Errorf("failed to receive chat completion stream: %w", err)
+		}
+		for i, choice := range chunk.Choices {
+			completion.WriteString(choice.Delta.Content)
+			restorer, exists := restorers[choice.Index]
+			if !exists {
+				restorer = masker.NewStreamRestorer()
+				restorers[choice.Index] = restorer
+			}
+			content := restorer.Write(choice.Delta.Content)
+			if choice.FinishReason != "" {
+				content += restorer.Flush()
+			}
+			chunk.Choices[i].Delta.Content = content
+		}
+		if err := onChunk(chunk); err != nil {
+			return usage, err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/redact"
+	"github.com/sashabaranov/go-openai"
+)
+
+// embeddingRequest is the body of a request to the embeddings endpoint. The
+// go-openai client only accepts the models it enumerates, so requests are
+// made directly to allow any embedding model.
+type embeddingRequest struct {
+	Input []string `json:"input"`
+	Model string   `json:"model"`
+}
+
+// embeddingResponse is the body of a response of the embeddings endpoint
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed computes the embedding of a text with the configured embedding model,
+// implementing semanticcache.Embedder. Failed requests are retried and
+// recorded like chat completions.
+func (c *Client) Embed(ctx context.Context, text string) ([]float32, error) {
+	// Organizations that don't send raw PII to OpenAI don't for embeddings either
+	text = redact.MaskerFromContext(ctx).Mask(text)
+
+	var resp embeddingResponse
+	err := c.withRetry(ctx, c.embeddingModel, "embedding", func() error {
+		var err error
+		resp, err = c.createEmbeddings(ctx, embeddingRequest{Input: []string{text}, Model: c.embeddingModel})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed text: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return nil, errors.New("no embeddings returned")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+// createEmbeddings sends a request to the embeddings endpoint. Error
+// responses are returned as *openai.APIError, like the go-openai client's, so
+// they are classified the same way.
+func (c *Client) createEmbeddings(ctx context.Context, body embeddingRequest) (embeddingResponse, error) {
+	var resp embeddingResponse
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return resp, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.baseURL, "/")+"/embeddings", bytes.NewReader(payload))
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < http.StatusOK || httpResp.StatusCode >= http.StatusBadRequest {
+		var errResp openai.ErrorResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return resp, &openai.RequestError{HTTPStatusCode: httpResp.StatusCode, Err: fmt.Errorf("embeddings request failed with status %d", httpResp.StatusCode)}
+		}
+		errResp.Error.HTTPStatusCode = httpResp.StatusCode
+		return resp, errResp.Error
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("failed to decode embeddings: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,144 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Error kinds returned by the client. Errors from the upstream API are
+// wrapped in an *Error whose Kind is one of these, so callers can test for
+// them with errors.Is.
+var (
+	ErrRateLimited           = errors.New("rate limited by upstream")
+	ErrUpstreamUnavailable   = errors.New("upstream unavailable")
+	ErrContextLengthExceeded = errors.New("context length exceeded")
+	ErrContentFiltered       = errors.New("content filtered by upstream")
+	ErrTimeout               = errors.New("request timed out")
+	ErrAuthFailed            = errors.New("upstream authentication failed")
+)
+
+// Error is an upstream error classified into one of the error kinds
+type Error struct {
+	Kind      error
+	Err       error
+	retryable bool
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// Unwrap exposes both the kind and the underlying error to errors.Is/As
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Retryable reports whether the same request may succeed if retried later
+func (e *Error) Retryable() bool {
+	return e.retryable
+}
+
+// IsRetryable reports whether err is a classified error that may succeed if
+// the request is retried later
+func IsRetryable(err error) bool {
+	var classified *Error
+	return errors.As(err, &classified) && classified.Retryable()
+}
+
+// classifyError maps an error from the upstream API onto an error kind.
+// Errors that can't be classified, including cancellations, are returned
+// unchanged.
+func classifyError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &Error{Kind: ErrTimeout, Err: err, retryable: true}
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		code, _ := apiErr.Code.(string)
+		return classifyStatus(apiErr.HTTPStatusCode, code, apiErr.Message, err)
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return classifyStatus(reqErr.HTTPStatusCode, "", "", err)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return &Error{Kind: ErrTimeout, Err: err, retryable: true}
+		}
+		return &Error{Kind: ErrUpstreamUnavailable, Err: err, retryable: true}
+	}
+
+	return err
+}
+
+// classifyStatus maps an upstream HTTP status and error code onto an error kind
+func classifyStatus(status int, code, message string, err error) error {
+	switch {
+	case code == "context_length_exceeded":
+		return &Error{Kind: ErrContextLengthExceeded, Err: err}
+	case code == "content_filter" || code == "content_policy_violation" ||
+		strings.Contains(message, "content management policy"):
+		return &Error{Kind: ErrContentFiltered, Err: err}
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &Error{Kind: ErrAuthFailed, Err: err}
+	case status == http.StatusTooManyRequests:
+		// An exhausted quota won't recover by retrying
+		return &Error{Kind: ErrRateLimited, Err: err, retryable: code != "insufficient_quota"}
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return &Error{Kind: ErrTimeout, Err: err, retryable: true}
+	case status >= http.StatusInternalServerError:
+		return &Error{Kind: ErrUpstreamUnavailable, Err: err, retryable: true}
+	}
+	return err
+}
+
+// errorKindLabel returns the metrics label for the kind of an error
+func errorKindLabel(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "upstream_unavailable"
+	case errors.Is(err, ErrContextLengthExceeded):
+		return "context_length_exceeded"
+	case errors.Is(err, ErrContentFiltered):
+		return "content_filtered"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	default:
+		return "other"
+	}
+}
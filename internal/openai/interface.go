@@ -5,12 +5,25 @@ import (
 	"time"
 
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/sashabaranov/go-openai"
 )
 
 // ClientInterface defines the interface for the OpenAI client
 type ClientInterface interface {
-	GetOrCreateThread(ctx context.Context, sessionID, agentID, userID string) (*models.ThreadInfo, error)
+	GetOrCreateThread(ctx context.Context, sessionID, organizationID, agentID, userID string) (*models.ThreadInfo, error)
 	AddMessageToThread(ctx context.Context, threadID, content string) error
-	RunThread(ctx context.Context, threadID, model string) (string, error)
+	SeedThread(ctx context.Context, threadID string, messages []models.ThreadMessage) (bool, error)
+	RunThread(ctx context.Context, threadID string, opts RunOptions) (*RunResult, error)
+	RunThreadStream(ctx context.Context, threadID string, opts RunOptions, onDelta func(delta string) error) (*RunResult, error)
+	CommitCachedReply(ctx context.Context, result *RunResult)
+	DiscardLastTurn(ctx context.Context, threadID string) error
+	SetFeedback(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error)
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(chunk openai.ChatCompletionStreamResponse) error) (openai.Usage, error)
+	StartRun(ctx context.Context, sessionID, organizationID, userID string) (context.Context, func(), error)
+	CancelRun(sessionID, organizationID, userID string) bool
 	CleanupOldCacheEntries(threadTTL time.Duration)
+	PurgeThreads(match func(thread *models.ThreadInfo) bool) int
+	Threads(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo
+	Ping(ctx context.Context) error
 }
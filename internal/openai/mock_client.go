@@ -2,6 +2,7 @@ package openai
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
@@ -11,41 +12,124 @@ import (
 
 // MockClient is a mock implementation of the OpenAI client for testing
 type MockClient struct {
-	GetOrCreateThreadFunc func(ctx context.Context, sessionID, agentID, userID string) (*models.ThreadInfo, error)
+	GetOrCreateThreadFunc func(ctx context.Context, sessionID, organizationID, agentID, userID string) (*models.ThreadInfo, error)
 	AddMessageToThreadFunc func(ctx context.Context, threadID, content string) error
+	SeedThreadFunc func(ctx context.Context, threadID string, messages []models.ThreadMessage) (bool, error)
 	RunThreadFunc func(ctx context.Context, threadID, model string) (string, error)
+	RunThreadStreamFunc func(ctx context.Context, threadID, model string, onDelta func(delta string) error) (string, error)
+	DiscardLastTurnFunc func(ctx context.Context, threadID string) error
+	SetFeedbackFunc func(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error)
+	CreateChatCompletionFunc func(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStreamFunc func(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(chunk openai.ChatCompletionStreamResponse) error) error
+	StartRunFunc func(ctx context.Context, sessionID, organizationID, userID string) (context.Context, func(), error)
+	CancelRunFunc func(sessionID, organizationID, userID string) bool
 	CleanupOldCacheEntriesFunc func(threadTTL time.Duration)
+	PurgeThreadsFunc func(match func(thread *models.ThreadInfo) bool) int
+	ThreadsFunc func(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo
+	PingFunc func(ctx context.Context) error
+
+	// Runs records the options of every run
+	Runs []RunOptions
+	// Committed records the results whose replies were committed to the caches
+	Committed []*RunResult
 }
 
 // NewMockClient creates a new mock OpenAI client
 func NewMockClient(log *logrus.Logger) *MockClient {
 	return &MockClient{
-		GetOrCreateThreadFunc: func(ctx context.Context, sessionID, agentID, userID string) (*models.ThreadInfo, error) {
+		GetOrCreateThreadFunc: func(ctx context.Context, sessionID, organizationID, agentID, userID string) (*models.ThreadInfo, error) {
 			return &models.ThreadInfo{
-				ThreadID:  "mock-thread-id",
-				SessionID: sessionID,
-				AgentID:   agentID,
-				UserID:    userID,
-				Messages:  []openai.ChatCompletionMessage{},
-				CreatedAt: time.Now(),
-				LastUsed:  time.Now(),
+				ThreadID:       "mock-thread-id",
+				SessionID:      sessionID,
+				OrganizationID: organizationID,
+				AgentID:        agentID,
+				UserID:         userID,
+				Messages:       []models.ThreadMessage{},
+				CreatedAt:      time.Now(),
+				LastUsed:       time.Now(),
 			}, nil
 		},
 		AddMessageToThreadFunc: func(ctx context.Context, threadID, content string) error {
 			return nil
 		},
+		SeedThreadFunc: func(ctx context.Context, threadID string, messages []models.ThreadMessage) (bool, error) {
+			return len(messages) > 0, nil
+		},
 		RunThreadFunc: func(ctx context.Context, threadID, model string) (string, error) {
 			return "This is a mock response from the OpenAI API.", nil
 		},
+		RunThreadStreamFunc: func(ctx context.Context, threadID, model string, onDelta func(delta string) error) (string, error) {
+			response := "This is a mock response from the OpenAI API."
+			for _, word := range strings.SplitAfter(response, " ") {
+				if err := onDelta(word); err != nil {
+					return "", err
+				}
+			}
+			return response, nil
+		},
+		DiscardLastTurnFunc: func(ctx context.Context, threadID string) error {
+			return nil
+		},
+		SetFeedbackFunc: func(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error) {
+			return nil, nil, ErrResponseNotFound
+		},
+		CreateChatCompletionFunc: func(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+			return openai.ChatCompletionResponse{
+				ID:      "mock-completion-id",
+				Object:  "chat.completion",
+				Created: time.Now().Unix(),
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionChoice{{
+					Message: openai.ChatCompletionMessage{
+						Role:    "assistant",
+						Content: "This is a mock response from the OpenAI API.",
+					},
+					FinishReason: openai.FinishReasonStop,
+				}},
+			}, nil
+		},
+		CreateChatCompletionStreamFunc: func(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(chunk openai.ChatCompletionStreamResponse) error) error {
+			for _, word := range strings.SplitAfter("This is a mock response from the OpenAI API.", " ") {
+				chunk := openai.ChatCompletionStreamResponse{
+					ID:      "mock-completion-id",
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   req.Model,
+					Choices: []openai.ChatCompletionStreamChoice{{
+						Delta: openai.ChatCompletionStreamChoiceDelta{Content: word},
+					}},
+				}
+				if err := onChunk(chunk); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		StartRunFunc: func(ctx context.Context, sessionID, organizationID, userID string) (context.Context, func(), error) {
+			runCtx, cancel := context.WithCancel(ctx)
+			return runCtx, cancel, nil
+		},
+		CancelRunFunc: func(sessionID, organizationID, userID string) bool {
+			return false
+		},
 		CleanupOldCacheEntriesFunc: func(threadTTL time.Duration) {
 			// Do nothing in mock
 		},
+		PurgeThreadsFunc: func(match func(thread *models.ThreadInfo) bool) int {
+			return 0
+		},
+		ThreadsFunc: func(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo {
+			return nil
+		},
+		PingFunc: func(ctx context.Context) error {
+			return nil
+		},
 	}
 }
 
 // GetOrCreateThread gets an existing thread or creates a new one
-func (c *MockClient) GetOrCreateThread(ctx context.Context, sessionID, agentID, userID string) (*models.ThreadInfo, error) {
-	return c.GetOrCreateThreadFunc(ctx, sessionID, agentID, userID)
+func (c *MockClient) GetOrCreateThread(ctx context.Context, sessionID, organizationID, agentID, userID string) (*models.ThreadInfo, error) {
+	return c.GetOrCreateThreadFunc(ctx, sessionID, organizationID, agentID, userID)
 }
 
 // AddMessageToThread adds a message to a thread
@@ -53,12 +137,98 @@ func (c *MockClient) AddMessageToThread(ctx context.Context, threadID, content s
 	return c.AddMessageToThreadFunc(ctx, threadID, content)
 }
 
+// SeedThread fills an empty thread with prior conversation history
+func (c *MockClient) SeedThread(ctx context.Context, threadID string, messages []models.ThreadMessage) (bool, error) {
+	return c.SeedThreadFunc(ctx, threadID, messages)
+}
+
 // RunThread runs a thread with the model and returns the assistant's response
-func (c *MockClient) RunThread(ctx context.Context, threadID, model string) (string, error) {
-	return c.RunThreadFunc(ctx, threadID, model)
+func (c *MockClient) RunThread(ctx context.Context, threadID string, opts RunOptions) (*RunResult, error) {
+	c.Runs = append(c.Runs, opts)
+	content, err := c.RunThreadFunc(ctx, threadID, opts.Model)
+	if err != nil {
+		return nil, err
+	}
+	return mockRunResult(opts.Model, content), nil
+}
+
+// RunThreadStream runs a thread with the model, streaming deltas to onDelta
+func (c *MockClient) RunThreadStream(ctx context.Context, threadID string, opts RunOptions, onDelta func(delta string) error) (*RunResult, error) {
+	c.Runs = append(c.Runs, opts)
+	content, err := c.RunThreadStreamFunc(ctx, threadID, opts.Model, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	return mockRunResult(opts.Model, content), nil
+}
+
+// CommitCachedReply records the result as committed to the caches
+func (c *MockClient) CommitCachedReply(ctx context.Context, result *RunResult) {
+	c.Committed = append(c.Committed, result)
+}
+
+// DiscardLastTurn removes the last exchange from a thread
+func (c *MockClient) DiscardLastTurn(ctx context.Context, threadID string) error {
+	return c.DiscardLastTurnFunc(ctx, threadID)
+}
+
+// SetFeedback records feedback on a reply in a thread
+func (c *MockClient) SetFeedback(ctx context.Context, organizationID, sessionID, responseID string, feedback models.Feedback) (*models.ThreadInfo, *models.Feedback, error) {
+	return c.SetFeedbackFunc(ctx, organizationID, sessionID, responseID, feedback)
+}
+
+// mockRunResult wraps a mock response with a fixed token usage
+func mockRunResult(model, content string) *RunResult {
+	return &RunResult{
+		Content: content,
+		Model:   model,
+		Usage: openai.Usage{
+			PromptTokens:     10,
+			CompletionTokens: 20,
+			TotalTokens:      30,
+		},
+	}
+}
+
+// CreateChatCompletion passes a stateless chat completion request through
+func (c *MockClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return c.CreateChatCompletionFunc(ctx, req)
+}
+
+// CreateChatCompletionStream passes a stateless streaming chat completion request through
+func (c *MockClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(chunk openai.ChatCompletionStreamResponse) error) (openai.Usage, error) {
+	if err := c.CreateChatCompletionStreamFunc(ctx, req, onChunk); err != nil {
+		return openai.Usage{}, err
+	}
+	return mockRunResult(req.Model, "").Usage, nil
+}
+
+// StartRun registers a cancellable run for the session
+func (c *MockClient) StartRun(ctx context.Context, sessionID, organizationID, userID string) (context.Context, func(), error) {
+	return c.StartRunFunc(ctx, sessionID, organizationID, userID)
+}
+
+// CancelRun cancels the user's active run for a session
+func (c *MockClient) CancelRun(sessionID, organizationID, userID string) bool {
+	return c.CancelRunFunc(sessionID, organizationID, userID)
 }
 
 // CleanupOldCacheEntries removes old entries from the cache
 func (c *MockClient) CleanupOldCacheEntries(threadTTL time.Duration) {
 	c.CleanupOldCacheEntriesFunc(threadTTL)
 }
+
+// PurgeThreads removes every cached thread matched by match
+func (c *MockClient) PurgeThreads(match func(thread *models.ThreadInfo) bool) int {
+	return c.PurgeThreadsFunc(match)
+}
+
+// Threads returns copies of the cached threads matched by match
+func (c *MockClient) Threads(match func(thread *models.ThreadInfo) bool) []*models.ThreadInfo {
+	return c.ThreadsFunc(match)
+}
+
+// Ping checks that the OpenAI API is reachable
+func (c *MockClient) Ping(ctx context.Context) error {
+	return c.PingFunc(ctx)
+}
@@ -0,0 +1,144 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// ErrRunCancelled is the cancellation cause of runs stopped through CancelRun
+	ErrRunCancelled = errors.New("run cancelled")
+
+	// ErrRunSuperseded is the cancellation cause of runs replaced by a newer
+	// request for the same session
+	ErrRunSuperseded = fmt.Errorf("%w: superseded by a newer request for the session", ErrRunCancelled)
+
+	// ErrSessionBusy is returned by StartRun when another run for the session
+	// is in progress and the client is configured to reject concurrent runs
+	ErrSessionBusy = errors.New("session is busy with another request")
+)
+
+// activeRun is a registered run for a session, either in progress or waiting
+// for its turn, of a user in an organization
+type activeRun struct {
+	organizationID string
+	userID         string
+	cancel         context.CancelCauseFunc
+}
+
+// sessionGate serializes the runs of a single session. Holding the token in
+// sem means owning the session's thread; runs holds every registered run.
+type sessionGate struct {
+	sem  chan struct{}
+	runs map[*activeRun]struct{}
+}
+
+// StartRun registers a cancellable run for the session and waits until the
+// session is free, so a run's AddMessageToThread and RunThread calls are never
+// interleaved with another request's. What happens when the session is
+// already busy depends on the configured session concurrency mode.
+//
+// The returned context is cancelled with ErrRunCancelled when CancelRun is
+// called for the session by the run's organization and user, and the returned
+// function must be called once the run has finished.
+func (c *Client) StartRun(ctx context.Context, sessionID, organizationID, userID string) (context.Context, func(), error) {
+	// The span covers only the wait for the session, so time spent queueing
+	// behind other requests can be told apart from time spent upstream
+	_, span := tracing.Tracer().Start(ctx, "openai.StartRun")
+	span.SetAttributes(
+		tracing.AttrSessionID.String(sessionID),
+		attribute.String("chat.session_concurrency", c.sessionConcurrency),
+	)
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	run := &activeRun{organizationID: organizationID, userID: userID, cancel: cancel}
+
+	c.runMutex.Lock()
+	gate, exists := c.sessionGates[sessionID]
+	if !exists {
+		gate = &sessionGate{
+			sem:  make(chan struct{}, 1),
+			runs: make(map[*activeRun]struct{}),
+		}
+		c.sessionGates[sessionID] = gate
+	}
+	if c.sessionConcurrency == config.SessionConcurrencyCancel {
+		for previous := range gate.runs {
+			previous.cancel(ErrRunSuperseded)
+		}
+	}
+	gate.runs[run] = struct{}{}
+	c.runMutex.Unlock()
+
+	unregister := func() {
+		c.runMutex.Lock()
+		delete(gate.runs, run)
+		if len(gate.runs) == 0 {
+			delete(c.sessionGates, sessionID)
+		}
+		c.runMutex.Unlock()
+		cancel(nil)
+	}
+
+	if c.sessionConcurrency == config.SessionConcurrencyReject {
+		select {
+		case gate.sem <- struct{}{}:
+		default:
+			unregister()
+			tracing.EndSpan(span, ErrSessionBusy)
+			return nil, nil, ErrSessionBusy
+		}
+	} else {
+		select {
+		case gate.sem <- struct{}{}:
+		case <-runCtx.Done():
+			err := context.Cause(runCtx)
+			unregister()
+			tracing.EndSpan(span, err)
+			return nil, nil, err
+		}
+	}
+	span.End()
+
+	return runCtx, func() {
+		<-gate.sem
+		unregister()
+	}, nil
+}
+
+// CancelRun cancels every run the user of the organization registered for a
+// session, in progress or waiting, and reports whether there were any. Runs
+// are matched by the organization and user they were started with, so runs
+// still waiting for a session whose thread doesn't exist yet can be cancelled.
+func (c *Client) CancelRun(sessionID, organizationID, userID string) bool {
+	c.runMutex.Lock()
+	defer c.runMutex.Unlock()
+
+	gate, exists := c.sessionGates[sessionID]
+	if !exists {
+		return false
+	}
+
+	cancelled := false
+	for run := range gate.runs {
+		if run.organizationID == organizationID && run.userID == userID {
+			run.cancel(ErrRunCancelled)
+			cancelled = true
+		}
+	}
+	if cancelled {
+		c.log.Infof("Cancelled active runs for session %s", sessionID)
+	}
+	return cancelled
+}
+
+// IsCancelled reports whether a run context was cancelled through CancelRun
+// or superseded by a newer request
+func IsCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrRunCancelled)
+}
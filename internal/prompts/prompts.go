@@ -0,0 +1,231 @@
+package prompts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// MaxRenderedBytes bounds the size of rendered instructions
+const MaxRenderedBytes = 256 << 10
+
+// MaxRenderSteps bounds the number of writes of a rendering, each output of
+// an action or of text between actions being one
+const MaxRenderSteps = 10000
+
+// MaxRenderTime bounds the time rendering takes, when the context allows more
+const MaxRenderTime = 100 * time.Millisecond
+
+// maxRangeDepth is how deeply ranges may be nested. Ranges only iterate over
+// the variables, so nesting bounds their iterations.
+const maxRangeDepth = 2
+
+// errTooLarge is returned when rendered instructions exceed MaxRenderedBytes
+var errTooLarge = fmt.Errorf("rendered instructions exceed %d bytes", MaxRenderedBytes)
+
+// errTooManySteps is returned when rendering exceeds MaxRenderSteps
+var errTooManySteps = fmt.Errorf("rendering instructions takes more than %d steps", MaxRenderSteps)
+
+// funcs are the functions available to templates besides the built-in ones
+var funcs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	// default returns value, or fallback if value is empty
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// Variables are the values instructions can refer to. Map entries are only
+// set for values that are known, so strict rendering fails on the others.
+type Variables struct {
+	// User holds the user's ID, Name, Email, Locale and TimeZone, and the
+	// attributes of their profile
+	User map[string]string
+	// Org holds the organization's ID and Name
+	Org map[string]string
+	// Agent holds the agent's ID and Name
+	Agent map[string]string
+	// Vars holds the variables supplied by the caller
+	Vars map[string]string
+	// Now is the current time in the user's or organization's time zone
+	Now time.Time
+}
+
+// data returns the template data of the variables
+func (v Variables) data() map[string]any {
+	return map[string]any{
+		"User":     orEmpty(v.User),
+		"Org":      orEmpty(v.Org),
+		"Agent":    orEmpty(v.Agent),
+		"Vars":     orEmpty(v.Vars),
+		"Now":      v.Now,
+		"Date":     v.Now.Format("2006-01-02"),
+		"Time":     v.Now.Format("15:04"),
+		"Weekday":  v.Now.Weekday().String(),
+		"TimeZone": v.Now.Location().String(),
+	}
+}
+
+// IsTemplate reports whether instructions contain template actions
+func IsTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// Parse checks that instructions are a valid template
+func Parse(text string) error {
+	_, err := parseTemplate(text)
+	return err
+}
+
+// Render renders instructions written as a text/template with the
+// variables. Missing variables render empty, unless strict is set, in which
+// case they fail rendering. Rendering stops when the context is done, after
+// MaxRenderTime or after MaxRenderSteps.
+func Render(ctx context.Context, text string, vars Variables, strict bool) (string, error) {
+	if !IsTemplate(text) {
+		return text, nil
+	}
+
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	if strict {
+		tmpl.Option("missingkey=error")
+	} else {
+		tmpl.Option("missingkey=zero")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MaxRenderTime)
+	defer cancel()
+	out := &limitedBuffer{ctx: ctx, limit: MaxRenderedBytes, steps: MaxRenderSteps}
+	if err := tmpl.Execute(out, vars.data()); err != nil {
+		for _, limitErr := range []error{errTooLarge, errTooManySteps, context.DeadlineExceeded, context.Canceled} {
+			if errors.Is(err, limitErr) {
+				return "", limitErr
+			}
+		}
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// parseTemplate parses instructions, rejecting templates that define or call
+// other templates, which could otherwise recurse without bound, and ranges
+// that could iterate without bound
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("instructions").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, errors.New("instructions must not define templates")
+	}
+	if tmpl.Tree != nil {
+		if err := checkNode(tmpl.Tree.Root, 0); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// checkNode checks that a parse tree calls no template and only ranges over
+// variables, in at most maxRangeDepth nested ranges. depth is the number of
+// ranges around the node.
+func checkNode(node parse.Node, depth int) error {
+	switch n := node.(type) {
+	case *parse.TemplateNode:
+		return errors.New("instructions must not call templates")
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkNode(child, depth); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranches(&n.BranchNode, depth)
+	case *parse.WithNode:
+		return checkBranches(&n.BranchNode, depth)
+	case *parse.RangeNode:
+		if !rangesOverVariable(n.Pipe) {
+			return errors.New("instructions may only range over variables")
+		}
+		if depth == maxRangeDepth {
+			return fmt.Errorf("instructions must not nest more than %d ranges", maxRangeDepth)
+		}
+		return checkBranches(&n.BranchNode, depth+1)
+	}
+	return nil
+}
+
+// checkBranches checks the branches of an if, with or range
+func checkBranches(n *parse.BranchNode, depth int) error {
+	if err := checkNode(n.List, depth); err != nil {
+		return err
+	}
+	return checkNode(n.ElseList, depth)
+}
+
+// rangeable are the variables instructions may range over
+var rangeable = map[string]bool{"User": true, "Org": true, "Agent": true, "Vars": true}
+
+// rangesOverVariable reports whether the pipeline of a range is one of the
+// rangeable variables, such as .Vars or $.Vars, rather than a number, the
+// result of a function or method, or a variable of the template, which could
+// iterate any number of times
+func rangesOverVariable(pipe *parse.PipeNode) bool {
+	if len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		return len(arg.Ident) == 1 && rangeable[arg.Ident[0]]
+	case *parse.VariableNode:
+		return len(arg.Ident) == 2 && arg.Ident[0] == "$" && rangeable[arg.Ident[1]]
+	}
+	return false
+}
+
+// limitedBuffer is a buffer failing writes beyond its limit, beyond its number
+// of steps or once its context is done
+type limitedBuffer struct {
+	bytes.Buffer
+	ctx   context.Context
+	limit int
+	steps int
+}
+
+// Write implements io.Writer
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if b.steps--; b.steps < 0 {
+		return 0, errTooManySteps
+	}
+	if b.Len()+len(p) > b.limit {
+		return 0, errTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// orEmpty returns m, or an empty map if m is nil
+func orEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
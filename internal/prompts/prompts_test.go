@@ -0,0 +1,115 @@
+package prompts
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	vars := Variables{
+		User: map[string]string{"ID": "user1", "Name": "Ada", "plan": "pro"},
+		Org:  map[string]string{"ID": "org1", "Name": "Acme"},
+		Vars: map[string]string{"product": "Rockets"},
+		Now:  time.Date(2024, 3, 1, 9, 30, 0, 0, berlin),
+	}
+
+	testCases := []struct {
+		name          string
+		text          string
+		strict        bool
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "Plain instructions",
+			text:     "You are helpful.",
+			expected: "You are helpful.",
+		},
+		{
+			name:     "Variables",
+			text:     "Help {{.User.Name}} ({{.User.plan}}) of {{.Org.Name}} with {{.Vars.product}} on {{.Weekday}} {{.Date}} at {{.Time}} {{.TimeZone}}.",
+			expected: "Help Ada (pro) of Acme with Rockets on Friday 2024-03-01 at 09:30 Europe/Berlin.",
+		},
+		{
+			name:     "Functions and conditions",
+			text:     `{{upper .Org.Name}} {{default "there" .User.Email}}{{if .Vars.tone}} {{.Vars.tone}}{{end}}`,
+			expected: "ACME there",
+		},
+		{
+			name:     "Missing variable",
+			text:     "Hello {{.User.Email}}!",
+			expected: "Hello !",
+		},
+		{
+			name:          "Missing variable in strict mode",
+			text:          "Hello {{.User.Email}}!",
+			strict:        true,
+			expectedError: `map has no entry for key "Email"`,
+		},
+		{
+			name:          "Templates defined",
+			text:          `{{define "loop"}}{{template "loop" .}}{{template "loop" .}}{{end}}{{template "loop" .}}`,
+			expectedError: "must not define templates",
+		},
+		{
+			name:          "Range over a number",
+			text:          `{{range 2000000000}}{{end}}`,
+			expectedError: "may only range over variables",
+		},
+		{
+			name:          "Range over a method",
+			text:          `{{range .Now.Unix}}{{end}}`,
+			expectedError: "may only range over variables",
+		},
+		{
+			name:          "Range over a template variable",
+			text:          `{{$n := 2000000000}}{{range $n}}{{end}}`,
+			expectedError: "may only range over variables",
+		},
+		{
+			name:     "Range over variables",
+			text:     `{{range $name, $value := .Org}}{{$name}}={{$value}} {{range $.Vars}}{{.}}{{end}} {{end}}`,
+			expected: "ID=org1 Rockets Name=Acme Rockets ",
+		},
+		{
+			name:          "Nested ranges",
+			text:          `{{range .Vars}}{{range $.Vars}}{{range $.Vars}}{{end}}{{end}}{{end}}`,
+			expectedError: "must not nest more than 2 ranges",
+		},
+		{
+			name:          "Too many steps",
+			text:          `{{range .User}}{{range $.User}}` + strings.Repeat("{{.}}", MaxRenderSteps/9+1) + `{{end}}{{end}}`,
+			expectedError: "steps",
+		},
+		{
+			name:          "Invalid syntax",
+			text:          "Hello {{.User.Name",
+			expectedError: "unclosed action",
+		},
+		{
+			name:          "Too large",
+			text:          `{{range .User}}` + strings.Repeat("x", MaxRenderedBytes/2) + `{{end}}`,
+			expectedError: "exceed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := Render(context.Background(), tc.text, vars, tc.strict)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rendered)
+		})
+	}
+}
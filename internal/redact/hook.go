@@ -0,0 +1,50 @@
+package redact
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hook scrubs sensitive values from log entries before they are written.
+// Entries of a request whose organization masks upstream calls are scrubbed
+// with the organization's rules, others with the hook's redactor.
+type Hook struct {
+	redactor *Redactor
+}
+
+// NewHook creates a logrus hook that scrubs log messages and fields with the
+// redactor, unless the entry's context carries a masker
+func NewHook(redactor *Redactor) *Hook {
+	return &Hook{redactor: redactor}
+}
+
+// Levels implements logrus.Hook
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	redactor := h.redactor
+	if entry.Context != nil {
+		if masker := MaskerFromContext(entry.Context); masker != nil {
+			redactor = masker.redactor
+		}
+	}
+
+	entry.Message = redactor.Redact(entry.Message)
+
+	// Hooks are fired on a copy of the entry, so its data can be modified in place
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = redactor.Redact(v)
+		case error:
+			entry.Data[key] = redactor.Redact(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = redactor.Redact(v.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package redact
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookUsesOrganizationRules(t *testing.T) {
+	orgRedactor, err := New([]string{KindEmail}, map[string]string{"employee_id": `EMP-\d{6}`})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		expectedMsg   string
+		expectedField string
+	}{
+		{
+			name:          "no context",
+			expectedMsg:   "Lookup of EMP-123456 by [REDACTED_EMAIL]",
+			expectedField: "failed for [REDACTED_PHONE]",
+		},
+		{
+			name:          "context without masker",
+			ctx:           context.Background(),
+			expectedMsg:   "Lookup of EMP-123456 by [REDACTED_EMAIL]",
+			expectedField: "failed for [REDACTED_PHONE]",
+		},
+		{
+			name:          "organization masker",
+			ctx:           WithMasker(context.Background(), orgRedactor.NewMasker()),
+			expectedMsg:   "Lookup of [REDACTED_EMPLOYEE_ID] by [REDACTED_EMAIL]",
+			expectedField: "failed for (555) 123-4567",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := logrus.NewEntry(logrus.New()).WithField("error", errors.New("failed for (555) 123-4567"))
+			if tt.ctx != nil {
+				entry = entry.WithContext(tt.ctx)
+			}
+			entry.Message = "Lookup of EMP-123456 by jane@example.com"
+
+			require.NoError(t, NewHook(Default()).Fire(entry))
+
+			assert.Equal(t, tt.expectedMsg, entry.Message)
+			assert.Equal(t, tt.expectedField, entry.Data["error"])
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+)
+
+// Registry builds and caches the redactors of organizations' redaction
+// policies. The cache is rebuilt when the configuration is reloaded.
+type Registry struct {
+	configs   *config.Store
+	mu        sync.Mutex
+	cached    *config.Config
+	redactors map[string]*Redactor
+}
+
+// NewRegistry creates a registry for the policies in the stored configuration
+func NewRegistry(configs *config.Store) *Registry {
+	return &Registry{
+		configs:   configs,
+		redactors: make(map[string]*Redactor),
+	}
+}
+
+// Masker returns a masker for a request of the organization under the
+// configuration the request runs with, or nil if the organization's policy
+// doesn't mask upstream calls
+func (r *Registry) Masker(ctx context.Context, organizationID string) *Masker {
+	cfg := r.configs.For(ctx)
+	policy := cfg.PolicyFor(organizationID).Redaction
+	if !policy.MaskUpstream {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Start over once the configuration was reloaded. Requests still running
+	// with an earlier configuration build their redactors without caching.
+	if cfg != r.cached {
+		if cfg != r.configs.Current() {
+			return newRedactor(policy).NewMasker()
+		}
+		r.cached = cfg
+		r.redactors = make(map[string]*Redactor)
+	}
+
+	redactor, exists := r.redactors[organizationID]
+	if !exists {
+		redactor = newRedactor(policy)
+		r.redactors[organizationID] = redactor
+	}
+	return redactor.NewMasker()
+}
+
+// newRedactor builds the redactor of a policy
+func newRedactor(policy config.RedactionPolicy) *Redactor {
+	redactor, err := New(policy.Kinds, policy.Patterns)
+	if err != nil {
+		// Policies are validated when loaded; should one still be invalid,
+		// mask everything the built-in detectors find
+		return Default()
+	}
+	return redactor
+}
+
+// ValidatePolicies checks that the redaction policies in cfg only use known
+// detector kinds and valid patterns
+func ValidatePolicies(cfg *config.Config) error {
+	if _, err := New(cfg.DefaultPolicy.Redaction.Kinds, cfg.DefaultPolicy.Redaction.Patterns); err != nil {
+		return fmt.Errorf("default policy: %w", err)
+	}
+	for organizationID, policy := range cfg.OrgPolicies {
+		if _, err := New(policy.Redaction.Kinds, policy.Redaction.Patterns); err != nil {
+			return fmt.Errorf("policy of organization %s: %w", organizationID, err)
+		}
+	}
+	return nil
+}
+
+type maskerKey struct{}
+
+// WithMasker returns a copy of ctx carrying the masker to apply to upstream
+// calls made for the request
+func WithMasker(ctx context.Context, masker *Masker) context.Context {
+	return context.WithValue(ctx, maskerKey{}, masker)
+}
+
+// MaskerFromContext returns the masker carried by ctx, or nil if upstream
+// calls shouldn't be masked
+func MaskerFromContext(ctx context.Context) *Masker {
+	masker, _ := ctx.Value(maskerKey{}).(*Masker)
+	return masker
+}
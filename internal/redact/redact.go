@@ -0,0 +1,262 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Built-in detector kinds
+const (
+	KindEmail      = "email"
+	KindPhone      = "phone"
+	KindCreditCard = "credit_card"
+	KindAPIKey     = "api_key"
+)
+
+// builtinPatterns are the expressions of the built-in detectors. Secrets come
+// first so the digits in a key aren't taken for a phone or card number.
+var builtinPatterns = []struct {
+	kind    string
+	pattern string
+}{
+	{KindAPIKey, `\bsk-[A-Za-z0-9_-]{20,}|\bAKIA[0-9A-Z]{16}\b|\bgh[pousr]_[A-Za-z0-9]{36,}|\bxox[abprs]-[A-Za-z0-9-]{10,}|\bAIza[0-9A-Za-z_-]{35}|(?i:\bbearer\s+)[A-Za-z0-9._~+/-]{20,}=*`},
+	{KindEmail, `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	{KindCreditCard, `\b(?:\d[ -]?){12,18}\d\b`},
+	{KindPhone, `(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]\d{3}[\s.-]\d{4}\b|\+\d{1,3}(?:[\s.-]?\d{2,4}){2,5}\b`},
+}
+
+// placeholderPattern matches the placeholders produced by a Masker
+var placeholderPattern = regexp.MustCompile(`\[[A-Z0-9_]+_[0-9a-f]{8}\]`)
+
+// maxPlaceholderLength bounds how much streamed text is held back while
+// waiting for the rest of a placeholder
+const maxPlaceholderLength = 80
+
+// placeholderKey keys the hashes of masked values, so placeholders are stable
+// within the process but can't be reversed by hashing candidate values
+var placeholderKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return key
+}()
+
+// rule is a single detector
+type rule struct {
+	label string
+	re    *regexp.Regexp
+	valid func(match string) bool
+}
+
+// Redactor detects sensitive values in text
+type Redactor struct {
+	rules []rule
+}
+
+// New creates a redactor with the given built-in detector kinds, all of them
+// if kinds is empty, and custom detectors given as regular expressions by name
+func New(kinds []string, patterns map[string]string) (*Redactor, error) {
+	enabled := make(map[string]bool)
+	for _, kind := range kinds {
+		enabled[kind] = true
+	}
+
+	r := &Redactor{}
+	for _, builtin := range builtinPatterns {
+		if len(kinds) > 0 && !enabled[builtin.kind] {
+			continue
+		}
+		delete(enabled, builtin.kind)
+		rule := rule{
+			label: label(builtin.kind),
+			re:    regexp.MustCompile(builtin.pattern),
+		}
+		if builtin.kind == KindCreditCard {
+			rule.valid = luhnValid
+		}
+		r.rules = append(r.rules, rule)
+	}
+	for kind := range enabled {
+		return nil, fmt.Errorf("unknown redaction kind %q", kind)
+	}
+
+	for name, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", name, err)
+		}
+		r.rules = append(r.rules, rule{label: label(name), re: re})
+	}
+
+	return r, nil
+}
+
+var defaultRedactor, _ = New(nil, nil)
+
+// Default returns a redactor with all built-in detectors
+func Default() *Redactor {
+	return defaultRedactor
+}
+
+// String replaces sensitive values in text using the default redactor
+func String(text string) string {
+	return defaultRedactor.Redact(text)
+}
+
+// Redact replaces every sensitive value in text with a marker naming its kind,
+// e.g. [REDACTED_EMAIL]
+func (r *Redactor) Redact(text string) string {
+	return r.replace(text, func(rule rule, match string) string {
+		return "[REDACTED_" + rule.label + "]"
+	})
+}
+
+// Detects reports whether text contains a sensitive value
+func (r *Redactor) Detects(text string) bool {
+	for _, rule := range r.rules {
+		for _, match := range rule.re.FindAllString(text, -1) {
+			if rule.valid == nil || rule.valid(match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replace replaces every sensitive value in text with the result of fn
+func (r *Redactor) replace(text string, fn func(rule rule, match string) string) string {
+	for _, rule := range r.rules {
+		text = rule.re.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+			return fn(rule, match)
+		})
+	}
+	return text
+}
+
+// label turns a detector name into the upper-case label used in markers
+func label(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// luhnValid reports whether the digits in a candidate card number pass the
+// Luhn checksum
+func luhnValid(number string) bool {
+	sum, digits := 0, 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+		double = !double
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// Masker replaces sensitive values with placeholders and restores them again.
+// A Masker belongs to a single request; the same value always maps to the
+// same placeholder, so a conversation's history is masked consistently. A nil
+// *Masker leaves text unchanged.
+type Masker struct {
+	redactor  *Redactor
+	originals map[string]string
+}
+
+// NewMasker creates a masker using the redactor's detectors
+func (r *Redactor) NewMasker() *Masker {
+	return &Masker{redactor: r, originals: make(map[string]string)}
+}
+
+// Mask replaces every sensitive value in text with a placeholder such as
+// [EMAIL_1a2b3c4d]
+func (m *Masker) Mask(text string) string {
+	if m == nil {
+		return text
+	}
+	return m.redactor.replace(text, func(rule rule, match string) string {
+		mac := hmac.New(sha256.New, placeholderKey)
+		mac.Write([]byte(match))
+		placeholder := "[" + rule.label + "_" + hex.EncodeToString(mac.Sum(nil)[:4]) + "]"
+		m.originals[placeholder] = match
+		return placeholder
+	})
+}
+
+// Detects reports whether text contains a value the masker would mask
+func (m *Masker) Detects(text string) bool {
+	return m != nil && m.redactor.Detects(text)
+}
+
+// Restore replaces the placeholders the masker produced with their original values
+func (m *Masker) Restore(text string) string {
+	if m == nil || len(m.originals) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if original, exists := m.originals[placeholder]; exists {
+			return original
+		}
+		return placeholder
+	})
+}
+
+// NewStreamRestorer creates a restorer for a reply that arrives in fragments
+func (m *Masker) NewStreamRestorer() *StreamRestorer {
+	return &StreamRestorer{masker: m}
+}
+
+// StreamRestorer restores placeholders in streamed text, holding back a
+// fragment that may be the start of a placeholder until it is complete
+type StreamRestorer struct {
+	masker  *Masker
+	pending string
+}
+
+// Write adds a fragment of the reply and returns the restored text that is
+// ready to be passed on
+func (s *StreamRestorer) Write(fragment string) string {
+	if s.masker == nil || len(s.masker.originals) == 0 {
+		return fragment
+	}
+
+	text := s.pending + fragment
+	s.pending = ""
+	if start := strings.LastIndexByte(text, '['); start >= 0 &&
+		!strings.Contains(text[start:], "]") && len(text)-start < maxPlaceholderLength {
+		text, s.pending = text[:start], text[start:]
+	}
+	return s.masker.Restore(text)
+}
+
+// Flush returns any text still held back
+func (s *StreamRestorer) Flush() string {
+	text := s.pending
+	s.pending = ""
+	return s.masker.Restore(text)
+}
@@ -0,0 +1,166 @@
+package responsecache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Entry is a cached reply
+type Entry struct {
+	Content string
+	Model   string
+	// OrganizationID, AgentID and UserID are those of the exchange the reply
+	// was generated in
+	OrganizationID string
+	AgentID        string
+	UserID         string
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
+}
+
+// Store holds cached replies by key. Stores must be safe for concurrent use.
+type Store interface {
+	// Get returns the entry with a key, or nil if there is none or it expired
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Set stores an entry with a key, replacing any entry it had
+	Set(ctx context.Context, key string, entry *Entry) error
+	// Purge removes the entries matched by match and returns their number
+	Purge(ctx context.Context, match func(entry *Entry) bool) (int, error)
+}
+
+// keyRequest is the part of a chat completion request that determines its
+// reply
+type keyRequest struct {
+	OrganizationID string       `json:"organizationId"`
+	AgentID        string       `json:"agentId"`
+	Model          string       `json:"model"`
+	Messages       []keyMessage `json:"messages"`
+	Temperature    float32      `json:"temperature"`
+	MaxTokens      int          `json:"maxTokens"`
+	// Functions the model may call change its reply
+	Functions []openai.FunctionDefinition `json:"functions,omitempty"`
+}
+
+type keyMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Key returns the key of the reply to a chat completion request of an
+// organization's agent. Requests of other agents never share replies.
+func Key(organizationID, agentID string, req openai.ChatCompletionRequest) string {
+	key := keyRequest{
+		OrganizationID: organizationID,
+		AgentID:        agentID,
+		Model:          req.Model,
+		Messages:       make([]keyMessage, len(req.Messages)),
+		Temperature:    req.Temperature,
+		MaxTokens:      req.MaxTokens,
+		Functions:      req.Functions,
+	}
+	for i, message := range req.Messages {
+		key.Messages[i] = keyMessage{Role: message.Role, Content: message.Content}
+	}
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryStore keeps entries in memory, evicting the least recently used
+// entry when it is full
+type MemoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// recency lists the entries' keys, most recently used first
+	recency *list.List
+}
+
+// memoryEntry is an entry of a MemoryStore
+type memoryEntry struct {
+	key   string
+	entry Entry
+}
+
+// NewMemoryStore creates a store holding at most maxEntries entries
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		recency:    list.New(),
+	}
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, exists := s.entries[key]
+	if !exists {
+		return nil, nil
+	}
+	cached := element.Value.(*memoryEntry)
+	if !time.Now().Before(cached.entry.ExpiresAt) {
+		s.remove(element)
+		return nil, nil
+	}
+	s.recency.MoveToFront(element)
+	entry := cached.entry
+	return &entry, nil
+}
+
+// Set implements Store
+func (s *MemoryStore) Set(ctx context.Context, key string, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, exists := s.entries[key]; exists {
+		element.Value.(*memoryEntry).entry = *entry
+		s.recency.MoveToFront(element)
+		return nil
+	}
+	s.entries[key] = s.recency.PushFront(&memoryEntry{key: key, entry: *entry})
+	for s.maxEntries > 0 && len(s.entries) > s.maxEntries {
+		s.remove(s.recency.Back())
+		metrics.ResponseCacheEvictions.Inc()
+	}
+	metrics.ResponseCacheSize.Set(float64(len(s.entries)))
+	return nil
+}
+
+// Purge implements Store. Expired entries are purged along with those matched.
+func (s *MemoryStore) Purge(ctx context.Context, match func(entry *Entry) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for element := s.recency.Front(); element != nil; {
+		next := element.Next()
+		cached := element.Value.(*memoryEntry)
+		if !now.Before(cached.entry.ExpiresAt) {
+			s.remove(element)
+		} else if entry := cached.entry; match(&entry) {
+			s.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged, nil
+}
+
+// remove removes an entry. The caller must hold the lock.
+func (s *MemoryStore) remove(element *list.Element) {
+	s.recency.Remove(element)
+	delete(s.entries, element.Value.(*memoryEntry).key)
+	metrics.ResponseCacheSize.Set(float64(len(s.entries)))
+}
@@ -0,0 +1,66 @@
+package responsecache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	request := func(model, message string, temperature float32) openai.ChatCompletionRequest {
+		return openai.ChatCompletionRequest{
+			Model:       model,
+			Messages:    []openai.ChatCompletionMessage{{Role: "system", Content: "Be brief"}, {Role: "user", Content: message}},
+			Temperature: temperature,
+		}
+	}
+	key := Key("org1", "agent1", request("gpt-4o", "Hello?", 0))
+
+	streamed := request("gpt-4o", "Hello?", 0)
+	streamed.Stream = true
+	assert.Equal(t, key, Key("org1", "agent1", streamed))
+
+	assert.NotEqual(t, key, Key("org2", "agent1", request("gpt-4o", "Hello?", 0)))
+	assert.NotEqual(t, key, Key("org1", "agent2", request("gpt-4o", "Hello?", 0)))
+	assert.NotEqual(t, key, Key("org1", "agent1", request("gpt-4o-mini", "Hello?", 0)))
+	assert.NotEqual(t, key, Key("org1", "agent1", request("gpt-4o", "Hello!", 0)))
+	assert.NotEqual(t, key, Key("org1", "agent1", request("gpt-4o", "Hello?", 0.5)))
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(2)
+	entry := func(userID string, ttl time.Duration) *Entry {
+		return &Entry{Content: "Reply", OrganizationID: "org1", UserID: userID, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(ttl)}
+	}
+
+	require.NoError(t, store.Set(ctx, "a", entry("user1", time.Hour)))
+	require.NoError(t, store.Set(ctx, "b", entry("user2", time.Hour)))
+	cached, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, cached)
+	assert.Equal(t, "Reply", cached.Content)
+
+	// The least recently used entry makes room for new ones
+	require.NoError(t, store.Set(ctx, "c", entry("user1", time.Hour)))
+	cached, err = store.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	purged, err := store.Purge(ctx, func(entry *Entry) bool { return entry.UserID == "user1" })
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	cached, err = store.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	// Expired entries aren't returned
+	require.NoError(t, store.Set(ctx, "d", entry("user1", -time.Second)))
+	cached, err = store.Get(ctx, "d")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+}
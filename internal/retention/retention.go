@@ -0,0 +1,150 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/logging"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+	"github.com/oregpt/agentplatform-chatgpt-service/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Erasure statuses of a receipt and of each store in it
+const (
+	StatusCompleted   = "completed"
+	StatusPartial     = "partial"
+	StatusErased      = "erased"
+	StatusUnsupported = "unsupported"
+	StatusFailed      = "failed"
+)
+
+// ErrUnsupported is returned by stores that can't remove data once written
+var ErrUnsupported = errors.New("store does not support removing data")
+
+// Store holds conversation data that is purged under organizations'
+// retention policies and erased on request
+type Store interface {
+	Name() string
+	// PurgeExpired removes content older than its organization's retention
+	// period and returns the number of items purged
+	PurgeExpired(ctx context.Context, now time.Time) (int, error)
+	// EraseUser removes all data of a user in an organization and returns the
+	// number of items erased
+	EraseUser(ctx context.Context, organizationID, userID string) (int, error)
+}
+
+// Receipt records the erasure of a user's data
+type Receipt struct {
+	ReceiptID      string         `json:"receiptId"`
+	OrganizationID string         `json:"organizationId"`
+	UserID         string         `json:"userId"`
+	ErasedAt       time.Time      `json:"erasedAt"`
+	Status         string         `json:"status"` // "completed" or "partial"
+	Stores         []StoreReceipt `json:"stores"`
+}
+
+// StoreReceipt records the erasure of a user's data from a single store
+type StoreReceipt struct {
+	Store  string `json:"store"`
+	Status string `json:"status"` // "erased", "unsupported" or "failed"
+	Erased int    `json:"erased"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Failed reports whether erasing data failed in any store
+func (r *Receipt) Failed() bool {
+	for _, store := range r.Stores {
+		if store.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Service applies retention policies and erasure requests to every store
+type Service struct {
+	stores []Store
+	log    *logrus.Logger
+}
+
+// NewService creates a service over the client's thread cache and, unless
+// they are nil, the audit trail, the response cache and the semantic cache
+func NewService(client openai.ClientInterface, auditSink audit.Sink, responseCache responsecache.Store, semanticCache *semanticcache.Cache, configs *config.Store, log *logrus.Logger) *Service {
+	stores := []Store{NewThreadStore(client, configs)}
+	if auditSink != nil {
+		stores = append(stores, NewAuditStore(auditSink, configs))
+	}
+	if responseCache != nil {
+		stores = append(stores, NewResponseCacheStore(responseCache, configs))
+	}
+	if semanticCache != nil {
+		stores = append(stores, NewSemanticCacheStore(semanticCache, configs))
+	}
+	return &Service{stores: stores, log: log}
+}
+
+// PurgeExpired purges expired content from every store. Failures are logged
+// and don't stop the other stores from being purged.
+func (s *Service) PurgeExpired(ctx context.Context, now time.Time) {
+	for _, store := range s.stores {
+		purged, err := store.PurgeExpired(ctx, now)
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			s.log.Errorf("Failed to purge expired data from %s: %v", store.Name(), err)
+			continue
+		}
+		if purged > 0 {
+			metrics.RetentionPurged.WithLabelValues(store.Name(), "retention").Add(float64(purged))
+			s.log.Infof("Purged %d expired items from %s", purged, store.Name())
+		}
+	}
+}
+
+// EraseUser erases all data of a user in an organization from every store
+func (s *Service) EraseUser(ctx context.Context, organizationID, userID string) *Receipt {
+	receipt := &Receipt{
+		ReceiptID:      utils.GenerateUUID(),
+		OrganizationID: organizationID,
+		UserID:         userID,
+		ErasedAt:       time.Now().UTC(),
+		Status:         StatusCompleted,
+	}
+
+	log := logging.FromContext(ctx, s.log)
+	for _, store := range s.stores {
+		erased, err := store.EraseUser(ctx, organizationID, userID)
+		storeReceipt := StoreReceipt{Store: store.Name(), Status: StatusErased, Erased: erased}
+		switch {
+		case errors.Is(err, ErrUnsupported):
+			storeReceipt.Status = StatusUnsupported
+			receipt.Status = StatusPartial
+		case err != nil:
+			log.Errorf("Failed to erase user data from %s: %v", store.Name(), err)
+			storeReceipt.Status = StatusFailed
+			storeReceipt.Error = "erasure failed"
+			receipt.Status = StatusPartial
+		default:
+			metrics.RetentionPurged.WithLabelValues(store.Name(), "erasure").Add(float64(erased))
+		}
+		receipt.Stores = append(receipt.Stores, storeReceipt)
+	}
+
+	log.WithField("receipt_id", receipt.ReceiptID).Infof("Erased user data with status %s", receipt.Status)
+	return receipt
+}
+
+// expired reports whether content of an organization created at a time has
+// outlived the organization's retention period
+func expired(cfg *config.Config, organizationID string, created, now time.Time) bool {
+	days := cfg.PolicyFor(organizationID).Retention.Days
+	return days > 0 && now.Sub(created) > time.Duration(days)*24*time.Hour
+}
@@ -0,0 +1,161 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestService creates a service over a real thread cache and audit sink
+func newTestService(t *testing.T, cfg *config.Config, sink audit.Sink) (*Service, *openai.Client) {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	cfg.OpenAIAPIKey = "test-key"
+	client := openai.NewClient(cfg, log, nil)
+	return NewService(client, sink, nil, nil, config.NewStore(cfg, nil), log), client
+}
+
+func TestPurgeExpired(t *testing.T) {
+	cfg := &config.Config{
+		DefaultPolicy: config.OrgPolicy{Retention: config.RetentionPolicy{Days: 30}},
+		OrgPolicies: map[string]config.OrgPolicy{
+			"org-keep": {},
+		},
+	}
+	sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	service, client := newTestService(t, cfg, sink)
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, org := range []string{"org1", "org-keep"} {
+		_, err := client.GetOrCreateThread(ctx, "session-"+org, org, "agent1", "user1")
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(ctx, &audit.Record{
+			ID:             org,
+			Time:           now,
+			OrganizationID: org,
+			UserID:         "user1",
+			Message:        "Hello",
+		}))
+	}
+
+	// Nothing has expired yet
+	service.PurgeExpired(ctx, now.Add(29*24*time.Hour))
+	records, err := sink.Query(ctx, audit.Filter{OrganizationID: "org1"})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", records[0].Message)
+
+	service.PurgeExpired(ctx, now.Add(31*24*time.Hour))
+
+	// Only the thread of the organization without a retention period is still cached
+	assert.Equal(t, 0, client.PurgeThreads(func(thread *models.ThreadInfo) bool { return thread.OrganizationID == "org1" }))
+	assert.Equal(t, 1, client.PurgeThreads(func(thread *models.ThreadInfo) bool { return thread.OrganizationID == "org-keep" }))
+	records, err = sink.Query(ctx, audit.Filter{})
+	require.NoError(t, err)
+	for _, record := range records {
+		if record.OrganizationID == "org1" {
+			assert.Empty(t, record.Message)
+		} else {
+			assert.Equal(t, "Hello", record.Message)
+		}
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	sink, err := audit.NewJSONLSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	service, client := newTestService(t, &config.Config{}, sink)
+
+	ctx := context.Background()
+	for _, session := range []struct{ id, org, user string }{
+		{"s1", "org1", "user1"},
+		{"s2", "org1", "user1"},
+		{"s3", "org1", "user2"},
+		{"s4", "org2", "user1"},
+	} {
+		_, err := client.GetOrCreateThread(ctx, session.id, session.org, "agent1", session.user)
+		require.NoError(t, err)
+		require.NoError(t, sink.Write(ctx, &audit.Record{
+			ID:             session.id,
+			Time:           time.Now(),
+			OrganizationID: session.org,
+			UserID:         session.user,
+			Message:        "Hello",
+		}))
+	}
+
+	// Sessions the user sent messages to are theirs to erase too
+	_, err = client.GetOrCreateThread(ctx, "s3", "org1", "agent1", "user1")
+	require.NoError(t, err)
+
+	receipt := service.EraseUser(ctx, "org1", "user1")
+
+	assert.NotEmpty(t, receipt.ReceiptID)
+	assert.Equal(t, "org1", receipt.OrganizationID)
+	assert.Equal(t, "user1", receipt.UserID)
+	assert.Equal(t, StatusCompleted, receipt.Status)
+	assert.Equal(t, []StoreReceipt{
+		{Store: "threads", Status: StatusErased, Erased: 3},
+		{Store: "audit", Status: StatusErased, Erased: 2},
+	}, receipt.Stores)
+
+	records, err := sink.Query(ctx, audit.Filter{UserID: "user1"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "org2", records[0].OrganizationID)
+}
+
+func TestEraseUserWithUnsupportedSink(t *testing.T) {
+	service, _ := newTestService(t, &config.Config{}, audit.NewWriterSink(&bytes.Buffer{}))
+
+	receipt := service.EraseUser(context.Background(), "org1", "user1")
+
+	assert.Equal(t, StatusPartial, receipt.Status)
+	assert.False(t, receipt.Failed())
+	assert.Equal(t, StoreReceipt{Store: "audit", Status: StatusUnsupported}, receipt.Stores[1])
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	cfg := &config.Config{DefaultPolicy: config.OrgPolicy{Retention: config.RetentionPolicy{Days: 30}}}
+	cache := responsecache.NewMemoryStore(10)
+	store := NewResponseCacheStore(cache, config.NewStore(cfg, nil))
+
+	ctx := context.Background()
+	now := time.Now()
+	for key, entry := range map[string]responsecache.Entry{
+		"old":   {OrganizationID: "org1", UserID: "user2", CreatedAt: now.AddDate(0, 0, -31)},
+		"user1": {OrganizationID: "org1", UserID: "user1", CreatedAt: now},
+		"other": {OrganizationID: "org2", UserID: "user1", CreatedAt: now},
+	} {
+		entry.Content = "Reply"
+		entry.ExpiresAt = now.Add(time.Hour)
+		require.NoError(t, cache.Set(ctx, key, &entry))
+	}
+
+	purged, err := store.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	erased, err := store.EraseUser(ctx, "org1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, erased)
+
+	for key, kept := range map[string]bool{"old": false, "user1": false, "other": true} {
+		entry, err := cache.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, kept, entry != nil, key)
+	}
+}
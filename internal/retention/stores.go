@@ -0,0 +1,156 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/audit"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/openai"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/responsecache"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/semanticcache"
+)
+
+// ThreadStore purges conversation threads from the client's thread cache
+type ThreadStore struct {
+	client  openai.ClientInterface
+	configs *config.Store
+}
+
+// NewThreadStore creates a store over the client's thread cache
+func NewThreadStore(client openai.ClientInterface, configs *config.Store) *ThreadStore {
+	return &ThreadStore{client: client, configs: configs}
+}
+
+// Name implements Store
+func (s *ThreadStore) Name() string {
+	return "threads"
+}
+
+// PurgeExpired implements Store, removing threads created before their
+// organization's retention period
+func (s *ThreadStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	cfg := s.configs.Current()
+	return s.client.PurgeThreads(func(thread *models.ThreadInfo) bool {
+		return expired(cfg, thread.OrganizationID, thread.CreatedAt, now)
+	}), nil
+}
+
+// EraseUser implements Store, removing the threads the user started or sent
+// messages to
+func (s *ThreadStore) EraseUser(ctx context.Context, organizationID, userID string) (int, error) {
+	return s.client.PurgeThreads(func(thread *models.ThreadInfo) bool {
+		return thread.OrganizationID == organizationID && thread.HasUser(userID)
+	}), nil
+}
+
+// AuditStore removes content from the audit trail. The records themselves are
+// kept as evidence of the exchanges.
+type AuditStore struct {
+	sink    audit.Sink
+	configs *config.Store
+}
+
+// NewAuditStore creates a store over the audit trail
+func NewAuditStore(sink audit.Sink, configs *config.Store) *AuditStore {
+	return &AuditStore{sink: sink, configs: configs}
+}
+
+// Name implements Store
+func (s *AuditStore) Name() string {
+	return "audit"
+}
+
+// PurgeExpired implements Store, removing the message and reply from records
+// older than their organization's retention period
+func (s *AuditStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	cfg := s.configs.Current()
+	purged, err := s.sink.Scrub(ctx, audit.Filter{}, func(record *audit.Record) bool {
+		return expired(cfg, record.OrganizationID, record.Time, now) && record.RemoveContent()
+	})
+	return purged, unsupported(err)
+}
+
+// EraseUser implements Store, removing the content and user ID from the
+// user's records
+func (s *AuditStore) EraseUser(ctx context.Context, organizationID, userID string) (int, error) {
+	filter := audit.Filter{OrganizationID: organizationID, UserID: userID}
+	erased, err := s.sink.Scrub(ctx, filter, (*audit.Record).EraseUser)
+	return erased, unsupported(err)
+}
+
+// ResponseCacheStore purges cached replies from the response cache
+type ResponseCacheStore struct {
+	cache   responsecache.Store
+	configs *config.Store
+}
+
+// NewResponseCacheStore creates a store over the response cache
+func NewResponseCacheStore(cache responsecache.Store, configs *config.Store) *ResponseCacheStore {
+	return &ResponseCacheStore{cache: cache, configs: configs}
+}
+
+// Name implements Store
+func (s *ResponseCacheStore) Name() string {
+	return "response_cache"
+}
+
+// PurgeExpired implements Store, removing replies cached before their
+// organization's retention period
+func (s *ResponseCacheStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	cfg := s.configs.Current()
+	return s.cache.Purge(ctx, func(entry *responsecache.Entry) bool {
+		return expired(cfg, entry.OrganizationID, entry.CreatedAt, now)
+	})
+}
+
+// EraseUser implements Store, removing the replies generated in the user's
+// conversations
+func (s *ResponseCacheStore) EraseUser(ctx context.Context, organizationID, userID string) (int, error) {
+	return s.cache.Purge(ctx, func(entry *responsecache.Entry) bool {
+		return entry.OrganizationID == organizationID && entry.UserID == userID
+	})
+}
+
+// SemanticCacheStore purges cached answers from the semantic cache
+type SemanticCacheStore struct {
+	cache   *semanticcache.Cache
+	configs *config.Store
+}
+
+// NewSemanticCacheStore creates a store over the semantic cache
+func NewSemanticCacheStore(cache *semanticcache.Cache, configs *config.Store) *SemanticCacheStore {
+	return &SemanticCacheStore{cache: cache, configs: configs}
+}
+
+// Name implements Store
+func (s *SemanticCacheStore) Name() string {
+	return "semantic_cache"
+}
+
+// PurgeExpired implements Store, removing answers cached before their
+// organization's retention period
+func (s *SemanticCacheStore) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	cfg := s.configs.Current()
+	return s.cache.Purge(func(entry *semanticcache.Entry) bool {
+		return expired(cfg, entry.OrganizationID, entry.CreatedAt, now)
+	}), nil
+}
+
+// EraseUser implements Store, removing the questions and answers of the
+// user's conversations
+func (s *SemanticCacheStore) EraseUser(ctx context.Context, organizationID, userID string) (int, error) {
+	return s.cache.Purge(func(entry *semanticcache.Entry) bool {
+		return entry.OrganizationID == organizationID && entry.UserID == userID
+	}), nil
+}
+
+// unsupported maps an audit sink that can't scrub records onto ErrUnsupported
+func unsupported(err error) error {
+	if errors.Is(err, audit.ErrScrubUnsupported) {
+		return ErrUnsupported
+	}
+	return err
+}
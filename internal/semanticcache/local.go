@@ -0,0 +1,48 @@
+package semanticcache
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// localDimensions is the length of the local embedder's embeddings
+const localDimensions = 512
+
+// LocalEmbedder computes embeddings locally by hashing the words and word
+// pairs of texts into a fixed number of dimensions. Texts are similar when
+// they share words, regardless of their case and punctuation; synonyms and
+// paraphrases aren't recognized, but no network calls are needed.
+type LocalEmbedder struct{}
+
+// NewLocalEmbedder creates a local embedder
+func NewLocalEmbedder() *LocalEmbedder {
+	return &LocalEmbedder{}
+}
+
+// Embed implements Embedder
+func (e *LocalEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	embedding := make([]float32, localDimensions)
+	add := func(feature string) {
+		h := fnv.New32a()
+		h.Write([]byte(feature))
+		sum := h.Sum32()
+		// The lowest bit signs the feature, so collisions tend to cancel out
+		sign := float32(1)
+		if sum&1 == 1 {
+			sign = -1
+		}
+		embedding[(sum>>1)%localDimensions] += sign
+	}
+	for i, word := range words {
+		add(word)
+		if i > 0 {
+			add(words[i-1] + " " + word)
+		}
+	}
+	return embedding, nil
+}
@@ -0,0 +1,254 @@
+package semanticcache
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/config"
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/metrics"
+)
+
+// Embedder computes embeddings of texts. The more similar the meanings of two
+// texts, the higher the cosine similarity of their embeddings.
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// NewEmbedder creates the embedder selected by the configured provider. The
+// openai provider embeds with remote, the OpenAI client.
+func NewEmbedder(cfg *config.Config, remote Embedder) Embedder {
+	if cfg.EmbeddingProvider == config.EmbeddingProviderLocal {
+		return NewLocalEmbedder()
+	}
+	return remote
+}
+
+// Entry is a cached answer to a question
+type Entry struct {
+	Question string
+	Content  string
+	Model    string
+	// OrganizationID, AgentID and UserID are those of the exchange the answer
+	// was generated in
+	OrganizationID string
+	AgentID        string
+	UserID         string
+	// Fingerprint identifies the agent's configuration the answer was
+	// generated with. Only questions with the same fingerprint get the answer.
+	Fingerprint string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+
+	// embedding is the question's normalized embedding
+	embedding []float32
+}
+
+// Query is a question to an organization's agent
+type Query struct {
+	OrganizationID string
+	AgentID        string
+	Fingerprint    string
+	Question       string
+	// Threshold is the minimum similarity of a cached question whose answer
+	// is returned, between 0 and 1
+	Threshold float64
+}
+
+// Match is the cached answer to a question similar to the queried one
+type Match struct {
+	Entry
+	// Similarity is the cosine similarity of the questions' embeddings
+	Similarity float64
+}
+
+// scope identifies an agent, whose answers are searched separately from
+// other agents'
+type scope struct {
+	organizationID string
+	agentID        string
+}
+
+// Cache holds answers to questions per agent in memory, and finds those to
+// questions similar to new ones by comparing embeddings. It is safe for
+// concurrent use.
+type Cache struct {
+	embedder   Embedder
+	maxEntries int
+
+	mu sync.Mutex
+	// entries holds every agent's entries, oldest first
+	entries map[scope][]*Entry
+	size    int
+}
+
+// New creates a cache embedding questions with embedder and holding at most
+// maxEntries answers per agent
+func New(embedder Embedder, maxEntries int) *Cache {
+	return &Cache{
+		embedder:   embedder,
+		maxEntries: maxEntries,
+		entries:    make(map[scope][]*Entry),
+	}
+}
+
+// Lookup returns the answer to the cached question most similar to the
+// query's, or nil if none is similar enough. It also returns the question's
+// embedding, to Add its answer with.
+func (c *Cache) Lookup(ctx context.Context, query Query) (*Match, []float32, error) {
+	embedding, err := c.embedder.Embed(ctx, query.Question)
+	if err != nil {
+		return nil, nil, err
+	}
+	embedding = normalize(embedding)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	agent := scope{organizationID: query.OrganizationID, agentID: query.AgentID}
+	c.removeExpired(agent, time.Now())
+	var best *Entry
+	bestSimilarity := 0.0
+	for _, entry := range c.entries[agent] {
+		if entry.Fingerprint != query.Fingerprint {
+			continue
+		}
+		if similarity := dot(embedding, entry.embedding); best == nil || similarity > bestSimilarity {
+			best, bestSimilarity = entry, similarity
+		}
+	}
+	if best == nil {
+		return nil, embedding, nil
+	}
+	metrics.SemanticCacheSimilarity.Observe(bestSimilarity)
+	if bestSimilarity < query.Threshold {
+		return nil, embedding, nil
+	}
+	match := &Match{Entry: *best, Similarity: bestSimilarity}
+	match.embedding = nil
+	return match, embedding, nil
+}
+
+// Add caches the answer to a question with the embedding returned by Lookup.
+// The entry's question, organization, agent and fingerprint are the query's.
+// The agent's oldest answer is evicted if it has too many.
+func (c *Cache) Add(query Query, embedding []float32, entry Entry) {
+	entry.Question = query.Question
+	entry.OrganizationID = query.OrganizationID
+	entry.AgentID = query.AgentID
+	entry.Fingerprint = query.Fingerprint
+	entry.embedding = embedding
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	agent := scope{organizationID: query.OrganizationID, agentID: query.AgentID}
+	c.removeExpired(agent, entry.CreatedAt)
+	entries := append(c.entries[agent], &entry)
+	c.size++
+	if c.maxEntries > 0 && len(entries) > c.maxEntries {
+		c.size -= len(entries) - c.maxEntries
+		entries = entries[len(entries)-c.maxEntries:]
+	}
+	c.entries[agent] = entries
+	metrics.SemanticCacheSize.Set(float64(c.size))
+}
+
+// Invalidate removes every answer of an agent, whose configuration changed,
+// and returns their number
+func (c *Cache) Invalidate(organizationID, agentID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	agent := scope{organizationID: organizationID, agentID: agentID}
+	removed := len(c.entries[agent])
+	delete(c.entries, agent)
+	c.size -= removed
+	metrics.SemanticCacheSize.Set(float64(c.size))
+	metrics.SemanticCacheInvalidations.Add(float64(removed))
+	return removed
+}
+
+// Purge removes the answers matched by match and returns their number.
+// Expired answers are removed along with those matched.
+func (c *Cache) Purge(match func(entry *Entry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for agent, entries := range c.entries {
+		c.removeExpired(agent, now)
+		entries = c.entries[agent]
+		kept := entries[:0]
+		for _, entry := range entries {
+			if match(entry) {
+				purged++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		c.setEntries(agent, kept)
+	}
+	c.size -= purged
+	metrics.SemanticCacheSize.Set(float64(c.size))
+	return purged
+}
+
+// removeExpired removes an agent's answers that expired by now. The caller
+// must hold the lock.
+func (c *Cache) removeExpired(agent scope, now time.Time) {
+	entries := c.entries[agent]
+	kept := entries[:0]
+	for _, entry := range entries {
+		if now.Before(entry.ExpiresAt) {
+			kept = append(kept, entry)
+		}
+	}
+	c.size -= len(entries) - len(kept)
+	c.setEntries(agent, kept)
+	metrics.SemanticCacheSize.Set(float64(c.size))
+}
+
+// setEntries replaces an agent's answers, forgetting agents without any. The
+// caller must hold the lock.
+func (c *Cache) setEntries(agent scope, entries []*Entry) {
+	if len(entries) == 0 {
+		delete(c.entries, agent)
+		return
+	}
+	c.entries[agent] = entries
+}
+
+// normalize returns a copy of an embedding scaled to unit length, so the dot
+// product of two normalized embeddings is their cosine similarity
+func normalize(embedding []float32) []float32 {
+	var sum float64
+	for _, v := range embedding {
+		sum += float64(v) * float64(v)
+	}
+	normalized := make([]float32, len(embedding))
+	if sum == 0 {
+		return normalized
+	}
+	norm := math.Sqrt(sum)
+	for i, v := range embedding {
+		normalized[i] = float32(float64(v) / norm)
+	}
+	return normalized
+}
+
+// dot returns the dot product of two embeddings. Embeddings of different
+// lengths come from different embedders and are compared over their common
+// length.
+func dot(a, b []float32) float64 {
+	if len(b) < len(a) {
+		a = a[:len(b)]
+	}
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
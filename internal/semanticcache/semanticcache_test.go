@@ -0,0 +1,77 @@
+package semanticcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalEmbedder(t *testing.T) {
+	ctx := context.Background()
+	embedder := NewLocalEmbedder()
+	similarity := func(a, b string) float64 {
+		embeddingA, err := embedder.Embed(ctx, a)
+		require.NoError(t, err)
+		embeddingB, err := embedder.Embed(ctx, b)
+		require.NoError(t, err)
+		return dot(normalize(embeddingA), normalize(embeddingB))
+	}
+
+	assert.InDelta(t, 1, similarity("What are your opening hours?", "what are your opening hours"), 1e-6)
+	related := similarity("What are your opening hours?", "What are your opening hours on Sunday?")
+	unrelated := similarity("What are your opening hours?", "How do I reset my password?")
+	assert.Greater(t, related, 0.7)
+	assert.Less(t, unrelated, 0.3)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	cache := New(NewLocalEmbedder(), 2)
+	query := func(agentID, fingerprint, question string) Query {
+		return Query{OrganizationID: "org1", AgentID: agentID, Fingerprint: fingerprint, Question: question, Threshold: 0.9}
+	}
+	add := func(q Query, answer string, ttl time.Duration) {
+		match, embedding, err := cache.Lookup(ctx, q)
+		require.NoError(t, err)
+		require.Nil(t, match)
+		cache.Add(q, embedding, Entry{Content: answer, UserID: "user1", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(ttl)})
+	}
+	lookup := func(q Query) *Match {
+		match, _, err := cache.Lookup(ctx, q)
+		require.NoError(t, err)
+		return match
+	}
+
+	add(query("agent1", "v1", "What are your opening hours?"), "9 to 5", time.Hour)
+	match := lookup(query("agent1", "v1", "what are your opening hours"))
+	require.NotNil(t, match)
+	assert.Equal(t, "9 to 5", match.Content)
+	assert.Equal(t, "What are your opening hours?", match.Question)
+	assert.InDelta(t, 1, match.Similarity, 1e-6)
+
+	// Questions that aren't similar enough, or are to other agents or
+	// configurations, miss
+	assert.Nil(t, lookup(query("agent1", "v1", "How do I reset my password?")))
+	assert.Nil(t, lookup(query("agent2", "v1", "What are your opening hours?")))
+	assert.Nil(t, lookup(query("agent1", "v2", "What are your opening hours?")))
+
+	// The oldest answer makes room for new ones
+	add(query("agent1", "v1", "How do I reset my password?"), "Click forgot password", time.Hour)
+	add(query("agent1", "v1", "Where are you located?"), "Main Street", time.Hour)
+	assert.Nil(t, lookup(query("agent1", "v1", "What are your opening hours?")))
+	assert.NotNil(t, lookup(query("agent1", "v1", "How do I reset my password?")))
+
+	// Expired answers aren't returned
+	add(query("agent2", "v1", "What are your opening hours?"), "9 to 5", -time.Second)
+	assert.Nil(t, lookup(query("agent2", "v1", "What are your opening hours?")))
+
+	assert.Equal(t, 2, cache.Invalidate("org1", "agent1"))
+	assert.Nil(t, lookup(query("agent1", "v1", "How do I reset my password?")))
+
+	add(query("agent2", "v1", "What are your opening hours?"), "9 to 5", time.Hour)
+	assert.Equal(t, 1, cache.Purge(func(entry *Entry) bool { return entry.UserID == "user1" }))
+	assert.Nil(t, lookup(query("agent2", "v1", "What are your opening hours?")))
+}
@@ -0,0 +1,283 @@
+package transcripts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Import formats
+const (
+	// ImportEntries is a list of chat history entries, as in chat requests
+	ImportEntries = "entries"
+	// ImportOpenAI is a list of OpenAI chat messages, or an object with one
+	// in messages as in fine-tuning datasets
+	ImportOpenAI = "openai"
+	// ImportChatGPT is a conversation, or a list of them, from a ChatGPT data
+	// export's conversations.json
+	ImportChatGPT = "chatgpt"
+)
+
+// ErrConversationNotFound is returned for ChatGPT exports without the
+// conversation to import
+var ErrConversationNotFound = errors.New("conversation not found in the export")
+
+// Parse parses a transcript in an import format into thread messages. Their
+// roles and content are left to the caller to validate. conversationID picks
+// the conversation of a ChatGPT export holding several.
+func Parse(format string, data []byte, conversationID string) ([]models.ThreadMessage, error) {
+	switch format {
+	case ImportEntries:
+		return parseEntries(data)
+	case ImportOpenAI:
+		return parseOpenAI(data)
+	case ImportChatGPT:
+		return parseChatGPT(data, conversationID)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// Dedup drops messages that repeat the role and content of the message before
+// them, as left behind by retried requests, and returns the number dropped
+func Dedup(messages []models.ThreadMessage) ([]models.ThreadMessage, int) {
+	deduped := make([]models.ThreadMessage, 0, len(messages))
+	for _, message := range messages {
+		if n := len(deduped); n > 0 && deduped[n-1].Role == message.Role && deduped[n-1].Content == message.Content {
+			continue
+		}
+		deduped = append(deduped, message)
+	}
+	return deduped, len(messages) - len(deduped)
+}
+
+// WithSystemPrompt replaces the system messages of a transcript with a
+// system prompt leading it, or drops them if the prompt is ""
+func WithSystemPrompt(messages []models.ThreadMessage, prompt string) []models.ThreadMessage {
+	replaced := make([]models.ThreadMessage, 0, len(messages)+1)
+	if prompt != "" {
+		replaced = append(replaced, models.ThreadMessage{
+			ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: prompt},
+		})
+	}
+	for _, message := range messages {
+		if message.Role != openai.ChatMessageRoleSystem {
+			replaced = append(replaced, message)
+		}
+	}
+	return replaced
+}
+
+// parseEntries parses a list of chat history entries
+func parseEntries(data []byte) ([]models.ThreadMessage, error) {
+	var entries []models.ChatEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	messages := make([]models.ThreadMessage, 0, len(entries))
+	for _, entry := range entries {
+		messages = append(messages, models.ThreadMessage{
+			ChatCompletionMessage: openai.ChatCompletionMessage{Role: entry.Role, Content: entry.Content},
+			Time:                  entry.Timestamp,
+		})
+	}
+	return messages, nil
+}
+
+// openAIMessage is a chat message in the OpenAI API's format, whose content is
+// a string or a list of content parts
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// parseOpenAI parses OpenAI chat messages. The text parts of content given
+// as parts are joined; other parts, such as images, are left out.
+func parseOpenAI(data []byte) ([]models.ThreadMessage, error) {
+	var list []openAIMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var dataset struct {
+			Messages []openAIMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(data, &dataset); err != nil {
+			return nil, err
+		}
+		list = dataset.Messages
+	} else if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.ThreadMessage, 0, len(list))
+	for _, message := range list {
+		content, err := openAIContent(message.Content)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, models.ThreadMessage{
+			ChatCompletionMessage: openai.ChatCompletionMessage{Role: message.Role, Content: content},
+		})
+	}
+	return messages, nil
+}
+
+// openAIContent returns the text of the content of an OpenAI chat message
+func openAIContent(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("content must be a string or a list of content parts: %w", err)
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// chatGPTConversation is a conversation of a ChatGPT data export. Its
+// messages form a tree, with a branch per edited message or regenerated
+// reply, whose current node is the last message shown.
+type chatGPTConversation struct {
+	ID             string                 `json:"id"`
+	ConversationID string                 `json:"conversation_id"`
+	CurrentNode    string                 `json:"current_node"`
+	Mapping        map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Message *chatGPTMessage `json:"message"`
+	Parent  string          `json:"parent"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// chatGPTRoles are the roles of the messages imported from ChatGPT exports.
+// Tool messages, such as browsing results, are left out.
+var chatGPTRoles = map[string]bool{
+	openai.ChatMessageRoleUser:      true,
+	openai.ChatMessageRoleAssistant: true,
+	openai.ChatMessageRoleSystem:    true,
+}
+
+// parseChatGPT parses the branch of a ChatGPT conversation ending at its
+// current node. Only the visible text of user, assistant and system messages
+// is imported.
+func parseChatGPT(data []byte, conversationID string) ([]models.ThreadMessage, error) {
+	conversation, err := chatGPTConversationByID(data, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var branch []models.ThreadMessage
+	id := conversation.CurrentNode
+	// The branch can't be longer than the tree, unless the export is corrupt
+	for steps := 0; id != "" && steps <= len(conversation.Mapping); steps++ {
+		node, exists := conversation.Mapping[id]
+		if !exists {
+			return nil, fmt.Errorf("message %s is missing from the conversation", id)
+		}
+		if message, ok := chatGPTThreadMessage(node.Message); ok {
+			branch = append(branch, message)
+		}
+		id = node.Parent
+	}
+
+	messages := make([]models.ThreadMessage, 0, len(branch))
+	for i := len(branch) - 1; i >= 0; i-- {
+		messages = append(messages, branch[i])
+	}
+	return messages, nil
+}
+
+// chatGPTConversationByID returns the conversation of an export with an ID,
+// or its only conversation if conversationID is ""
+func chatGPTConversationByID(data []byte, conversationID string) (*chatGPTConversation, error) {
+	var conversations []chatGPTConversation
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var conversation chatGPTConversation
+		if err := json.Unmarshal(data, &conversation); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	} else if err := json.Unmarshal(data, &conversations); err != nil {
+		return nil, err
+	}
+
+	if conversationID == "" {
+		if len(conversations) != 1 {
+			return nil, fmt.Errorf("%w: the export has %d conversations", ErrConversationNotFound, len(conversations))
+		}
+		return &conversations[0], nil
+	}
+	for i := range conversations {
+		if conversations[i].ID == conversationID || conversations[i].ConversationID == conversationID {
+			return &conversations[i], nil
+		}
+	}
+	return nil, ErrConversationNotFound
+}
+
+// chatGPTThreadMessage converts a message of a ChatGPT export, reporting
+// whether it is a visible text message
+func chatGPTThreadMessage(message *chatGPTMessage) (models.ThreadMessage, bool) {
+	if message == nil || message.Metadata.Hidden || !chatGPTRoles[message.Author.Role] {
+		return models.ThreadMessage{}, false
+	}
+	if message.Content.ContentType != "text" && message.Content.ContentType != "multimodal_text" {
+		return models.ThreadMessage{}, false
+	}
+
+	var texts []string
+	for _, part := range message.Content.Parts {
+		var text string
+		if err := json.Unmarshal(part, &text); err == nil && text != "" {
+			texts = append(texts, text)
+		}
+	}
+	if len(texts) == 0 {
+		return models.ThreadMessage{}, false
+	}
+
+	threadMessage := models.ThreadMessage{
+		ChatCompletionMessage: openai.ChatCompletionMessage{Role: message.Author.Role, Content: strings.Join(texts, "\n")},
+	}
+	if message.CreateTime > 0 {
+		seconds, fraction := math.Modf(message.CreateTime)
+		threadMessage.Time = time.Unix(int64(seconds), int64(fraction*float64(time.Second))).UTC()
+	}
+	if message.Author.Role == openai.ChatMessageRoleAssistant {
+		threadMessage.Model = message.Metadata.ModelSlug
+	}
+	return threadMessage, true
+}
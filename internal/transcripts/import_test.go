@@ -0,0 +1,131 @@
+package transcripts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chatGPTExport is a ChatGPT export with a regenerated reply, whose current
+// branch ends with the second reply
+const chatGPTExport = `[
+	{"id": "other", "current_node": "x", "mapping": {"x": {"message": null}}},
+	{
+		"id": "conv1",
+		"current_node": "reply2",
+		"mapping": {
+			"root": {"message": null, "parent": null},
+			"system": {"message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}, "metadata": {"is_visually_hidden_from_conversation": true}}, "parent": "root"},
+			"question": {"message": {"author": {"role": "user"}, "create_time": 1709294400.5, "content": {"content_type": "text", "parts": ["Hello?"]}}, "parent": "system"},
+			"reply1": {"message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Discarded"]}}, "parent": "question"},
+			"search": {"message": {"author": {"role": "tool"}, "content": {"content_type": "text", "parts": ["Results"]}}, "parent": "question"},
+			"reply2": {"message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Hi", {"asset": "image"}, "there"]}, "metadata": {"model_slug": "gpt-4o"}}, "parent": "search"}
+		}
+	}
+]`
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name           string
+		format         string
+		data           string
+		conversationID string
+		expected       []models.ThreadMessage
+		expectedErr    error
+	}{
+		{
+			name:   "Chat history entries",
+			format: ImportEntries,
+			data:   `[{"role": "user", "content": "Hello?", "timestamp": "2024-03-01T12:00:00Z"}, {"role": "assistant", "content": "Hi"}]`,
+			expected: []models.ThreadMessage{
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "user", Content: "Hello?"}, Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "assistant", Content: "Hi"}},
+			},
+		},
+		{
+			name:   "OpenAI messages",
+			format: ImportOpenAI,
+			data:   `[{"role": "system", "content": "Be brief"}, {"role": "user", "content": [{"type": "text", "text": "Look"}, {"type": "image_url", "image_url": {"url": "x"}}, {"type": "text", "text": "at this"}]}, {"role": "tool", "content": null}]`,
+			expected: []models.ThreadMessage{
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "system", Content: "Be brief"}},
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "user", Content: "Look\nat this"}},
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "tool"}},
+			},
+		},
+		{
+			name:   "OpenAI fine-tuning example",
+			format: ImportOpenAI,
+			data:   `{"messages": [{"role": "user", "content": "Hello?"}]}`,
+			expected: []models.ThreadMessage{
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "user", Content: "Hello?"}},
+			},
+		},
+		{
+			name:           "ChatGPT export",
+			format:         ImportChatGPT,
+			data:           chatGPTExport,
+			conversationID: "conv1",
+			expected: []models.ThreadMessage{
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "user", Content: "Hello?"}, Time: time.Date(2024, 3, 1, 12, 0, 0, int(500*time.Millisecond), time.UTC)},
+				{ChatCompletionMessage: openai.ChatCompletionMessage{Role: "assistant", Content: "Hi\nthere"}, Model: "gpt-4o"},
+			},
+		},
+		{
+			name:        "ChatGPT export of several conversations",
+			format:      ImportChatGPT,
+			data:        chatGPTExport,
+			expectedErr: ErrConversationNotFound,
+		},
+		{
+			name:           "Unknown ChatGPT conversation",
+			format:         ImportChatGPT,
+			data:           chatGPTExport,
+			conversationID: "conv2",
+			expectedErr:    ErrConversationNotFound,
+		},
+		{
+			name:        "Unknown format",
+			format:      "csv",
+			data:        `[]`,
+			expectedErr: ErrUnknownFormat,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			messages, err := Parse(tc.format, []byte(tc.data), tc.conversationID)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, messages)
+		})
+	}
+
+	_, err := Parse(ImportOpenAI, []byte(`[{"role": "user", "content": 42}]`), "")
+	assert.Error(t, err)
+}
+
+func TestDedup(t *testing.T) {
+	message := func(role, content string) models.ThreadMessage {
+		return models.ThreadMessage{ChatCompletionMessage: openai.ChatCompletionMessage{Role: role, Content: content}}
+	}
+	messages, duplicates := Dedup([]models.ThreadMessage{
+		message("user", "Hello?"),
+		message("user", "Hello?"),
+		message("assistant", "Hello?"),
+		message("user", "Hello?"),
+	})
+	assert.Equal(t, 1, duplicates)
+	assert.Equal(t, []models.ThreadMessage{message("user", "Hello?"), message("assistant", "Hello?"), message("user", "Hello?")}, messages)
+
+	messages = WithSystemPrompt([]models.ThreadMessage{message("user", "Hello?"), message("system", "Old")}, "New")
+	assert.Equal(t, []models.ThreadMessage{message("system", "New"), message("user", "Hello?")}, messages)
+	messages = WithSystemPrompt(messages, "")
+	assert.Equal(t, []models.ThreadMessage{message("user", "Hello?")}, messages)
+}
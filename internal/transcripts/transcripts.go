@@ -0,0 +1,296 @@
+package transcripts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Transcript formats
+const (
+	FormatJSON     = "json"
+	FormatJSONL    = "jsonl"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// ErrUnknownFormat is returned for formats that aren't one of the Format* formats
+var ErrUnknownFormat = errors.New("unknown transcript format")
+
+// formats maps each format onto its content type and file extension
+var formats = map[string]struct{ contentType, extension string }{
+	FormatJSON:     {"application/json; charset=utf-8", "json"},
+	FormatJSONL:    {"application/x-ndjson; charset=utf-8", "jsonl"},
+	FormatMarkdown: {"text/markdown; charset=utf-8", "md"},
+	FormatHTML:     {"text/html; charset=utf-8", "html"},
+}
+
+// timeLayout is how times are shown in Markdown and HTML transcripts
+const timeLayout = "2006-01-02 15:04:05 MST"
+
+// Transcript is a conversation with the annotations of its messages
+type Transcript struct {
+	SessionID      string    `json:"sessionId"`
+	OrganizationID string    `json:"organizationId"`
+	AgentID        string    `json:"agentId"`
+	UserID         string    `json:"userId"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastUsed       time.Time `json:"lastUsed"`
+	// TokensUsed is the total of the tokens used by the replies
+	TokensUsed int       `json:"tokensUsed"`
+	Messages   []Message `json:"messages"`
+}
+
+// Message is a message of a transcript. Replies of the assistant carry the
+// response they were sent in, and the feedback on them.
+type Message struct {
+	SessionID  string           `json:"sessionId,omitempty"` // Set in JSONL transcripts only
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	Time       *time.Time       `json:"time,omitempty"`
+	ResponseID string           `json:"responseId,omitempty"`
+	Model      string           `json:"model,omitempty"`
+	TokensUsed int              `json:"tokensUsed,omitempty"`
+	Feedback   *models.Feedback `json:"feedback,omitempty"`
+}
+
+// New returns the transcript of a thread
+func New(thread *models.ThreadInfo) *Transcript {
+	transcript := &Transcript{
+		SessionID:      thread.SessionID,
+		OrganizationID: thread.OrganizationID,
+		AgentID:        thread.AgentID,
+		UserID:         thread.UserID,
+		CreatedAt:      thread.CreatedAt.UTC(),
+		LastUsed:       thread.LastUsed.UTC(),
+		Messages:       make([]Message, 0, len(thread.Messages)),
+	}
+	for _, message := range thread.Messages {
+		m := Message{
+			Role:       message.Role,
+			Content:    message.Content,
+			ResponseID: message.ResponseID,
+			Model:      message.Model,
+			TokensUsed: message.TokensUsed,
+			Feedback:   message.Feedback,
+		}
+		if !message.Time.IsZero() {
+			t := message.Time.UTC()
+			m.Time = &t
+		}
+		transcript.TokensUsed += message.TokensUsed
+		transcript.Messages = append(transcript.Messages, m)
+	}
+	return transcript
+}
+
+// ContentType returns the content type of a format
+func ContentType(format string) (string, error) {
+	f, exists := formats[format]
+	if !exists {
+		return "", ErrUnknownFormat
+	}
+	return f.contentType, nil
+}
+
+// Filename returns the name of the file of a session's transcript in a format
+func Filename(sessionID, format string) string {
+	return sessionID + "." + formats[format].extension
+}
+
+// Write renders the transcript in a format
+func (t *Transcript) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(t)
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		for _, message := range t.Messages {
+			message.SessionID = t.SessionID
+			if err := encoder.Encode(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatMarkdown:
+		return t.writeMarkdown(w)
+	case FormatHTML:
+		return htmlTemplate.Execute(w, t)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// writeMarkdown renders the transcript as Markdown, with a heading per
+// message listing its annotations
+func (t *Transcript) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Conversation %s\n\n", t.SessionID)
+	fmt.Fprintf(&b, "- Organization: %s\n", t.OrganizationID)
+	fmt.Fprintf(&b, "- Agent: %s\n", t.AgentID)
+	fmt.Fprintf(&b, "- User: %s\n", t.UserID)
+	fmt.Fprintf(&b, "- Started: %s\n", t.CreatedAt.Format(timeLayout))
+	fmt.Fprintf(&b, "- Tokens: %d\n", t.TokensUsed)
+	for _, message := range t.Messages {
+		fmt.Fprintf(&b, "\n### %s\n\n%s\n", strings.Join(append([]string{roleTitle(message.Role)}, message.annotations()...), " · "), message.Content)
+		if message.Feedback != nil {
+			fmt.Fprintf(&b, "\n> Feedback: %s\n", describeFeedback(message.Feedback))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// annotations returns the time, model and token usage of a message, where known
+func (m Message) annotations() []string {
+	var annotations []string
+	if m.Time != nil {
+		annotations = append(annotations, m.Time.Format(timeLayout))
+	}
+	if m.Model != "" {
+		annotations = append(annotations, m.Model)
+	}
+	if m.TokensUsed > 0 {
+		annotations = append(annotations, fmt.Sprintf("%d tokens", m.TokensUsed))
+	}
+	return annotations
+}
+
+// roleTitle returns the heading of a message with a role
+func roleTitle(role string) string {
+	if role == "" {
+		return ""
+	}
+	return strings.ToUpper(role[:1]) + role[1:]
+}
+
+// describeFeedback summarizes feedback in a line
+func describeFeedback(feedback *models.Feedback) string {
+	var parts []string
+	if feedback.Thumbs != "" {
+		parts = append(parts, "thumbs "+feedback.Thumbs)
+	}
+	if feedback.Rating > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d", feedback.Rating, models.MaxRating))
+	}
+	if feedback.Comment != "" {
+		parts = append(parts, fmt.Sprintf("%q", feedback.Comment))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// fineTuningExample is a conversation in OpenAI's chat fine-tuning format
+type fineTuningExample struct {
+	Messages []fineTuningMessage `json:"messages"`
+}
+
+type fineTuningMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// WriteFineTuning writes a thread as a line of an OpenAI chat fine-tuning
+// dataset, starting with the system prompt the thread last ran with. Messages
+// after the last reply of the assistant are left out, and threads without
+// replies are skipped, in which case false is returned.
+func WriteFineTuning(w io.Writer, thread *models.ThreadInfo) (bool, error) {
+	last := -1
+	for i, message := range thread.Messages {
+		if message.Role == openai.ChatMessageRoleAssistant && message.Content != "" {
+			last = i
+		}
+	}
+	if last < 0 {
+		return false, nil
+	}
+
+	example := fineTuningExample{Messages: make([]fineTuningMessage, 0, last+2)}
+	if thread.SystemPrompt != "" {
+		example.Messages = append(example.Messages, fineTuningMessage{Role: openai.ChatMessageRoleSystem, Content: thread.SystemPrompt})
+	}
+	for _, message := range thread.Messages[:last+1] {
+		if message.Content == "" {
+			continue
+		}
+		example.Messages = append(example.Messages, fineTuningMessage{Role: message.Role, Content: message.Content})
+	}
+	if err := json.NewEncoder(w).Encode(example); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HasPositiveFeedback reports whether feedback was given on a reply in a
+// thread, and all feedback in it is positive: thumbs up, or a rating above
+// the middle of the scale
+func HasPositiveFeedback(thread *models.ThreadInfo) bool {
+	middle := (models.MinRating + models.MaxRating) / 2
+	positive := false
+	for _, message := range thread.Messages {
+		feedback := message.Feedback
+		if feedback == nil {
+			continue
+		}
+		if feedback.Thumbs == "down" || (feedback.Rating > 0 && feedback.Rating < middle) {
+			return false
+		}
+		if feedback.Thumbs == "up" || feedback.Rating > middle {
+			positive = true
+		}
+	}
+	return positive
+}
+
+// htmlTemplate renders a transcript as a standalone HTML page
+var htmlTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"roleTitle":   roleTitle,
+	"feedback":    describeFeedback,
+	"annotations": func(m Message) string { return strings.Join(m.annotations(), " · ") },
+	"formatTime":  func(t time.Time) string { return t.Format(timeLayout) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Conversation {{.SessionID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.25rem 1rem; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+.message { border-left: 4px solid #ccc; margin: 1.5rem 0; padding: 0.25rem 1rem; }
+.message.assistant { border-color: #4a7bd0; }
+.message header { color: #666; font-size: 0.875rem; }
+.content { white-space: pre-wrap; }
+.feedback { color: #666; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>Conversation {{.SessionID}}</h1>
+<dl>
+<dt>Organization</dt><dd>{{.OrganizationID}}</dd>
+<dt>Agent</dt><dd>{{.AgentID}}</dd>
+<dt>User</dt><dd>{{.UserID}}</dd>
+<dt>Started</dt><dd>{{formatTime .CreatedAt}}</dd>
+<dt>Tokens</dt><dd>{{.TokensUsed}}</dd>
+</dl>
+{{- range .Messages}}
+<section class="message {{.Role}}">
+<header><strong>{{roleTitle .Role}}</strong>{{with annotations .}} · {{.}}{{end}}</header>
+<div class="content">{{.Content}}</div>
+{{- with .Feedback}}
+<p class="feedback">Feedback: {{feedback .}}</p>
+{{- end}}
+</section>
+{{- end}}
+</body>
+</html>
+`))
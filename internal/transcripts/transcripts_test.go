@@ -0,0 +1,155 @@
+package transcripts
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oregpt/agentplatform-chatgpt-service/internal/models"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testThread() *models.ThreadInfo {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &models.ThreadInfo{
+		ThreadID:       "session123",
+		SessionID:      "session123",
+		OrganizationID: "org123",
+		AgentID:        "agent123",
+		UserID:         "user123",
+		CreatedAt:      start,
+		LastUsed:       start.Add(time.Minute),
+		Messages: []models.ThreadMessage{
+			{
+				ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "Is <b>this</b> escaped?"},
+				Time:                  start,
+			},
+			{
+				ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Yes."},
+				Time:                  start.Add(time.Minute),
+				ResponseID:            "resp1",
+				Model:                 "gpt-4",
+				TokensUsed:            42,
+				Feedback:              &models.Feedback{Thumbs: "up", Rating: 5},
+			},
+			{
+				ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "Unanswered"},
+			},
+		},
+	}
+}
+
+func TestWrite(t *testing.T) {
+	transcript := New(testThread())
+	assert.Equal(t, 42, transcript.TokensUsed)
+
+	testCases := []struct {
+		format   string
+		contains []string
+		excludes []string
+	}{
+		{
+			format:   FormatJSON,
+			contains: []string{`"sessionId": "session123"`, `"responseId": "resp1"`, `"tokensUsed": 42`, `"thumbs": "up"`},
+		},
+		{
+			format:   FormatMarkdown,
+			contains: []string{"# Conversation session123", "### User · 2024-03-01 12:00:00 UTC", "### Assistant · 2024-03-01 12:01:00 UTC · gpt-4 · 42 tokens", "> Feedback: thumbs up · 5/5", "### User\n\nUnanswered"},
+		},
+		{
+			format:   FormatHTML,
+			contains: []string{"<title>Conversation session123</title>", "Is &lt;b&gt;this&lt;/b&gt; escaped?", "gpt-4 · 42 tokens", "Feedback: thumbs up · 5/5"},
+			excludes: []string{"<b>this</b>"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			_, err := ContentType(tc.format)
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			require.NoError(t, transcript.Write(&buf, tc.format))
+			for _, s := range tc.contains {
+				assert.Contains(t, buf.String(), s)
+			}
+			for _, s := range tc.excludes {
+				assert.NotContains(t, buf.String(), s)
+			}
+		})
+	}
+
+	t.Run(FormatJSONL, func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, transcript.Write(&buf, FormatJSONL))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 3)
+		var message Message
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &message))
+		assert.Equal(t, "session123", message.SessionID)
+		assert.Equal(t, "resp1", message.ResponseID)
+		assert.Equal(t, 42, message.TokensUsed)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := ContentType("pdf")
+		assert.ErrorIs(t, err, ErrUnknownFormat)
+		assert.ErrorIs(t, transcript.Write(&bytes.Buffer{}, "pdf"), ErrUnknownFormat)
+	})
+}
+
+func TestWriteFineTuning(t *testing.T) {
+	var buf bytes.Buffer
+	written, err := WriteFineTuning(&buf, testThread())
+	require.NoError(t, err)
+	assert.True(t, written)
+	assert.JSONEq(t, `{"messages": [{"role": "user", "content": "Is <b>this</b> escaped?"}, {"role": "assistant", "content": "Yes."}]}`, buf.String())
+
+	// The system prompt comes first
+	buf.Reset()
+	thread := testThread()
+	thread.SystemPrompt = "Be brief."
+	written, err = WriteFineTuning(&buf, thread)
+	require.NoError(t, err)
+	assert.True(t, written)
+	assert.JSONEq(t, `{"messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Is <b>this</b> escaped?"}, {"role": "assistant", "content": "Yes."}]}`, buf.String())
+
+	buf.Reset()
+	thread = testThread()
+	thread.Messages = thread.Messages[:1]
+	written, err = WriteFineTuning(&buf, thread)
+	require.NoError(t, err)
+	assert.False(t, written)
+	assert.Empty(t, buf.String())
+}
+
+func TestHasPositiveFeedback(t *testing.T) {
+	testCases := []struct {
+		name      string
+		feedbacks []*models.Feedback
+		expected  bool
+	}{
+		{name: "No feedback", feedbacks: []*models.Feedback{nil}, expected: false},
+		{name: "Thumbs up", feedbacks: []*models.Feedback{{Thumbs: "up"}, nil}, expected: true},
+		{name: "High rating", feedbacks: []*models.Feedback{{Rating: 4}}, expected: true},
+		{name: "Middle rating", feedbacks: []*models.Feedback{{Rating: 3}}, expected: false},
+		{name: "Thumbs down on another reply", feedbacks: []*models.Feedback{{Thumbs: "up"}, {Thumbs: "down"}}, expected: false},
+		{name: "Low rating on another reply", feedbacks: []*models.Feedback{{Rating: 5}, {Rating: 1}}, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			thread := &models.ThreadInfo{}
+			for _, feedback := range tc.feedbacks {
+				thread.Messages = append(thread.Messages, models.ThreadMessage{
+					ChatCompletionMessage: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "Reply"},
+					Feedback:              feedback,
+				})
+			}
+			assert.Equal(t, tc.expected, HasPositiveFeedback(thread))
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -29,9 +30,15 @@ func FormatDuration(d time.Duration) string {
 	return fmt.Sprintf("%.2f min", float64(d)/float64(time.Minute))
 }
 
-// GenerateUUID generates a simple UUID-like string
+// GenerateUUID generates a random (version 4) UUID
 func GenerateUUID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
 
 // TruncateString truncates a string to the specified length and adds "..." if truncated